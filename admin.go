@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runtimeConfig is the part of the server's config that can change without
+// a restart: via the admin endpoints, or by editing -server-config and
+// sending the process a SIGHUP.
+type runtimeConfig struct {
+	// Number of scrapes, interactive or background, that run at once.
+	Workers int `json:"workers"`
+	// Max items and fields (including nested) per scrape request, 0 for no
+	// limit.
+	MaxItems  int `json:"max_items"`
+	MaxFields int `json:"max_fields"`
+	// Longest websocket items can listen for, 0 for no limit.
+	MaxWebsocketSeconds float64 `json:"max_websocket_seconds"`
+	// Max pipeline step runs and crawl pages per scrape request, 0 for no
+	// limit.
+	MaxPipelineRuns int `json:"max_pipeline_runs"`
+	MaxCrawlPages   int `json:"max_crawl_pages"`
+	// Max requests per second to each domain, 0 for no limit.
+	RateLimit float64 `json:"rate_limit"`
+	// Domains (including their subdomains) that may or may not be scraped.
+	// No allow list means any domain not denied.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func checkRuntimeConfig(rc runtimeConfig) error {
+	if rc.Workers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+	if rc.MaxItems < 0 || rc.MaxFields < 0 {
+		return errors.New("max_items and max_fields can't be negative")
+	}
+	if rc.MaxWebsocketSeconds < 0 {
+		return errors.New("max_websocket_seconds can't be negative")
+	}
+	if rc.MaxPipelineRuns < 0 || rc.MaxCrawlPages < 0 {
+		return errors.New("max_pipeline_runs and max_crawl_pages can't be negative")
+	}
+	if rc.RateLimit < 0 {
+		return errors.New("rate_limit can't be negative")
+	}
+	for _, list := range []struct {
+		name    string
+		domains []string
+	}{{"allow", rc.Allow}, {"deny", rc.Deny}} {
+		for idx, domain := range list.domains {
+			if len(domain) == 0 || strings.ContainsAny(domain, "/: ") {
+				return fmt.Errorf("%s[%d] must be a domain name, ex: \"example.com\"", list.name, idx)
+			}
+		}
+	}
+	return nil
+}
+
+// Overlays the json in data onto base, keeping base's values for anything
+// it leaves out.
+func overlayRuntimeConfig(base runtimeConfig, data []byte) (runtimeConfig, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&base); err != nil {
+		return base, err
+	}
+	return base, checkRuntimeConfig(base)
+}
+
+// The flag values overlaid with -server-config, if any.  Anything removed
+// from the file goes back to its flag value.
+func (s *server) loadRuntimeConfig() (runtimeConfig, error) {
+	if len(s.conf.ConfigFile) == 0 {
+		return s.conf.Runtime, nil
+	}
+	data, err := ioutil.ReadFile(s.conf.ConfigFile)
+	if err != nil {
+		return s.conf.Runtime, err
+	}
+	return overlayRuntimeConfig(s.conf.Runtime, data)
+}
+
+func (s *server) runtime() runtimeConfig {
+	s.runtimeLock.RLock()
+	defer s.runtimeLock.RUnlock()
+	return s.rt
+}
+
+// Puts rc into effect.  Running scrapes keep going: extra workers exit as
+// they finish, new limits apply to the next request.
+func (s *server) applyRuntimeConfig(rc runtimeConfig) {
+	s.runtimeLock.Lock()
+	defer s.runtimeLock.Unlock()
+	s.rt = rc
+	s.queue.resize(rc.Workers)
+	if s.conf.Policy != nil {
+		s.conf.Policy.set(rc.RateLimit, rc.Allow, rc.Deny)
+	}
+}
+
+func (s *server) reloadConfig() error {
+	rc, err := s.loadRuntimeConfig()
+	if err != nil {
+		return err
+	}
+	s.applyRuntimeConfig(rc)
+	log.Printf("Reloaded %s\n", s.conf.ConfigFile)
+	return nil
+}
+
+// Reloads -server-config on SIGHUP.
+func (s *server) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := s.reloadConfig(); err != nil {
+			log.Printf("Failed to reload %s, keeping the current config: %s\n", s.conf.ConfigFile, err)
+		}
+	}
+}
+
+// GET /admin/config returns the runtime config in effect.  PATCH with some
+// of its fields changes just those, until the next reload.
+func (s *server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, s.runtime())
+	case http.MethodPatch:
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.conf.MaxBodyBytes))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read request body: %s", err))
+			return
+		}
+		rc, err := overlayRuntimeConfig(s.runtime(), body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid config: %s", err))
+			return
+		}
+		s.applyRuntimeConfig(rc)
+		log.Println("Runtime config changed via /admin/config")
+		writeJson(w, http.StatusOK, rc)
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET or PATCH"))
+	}
+}
+
+// POST /admin/reload re-reads -server-config, as a SIGHUP does.
+func (s *server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	if len(s.conf.ConfigFile) == 0 {
+		writeError(w, http.StatusConflict, errors.New("no -server-config file to reload"))
+		return
+	}
+	if err := s.reloadConfig(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("failed to reload %s, keeping the current config: %s", s.conf.ConfigFile, err))
+		return
+	}
+	writeJson(w, http.StatusOK, s.runtime())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
+)
+
+const itemTypeArticle = "article"
+
+// Elements that never hold an article's main text.
+const articleBoilerplate = "script, style, noscript, nav, header, footer, aside, form, iframe, svg, button, " +
+	"[role=navigation], [role=banner], [role=contentinfo], [aria-hidden=true]"
+
+// Readability style extraction of a page's main article, without selectors.
+// Title, author and published date come from metadata (json-ld, open graph,
+// meta tags) where present, the body text from whichever element holds the
+// most paragraph text.
+func extractArticle(e *colly.HTMLElement) map[string]interface{} {
+	doc := e.DOM
+	ld := articleJsonLd(doc)
+	return map[string]interface{}{
+		"url": e.Request.URL.String(),
+		"title": firstNonEmpty(
+			ld.headline(),
+			metaContent(doc, "meta[property='og:title']", "meta[name='twitter:title']"),
+			strings.TrimSpace(doc.Find("h1").First().Text()),
+			strings.TrimSpace(doc.Find("title").First().Text())),
+		"author": firstNonEmpty(
+			ld.author(),
+			metaContent(doc, "meta[name=author]", "meta[property='article:author']"),
+			strings.TrimSpace(doc.Find("[itemprop=author], [rel=author], .byline, .author").First().Text())),
+		"published": firstNonEmpty(
+			ld.string("datePublished"),
+			metaContent(doc, "meta[property='article:published_time']", "meta[itemprop=datePublished]",
+				"meta[name=pubdate]", "meta[name=publishdate]", "meta[name=date]"),
+			attrOf(doc.Find("time[datetime]").First(), "datetime")),
+		"text": articleText(doc),
+	}
+}
+
+// Scores each element by the paragraph text directly beneath it (with half
+// credit going to its parent) and returns the best one's paragraphs.
+func articleText(doc *goquery.Selection) string {
+	body := doc.Clone()
+	body.Find(articleBoilerplate).Remove()
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+	addScore := func(sel *goquery.Selection, score float64) {
+		if sel.Length() == 0 {
+			return
+		}
+		node := sel.Get(0)
+		if _, found := scores[node]; !found {
+			candidates = append(candidates, node)
+		}
+		scores[node] += score
+	}
+	body.Find("p, pre, blockquote").Each(func(_ int, p *goquery.Selection) {
+		text := strings.TrimSpace(p.Text())
+		if len(text) < 25 {
+			return
+		}
+		// longer paragraphs and ones with more commas read like prose
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+		addScore(p.Parent(), score)
+		addScore(p.Parent().Parent(), score/2)
+	})
+
+	var best *goquery.Selection
+	bestScore := 0.0
+	for _, node := range candidates {
+		candidate := body.FindNodes(node)
+		// penalize link heavy containers like "related stories" lists
+		score := scores[node] * (1 - linkDensity(candidate))
+		if best == nil || score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	if best == nil {
+		return strings.Join(strings.Fields(body.Find("body").Text()), " ")
+	}
+	var paragraphs []string
+	best.Find("p, pre, blockquote, h2, h3, li").Each(func(_ int, el *goquery.Selection) {
+		// nested matches (a p inside a blockquote) are covered by the outer one
+		if el.ParentsUntilSelection(best).Filter("p, pre, blockquote, li").Length() > 0 {
+			return
+		}
+		if text := strings.Join(strings.Fields(el.Text()), " "); len(text) > 0 {
+			paragraphs = append(paragraphs, text)
+		}
+	})
+	return strings.Join(paragraphs, "\n\n")
+}
+
+func linkDensity(sel *goquery.Selection) float64 {
+	textLen := len(strings.TrimSpace(sel.Text()))
+	if textLen == 0 {
+		return 0
+	}
+	linkLen := 0
+	sel.Find("a").Each(func(_ int, a *goquery.Selection) {
+		linkLen += len(strings.TrimSpace(a.Text()))
+	})
+	return math.Min(float64(linkLen)/float64(textLen), 1)
+}
+
+// The first schema.org Article-like object found in the page's json-ld.
+type jsonLd map[string]interface{}
+
+func articleJsonLd(doc *goquery.Selection) jsonLd {
+	var found jsonLd
+	doc.Find("script[type='application/ld+json']").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		var data interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &data); err != nil {
+			return true
+		}
+		found = findLdArticle(data)
+		return found == nil
+	})
+	return found
+}
+
+func findLdArticle(data interface{}) jsonLd {
+	switch v := data.(type) {
+	case []interface{}:
+		for _, el := range v {
+			if found := findLdArticle(el); found != nil {
+				return found
+			}
+		}
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			return findLdArticle(graph)
+		}
+		types := v["@type"]
+		if typeList, ok := types.([]interface{}); ok && len(typeList) > 0 {
+			types = typeList[0]
+		}
+		if t, ok := types.(string); ok && strings.HasSuffix(t, "Article") || types == "BlogPosting" {
+			return jsonLd(v)
+		}
+	}
+	return nil
+}
+
+func (ld jsonLd) string(key string) string {
+	s, _ := ld[key].(string)
+	return strings.TrimSpace(s)
+}
+
+func (ld jsonLd) headline() string {
+	return firstNonEmpty(ld.string("headline"), ld.string("name"))
+}
+
+// Authors may be a name, a Person object or a list of either.
+func (ld jsonLd) author() string {
+	var names []string
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch a := v.(type) {
+		case string:
+			names = append(names, strings.TrimSpace(a))
+		case map[string]interface{}:
+			if name, ok := a["name"].(string); ok {
+				names = append(names, strings.TrimSpace(name))
+			}
+		case []interface{}:
+			for _, el := range a {
+				collect(el)
+			}
+		}
+	}
+	collect(ld["author"])
+	return strings.Join(names, ", ")
+}
+
+func metaContent(doc *goquery.Selection, selectors ...string) string {
+	for _, selector := range selectors {
+		if content := attrOf(doc.Find(selector).First(), "content"); len(content) > 0 {
+			return content
+		}
+	}
+	return ""
+}
+
+func attrOf(sel *goquery.Selection, attr string) string {
+	val, _ := sel.Attr(attr)
+	return strings.TrimSpace(val)
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if len(val) > 0 {
+			return val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// AssertionError is a page that was fetched fine but failed the request's
+// expect_status or expect_selector, ex: a soft 404 or a "please enable
+// JavaScript" page, rather than silently yielding nothing.
+type AssertionError struct {
+	Url    string
+	Reason string
+}
+
+func (e *AssertionError) Error() string {
+	return fmt.Sprintf("%s: assertion failed: %s", e.Url, e.Reason)
+}
+
+// Why r fails req's assertions, blank if it doesn't.  Only responses colly
+// didn't already fail are checked, so expected statuses are among the 2xx.
+func checkAssertions(req ScrapeRequest, r *colly.Response) string {
+	if len(req.ExpectStatus) > 0 && !containsInt(req.ExpectStatus, r.StatusCode) {
+		statuses := make([]string, len(req.ExpectStatus))
+		for i, status := range req.ExpectStatus {
+			statuses[i] = strconv.Itoa(status)
+		}
+		return fmt.Sprintf("expected status %s, got %d", strings.Join(statuses, " or "), r.StatusCode)
+	}
+	if len(req.ExpectSelector) == 0 {
+		return ""
+	}
+	if !strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+		return fmt.Sprintf("expected %q, got a %s page", req.ExpectSelector, r.Headers.Get("Content-Type"))
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(r.Body))
+	if err != nil {
+		return fmt.Sprintf("expected %q, page didn't parse: %v", req.ExpectSelector, err)
+	}
+	if selectFrom(doc.Selection, req.ExpectSelector).Length() == 0 {
+		return fmt.Sprintf("nothing matched %q", req.ExpectSelector)
+	}
+	return ""
+}
+
+func containsInt(vals []int, val int) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
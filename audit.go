@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a line of the -audit-log, one per scrape request made to
+// the server, accepted or not.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Value of -audit-user-header, ex: set by an authenticating proxy, or
+	// else the name of the api key used.
+	User         string `json:"user,omitempty"`
+	RemoteAddr   string `json:"remote_addr"`
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Method       string `json:"method"`
+	Path         string `json:"path"`
+	Url          string `json:"url,omitempty"`
+	// The request as parsed, with secrets redacted, see redactRequest.
+	// Missing if the body wasn't a valid scrape request json.
+	Request *ScrapeRequest `json:"request,omitempty"`
+	// http status the request was answered with, or 200 for accepted ones.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Appends AuditRecords to a json-lines file, which is only ever added to.
+type auditLog struct {
+	lock       sync.Mutex
+	f          *os.File
+	userHeader string
+}
+
+func openAuditLog(filename, userHeader string) (*auditLog, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, userHeader: userHeader}, nil
+}
+
+// Records a scrape request.  req is nil if the body couldn't be parsed.
+func (al *auditLog) record(r *http.Request, req *ScrapeRequest, status int, err error) {
+	rec := AuditRecord{
+		Time:         time.Now().UTC(),
+		RemoteAddr:   r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Status:       status,
+	}
+	if len(al.userHeader) > 0 {
+		rec.User = r.Header.Get(al.userHeader)
+	}
+	if len(rec.User) == 0 {
+		rec.User = keyName(r)
+	}
+	if req != nil {
+		rec.Url = req.Url
+		rec.Request = redactRequest(*req)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	line, _ := json.Marshal(rec)
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if _, err := al.f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %s\n", err)
+	}
+}
+
+// A copy of req with the values of headers and form fields, which tend to
+// hold credentials, replaced.  Names are kept.
+func redactRequest(req ScrapeRequest) *ScrapeRequest {
+	if req.Webhook != nil {
+		hook := *req.Webhook
+		hook.Headers = redactValues(hook.Headers)
+		req.Webhook = &hook
+	}
+	if req.Form != nil {
+		form := *req.Form
+		form.Values = redactValues(form.Values)
+		req.Form = &form
+	}
+	items := make(map[string]ScrapeItem, len(req.Items))
+	for name, item := range req.Items {
+		if item.Graphql != nil {
+			query := *item.Graphql
+			query.Headers = redactValues(query.Headers)
+			item.Graphql = &query
+		}
+		if item.Websocket != nil {
+			capture := *item.Websocket
+			capture.Headers = redactValues(capture.Headers)
+			item.Websocket = &capture
+		}
+		items[name] = item
+	}
+	req.Items = items
+	return &req
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if len(values) == 0 {
+		return values
+	}
+	redacted := make(map[string]string, len(values))
+	for name := range values {
+		redacted[name] = "REDACTED"
+	}
+	return redacted
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Roles an -api-keys entry can have, see roleGrants.
+const (
+	roleReader    = "reader"
+	roleSubmitter = "submitter"
+	roleWorker    = "worker"
+	roleAdmin     = "admin"
+)
+
+// What endpoints need.
+const (
+	// Read jobs, results and stats.
+	permRead = "read"
+	// Run scrapes and submit jobs.
+	permSubmit = "submit"
+	// Claim jobs and post their results, as a remote worker.
+	permWork = "work"
+	// Change runtime settings (limits, allow/deny lists).
+	permAdmin = "admin"
+)
+
+var roleGrants = map[string][]string{
+	roleReader:    {permRead},
+	roleSubmitter: {permRead, permSubmit},
+	roleWorker:    {permWork},
+	roleAdmin:     {permRead, permSubmit, permWork, permAdmin},
+}
+
+// ApiKey is an entry of the -api-keys file.
+type ApiKey struct {
+	Key string `json:"key"`
+	// Who the key belongs to, recorded in the audit log.
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func loadApiKeys(filename string) ([]ApiKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ApiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for idx, key := range keys {
+		if len(key.Key) < 16 {
+			return nil, fmt.Errorf("[%d].key must be at least 16 characters", idx)
+		}
+		if len(key.Name) == 0 {
+			return nil, fmt.Errorf("[%d].name was empty", idx)
+		}
+		if _, found := roleGrants[key.Role]; !found {
+			return nil, fmt.Errorf("[%d].role must be %q, %q, %q or %q", idx, roleReader, roleSubmitter, roleWorker, roleAdmin)
+		}
+	}
+	return keys, nil
+}
+
+type apiKeyCtxKey struct{}
+
+// Name of the api key the request was made with, if any.
+func keyName(r *http.Request) string {
+	key, _ := r.Context().Value(apiKeyCtxKey{}).(ApiKey)
+	return key.Name
+}
+
+// Whether what the request can see of jobs and stored runs is limited to
+// those submitted with keys of its key's name, and that name.  Only with
+// -api-keys, and not for admins.
+func (s *server) ownerScope(r *http.Request) (bool, string) {
+	key, _ := r.Context().Value(apiKeyCtxKey{}).(ApiKey)
+	return s.keysRequired && key.Role != roleAdmin, key.Name
+}
+
+// The key sent as a bearer token, if it's one of the server's.
+func (s *server) authenticate(r *http.Request) (ApiKey, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(token) == 0 {
+		return ApiKey{}, false
+	}
+	found := -1
+	// compare against every key so timing doesn't tell which one matched
+	for idx, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key.Key)) == 1 {
+			found = idx
+		}
+	}
+	if found == -1 {
+		return ApiKey{}, false
+	}
+	return s.keys[found], true
+}
+
+// Requires a key whose role grants perm.  Without -api-keys only the admin
+// endpoints need a key (the -admin-token), everything else is open.
+func (s *server) requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.keysRequired && perm != permAdmin {
+			next(w, r)
+			return
+		}
+		reject := func(status int, err error) {
+			if perm == permSubmit && s.conf.Audit != nil {
+				s.conf.Audit.record(r, nil, status, err)
+			}
+			writeError(w, status, err)
+		}
+		key, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			reject(http.StatusUnauthorized, errors.New("missing or unknown api key, send it as a bearer token"))
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, key))
+		if !containsString(roleGrants[key.Role], perm) {
+			reject(http.StatusForbidden, fmt.Errorf("api key %q (%s) isn't allowed to %s", key.Name, key.Role, perm))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Sends key as a bearer token with every request, ex: a remote worker's
+// api key for the coordinator.
+type apiKeyTransport struct {
+	base http.RoundTripper
+	key  string
+}
+
+func withApiKey(base http.RoundTripper, key string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &apiKeyTransport{base: base, key: key}
+}
+
+func (kt *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return kt.base.RoundTrip(withBearer(req, kt.key))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testKeys() []ApiKey {
+	return []ApiKey{
+		{Key: "reader-key-0123456789", Name: "team-a", Role: roleReader},
+		{Key: "submitter-key-0123456789", Name: "team-a", Role: roleSubmitter},
+		{Key: "worker-key-0123456789", Name: "workers", Role: roleWorker},
+		{Key: "admin-key-0123456789", Name: "ops", Role: roleAdmin},
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	keyed := &server{keys: testKeys(), keysRequired: true}
+	open := &server{keys: []ApiKey{{Key: "admin-key-0123456789", Name: "admin-token", Role: roleAdmin}}}
+	for _, test := range []struct {
+		name string
+		s    *server
+		perm string
+		key  string
+		want int
+	}{
+		{"no key", keyed, permRead, "", http.StatusUnauthorized},
+		{"unknown key", keyed, permRead, "nobody-key-0123456789", http.StatusUnauthorized},
+		{"reader reads", keyed, permRead, "reader-key-0123456789", http.StatusOK},
+		{"reader submits", keyed, permSubmit, "reader-key-0123456789", http.StatusForbidden},
+		{"submitter reads", keyed, permRead, "submitter-key-0123456789", http.StatusOK},
+		{"submitter submits", keyed, permSubmit, "submitter-key-0123456789", http.StatusOK},
+		{"submitter works", keyed, permWork, "submitter-key-0123456789", http.StatusForbidden},
+		{"worker works", keyed, permWork, "worker-key-0123456789", http.StatusOK},
+		{"worker reads", keyed, permRead, "worker-key-0123456789", http.StatusForbidden},
+		{"submitter administers", keyed, permAdmin, "submitter-key-0123456789", http.StatusForbidden},
+		{"admin administers", keyed, permAdmin, "admin-key-0123456789", http.StatusOK},
+		{"admin works", keyed, permWork, "admin-key-0123456789", http.StatusOK},
+		{"open server reads", open, permRead, "", http.StatusOK},
+		{"open server submits", open, permSubmit, "", http.StatusOK},
+		{"open server administers", open, permAdmin, "", http.StatusUnauthorized},
+		{"admin token administers", open, permAdmin, "admin-key-0123456789", http.StatusOK},
+	} {
+		handler := test.s.requirePermission(test.perm, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(test.key) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, expected %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestOwnerScope(t *testing.T) {
+	keyed := &server{keys: testKeys(), keysRequired: true}
+	open := &server{}
+	for _, test := range []struct {
+		name       string
+		s          *server
+		key        string
+		wantScoped bool
+		wantOwner  string
+	}{
+		{"reader", keyed, "reader-key-0123456789", true, "team-a"},
+		{"submitter", keyed, "submitter-key-0123456789", true, "team-a"},
+		{"admin", keyed, "admin-key-0123456789", false, "ops"},
+		{"open server", open, "", false, ""},
+	} {
+		var scoped bool
+		var owner string
+		handler := test.s.requirePermission(permRead, func(w http.ResponseWriter, r *http.Request) {
+			scoped, owner = test.s.ownerScope(r)
+		})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(test.key) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		handler(httptest.NewRecorder(), r)
+		if scoped != test.wantScoped || owner != test.wantOwner {
+			t.Errorf("%s: got %v %q, expected %v %q", test.name, scoped, owner, test.wantScoped, test.wantOwner)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Times each synthetic page is scraped per extraction mode.
+const benchRuns = 5
+
+// BenchResult is how extracting from a synthetic page of Rows products went,
+// from the DOM and tokenized, see runBench.
+type BenchResult struct {
+	Rows      int        `json:"rows"`
+	PageBytes int        `json:"page_bytes"`
+	Dom       BenchTimes `json:"dom"`
+	Tokenize  BenchTimes `json:"tokenize"`
+}
+
+type BenchTimes struct {
+	// Per run, averaged over benchRuns.
+	Ms      float64 `json:"ms"`
+	AllocMb float64 `json:"alloc_mb"`
+	Results int     `json:"results"`
+}
+
+// A product listing of n products, each with a link, price, tags and an
+// image, as listing pages tend to have.
+func benchPage(n int) []byte {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html><html><head><title>Products</title></head><body><main>\n")
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		b.WriteString(`<div class="product" data-id="` + id + `"><h2 class="name"><a href="/products/` + id + `">Product ` + id + "</a></h2>")
+		b.WriteString(`<p class="desc">Description of product ` + id + ` with <b>some</b> markup in it.</p>`)
+		b.WriteString(`<span class="price">$` + strconv.Itoa(i%1000) + ".99</span>")
+		b.WriteString(`<ul class="tags"><li>tag` + strconv.Itoa(i%7) + "</li><li>tag" + strconv.Itoa(i%11) + "</li></ul>")
+		b.WriteString(`<img src="/img/` + id + `.jpg" alt="Product ` + id + `"></div>` + "\n")
+	}
+	b.WriteString("</main></body></html>")
+	return []byte(b.String())
+}
+
+func benchRequest(pageUrl string, tokenize bool) ScrapeRequest {
+	return ScrapeRequest{Url: pageUrl, Tokenize: tokenize, Items: map[string]ScrapeItem{
+		"products": {Selector: "div.product", Fields: map[string]interface{}{
+			"id":    "|data-id",
+			"name":  "h2.name",
+			"link":  "h2.name a|href",
+			"desc":  "p.desc|owntext",
+			"price": "span.price",
+			"tags":  "ul.tags li",
+			"image": map[string]interface{}{"src": "img|src", "alt": "img|alt"},
+		}},
+	}}
+}
+
+// Scrapes synthetic pages of each number of rows from a local server,
+// benchRuns times from the DOM and benchRuns times tokenized, to measure
+// extraction with -cpuprofile and the like, or compare builds.
+func runBench(rows []int, opts scrapeOptions) ([]BenchResult, error) {
+	var page []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}))
+	defer srv.Close()
+	// only the extraction is being measured
+	opts.Transport = nil
+	opts.MaxPageBytes = 0
+	opts.Stream = nil
+	var results []BenchResult
+	for _, n := range rows {
+		page = benchPage(n)
+		res := BenchResult{Rows: n, PageBytes: len(page)}
+		var err error
+		if res.Dom, err = benchScrape(benchRequest(srv.URL, false), opts); err != nil {
+			return results, err
+		}
+		if res.Tokenize, err = benchScrape(benchRequest(srv.URL, true), opts); err != nil {
+			return results, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func benchScrape(req ScrapeRequest, opts scrapeOptions) (BenchTimes, error) {
+	var times BenchTimes
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < benchRuns; i++ {
+		results, err := scrape(req, opts)
+		if err != nil {
+			return times, err
+		}
+		times.Results = countValues(results["products"])
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	times.Ms = math.Round(float64(elapsed)/float64(time.Millisecond)/benchRuns*10) / 10
+	times.AllocMb = math.Round(float64(after.TotalAlloc-before.TotalAlloc)/(1<<20)/benchRuns*10) / 10
+	return times, nil
+}
+
+// Parses "gluestick bench" row counts, defaulting to a small, medium and
+// large page.
+func benchRows(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return []int{100, 10000, 100000}, nil
+	}
+	rows := make([]int, len(args))
+	for i, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("rows must be a positive number, got %q", arg)
+		}
+		rows[i] = n
+	}
+	return rows, nil
+}
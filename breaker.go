@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// breaker stops requests to a domain after too many consecutive failures,
+// until a cool down period has passed, so one dead host doesn't eat up the
+// whole run's time.
+type breaker struct {
+	lock      sync.Mutex
+	failures  map[string]int
+	openUntil map[string]time.Time
+	key       func(host string) string
+	threshold int
+	cooldown  time.Duration
+	verbose   bool
+}
+
+func newBreaker(key func(host string) string, threshold int, cooldown time.Duration, verbose bool) *breaker {
+	return &breaker{
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+		key:       key,
+		threshold: threshold,
+		cooldown:  cooldown,
+		verbose:   verbose,
+	}
+}
+
+// Returns true if requests to the host are currently allowed.
+func (b *breaker) allow(host string) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return time.Now().After(b.openUntil[b.key(host)])
+}
+
+func (b *breaker) success(host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.failures, b.key(host))
+}
+
+func (b *breaker) failure(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+	key := b.key(host)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures[key]++
+	if b.failures[key] >= b.threshold {
+		b.openUntil[key] = time.Now().Add(b.cooldown)
+		b.failures[key] = 0
+		if b.verbose {
+			log.Printf("%s failed %d times in a row, skipping it for %s\n", key, b.threshold, b.cooldown)
+		}
+	}
+}
+
+// Aborts the request if its domain's breaker is open, recording it as skipped.
+func (b *breaker) onRequest(r *colly.Request, meta *ScrapeMeta) {
+	if !b.allow(r.URL.Host) {
+		meta.skip(r.URL.String(), "too many consecutive failures for "+b.key(r.URL.Host))
+		r.Abort()
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files in a -bundle.
+const (
+	bundleManifest  = "manifest.json"
+	bundleRequest   = "request.json"
+	bundleSnapshots = "snapshots.har"
+	bundleResults   = "results.json"
+)
+
+// Everything needed to audit or reproduce a run, written to -bundle as a
+// .tar.gz once the run is done: the request as run, every response fetched
+// (see -replay), the results and a manifest.
+type runBundle struct {
+	filename string
+	started  time.Time
+	// Every request and response, bodies whole.
+	pages *harRecorder
+}
+
+// BundleManifest is a -bundle's manifest.json, describing the run.
+type BundleManifest struct {
+	RequestVersion int       `json:"request_version"`
+	Args           []string  `json:"args"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	// See configKey.
+	Config string `json:"config"`
+	// Urls the request was run on, more than its own with -seed-from or
+	// -urls.
+	Urls     []string       `json:"urls"`
+	Pages    int            `json:"pages"`
+	Counts   map[string]int `json:"counts,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	ExitCode int            `json:"exit_code"`
+}
+
+func newRunBundle(filename string) *runBundle {
+	return &runBundle{filename: filename, started: time.Now(), pages: newHarRecorder("", math.MaxInt64)}
+}
+
+// Writes the bundle, output being the results as printed.  Snapshots hold
+// request headers (ex: cookies), so the file is only readable by its owner.
+func (rb *runBundle) write(req ScrapeRequest, urls []string, output []byte, counts map[string]int, scrapeErr error, exitCode int) error {
+	manifest := BundleManifest{
+		RequestVersion: requestVersion,
+		Args:           os.Args,
+		Started:        rb.started,
+		Finished:       time.Now(),
+		Config:         configKey(req),
+		Urls:           urls,
+		Counts:         counts,
+		ExitCode:       exitCode,
+	}
+	rb.pages.lock.Lock()
+	entries := append([]harEntry{}, rb.pages.entries...)
+	rb.pages.lock.Unlock()
+	manifest.Pages = len(entries)
+	if scrapeErr != nil {
+		manifest.Error = scrapeErr.Error()
+	}
+	reqJson, err := json.MarshalIndent(req, "", "    ")
+	if err != nil {
+		return err
+	}
+	manifestJson, _ := json.MarshalIndent(manifest, "", "    ")
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "gluestick", "version": "1"},
+			"entries": entries,
+		},
+	}
+	harJson, err := json.Marshal(har)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(rb.filename), ".bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{bundleManifest, manifestJson},
+		{bundleRequest, reqJson},
+		{bundleSnapshots, harJson},
+		{bundleResults, output},
+	}
+	for _, f := range files {
+		if f.data == nil {
+			continue // no results if the scrape failed
+		}
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: manifest.Finished}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(f.data); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rb.filename)
+}
+
+// Reads the named files of a -bundle, those missing being left out.
+func readBundle(filename string, names ...string) (map[string][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a bundle: %v", filename, err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%q isn't a bundle: %v", filename, err)
+		}
+		if containsString(names, hdr.Name) {
+			if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Answers requests with the responses in a -bundle's snapshots rather than
+// fetching them, so its run can be reproduced.  A url requested several
+// times gets its responses in the order they were recorded, the last one
+// again after that.
+type replayTransport struct {
+	lock      sync.Mutex
+	responses map[string][]harEntry
+	// The bundle's request.
+	request []byte
+}
+
+func loadReplay(filename string) (*replayTransport, error) {
+	files, err := readBundle(filename, bundleRequest, bundleSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	if files[bundleSnapshots] == nil {
+		return nil, fmt.Errorf("%q has no %s", filename, bundleSnapshots)
+	}
+	var har struct {
+		Log struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(files[bundleSnapshots], &har); err != nil {
+		return nil, fmt.Errorf("bad %s in %q: %v", bundleSnapshots, filename, err)
+	}
+	rt := &replayTransport{responses: make(map[string][]harEntry), request: files[bundleRequest]}
+	for _, entry := range har.Log.Entries {
+		if entry.Response.Status == 0 {
+			continue // failed to fetch, replayed as not recorded
+		}
+		key := entry.Request.Method + " " + entry.Request.Url
+		rt.responses[key] = append(rt.responses[key], entry)
+	}
+	return rt, nil
+}
+
+func (rt *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := req.Method + " " + req.URL.String()
+	rt.lock.Lock()
+	entries := rt.responses[key]
+	if len(entries) > 1 {
+		rt.responses[key] = entries[1:]
+	}
+	rt.lock.Unlock()
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s isn't in the -replay bundle", key)
+	}
+	recorded := entries[0].Response
+	body := []byte(recorded.Content.Text)
+	if recorded.Content.Encoding == "base64" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(recorded.Content.Text); err != nil {
+			return nil, err
+		}
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, recorded.StatusText),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	for _, h := range recorded.Headers {
+		if !strings.EqualFold(h.Name, "Content-Length") {
+			resp.Header.Add(h.Name, h.Value)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server side cache of /scrape results for requests with a cache_ttl, so
+// many clients asking for the same popular page don't each fetch it.
+// Identical requests arriving while one is being scraped wait for it rather
+// than starting their own.
+type resultCache struct {
+	lock    sync.Mutex
+	size    int
+	maxTtl  time.Duration
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	// Closed once results/err are set.
+	done    chan struct{}
+	results ScrapeResult
+	err     error
+	stored  time.Time
+}
+
+func newResultCache(size int, maxTtl time.Duration) *resultCache {
+	return &resultCache{size: size, maxTtl: maxTtl, entries: make(map[string]*cacheEntry)}
+}
+
+// What a cached response's "_meta" holds: the original run's meta, if it
+// was asked for, plus when it was scraped.
+type cachedMeta struct {
+	*ScrapeMeta
+	Cached   bool      `json:"cached"`
+	CachedAt time.Time `json:"cached_at"`
+}
+
+// Key for req that ignores settings not affecting the results, so
+// requests differing only in those share a cache entry.
+func cacheKey(req ScrapeRequest) string {
+	req.CacheTtl = 0
+	req.Webhook = nil
+	if u, err := url.Parse(req.Url); err == nil {
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		u.Fragment = ""
+		req.Url = u.String()
+	}
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns req's results scraped within ttl (capped to maxTtl), otherwise
+// runs the scrape and caches its results.  Results from another request's
+// scrape are marked as cached in "_meta".
+func (rc *resultCache) get(req ScrapeRequest, ttl time.Duration, run func() (ScrapeResult, error)) (ScrapeResult, error) {
+	if ttl > rc.maxTtl {
+		ttl = rc.maxTtl
+	}
+	// kept apart per api key, results can depend on a key's session
+	key := req.owner + "/" + cacheKey(req)
+	rc.lock.Lock()
+	if entry, found := rc.entries[key]; found {
+		select {
+		case <-entry.done:
+			if time.Since(entry.stored) <= ttl {
+				rc.lock.Unlock()
+				return withCachedMeta(entry.results, entry.stored), nil
+			}
+		default:
+			rc.lock.Unlock()
+			<-entry.done
+			if entry.err != nil {
+				return nil, entry.err
+			}
+			return withCachedMeta(entry.results, entry.stored), nil
+		}
+	}
+	entry := &cacheEntry{done: make(chan struct{})}
+	rc.entries[key] = entry
+	rc.evictLocked()
+	rc.lock.Unlock()
+
+	entry.results, entry.err = run()
+	entry.stored = time.Now()
+	close(entry.done)
+	if entry.err != nil {
+		rc.lock.Lock()
+		if rc.entries[key] == entry {
+			delete(rc.entries, key)
+		}
+		rc.lock.Unlock()
+	}
+	return entry.results, entry.err
+}
+
+// Drops entries too old for any request to use, then the oldest finished
+// entries until within size.
+func (rc *resultCache) evictLocked() {
+	cutoff := time.Now().Add(-rc.maxTtl)
+	for key, entry := range rc.entries {
+		if isDone(entry) && entry.stored.Before(cutoff) {
+			delete(rc.entries, key)
+		}
+	}
+	for len(rc.entries) > rc.size {
+		oldestKey := ""
+		var oldest time.Time
+		for key, entry := range rc.entries {
+			if isDone(entry) && (len(oldestKey) == 0 || entry.stored.Before(oldest)) {
+				oldestKey, oldest = key, entry.stored
+			}
+		}
+		if len(oldestKey) == 0 {
+			return // everything is still being scraped
+		}
+		delete(rc.entries, oldestKey)
+	}
+}
+
+func isDone(entry *cacheEntry) bool {
+	select {
+	case <-entry.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// A copy of results, which are shared between responses, with "_meta"
+// marking them as cached.
+func withCachedMeta(results ScrapeResult, stored time.Time) ScrapeResult {
+	copied := make(ScrapeResult, len(results)+1)
+	for name, val := range results {
+		copied[name] = val
+	}
+	meta, _ := results[metaKey].(*ScrapeMeta)
+	copied[metaKey] = cachedMeta{ScrapeMeta: meta, Cached: true, CachedAt: stored}
+	return copied
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// Set on the request context once a canonical url has been followed, so
+// canonical links are only ever followed one hop.
+const canonicalCtxKey = "gluestick.canonical"
+
+// Returns the page's rel=canonical url if it differs from the page's own url,
+// along with its rel=amphtml url if it has one.  Both are absolute.
+func pageCanonical(r *colly.Response) (canonical string, amp string) {
+	if !strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+		return "", ""
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(r.Body))
+	if err != nil {
+		return "", ""
+	}
+	if href, found := doc.Find("link[rel~=canonical]").First().Attr("href"); found && len(strings.TrimSpace(href)) > 0 {
+		canonical = r.Request.AbsoluteURL(strings.TrimSpace(href))
+		if sameDocument(canonical, r.Request.URL.String()) {
+			canonical = ""
+		}
+	}
+	if href, found := doc.Find("link[rel~=amphtml]").First().Attr("href"); found && len(strings.TrimSpace(href)) > 0 {
+		amp = r.Request.AbsoluteURL(strings.TrimSpace(href))
+	}
+	return canonical, amp
+}
+
+// Compares urls ignoring fragments.
+func sameDocument(a, b string) bool {
+	if idx := strings.Index(a, "#"); idx != -1 {
+		a = a[:idx]
+	}
+	if idx := strings.Index(b, "#"); idx != -1 {
+		b = b[:idx]
+	}
+	return a == b
+}
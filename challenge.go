@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gocolly/colly"
+)
+
+const challengeCtxKey = "gluestick.challenge"
+
+// Markers of bot challenge/CAPTCHA pages, checked in order.  Widget markers
+// alone aren't enough since plenty of real pages have a captcha on a form,
+// see detectChallenge.
+var challengeMarkers = []struct {
+	kind    string
+	markers []string
+	// Whether the marker only appears on interstitials, vs a widget that
+	// could be embedded in a normal page.
+	interstitial bool
+}{
+	{"cloudflare", []string{"cf-browser-verification", "cf_chl_opt", "/cdn-cgi/challenge-platform/"}, true},
+	{"datadome", []string{"captcha-delivery.com"}, true},
+	{"perimeterx", []string{"px-captcha", "_pxCaptcha"}, true},
+	{"turnstile", []string{"cf-turnstile", "challenges.cloudflare.com/turnstile"}, false},
+	{"hcaptcha", []string{"h-captcha", "hcaptcha.com/1/api.js"}, false},
+	{"recaptcha", []string{"g-recaptcha", "www.google.com/recaptcha/", "www.recaptcha.net/recaptcha/"}, false},
+}
+
+var (
+	challengeTitle = regexp.MustCompile(`(?is)<title[^>]*>[^<]*(just a moment|attention required|captcha|are you a robot|verify you are human|access denied|pardon our interruption)[^<]*</title>`)
+	siteKeyAttr    = regexp.MustCompile(`data-sitekey\s*=\s*["']([^"']+)["']`)
+)
+
+// Returns the kind of challenge r is, ex: "cloudflare" or "recaptcha", or ""
+// if it looks like a normal page.
+func detectChallenge(r *colly.Response) string {
+	if r.Headers != nil && strings.EqualFold(r.Headers.Get("Cf-Mitigated"), "challenge") {
+		return "cloudflare"
+	}
+	blocked := r.StatusCode == http.StatusForbidden || r.StatusCode == http.StatusTooManyRequests ||
+		r.StatusCode == http.StatusServiceUnavailable || challengeTitle.Match(r.Body)
+	for _, c := range challengeMarkers {
+		if !c.interstitial && !blocked {
+			continue
+		}
+		for _, marker := range c.markers {
+			if bytes.Contains(r.Body, []byte(marker)) {
+				return c.kind
+			}
+		}
+	}
+	return ""
+}
+
+// ChallengeInfo is sent to the -challenge-solver processor as json.
+type ChallengeInfo struct {
+	Url     string `json:"url"`
+	Kind    string `json:"kind"`
+	Status  int    `json:"status"`
+	SiteKey string `json:"site_key,omitempty"`
+}
+
+// A solver replies with headers to retry the page with, ex: a clearance
+// cookie, or nothing if it couldn't solve the challenge.
+type challengeSolution struct {
+	Headers map[string]string `json:"headers"`
+}
+
+func solveChallenge(solver processor, r *colly.Response, kind string) (map[string]string, error) {
+	info := ChallengeInfo{Url: r.Request.URL.String(), Kind: kind, Status: r.StatusCode}
+	if m := siteKeyAttr.FindSubmatch(r.Body); m != nil {
+		info.SiteKey = string(m[1])
+	}
+	in, _ := json.Marshal(info)
+	out, err := solver.run(string(in))
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	var solution challengeSolution
+	if err := json.Unmarshal([]byte(out), &solution); err != nil {
+		return nil, fmt.Errorf("invalid solver output: %v", err)
+	}
+	return solution.Headers, nil
+}
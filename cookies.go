@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// cookieJar is a cookie jar that can be saved to and loaded from a file, so
+// sessions (ex: a login) carry over between runs.  Matching is left to the
+// standard library's jar, this just keeps track of every cookie set so they
+// can be written out.
+type cookieJar struct {
+	*cookiejar.Jar
+	filename string
+	lock     sync.Mutex
+	// domain/host + path + name -> cookie
+	cookies map[string]savedCookie
+}
+
+type savedCookie struct {
+	// Url the cookie was set from, needed to replay host-only cookies.
+	Url string `json:"url"`
+	// The cookie in Set-Cookie form with an absolute Expires.
+	SetCookie string `json:"set_cookie"`
+}
+
+// Loads the jar from filename if it exists.
+func loadCookieJar(filename string) (*cookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	cj := &cookieJar{Jar: jar, filename: filename, cookies: make(map[string]savedCookie)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cj, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved []savedCookie
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, s := range saved {
+		u, err := url.Parse(s.Url)
+		if err != nil {
+			continue
+		}
+		header := http.Header{"Set-Cookie": {s.SetCookie}}
+		cj.SetCookies(u, (&http.Response{Header: header}).Cookies())
+	}
+	return cj, nil
+}
+
+func (cj *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	cj.Jar.SetCookies(u, cookies)
+	cj.lock.Lock()
+	defer cj.lock.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		if len(domain) == 0 {
+			domain = u.Hostname()
+		}
+		key := domain + ";" + c.Path + ";" + c.Name
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(cj.cookies, key)
+			continue
+		}
+		saved := *c
+		if saved.MaxAge > 0 {
+			// relative expiry would be extended on every load
+			saved.Expires = now.Add(time.Duration(saved.MaxAge) * time.Second)
+			saved.MaxAge = 0
+		}
+		cj.cookies[key] = savedCookie{Url: u.String(), SetCookie: saved.String()}
+	}
+}
+
+// Writes the jar out, dropping expired cookies.
+func (cj *cookieJar) save() error {
+	cj.lock.Lock()
+	saved := make([]savedCookie, 0, len(cj.cookies))
+	now := time.Now()
+	for key, s := range cj.cookies {
+		header := http.Header{"Set-Cookie": {s.SetCookie}}
+		if parsed := (&http.Response{Header: header}).Cookies(); len(parsed) == 1 &&
+			!parsed[0].Expires.IsZero() && parsed[0].Expires.Before(now) {
+			delete(cj.cookies, key)
+			continue
+		}
+		saved = append(saved, s)
+	}
+	cj.lock.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	// cookies are credentials, keep them private
+	tmp, err := ioutil.TempFile(filepath.Dir(cj.filename), ".cookies-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cj.filename)
+}
+
+// Handles cookies at the transport level so every request made with it
+// (pages, downloads, link checks, each redirect hop) shares the same jar.
+type cookieTransport struct {
+	base http.RoundTripper
+	jar  http.CookieJar
+}
+
+func withCookies(base http.RoundTripper, jar http.CookieJar) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &cookieTransport{base: base, jar: jar}
+}
+
+func (ct *cookieTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cookies := ct.jar.Cookies(req.URL); len(cookies) > 0 {
+		req = req.Clone(req.Context())
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+	}
+	resp, err := ct.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		ct.jar.SetCookies(req.URL, cookies)
+	}
+	return resp, nil
+}
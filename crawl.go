@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gocolly/colly"
+)
+
+// CrawlOptions make a scrape follow links from its url, extracting items from
+// every page reached.
+type CrawlOptions struct {
+	// Selector of links to follow, defaults to "a[href]".
+	Follow string `json:"follow,omitempty"`
+	// Link hops from the start url, defaults to 1.
+	MaxDepth int `json:"max_depth,omitempty"`
+	// Max number of pages fetched, defaults to 100.
+	MaxPages int `json:"max_pages,omitempty"`
+	// Follow links off of the start url's registrable domain.
+	AnyDomain bool `json:"any_domain,omitempty"`
+	// Include a map of all discovered urls in the run's metadata.
+	Sitemap bool `json:"sitemap,omitempty"`
+	// Check every discovered link, including other domains, and list broken
+	// ones in the run's metadata.  Items are optional when checking links.
+	CheckLinks bool `json:"check_links,omitempty"`
+}
+
+// SitemapEntry is a url discovered while crawling.  Urls found beyond the
+// crawl's limits are listed but not visited.
+type SitemapEntry struct {
+	Url     string `json:"url"`
+	Depth   int    `json:"depth"`
+	Visited bool   `json:"visited"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Number of distinct crawled pages linking here.
+	Inbound int `json:"inbound"`
+}
+
+type crawler struct {
+	opts    CrawlOptions
+	domain  string
+	lock    sync.Mutex
+	visited int
+	entries map[string]*SitemapEntry
+	sources map[string]map[string]bool
+}
+
+func newCrawler(opts CrawlOptions, startUrl string) *crawler {
+	if len(opts.Follow) == 0 {
+		opts.Follow = "a[href]"
+	}
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = 1
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = 100
+	}
+	cr := &crawler{
+		opts:    opts,
+		entries: make(map[string]*SitemapEntry),
+		sources: make(map[string]map[string]bool),
+	}
+	if u, err := url.Parse(startUrl); err == nil {
+		cr.domain = registrableDomain(u.Host)
+	}
+	cr.discover(crawlUrl(startUrl), "", 0)
+	return cr
+}
+
+// Registers the crawl's link following on c.
+func (cr *crawler) attach(c *colly.Collector) {
+	// colly counts the start url as depth 1
+	c.MaxDepth = cr.opts.MaxDepth + 1
+	c.OnHTML(cr.opts.Follow, func(e *colly.HTMLElement) {
+		link := crawlUrl(e.Request.AbsoluteURL(e.Attr("href")))
+		if len(link) == 0 {
+			return
+		}
+		inScope := cr.inScope(link)
+		if !inScope && !cr.opts.CheckLinks {
+			return
+		}
+		from := crawlUrl(e.Request.URL.String())
+		cr.discover(link, from, e.Request.Depth)
+		if !inScope {
+			return
+		}
+		// already visited, too deep, etc are all expected
+		e.Request.Visit(link)
+	})
+}
+
+// Aborts requests beyond max_pages.  Returns false if the request was aborted.
+func (cr *crawler) onRequest(r *colly.Request, meta *ScrapeMeta) bool {
+	link := crawlUrl(r.URL.String())
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	entry := cr.entries[link]
+	if entry != nil && entry.Visited {
+		return true // retry of a page already counted
+	}
+	if cr.visited >= cr.opts.MaxPages {
+		meta.skip(r.URL.String(), "crawl max_pages reached")
+		r.Abort()
+		return false
+	}
+	cr.visited++
+	if entry == nil { // redirects, canonical urls, etc
+		entry = &SitemapEntry{Url: link, Depth: r.Depth - 1}
+		cr.entries[link] = entry
+	}
+	entry.Visited = true
+	return true
+}
+
+func (cr *crawler) result(pageUrl string, status int, err error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if entry, found := cr.entries[crawlUrl(pageUrl)]; found {
+		entry.Status = status
+		entry.Error = ""
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	}
+}
+
+func (cr *crawler) discover(link string, from string, depth int) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	entry, found := cr.entries[link]
+	if !found {
+		entry = &SitemapEntry{Url: link, Depth: depth}
+		cr.entries[link] = entry
+	} else if depth < entry.Depth {
+		// pages are crawled depth first, so a shorter path may turn up later
+		entry.Depth = depth
+	}
+	if len(from) > 0 && from != link {
+		if cr.sources[link] == nil {
+			cr.sources[link] = make(map[string]bool)
+		}
+		cr.sources[link][from] = true
+		entry.Inbound = len(cr.sources[link])
+	}
+}
+
+func (cr *crawler) inScope(link string) bool {
+	if cr.opts.AnyDomain {
+		return true
+	}
+	u, err := url.Parse(link)
+	return err == nil && registrableDomain(u.Host) == cr.domain
+}
+
+// Discovered urls ordered by depth, then url.
+func (cr *crawler) sitemap() []SitemapEntry {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	entries := make([]SitemapEntry, 0, len(cr.entries))
+	for _, entry := range cr.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Depth != entries[j].Depth {
+			return entries[i].Depth < entries[j].Depth
+		}
+		return entries[i].Url < entries[j].Url
+	})
+	return entries
+}
+
+// Normalizes a link for crawling, dropping the fragment.  Returns "" for
+// anything that isn't http(s).
+func crawlUrl(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// How much html is shown around a near miss.
+const debugSnippetLen = 300
+
+func sortedItemNames(items map[string]ScrapeItem) []string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Number of elements each item selector, and each field selector within the
+// item's elements, matched on the page.  Keyed by item name and dotted field
+// path, ex: "articles" and "articles.image.src".
+func matchCounts(items map[string]ScrapeItem, doc *goquery.Selection) map[string]int {
+	counts := make(map[string]int)
+	for name, item := range items {
+		if len(item.Selector) == 0 || isJsonItem(item) || len(item.IframeSelector) > 0 {
+			continue // pdf or article of the whole page, not html at all, or in a frame
+		}
+		matches := safeFind(doc, item.Selector)
+		if matches == nil {
+			continue
+		}
+		counts[name] = matches.Length()
+		if item.Type != itemTypeArticle {
+			countFieldMatches(name, item.Fields, matches, counts)
+		}
+	}
+	return counts
+}
+
+func countFieldMatches(prefix string, fields map[string]interface{}, root *goquery.Selection, counts map[string]int) {
+	for name, field := range fields {
+		switch field := field.(type) {
+		case string:
+			if isUrlField(field) {
+				continue
+			}
+			sel, attr := getSelectorAndAttr(field)
+			if len(sel) == 0 {
+				if len(attr) > 0 && !isPseudoAttr(attr) {
+					counts[prefix+"."+name] = root.Filter("[" + attr + "]").Length()
+				} else {
+					counts[prefix+"."+name] = root.Length()
+				}
+			} else if found := safeFind(root, sel); found != nil {
+				counts[prefix+"."+name] = found.Length()
+			}
+		case map[string]interface{}:
+			countFieldMatches(prefix+"."+name, field, root, counts)
+		}
+	}
+}
+
+// "a=1 a.b=2" in key order, for logging.
+func formatCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", key, counts[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Logs why each item selector that matched nothing on the page didn't, and
+// the same for fields that matched nothing in any of their item's elements
+// (fields missing from only some are normal).
+func debugPage(items map[string]ScrapeItem, doc *goquery.Selection, pageUrl string) {
+	reported := make(map[string]bool)
+	for _, name := range sortedItemNames(items) {
+		item := items[name]
+		if len(item.Selector) == 0 || isJsonItem(item) || len(item.IframeSelector) > 0 {
+			continue // pdf or article of the whole page, not html at all, or in a frame
+		}
+		matches := safeFind(doc, item.Selector)
+		if matches == nil {
+			continue
+		}
+		if matches.Length() == 0 {
+			debugSelector(fmt.Sprintf("item %q", name), item.Selector, doc, pageUrl)
+		} else if item.Type != itemTypeArticle {
+			debugFields(name, item.Fields, matches, pageUrl, reported)
+		}
+	}
+}
+
+// Explains why selector matched nothing under root for -debug-selectors: the
+// longest leading part of it that does match, what the next step would match
+// if relaxed, and the html where the match stopped.
+func debugSelector(what string, selector string, root *goquery.Selection, pageUrl string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "DEBUG: %s selector %q matched nothing on %s\n", what, selector, pageUrl)
+	groups := splitSelectorGroups(selector)
+	for _, group := range groups {
+		steps := splitSelectorSteps(group)
+		// longest prefix that still matches
+		matched := root
+		n := 0
+		for ; n < len(steps); n++ {
+			sel := safeFind(root, strings.Join(steps[:n+1], ""))
+			if sel == nil || sel.Length() == 0 {
+				break
+			}
+			matched = sel
+		}
+		if len(groups) > 1 {
+			fmt.Fprintf(&b, "  group %q:\n", group)
+		}
+		if n == 0 {
+			fmt.Fprintf(&b, "  no part of it matches\n")
+		} else {
+			fmt.Fprintf(&b, "  longest matching part: %q (%d matches)\n",
+				strings.TrimSpace(strings.Join(steps[:n], "")), matched.Length())
+		}
+		if n < len(steps) {
+			prefix := strings.Join(steps[:n], "")
+			var near []string
+			for _, alt := range relaxedSteps(steps[n], n > 0) {
+				if sel := safeFind(root, prefix+alt); sel != nil && sel.Length() > 0 {
+					near = append(near, fmt.Sprintf("%q (%d)", strings.TrimSpace(prefix+alt), sel.Length()))
+				}
+			}
+			if len(near) > 0 {
+				fmt.Fprintf(&b, "  nearest candidates: %s\n", strings.Join(near, ", "))
+			}
+			if n > 0 {
+				fmt.Fprintf(&b, "  html where it stopped matching: %s\n", snippet(matched.First()))
+			}
+		}
+	}
+	log.Print(b.String())
+}
+
+// Finds sel under root, nil if it doesn't parse.
+func safeFind(root *goquery.Selection, sel string) (found *goquery.Selection) {
+	defer func() {
+		if recover() != nil {
+			found = nil
+		}
+	}()
+	return selectFrom(root, strings.TrimSpace(sel))
+}
+
+func snippet(sel *goquery.Selection) string {
+	html, err := goquery.OuterHtml(sel)
+	if err != nil {
+		return ""
+	}
+	html = strings.Join(strings.Fields(html), " ")
+	if len(html) > debugSnippetLen {
+		html = html[:debugSnippetLen] + "..."
+	}
+	return html
+}
+
+// Splits a selector on top level commas.
+func splitSelectorGroups(selector string) []string {
+	var groups []string
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range selector {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(' || r == '[':
+			depth++
+		case r == ')' || r == ']':
+			depth--
+		case r == ',' && depth == 0:
+			groups = append(groups, strings.TrimSpace(selector[start:i]))
+			start = i + 1
+		}
+	}
+	return append(groups, strings.TrimSpace(selector[start:]))
+}
+
+// Splits a selector into compound steps, each including the combinator
+// before it, so joining the first n steps gives a valid selector, ex:
+// "div.a > p b" -> ["div.a", " > p", " b"].
+func splitSelectorSteps(selector string) []string {
+	var steps []string
+	var cur strings.Builder
+	depth := 0
+	var quote rune
+	pendingSpace := false
+	for _, r := range selector {
+		if quote != 0 {
+			cur.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(' || r == '[':
+			depth++
+		case r == ')' || r == ']':
+			depth--
+		}
+		if depth == 0 && (r == ' ' || r == '\t' || r == '\n') {
+			pendingSpace = true
+			continue
+		}
+		if depth == 0 && (r == '>' || r == '+' || r == '~') {
+			if cur.Len() > 0 && strings.TrimSpace(cur.String()) != "" && !endsWithCombinator(cur.String()) {
+				steps = append(steps, cur.String())
+				cur.Reset()
+			}
+			cur.WriteString(" " + string(r) + " ")
+			pendingSpace = false
+			continue
+		}
+		if pendingSpace && cur.Len() > 0 && !endsWithCombinator(cur.String()) {
+			steps = append(steps, cur.String())
+			cur.Reset()
+			cur.WriteString(" ")
+		}
+		pendingSpace = false
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		steps = append(steps, cur.String())
+	}
+	return steps
+}
+
+func endsWithCombinator(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasSuffix(s, ">") || strings.HasSuffix(s, "+") || strings.HasSuffix(s, "~")
+}
+
+// Looser versions of a step to try when it matches nothing: the tag alone
+// and each class, id and attribute on its own, keeping the combinator.  With
+// any, also "*" to show whether anything at all is in that position.
+func relaxedSteps(step string, any bool) []string {
+	trimmed := strings.TrimLeft(step, " ")
+	combinator := step[:len(step)-len(trimmed)]
+	if idx := strings.IndexAny(trimmed, ">+~"); idx == 0 {
+		combinator = step[:len(step)-len(trimmed)] + trimmed[:1] + " "
+		trimmed = strings.TrimSpace(trimmed[1:])
+	}
+	var parts []string
+	var cur strings.Builder
+	depth := 0
+	for _, r := range trimmed {
+		if depth == 0 && (r == '.' || r == '#' || r == '[' || r == ':') && cur.Len() > 0 {
+			parts = append(parts, cur.String())
+			cur.Reset()
+		}
+		if r == '[' || r == '(' {
+			depth++
+		} else if r == ']' || r == ')' {
+			depth--
+		}
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	seen := make(map[string]bool)
+	var alts []string
+	for _, part := range parts {
+		if strings.HasPrefix(part, ":") || seen[part] || part == trimmed {
+			continue // pseudo classes on their own aren't useful
+		}
+		seen[part] = true
+		alts = append(alts, combinator+part)
+	}
+	if any && !seen["*"] {
+		alts = append(alts, combinator+"*")
+	}
+	return alts
+}
+
+// Reports fields (recursing into nested ones) whose selector matched nothing
+// within e.
+func debugFields(itemName string, fields map[string]interface{}, root *goquery.Selection, pageUrl string, reported map[string]bool) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch field := fields[name].(type) {
+		case string:
+			sel, _ := getSelectorAndAttr(field)
+			key := itemName + "." + name
+			if len(sel) == 0 || reported[key] || isUrlField(field) {
+				continue
+			}
+			if found := safeFind(root, sel); found != nil && found.Length() == 0 {
+				reported[key] = true
+				debugSelector(fmt.Sprintf("field %q", key), sel, root, pageUrl)
+			}
+		case map[string]interface{}:
+			debugFields(itemName+"."+name, field, root, pageUrl, reported)
+		}
+	}
+}
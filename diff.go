@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// FieldDiff is a value that differs between two scrapes.  A is nil if the
+// value is only in B and vice versa.
+type FieldDiff struct {
+	Path string      `json:"path"`
+	A    interface{} `json:"a"`
+	B    interface{} `json:"b"`
+}
+
+type DiffResult struct {
+	A           string      `json:"a"`
+	B           string      `json:"b"`
+	Differences []FieldDiff `json:"differences"`
+}
+
+// Runs the same request against urlA and urlB and compares their results
+// field by field.
+func scrapeDiff(req ScrapeRequest, urlA string, urlB string, opts scrapeOptions) (*DiffResult, error) {
+	var results [2]interface{}
+	for i, u := range []string{urlA, urlB} {
+		req.Url = u
+		res, err := scrape(req, opts)
+		if err != nil {
+			return nil, fmt.Errorf("scraping %s: %s", u, err)
+		}
+		delete(res, metaKey)
+		// compare plain json values rather than whatever types items produce
+		data, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &results[i]); err != nil {
+			return nil, err
+		}
+	}
+	diff := &DiffResult{A: urlA, B: urlB, Differences: []FieldDiff{}}
+	diffValues("", results[0], results[1], &diff.Differences)
+	return diff, nil
+}
+
+func diffValues(path string, a interface{}, b interface{}, diffs *[]FieldDiff) {
+	aMap, aIsMap := a.(map[string]interface{})
+	bMap, bIsMap := b.(map[string]interface{})
+	if aIsMap && bIsMap {
+		keys := make(map[string]bool)
+		for k := range aMap {
+			keys[k] = true
+		}
+		for k := range bMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			childPath := k
+			if len(path) > 0 {
+				childPath = path + "." + k
+			}
+			diffValues(childPath, aMap[k], bMap[k], diffs)
+		}
+		return
+	}
+	_, aIsList := a.([]interface{})
+	_, bIsList := b.([]interface{})
+	if (aIsList || bIsList) && a != nil && b != nil {
+		// a value matched once on one page and more on the other is still
+		// comparable item by item
+		aList, bList := valuesOf(a), valuesOf(b)
+		for i := 0; i < len(aList) || i < len(bList); i++ {
+			var aVal, bVal interface{}
+			if i < len(aList) {
+				aVal = aList[i]
+			}
+			if i < len(bList) {
+				bVal = bList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), aVal, bVal, diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, FieldDiff{Path: path, A: a, B: b})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ApiEndpoint is a request a rendered page made that returned json, a
+// candidate for scraping the underlying data directly instead of the DOM.
+type ApiEndpoint struct {
+	Url string `json:"url"`
+	// Url with numbers replaced by {n}, requests differing only by those are
+	// reported once.
+	Pattern     string `json:"pattern"`
+	Method      string `json:"method"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	PostData    string `json:"post_data,omitempty"`
+	// Top level keys of the response, and the length of its longest list,
+	// which is usually the data.
+	Keys    []string `json:"keys,omitempty"`
+	MaxList int      `json:"max_list,omitempty"`
+	Sample  string   `json:"sample,omitempty"`
+	// Times the pattern was requested.
+	Count int `json:"count"`
+}
+
+const apiSampleLen = 500
+
+var patternNumber = regexp.MustCompile(`\d+`)
+
+// Renders pageUrl via the -renderer-har endpoint and reports the json
+// endpoints the page requested while loading.
+func discoverApis(client *http.Client, endpoint string, pageUrl string) ([]ApiEndpoint, error) {
+	entries, err := renderHar(client, endpoint, pageUrl)
+	if err != nil {
+		return nil, err
+	}
+	return apiCandidates(entries, pageUrl), nil
+}
+
+// The requests pageUrl made while the -renderer-har endpoint rendered it.
+func renderHar(client *http.Client, endpoint string, pageUrl string) ([]harEntry, error) {
+	resp, err := client.Get(strings.Replace(endpoint, "{url}", url.QueryEscape(pageUrl), -1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("renderer returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var har struct {
+		Log struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("renderer didn't return a har: %v", err)
+	}
+	return har.Log.Entries, nil
+}
+
+func apiCandidates(entries []harEntry, pageUrl string) []ApiEndpoint {
+	byPattern := make(map[string]*ApiEndpoint)
+	var order []string
+	for _, entry := range entries {
+		if entry.Request.Url == pageUrl {
+			continue
+		}
+		content := entry.Response.Content
+		text := content.Text
+		if content.Encoding == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				continue
+			}
+			text = string(decoded)
+		}
+		trimmed := strings.TrimSpace(text)
+		isJson := strings.Contains(content.MimeType, "json") ||
+			strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+		if !isJson {
+			continue
+		}
+		pattern := entry.Request.Method + " " + urlPattern(entry.Request.Url)
+		if found, ok := byPattern[pattern]; ok {
+			found.Count++
+			continue
+		}
+		api := &ApiEndpoint{
+			Url:         entry.Request.Url,
+			Pattern:     urlPattern(entry.Request.Url),
+			Method:      entry.Request.Method,
+			Status:      entry.Response.Status,
+			ContentType: content.MimeType,
+			Count:       1,
+		}
+		if entry.Request.PostData != nil {
+			api.PostData = entry.Request.PostData.Text
+		}
+		var body interface{}
+		if err := json.Unmarshal([]byte(trimmed), &body); err == nil {
+			if m, ok := body.(map[string]interface{}); ok {
+				for key := range m {
+					api.Keys = append(api.Keys, key)
+				}
+				sort.Strings(api.Keys)
+			}
+			api.MaxList = longestList(body)
+		}
+		api.Sample = trimmed
+		if len(api.Sample) > apiSampleLen {
+			api.Sample = api.Sample[:apiSampleLen] + "..."
+		}
+		byPattern[pattern] = api
+		order = append(order, pattern)
+	}
+
+	apis := make([]ApiEndpoint, 0, len(order))
+	for _, pattern := range order {
+		apis = append(apis, *byPattern[pattern])
+	}
+	// most likely to be the page's data first
+	sort.SliceStable(apis, func(i, j int) bool {
+		return apis[i].MaxList > apis[j].MaxList
+	})
+	return apis
+}
+
+// Replaces numbers in the path and query values with {n}, ex: page numbers,
+// ids and cache busting timestamps.
+func urlPattern(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	u.Path = patternNumber.ReplaceAllString(u.Path, "{n}")
+	query := u.Query()
+	for name, vals := range query {
+		for i := range vals {
+			vals[i] = patternNumber.ReplaceAllString(vals[i], "{n}")
+		}
+		query[name] = vals
+	}
+	u.RawQuery = query.Encode()
+	pattern, _ := url.PathUnescape(u.String())
+	if unescaped, err := url.QueryUnescape(pattern); err == nil {
+		pattern = unescaped
+	}
+	return pattern
+}
+
+// Length of the longest list anywhere in a decoded json value.
+func longestList(val interface{}) int {
+	longest := 0
+	switch v := val.(type) {
+	case []interface{}:
+		longest = len(v)
+		for _, child := range v {
+			if n := longestList(child); n > longest {
+				longest = n
+			}
+		}
+	case map[string]interface{}:
+		for _, child := range v {
+			if n := longestList(child); n > longest {
+				longest = n
+			}
+		}
+	}
+	return longest
+}
+
+func checkDiscoverApis(req ScrapeRequest, endpoint string) error {
+	if req.DiscoverApis && len(endpoint) == 0 {
+		return errors.New("discover_apis requires a -renderer-har endpoint")
+	}
+	for _, name := range sortedItemNames(req.Items) {
+		if ws := req.Items[name].Websocket; ws != nil && ws.Rendered && len(endpoint) == 0 {
+			return fmt.Errorf("request.items[%q]: rendered websockets require a -renderer-har endpoint", name)
+		}
+	}
+	return nil
+}
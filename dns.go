@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolves a host name to its ip addresses.
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// Builds a lookupFunc from a -resolver value:
+//
+//	""                            system resolver
+//	"1.1.1.1:53"                  plain DNS against the given server
+//	"https://1.1.1.1/dns-query"   DNS over HTTPS (RFC 8484)
+func newLookup(resolver string) (lookupFunc, error) {
+	if len(resolver) == 0 {
+		return net.DefaultResolver.LookupHost, nil
+	}
+	if strings.HasPrefix(resolver, "https://") {
+		return dohLookup(resolver), nil
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return nil, fmt.Errorf("resolver must be host:port or an https:// DoH url, got %q", resolver)
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return newDialer().DialContext(ctx, network, resolver)
+		},
+	}
+	return r.LookupHost, nil
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Wraps lookup with an in-process cache so big crawls don't hammer the
+// resolver with the same few names.  Failed lookups are not cached.
+func cachedLookup(lookup lookupFunc, ttl time.Duration) lookupFunc {
+	var lock sync.Mutex
+	cache := make(map[string]dnsCacheEntry)
+	return func(ctx context.Context, host string) ([]string, error) {
+		lock.Lock()
+		entry, found := cache[host]
+		lock.Unlock()
+		if found && time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		cache[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+		lock.Unlock()
+		return addrs, nil
+	}
+}
+
+// Returns a DialContext that resolves names via lookup, trying each address
+// in turn until one connects.
+func dialWithLookup(dialer *net.Dialer, lookup lookupFunc) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		ips, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, firstErr
+	}
+}
+
+// DNS over HTTPS lookups of both A and AAAA records.
+func dohLookup(endpoint string) lookupFunc {
+	// NOTE: uses the default transport, resolving the DoH server itself must
+	// not go through this lookup.
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, host string) ([]string, error) {
+		var addrs []string
+		var lastErr error
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			found, err := dohQuery(ctx, client, endpoint, host, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			addrs = append(addrs, found...)
+		}
+		if len(addrs) == 0 {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no addresses found for %s", host)
+			}
+			return nil, lastErr
+		}
+		return addrs, nil
+	}
+}
+
+func dohQuery(ctx context.Context, client *http.Client, endpoint string, host string, qtype dnsmessage.Type) ([]string, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(body)
+	if err != nil {
+		return nil, err
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DoH lookup of %s failed: %s", host, header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch answer.Type {
+		case dnsmessage.TypeA:
+			a, err := parser.AResource()
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, net.IP(a.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, net.IP(aaaa.AAAA[:]).String())
+		default:
+			// CNAMEs etc, the A/AAAA records for the target follow
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const itemTypeDownload = "download"
+
+// DownloadedAsset replaces each value of a "download" item once fetched.
+type DownloadedAsset struct {
+	Url         string     `json:"url"`
+	Path        string     `json:"path,omitempty"`
+	Sha256      string     `json:"sha256,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Image       *ImageMeta `json:"image,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type downloader struct {
+	client      *http.Client
+	dir         string
+	maxBytes    int64
+	concurrency int
+	// Most assets, and bytes in all, downloaded per scrape, 0 for no limit.
+	maxFiles      int
+	maxTotalBytes int64
+	lock          sync.Mutex
+	files         int
+	totalBytes    int64
+	// Limits how far pdf streams are inflated, see extractPdf.
+	maxPageBytes int
+}
+
+func newDownloader(opts scrapeOptions) *downloader {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	if opts.Transport != nil {
+		client.Transport = opts.Transport
+	}
+	return &downloader{
+		client:       client,
+		dir:          opts.DownloadDir,
+		maxBytes:     opts.DownloadMaxBytes,
+		concurrency:  opts.DownloadConcurrency,
+		maxPageBytes: opts.MaxPageBytes,
+		// a scrape's downloader is shared by all its batches, so the
+		// limits hold across them
+		maxFiles:      opts.DownloadMaxFiles,
+		maxTotalBytes: opts.DownloadMaxTotalBytes,
+	}
+}
+
+// Downloads every url extracted by download items, replacing the values in
+// results with DownloadedAssets.
+func (d *downloader) downloadItems(req ScrapeRequest, results ScrapeResult) error {
+	// url -> whether image metadata is wanted for it
+	urls := make(map[string]bool)
+	var order []string
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		if item.Type != itemTypeDownload {
+			continue
+		}
+		mapFieldLeaves(results[name], func(url string) interface{} {
+			if len(url) > 0 {
+				if _, found := urls[url]; !found {
+					order = append(order, url)
+				}
+				urls[url] = urls[url] || item.ImageMeta
+			}
+			return url
+		})
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+
+	assets := make(map[string]*DownloadedAsset)
+	// past the limit, urls are left out in the order they were found
+	d.lock.Lock()
+	for _, url := range order {
+		if d.maxFiles > 0 && d.files >= d.maxFiles {
+			assets[url] = &DownloadedAsset{Url: url, Error: fmt.Sprintf("exceeds max of %d downloads per scrape", d.maxFiles)}
+			delete(urls, url)
+		} else {
+			d.files++
+		}
+	}
+	d.lock.Unlock()
+	var lock sync.Mutex
+	d.forEach(urls, func(url string, imageMeta bool) {
+		asset := d.download(url)
+		if imageMeta && len(asset.Path) > 0 && strings.HasPrefix(asset.ContentType, "image/") {
+			// formats we can't decode (webp, svg, etc) just don't get metadata
+			asset.Image, _ = readImageMeta(asset.Path)
+		}
+		lock.Lock()
+		assets[url] = asset
+		lock.Unlock()
+	})
+
+	for name, item := range req.Items {
+		if item.Type != itemTypeDownload {
+			continue
+		}
+		if val, found := results[name]; found {
+			results[name] = mapFieldLeaves(val, func(url string) interface{} {
+				if asset, found := assets[url]; found {
+					return asset
+				}
+				return url
+			})
+		}
+	}
+	return nil
+}
+
+// Runs fn for each url, at most d.concurrency at a time.
+func (d *downloader) forEach(urls map[string]bool, fn func(url string, flag bool)) {
+	concurrency := d.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for url, flag := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(url string, flag bool) {
+			defer func() { <-sem; wg.Done() }()
+			fn(url, flag)
+		}(url, flag)
+	}
+	wg.Wait()
+}
+
+// Fetches url into memory, subject to the same size limit as downloads.
+func (d *downloader) fetch(url string) ([]byte, string, error) {
+	resp, err := d.client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if d.maxBytes > 0 {
+		body = io.LimitReader(body, d.maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if d.maxBytes > 0 && int64(len(data)) > d.maxBytes {
+		return nil, "", fmt.Errorf("exceeds max of %d bytes", d.maxBytes)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// Fetches url to a file named by its sha256 so identical assets are only
+// stored once.  Failures are recorded on the asset rather than failing the
+// whole scrape.
+func (d *downloader) download(url string) *DownloadedAsset {
+	asset := &DownloadedAsset{Url: url}
+	resp, err := d.client.Get(url)
+	if err != nil {
+		asset.Error = err.Error()
+		return asset
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		asset.Error = fmt.Sprintf("unexpected status: %s", resp.Status)
+		return asset
+	}
+	if d.maxBytes > 0 && resp.ContentLength > d.maxBytes {
+		asset.Error = fmt.Sprintf("size %d exceeds max of %d bytes", resp.ContentLength, d.maxBytes)
+		return asset
+	}
+
+	tmp, err := ioutil.TempFile(d.dir, ".download-")
+	if err != nil {
+		asset.Error = err.Error()
+		return asset
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	var body io.Reader = resp.Body
+	if d.maxBytes > 0 {
+		body = io.LimitReader(body, d.maxBytes+1)
+	}
+	hash := sha256.New()
+	sniff := &sniffWriter{}
+	size, err := io.Copy(io.MultiWriter(tmp, hash, sniff), body)
+	tmp.Close()
+	if err != nil {
+		asset.Error = err.Error()
+		return asset
+	}
+	if d.maxBytes > 0 && size > d.maxBytes {
+		asset.Error = fmt.Sprintf("exceeds max of %d bytes", d.maxBytes)
+		return asset
+	}
+	if !d.reserve(size) {
+		asset.Error = fmt.Sprintf("exceeds max of %d bytes downloaded per scrape", d.maxTotalBytes)
+		return asset
+	}
+
+	asset.Size = size
+	asset.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	asset.ContentType = resp.Header.Get("Content-Type")
+	if len(asset.ContentType) == 0 || strings.HasPrefix(asset.ContentType, "application/octet-stream") {
+		asset.ContentType = http.DetectContentType(sniff.buf)
+	}
+	asset.Path = filepath.Join(d.dir, asset.Sha256+assetExtension(url, asset.ContentType))
+	if err := os.Rename(tmp.Name(), asset.Path); err != nil {
+		asset.Error = err.Error()
+		asset.Path = ""
+	}
+	return asset
+}
+
+// Counts size bytes towards the scrape's total, false if that would exceed
+// maxTotalBytes.
+func (d *downloader) reserve(size int64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.maxTotalBytes > 0 && d.totalBytes+size > d.maxTotalBytes {
+		return false
+	}
+	d.totalBytes += size
+	return true
+}
+
+// Prefers the url's own extension, falling back on one for the mime type.
+func assetExtension(url string, contentType string) string {
+	urlPath := url
+	if idx := strings.IndexAny(urlPath, "?#"); idx != -1 {
+		urlPath = urlPath[:idx]
+	}
+	if ext := path.Ext(urlPath); len(ext) > 1 && len(ext) <= 6 && !strings.Contains(ext, "/") {
+		return strings.ToLower(ext)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	// prefer the obvious one, ex: ".html" over ".ehtml" for text/html
+	if idx := strings.LastIndex(mediaType, "/"); idx != -1 {
+		for _, ext := range exts {
+			if ext == "."+mediaType[idx+1:] {
+				return ext
+			}
+		}
+	}
+	return exts[0]
+}
+
+// Keeps the first 512 bytes written, enough for http.DetectContentType.
+type sniffWriter struct {
+	buf []byte
+}
+
+func (s *sniffWriter) Write(p []byte) (int, error) {
+	if remaining := 512 - len(s.buf); remaining > 0 {
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		s.buf = append(s.buf, p[:remaining]...)
+	}
+	return len(p), nil
+}
+
+// Applies fn to every string leaf within accumulated values, returning the
+// updated value.  Maps and slices are updated in place.
+func mapLeaves(val interface{}, fn func(string) interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		return fn(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = mapLeaves(v[i], fn)
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = mapLeaves(v[k], fn)
+		}
+		return v
+	}
+	return val
+}
+
+// As mapLeaves, but leaving alone what's under keys starting with "_", which
+// gluestick adds to results (ex: "_language") rather than being fields.
+func mapFieldLeaves(val interface{}, fn func(string) interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = mapFieldLeaves(v[i], fn)
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			if !strings.HasPrefix(k, "_") {
+				v[k] = mapFieldLeaves(v[k], fn)
+			}
+		}
+		return v
+	}
+	return mapLeaves(val, fn)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Per request latency assumed when there are no -stats-window numbers for
+// the target domain.
+const defaultEstimateLatency = 500 * time.Millisecond
+
+// Estimate is a rough upper bound on the http requests a scrape makes and
+// how long it takes, see estimateScrape.
+type Estimate struct {
+	// Pages fetched at most.
+	Pages int `json:"pages"`
+	// Requests made at most, not counting those listed in Unbounded.
+	Requests int `json:"requests"`
+	// Time the requests take one after another, waiting out RateLimit.
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Requests per second to the domain, if limited (see -rate-limit).
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	// Time each request is assumed to take, from the domain's recent
+	// requests (see /stats/domains) if there were any.
+	LatencyMs       float64 `json:"latency_ms"`
+	LatencyMeasured bool    `json:"latency_measured"`
+	// Parts of the request whose number of requests depends on the pages.
+	Unbounded []string `json:"unbounded,omitempty"`
+	Notes     []string `json:"notes,omitempty"`
+}
+
+// Estimates req's requests from its config alone: pagination bounds, crawl
+// limits and the items needing requests of their own.  Pages are fetched
+// one at a time, so the duration is the requests times the slower of
+// latency and the rate limit's spacing.
+func estimateScrape(req ScrapeRequest, rate float64, latency time.Duration, measured bool) (Estimate, error) {
+	est := Estimate{RateLimit: rate, LatencyMs: math.Round(float64(latency) / float64(time.Millisecond)), LatencyMeasured: measured}
+	urls, err := pageUrls(req)
+	if err != nil {
+		return est, err
+	}
+	est.Pages = len(urls)
+	if len(urls) > 1 {
+		est.Notes = append(est.Notes, "pagination stops at the first page nothing is extracted from, so it may fetch fewer pages")
+	}
+	if req.Crawl != nil {
+		maxPages := req.Crawl.MaxPages
+		if maxPages == 0 {
+			maxPages = 100
+		}
+		est.Pages = maxPages
+		est.Notes = append(est.Notes, "crawls fetch up to max_pages, fewer if they run out of links within max_depth")
+		if req.Crawl.CheckLinks {
+			est.Unbounded = append(est.Unbounded, "check_links: a request per distinct link found")
+		}
+	}
+	if req.Form != nil {
+		// the form page, then its submission
+		est.Pages++
+	}
+	est.Requests = est.Pages
+	if req.Canonical {
+		est.Requests += est.Pages
+		est.Notes = append(est.Notes, "canonical may fetch a second page per page, counted as if every page had a canonical link")
+	}
+	if req.DiscoverApis {
+		est.Requests++
+	}
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		switch {
+		case item.Type == itemTypeGraphql || item.Type == itemTypeWebsocket:
+			est.Requests++
+		case item.Type == itemTypeDownload:
+			est.Unbounded = append(est.Unbounded, "items[\""+name+"\"]: a request per downloaded asset")
+		case item.Type == itemTypePdf && len(item.Selector) > 0:
+			est.Unbounded = append(est.Unbounded, "items[\""+name+"\"]: a request per linked pdf")
+		case len(item.IframeSelector) > 0:
+			est.Unbounded = append(est.Unbounded, "items[\""+name+"\"]: a request per frame")
+		}
+	}
+	for _, step := range req.Pipeline {
+		est.Unbounded = append(est.Unbounded, "pipeline[\""+step.Name+"\"]: a scrape per "+step.From+" result")
+	}
+	perRequest := latency
+	if rate > 0 {
+		if spacing := time.Duration(float64(time.Second) / rate); spacing > perRequest {
+			perRequest = spacing
+		}
+	}
+	est.DurationSeconds = math.Round(float64(est.Requests)*perRequest.Seconds()*10) / 10
+	return est, nil
+}
+
+// POST /estimate with a scrape request returns its Estimate under the
+// server's current rate limit, without scraping.
+func (s *server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	scrapeReq, status, err := s.readScrapeRequest(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	latency, measured := defaultEstimateLatency, false
+	if u, err := url.Parse(scrapeReq.Url); err == nil && s.conf.Stats != nil {
+		if avg, ok := s.conf.Stats.latency(u.Host); ok {
+			latency, measured = avg, true
+		}
+	}
+	est, err := estimateScrape(scrapeReq, s.runtime().RateLimit, latency, measured)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJson(w, http.StatusOK, est)
+}
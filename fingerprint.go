@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Request "fingerprint" values.
+const (
+	fingerprintHash    = "hash"
+	fingerprintSimhash = "simhash" // as well as the hash
+)
+
+// Words per shingle hashed into a simhash.
+const simhashShingle = 3
+
+// The words of a page's content, lower cased: the visible text of html pages,
+// so changes to markup, scripts and styles alone (ex: a new nonce or asset
+// version) don't count, or the whole body of anything else.
+func contentWords(body []byte, contentType string) []string {
+	if !strings.Contains(strings.ToLower(contentType), "html") {
+		return strings.Fields(strings.ToLower(string(body)))
+	}
+	var words []string
+	eachVisibleText(body, func(text []byte) bool {
+		words = append(words, strings.Fields(strings.ToLower(string(text)))...)
+		return true
+	})
+	return words
+}
+
+// A sha256 of the page's normalized content (see contentWords), equal
+// between runs unless its content changed, and with withSimhash also a
+// 64 bit simhash, which differs in few bits when the content changed a
+// little.
+func pageFingerprint(body []byte, contentType string, withSimhash bool) (string, string) {
+	words := contentWords(body, contentType)
+	sum := sha256.Sum256([]byte(strings.Join(words, " ")))
+	if !withSimhash {
+		return hex.EncodeToString(sum[:]), ""
+	}
+	return hex.EncodeToString(sum[:]), fmt.Sprintf("%016x", simhash(words))
+}
+
+// Charikar's simhash of the word shingles.
+func simhash(words []string) uint64 {
+	var weights [64]int
+	n := len(words) - simhashShingle + 1
+	if n < 1 && len(words) > 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		end := i + simhashShingle
+		if end > len(words) {
+			end = len(words)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:end], " ")))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << uint(bit)
+		}
+	}
+	return hash
+}
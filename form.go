@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// FormStep submits a form found on the request's url and extracts items from
+// the response instead, ex: a search or login form.  Fields already in the
+// form, including hidden ones like CSRF tokens, are submitted as found unless
+// overridden by Values.
+type FormStep struct {
+	// Selects the form, the first match is used.
+	Selector string `json:"selector"`
+	// Input name -> value to fill in.
+	Values map[string]string `json:"values,omitempty"`
+	// Optional submit button to click, its name/value is included as a
+	// browser would.
+	Submit string `json:"submit,omitempty"`
+}
+
+// Collects the form's current values the way a browser would submit them.
+func formValues(form *goquery.Selection) url.Values {
+	values := url.Values{}
+	form.Find("input, select, textarea").Each(func(_ int, el *goquery.Selection) {
+		name, hasName := el.Attr("name")
+		if !hasName || len(name) == 0 {
+			return
+		}
+		if _, disabled := el.Attr("disabled"); disabled {
+			return
+		}
+		switch goquery.NodeName(el) {
+		case "textarea":
+			values.Add(name, el.Text())
+		case "select":
+			selected := el.Find("option[selected]")
+			if selected.Length() == 0 {
+				if _, multiple := el.Attr("multiple"); !multiple {
+					selected = el.Find("option").First()
+				}
+			}
+			selected.Each(func(_ int, opt *goquery.Selection) {
+				val, found := opt.Attr("value")
+				if !found {
+					val = strings.TrimSpace(opt.Text())
+				}
+				values.Add(name, val)
+			})
+		default:
+			inputType := strings.ToLower(el.AttrOr("type", "text"))
+			switch inputType {
+			case "submit", "button", "image", "reset", "file":
+				return // only the clicked button is submitted, see Submit
+			case "checkbox", "radio":
+				if _, checked := el.Attr("checked"); !checked {
+					return
+				}
+				values.Add(name, el.AttrOr("value", "on"))
+			default:
+				values.Add(name, el.AttrOr("value", ""))
+			}
+		}
+	})
+	return values
+}
+
+// Fills in and submits the form selected by e, returning the error from
+// fetching the response.
+func submitForm(c *colly.Collector, e *colly.HTMLElement, step *FormStep) error {
+	values := formValues(e.DOM)
+	for name, val := range step.Values {
+		values.Set(name, val)
+	}
+	if len(step.Submit) > 0 {
+		if button := e.DOM.Find(step.Submit).First(); button.Length() > 0 {
+			if name, found := button.Attr("name"); found && len(name) > 0 {
+				values.Set(name, button.AttrOr("value", ""))
+			}
+		}
+	}
+
+	action := e.Request.AbsoluteURL(e.Attr("action"))
+	if len(strings.TrimSpace(e.Attr("action"))) == 0 {
+		action = e.Request.URL.String()
+	}
+	if strings.EqualFold(e.Attr("method"), http.MethodPost) {
+		hdr := http.Header{}
+		hdr.Set("Content-Type", "application/x-www-form-urlencoded")
+		return c.Request(http.MethodPost, action, strings.NewReader(values.Encode()), e.Request.Ctx, hdr)
+	}
+	u, err := url.Parse(action)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = values.Encode()
+	return c.Request(http.MethodGet, u.String(), nil, e.Request.Ctx, nil)
+}
@@ -5,37 +5,696 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
 	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
 )
 
 type ScrapeRequest struct {
-	Url   string                `json:"url"`
-	Items map[string]ScrapeItem `json:"items"`
+	// Request format version, see requestVersion.  Older versions are
+	// migrated when parsed, "gluestick migrate" upgrades files in place.
+	Version int                   `json:"version,omitempty"`
+	Url     string                `json:"url"`
+	Items   map[string]ScrapeItem `json:"items"`
+	// Include information about the run (pages, skipped urls) under "_meta".
+	Meta bool `json:"meta,omitempty"`
+	// Follow a page's rel=canonical link (ex: from an AMP variant) and
+	// extract from the canonical page instead.
+	Canonical bool `json:"canonical,omitempty"`
+	// Send all requests to a domain from the same egress IP (see -bind) for
+	// the whole run rather than rotating per request.
+	StickySession bool `json:"sticky_session,omitempty"`
+	// Fail pages answered with another status (among the 2xx, others fail
+	// anyway) or without an element matching ExpectSelector, see
+	// AssertionError.
+	ExpectStatus   []int  `json:"expect_status,omitempty"`
+	ExpectSelector string `json:"expect_selector,omitempty"`
+	// Record a "hash" of each page's content under "_meta", or "simhash" for
+	// a simhash as well, see pageFingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Leave out pages that look like errors despite their status: not found
+	// pages, redirects to a login page and nearly empty pages, see
+	// detectSoftError.  They're listed under "_meta".
+	SoftErrors bool `json:"soft_errors,omitempty"`
+	// How redirects are followed, and which hosts credentials follow them to.
+	Redirects *RedirectPolicy `json:"redirects,omitempty"`
+	// Render url (see -renderer-har) and report the json endpoints it loads
+	// data from under "_meta".
+	DiscoverApis bool `json:"discover_apis,omitempty"`
+	// Scrape pages 1..n of url by setting a query parameter.  Alternatively
+	// url can contain a range like "?page={1..50}".  Either way, stops at the
+	// first page nothing is extracted from.
+	PageParam *PageParam `json:"page_param,omitempty"`
+	// Follow links from url, extracting items from every page reached.
+	Crawl *CrawlOptions `json:"crawl,omitempty"`
+	// Further scrapes of urls made from the results, nested into them, see
+	// runPipeline.
+	Pipeline []PipelineStep `json:"pipeline,omitempty"`
+	// Submit a form on url and extract items from the response.
+	Form *FormStep `json:"form,omitempty"`
+	// Parse the markup inside "noscript" blocks and/or html "comments" so
+	// selectors can match it, see revealHidden.
+	ParseHidden []string `json:"parse_hidden,omitempty"`
+	// Extract items whose selectors are simple enough with a streaming html
+	// tokenizer instead of from each page's DOM, for huge pages, see
+	// tokenizeItems.  Other items are extracted from the DOM as usual.
+	Tokenize bool `json:"tokenize,omitempty"`
+	// What to do with fields that matched nothing: "omit", "null", "empty"
+	// or "drop" the result.  Defaults to -missing.
+	Missing string `json:"missing,omitempty"`
+	// Notified as the job progresses, for requests submitted as jobs.
+	Webhook *Webhook `json:"webhook,omitempty"`
+	// Return the pages and other requests the scrape would fetch under
+	// "_meta", without fetching anything.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Server only: seconds the results of an identical /scrape request can
+	// be reused for instead of scraping again, see resultCache.
+	CacheTtl float64 `json:"cache_ttl,omitempty"`
+	// Server only: name of a session kept between scrapes, whose cookies
+	// and egress IPs later scrapes naming it reuse, see sessionStore.
+	Session string `json:"session,omitempty"`
+
+	// Server only: name of the api key the request was made with, if any.
+	// Sessions are kept apart per key.
+	owner string
 }
 
 type ScrapeItem struct {
 	Selector string `json:"selector"`
+	// Blank to extract values, "download" to fetch each extracted value as
+	// an asset url, replacing it with where it was saved, or "pdf" to replace
+	// each extracted pdf url with its text.  A pdf item without a selector
+	// extracts the text of the scraped url itself when it is a pdf.
+	// "article" extracts the page's main article without any fields, within
+	// selector if given.  "graphql" runs Graphql, "websocket" captures
+	// messages from Websocket and "script" reads json from the page's
+	// scripts, their selector and fields are json paths rather than css.
+	Type string `json:"type,omitempty"`
+	// Extract from the documents of the page's frames matching this
+	// selector instead of the page itself, ex: "iframe#reviews".
+	// Cross-origin frames need -renderer.
+	IframeSelector string `json:"iframe_selector,omitempty"`
+	// Query sent by graphql items.
+	Graphql *GraphqlQuery `json:"graphql,omitempty"`
+	// Stream listened to by websocket items.
+	Websocket *WebsocketCapture `json:"websocket,omitempty"`
+	// Inline script state read by script items.
+	Script *ScriptData `json:"script,omitempty"`
+	// For download items: also record dimensions, format, exif and a
+	// perceptual hash of downloaded images.
+	ImageMeta bool `json:"image_meta,omitempty"`
+	// For pdf items: also return the text of each page separately.
+	PdfPages bool `json:"pdf_pages,omitempty"`
+	// Annotate each result with its detected language under "_language",
+	// and/or only keep results detected as one of Languages (ISO 639-1).
+	DetectLanguage bool     `json:"detect_language,omitempty"`
+	Languages      []string `json:"languages,omitempty"`
+	// Derived fields produced by running extracted text through processors.
+	PostProcess []PostProcess `json:"postprocess,omitempty"`
+	// Only keep results matching this expression, ex: "price < 100 && in_stock".
+	Where string `json:"where,omitempty"`
+	// How many values a field keeps when its selector matches more than once:
+	// "first", "last" or "all" (always a list), ex: {"title": "first"}.  Nested
+	// fields use dotted paths.  Fields not listed are a single value when one
+	// element matched and a list when several did.
+	Mode map[string]string `json:"mode,omitempty"`
+	// Structured values parsed from fields' text, ex: {"image": "srcset"}
+	// for a list of srcset candidates or "srcset_largest" for the url of the
+	// biggest.  Nested fields use dotted paths.
+	Transform map[string]string `json:"transform,omitempty"`
+	// Fields to order results by, "-" prefixed for descending, ex: ["-price", "name"].
+	SortBy []string `json:"sort_by,omitempty"`
+	// Renaming and flattening of fields in the output.
+	Output *OutputMapping `json:"output,omitempty"`
 	// Fields can be a single name->valueSelector, or nested name->{n1->s1, n2->s2, etc }}
 	// The field's valueSelectors can be a selector in which case the ChildText()
 	// is called. Or "selector|attr" to specify which ChildAttrs() is used.
 	// OR simple "|attr" to get Attr() directly on parent selected element.
 	Fields map[string]interface{} `json:"fields"`
+	// Optional thresholds used to flag runs where extraction volume collapses.
+	// expect_max_change_pct is relative to the previous run in the -history file.
+	ExpectMinItems     int     `json:"expect_min_items,omitempty"`
+	ExpectMaxChangePct float64 `json:"expect_max_change_pct,omitempty"`
+	// Numeric fields exported as metrics, see MetricField.
+	Metrics []MetricField `json:"metrics,omitempty"`
 }
 
 type ScrapeResult map[string]interface{}
 
+// Settings for how scrapes are run, as opposed to what is scraped.
+type scrapeOptions struct {
+	Verbose bool
+	// Used for all outgoing requests if set, otherwise colly's default.
+	Transport http.RoundTripper
+	// Times a request throttled with 429/503 is retried.
+	MaxRetries int
+	// Consecutive failures after which a domain is skipped for BreakerCooldown.
+	// Zero disables the circuit breaker.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// Throttle and circuit break per exact host instead of per registrable domain.
+	PolitenessByHost bool
+	// Pages are cut off after this many bytes, 0 for no limit.
+	MaxPageBytes int
+	// Where and how "download" items save assets.
+	DownloadDir         string
+	DownloadMaxBytes    int64
+	DownloadConcurrency int
+	// Most assets, and bytes in all, downloaded per scrape, 0 for no limit.
+	DownloadMaxFiles      int
+	DownloadMaxTotalBytes int64
+	// Named processors items can post process fields with.
+	Processors map[string]processor
+	// Policy for fields that matched nothing when the request doesn't say.
+	Missing string
+	// Processor asked to solve CAPTCHA/bot challenge pages, if any.  Unsolved
+	// challenges fail the scrape rather than being extracted from.
+	ChallengeSolver string
+	// Whether Transport can render pages (see -renderer), challenge pages
+	// the solver didn't get past are retried rendered and cross-origin
+	// frames are fetched rendered.
+	RenderChallenges bool
+	// Rendering service url returning a har of the page load, for
+	// discover_apis.
+	RendererHar string
+	// Log why item and field selectors that match nothing didn't match.
+	DebugSelectors bool
+	// Records all traffic for -har, if set.  Saved after each scrape.
+	Har *harRecorder
+	// Persistent cookie jar, if any.  Transport handles the cookies, it is
+	// only here so it can be saved after each scrape.
+	Cookies *cookieJar
+	// Sessions requests can name, nil if they're disabled.
+	Sessions *sessionStore
+	// If set, called with results as each page is scraped instead of them
+	// being returned, see streamer.  Returning an error stops the scrape.
+	Stream func(item string, results []interface{}) error
+	// Only start calling Stream once this many results are held, 0 to
+	// stream from the first page.  Results are returned as usual if there
+	// are never that many.
+	StreamAfter int
+	// Stops the scrape early when closed, ex: when a streaming client goes
+	// away.
+	Done <-chan struct{}
+	// If set, called as each page is done with, successfully or not.
+	OnPage func(page PageMeta)
+	// Order the CLI's output the same every run, see stableOrder.
+	Stable bool
+	// Record where each field value was extracted from, see FieldSource.
+	Provenance bool
+	// If set, called with the root element of each page items would be
+	// extracted from, ex: to check selectors against it.
+	OnDocument func(e *colly.HTMLElement)
+}
+
 func main() {
 	inFilename := flag.String("f", "", "Input json filename.")
 	inString := flag.String("in", "", "Input json directly.")
+	seedFrom := flag.String("seed-from", "", "Json output of a previous run to take the urls to scrape from (see -seed-field), the request is run once per url.")
+	seedField := flag.String("seed-field", "", "Item and field (dotted path) of the -seed-from results holding the urls, ex: \"products.url\".")
+	urlsFilename := flag.String("urls", "", "Csv file (tab separated if named .tsv) with a header row, the request is run once per row with its columns filling {column} placeholders in the request's url, or its \"url\" column as the url.  With \"-\", urls are read from stdin a line at a time and each run's output written as a line of json as it finishes.")
 	doVerbose := flag.Bool("v", false, "Verbose output.")
-	flag.Parse()
+	debugSelectors := flag.Bool("debug-selectors", false, "Log item and field selectors that match nothing, with the nearest partial matches and surrounding html.")
+	provenance := flag.Bool("provenance", false, "Add \"_provenance\" to each result: for every field value, its selector, the DOM path of the element it came from and the element's character offsets in the page's html.")
+	historyFilename := flag.String("history", "", "Json-lines file of previous runs' item counts, used for anomaly checks.")
+	pushgateway := flag.String("pushgateway", "", "Prometheus Pushgateway url each run's metrics (see item \"metrics\") are pushed to, ex: \"http://localhost:9091\".")
+	graphite := flag.String("graphite", "", "Graphite host:port each run's metrics are sent to over the plaintext protocol, ex: \"localhost:2003\".")
+	storeFilename := flag.String("store", "", "Json-lines file every run's results are appended to, see \"gluestick history\" and the server's /history.  \"gluestick audit\" suggests repairs for broken selectors from it.")
+	storeRetention := flag.String("store-retention", "", "How long runs are kept in -store and -history, ex: \"90d\" or \"720h\".  Older ones are dropped as new ones are added.  Forever if empty.")
+	since := flag.String("since", "", "History: only runs within this long, ex: \"7d\" or \"12h\".")
+	historyItem := flag.String("item", "", "History: only runs with this item, and only its values.")
+	historyField := flag.String("field", "", "History: only this field (dotted path) of each -item result, ex: \"price\".")
+	historyConfig := flag.String("config-key", "", "History: only runs of the request with this key, as listed by \"gluestick history\". Defaults to that of -f or -in, if given.")
+	serveAddr := flag.String("serve", "", "Run as an http server on the given address (ex: \":8080\") instead of a single scrape.")
+	maxBodyBytes := flag.Int64("max-body", 1<<20, "Server: max request body size in bytes.")
+	maxItems := flag.Int("max-items", 100, "Server: max number of items per scrape request.")
+	maxFields := flag.Int("max-fields", 1000, "Server: max number of fields (including nested) per scrape request.")
+	maxWebsocketSeconds := flag.Float64("max-websocket-seconds", 60, "Server: longest a websocket item's duration_seconds can be, 0 for no limit.")
+	maxPipelineRuns := flag.Int("max-pipeline-runs", 1000, "Server: max pipeline step runs per scrape request, adding up each step's limit, 0 for no limit.  Steps without a limit are rejected unless this is 0.")
+	maxCrawlPages := flag.Int("max-crawl-pages", 500, "Server: max crawl max_pages per scrape request, 0 for no limit.")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second, "Server: timeout for reading request headers and body.")
+	writeTimeout := flag.Duration("write-timeout", 2*time.Minute, "Server: timeout for scraping and writing the response.")
+	corsOrigins := flag.String("cors-origins", "", "Server: comma separated origins allowed to make CORS requests, \"*\" for any.")
+	corsMethods := flag.String("cors-methods", "GET,POST,OPTIONS", "Server: comma separated methods allowed in CORS requests.")
+	corsHeaders := flag.String("cors-headers", "Content-Type", "Server: comma separated headers allowed in CORS requests.")
+	corsMaxAge := flag.Duration("cors-max-age", 10*time.Minute, "Server: how long browsers may cache CORS preflight responses.")
+	serverDownloads := flag.Bool("server-downloads", false, "Server: allow \"download\" items, which save assets to -download-dir on the server.")
+	webhookAllow := flag.String("webhook-allow", "", "Server: comma separated hosts (and their subdomains) job webhooks may be sent to, any public host if empty.  Only these may resolve to loopback or private addresses.")
+	jobRetention := flag.Duration("job-retention", time.Hour, "Server: how long finished jobs and their results are kept.")
+	metricsTtl := flag.Duration("metrics-ttl", 24*time.Hour, "Server: how long /metrics keeps the samples of a request's items after their last run, 0 to keep them for good.")
+	cacheSize := flag.Int("cache-size", 1000, "Server: max /scrape results cached for requests with cache_ttl, 0 to disable caching.")
+	cacheMaxTtl := flag.Duration("cache-max-ttl", time.Hour, "Server: longest a request's cache_ttl can reuse results for.")
+	configFilename := flag.String("server-config", "", "Server: json file of runtime settings (workers, max_items, max_fields, rate_limit, allow, deny) overriding their flags, reloaded on SIGHUP.")
+	adminToken := flag.String("admin-token", "", "Server: bearer token enabling the /admin endpoints for changing runtime settings.")
+	rateLimit := flag.Float64("rate-limit", 0, "Max requests per second to each domain, 0 for no limit.")
+	allowDomains := flag.String("allow", "", "Comma separated domains (and their subdomains) that may be scraped, any if empty.")
+	denyDomains := flag.String("deny", "", "Comma separated domains (and their subdomains) that may not be scraped.")
+	statsWindow := flag.Duration("stats-window", 15*time.Minute, "Server: how far back /stats/domains reports per domain request stats, 0 to disable.")
+	apiKeysFilename := flag.String("api-keys", "", "Server: json file of api keys with their roles (reader, submitter, worker, admin), required by every endpoint if given.")
+	auditFilename := flag.String("audit-log", "", "Server: json-lines file every scrape request (who, when, url and config) is appended to.")
+	auditUserHeader := flag.String("audit-user-header", "", "Server: request header identifying the user for -audit-log, ex: \"X-Forwarded-User\" from an authenticating proxy.")
+	workers := flag.Int("workers", 4, "Server: number of scrapes run concurrently, shared by /scrape and jobs.")
+	distributed := flag.Bool("distributed", false, "Server: leave background jobs for remote workers (see -coordinator) instead of running them locally.")
+	workLease := flag.Duration("work-lease", 10*time.Minute, "Server: re-queue a remote worker's job if it hasn't sent a heartbeat or its results within this long.")
+	maxWorkResult := flag.Int64("max-work-result", 256<<20, "Server: max size in bytes of the results a remote worker posts back, see -distributed.")
+	coordinator := flag.String("coordinator", "", "Run as a remote worker pulling jobs from the given -distributed server url.")
+	apiKey := flag.String("api-key", "", "Worker: api key to send the -coordinator, if it requires one.")
+	workerName := flag.String("worker-name", "", "Worker: name reported to the coordinator, defaults to the hostname.")
+	maxRetries := flag.Int("max-retries", 3, "Times to retry a request throttled with 429/503, honoring Retry-After.")
+	breakerFailures := flag.Int("breaker-failures", 5, "Skip a domain after this many consecutive failed requests, 0 to disable.")
+	breakerCooldown := flag.Duration("breaker-cooldown", time.Minute, "How long a domain is skipped after tripping -breaker-failures.")
+	politenessByHost := flag.Bool("politeness-by-host", false, "Throttle and circuit break per exact host rather than per registrable domain.")
+	bindAddrs := flag.String("bind", "", "Comma separated local IPs to send requests from, rotated per request.")
+	resolver := flag.String("resolver", "", "DNS server to use instead of the system resolver, ex: \"1.1.1.1:53\" or DoH \"https://1.1.1.1/dns-query\".")
+	dnsCacheTTL := flag.Duration("dns-cache", time.Minute, "How long to cache DNS lookups in process, 0 to disable.")
+	downloadDir := flag.String("download-dir", "downloads", "Directory \"download\" items save assets to.")
+	maxPageBytes := flag.Int("max-page-bytes", 10<<20, "Pages are cut off after this many bytes, 0 for no limit.  Raise it for huge pages, see \"tokenize\".")
+	downloadMaxBytes := flag.Int64("download-max-bytes", 50<<20, "Max size of a single downloaded asset, 0 for no limit.")
+	downloadConcurrency := flag.Int("download-concurrency", 4, "Number of assets downloaded at once.")
+	downloadMaxFiles := flag.Int("download-max-files", 1000, "Max number of assets downloaded per scrape, 0 for no limit.")
+	downloadMaxTotalBytes := flag.Int64("download-max-total-bytes", 1<<30, "Max bytes downloaded in all per scrape, 0 for no limit.")
+	maxIdleConns := flag.Int("max-idle-conns", 100, "Connections kept open for reuse across all hosts, 0 for no limit.")
+	maxIdlePerHost := flag.Int("max-idle-per-host", 0, "Connections kept open for reuse per host, 0 for the larger of -workers and -download-concurrency.")
+	sessionTtl := flag.Duration("session-ttl", 30*time.Minute, "Server/worker: how long a named \"session\" is kept unused before it's dropped, 0 to disable sessions.")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 90*time.Second, "How long an unused connection is kept open for reuse.")
+	missing := flag.String("missing", missingOmit, "Default for fields that matched nothing: \"omit\", \"null\", \"empty\" or \"drop\" the result.")
+	cookiesFilename := flag.String("cookies", "", "Json file to load the cookie jar from and save it to after each scrape, so sessions carry over between runs.")
+	signFilename := flag.String("sign", "", "Json file of request signers, adding an HMAC of each request to a header or query param for the listed hosts.")
+	oauthFilename := flag.String("oauth2", "", "Json file of OAuth2 token endpoint settings, bearer tokens are added to requests to its hosts.")
+	harFilename := flag.String("har", "", "Record all requests and responses to the given file in HAR format, for debugging.")
+	harMaxBody := flag.Int64("har-max-body", 256<<10, "Max bytes of each request/response body kept in the -har file, 0 to leave bodies out.")
+	bundleFilename := flag.String("bundle", "", "Write the request, every response fetched, the results and a manifest of the run to the given .tar.gz, to audit the run or reproduce it with -replay.")
+	resultsKey := flag.String("results-key", "", "File holding a secret to sign the results with, see -results-sig.")
+	resultsSig := flag.String("results-sig", "", "File an HMAC-SHA256 of the results and the run's details is written to, checked with \"gluestick verify\".")
+	replayFilename := flag.String("replay", "", "Answer requests from the responses in a -bundle instead of fetching them, running the bundle's request if -f and -in aren't given.")
+	processorsFilename := flag.String("processors", "", "Json file of named commands/endpoints items can post process fields with.")
+	challengeSolver := flag.String("challenge-solver", "", "Name of a -processors entry to hand CAPTCHA/bot challenge pages to.")
+	rendererHar := flag.String("renderer-har", "", "Headless rendering service url with a {url} placeholder returning a HAR of the page load, used by discover_apis.")
+	spillAfter := flag.Int("spill-after", 0, "Once a scrape holds this many results, write them to temporary files rather than keeping them in memory, 0 to keep them all in memory.")
+	renderer := flag.String("renderer", "", "Headless rendering service url with a {url} placeholder, challenge pages are retried through it.")
+	// "gluestick diff <urlA> <urlB> -f config.json" compares two pages.
+	// "gluestick migrate <file>..." upgrades request files to the current version.
+	// "gluestick bench [rows...]" times extraction from synthetic pages.
+	// "gluestick history -store runs.jsonl [-since 7d] [-item name]" lists
+	// stored results over time.
+	// "gluestick verify results.json -results-key key -results-sig sig.json"
+	// checks signed results.
+	// "gluestick scrape -f 'configs/*.json' [-P 4]" runs many request files
+	// at once.
+	parallel := flag.Int("P", 4, "Scrape: number of request files run at once.")
+	outPattern := flag.String("out", "", "File the results are written to instead of stdout, a template like \"out/{{.domain}}/{{.date}}.json\" with name, domain, path, config, date and time.  Directories are created as needed.  Scrape: defaults to \""+defaultConfigsOut+"\".")
+	stable := flag.Bool("stable", false, "Order each item's results (by sort_by, then their json) and _meta's lists (by url) the same every run, so runs with the same content print the same.")
+	mergeMode := flag.String("merge", "", "Merge the results into those already in the -out file: \"append\" them, \"replace\" those with the same -merge-key or \"skip\" those already there.")
+	mergeKey := flag.String("merge-key", "", "Field (dotted path) identifying a result for -merge, ex: \"sku\".  Without one, \"skip\" compares whole results.")
+	cpuProfile := flag.String("cpuprofile", "", "Write a cpu profile to the given file, for go tool pprof.")
+	memProfile := flag.String("memprofile", "", "Write a memory (allocations) profile to the given file on exit, for go tool pprof.")
+	traceFilename := flag.String("trace", "", "Write an execution trace to the given file, for go tool trace.")
+	subcommand := ""
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "diff" || args[0] == "migrate" || args[0] == "bench" || args[0] == "history" || args[0] == "scrape" || args[0] == "verify" || args[0] == "audit") {
+		subcommand, args = args[0], args[1:]
+	}
+	positional := parseInterspersed(flag.CommandLine, args)
+	if subcommand == "diff" && len(positional) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: gluestick diff <urlA> <urlB> -f config.json [options]")
+		os.Exit(1)
+	}
+	if subcommand == "migrate" {
+		if len(positional) == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: gluestick migrate <file>...")
+			os.Exit(1)
+		}
+		if err := migrateFiles(positional); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if subcommand == "history" {
+		if err := printHistory(*storeFilename, *since, *historyItem, *historyField, *historyConfig, *inFilename, *inString); err != nil {
+			fmt.Fprintln(os.Stderr, "Usage: gluestick history -store runs.jsonl [-since 7d] [-item name [-field path]] [-f config.json | -config-key key]:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if subcommand == "verify" {
+		if len(positional) != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: gluestick verify results.json -results-key key -results-sig sig.json")
+			os.Exit(1)
+		}
+		if err := verifyResults(*resultsKey, *resultsSig, positional[0]); err != nil {
+			fmt.Fprintln(os.Stderr, "Verification failed:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "OK")
+		return
+	}
+	var benchRowCounts []int
+	if subcommand == "bench" {
+		var err error
+		if benchRowCounts, err = benchRows(positional); err != nil {
+			fmt.Fprintln(os.Stderr, "Usage: gluestick bench [rows...]:", err)
+			os.Exit(1)
+		}
+	}
+
+	scrapeOpts := scrapeOptions{
+		Verbose:          *doVerbose,
+		DebugSelectors:   *debugSelectors,
+		MaxRetries:       *maxRetries,
+		BreakerFailures:  *breakerFailures,
+		BreakerCooldown:  *breakerCooldown,
+		PolitenessByHost: *politenessByHost,
+		MaxPageBytes:     *maxPageBytes,
+
+		DownloadDir:           *downloadDir,
+		DownloadMaxBytes:      *downloadMaxBytes,
+		DownloadConcurrency:   *downloadConcurrency,
+		DownloadMaxFiles:      *downloadMaxFiles,
+		DownloadMaxTotalBytes: *downloadMaxTotalBytes,
+		Missing:               *missing,
+		ChallengeSolver:       *challengeSolver,
+		RenderChallenges:      len(*renderer) > 0,
+		RendererHar:           *rendererHar,
+		Stable:                *stable,
+		Provenance:            *provenance,
+	}
+	if len(*seedFrom) > 0 && len(*seedField) == 0 {
+		fmt.Fprintln(os.Stderr, "-seed-from requires -seed-field")
+		os.Exit(1)
+	}
+	if len(*seedFrom) > 0 && len(*urlsFilename) > 0 {
+		fmt.Fprintln(os.Stderr, "-seed-from and -urls can't be used together")
+		os.Exit(1)
+	}
+	if (len(*seedFrom) > 0 || len(*urlsFilename) > 0) && (subcommand == "diff" || subcommand == "scrape" || subcommand == "audit" || *spillAfter > 0) {
+		fmt.Fprintln(os.Stderr, "-seed-from and -urls can't be used with diff, scrape, audit or -spill-after")
+		os.Exit(1)
+	}
+	merge := mergePolicy{mode: *mergeMode, key: *mergeKey}
+	if len(merge.mode) > 0 {
+		if err := merge.check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(*outPattern) == 0 && subcommand != "scrape" {
+			fmt.Fprintln(os.Stderr, "-merge requires -out")
+			os.Exit(1)
+		}
+		if subcommand == "diff" || subcommand == "audit" || len(*seedFrom) > 0 || len(*urlsFilename) > 0 || *spillAfter > 0 {
+			fmt.Fprintln(os.Stderr, "-merge can't be used with diff, audit, -seed-from, -urls or -spill-after")
+			os.Exit(1)
+		}
+	} else if len(merge.key) > 0 {
+		fmt.Fprintln(os.Stderr, "-merge-key requires -merge")
+		os.Exit(1)
+	}
+	if (len(*resultsKey) > 0) != (len(*resultsSig) > 0) {
+		fmt.Fprintln(os.Stderr, "-results-key and -results-sig go together")
+		os.Exit(1)
+	}
+	var signer *resultsSigner
+	if len(*resultsKey) > 0 {
+		if len(subcommand) > 0 || *urlsFilename == "-" || len(*serveAddr) > 0 || len(*coordinator) > 0 {
+			fmt.Fprintln(os.Stderr, "-results-sig is only for single runs, and can't be used with subcommands, -urls -, -serve or -coordinator")
+			os.Exit(1)
+		}
+		key, err := loadResultsKey(*resultsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -results-key: %s\n", err)
+			os.Exit(1)
+		}
+		signer = newResultsSigner(key, *resultsSig)
+	}
+	if len(*bundleFilename) > 0 && (len(subcommand) > 0 || *urlsFilename == "-" || *spillAfter > 0 || len(*serveAddr) > 0 || len(*coordinator) > 0) {
+		fmt.Fprintln(os.Stderr, "-bundle is only for single runs, and can't be used with subcommands, -urls -, -spill-after, -serve or -coordinator")
+		os.Exit(1)
+	}
+	if *urlsFilename == "-" && len(*inFilename) == 0 && len(*inString) == 0 {
+		fmt.Fprintln(os.Stderr, "-urls - reads urls from stdin, so the request must be given with -f or -in")
+		os.Exit(1)
+	}
+	if len(*storeFilename) > 0 && *spillAfter > 0 {
+		fmt.Fprintln(os.Stderr, "-store can't be used with -spill-after, spilled results aren't kept in memory")
+		os.Exit(1)
+	}
+	if *stable && *spillAfter > 0 {
+		fmt.Fprintln(os.Stderr, "-stable can't be used with -spill-after, spilled results are written in the order they were scraped")
+		os.Exit(1)
+	}
+	if !validMissingPolicy(*missing) {
+		fmt.Fprintf(os.Stderr, "Invalid -missing: %q\n", *missing)
+		os.Exit(1)
+	}
+	lookup, err := newLookup(*resolver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -resolver: %s\n", err)
+		os.Exit(1)
+	}
+	if *dnsCacheTTL > 0 {
+		lookup = cachedLookup(lookup, *dnsCacheTTL)
+	}
+	idle := idleLimits{Max: *maxIdleConns, PerHost: *maxIdlePerHost, Timeout: *idleConnTimeout}
+	if idle.PerHost <= 0 {
+		// enough for every worker or download to be hitting the same host
+		idle.PerHost = *workers
+		if *downloadConcurrency > idle.PerHost {
+			idle.PerHost = *downloadConcurrency
+		}
+	}
+	transport, err := buildTransport(splitList(*bindAddrs), lookup, idle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -bind: %s\n", err)
+		os.Exit(1)
+	}
+	if len(*harFilename) > 0 {
+		if *harMaxBody < 0 {
+			fmt.Fprintln(os.Stderr, "Invalid -har-max-body: must not be negative")
+			os.Exit(1)
+		}
+		// innermost so it records what is actually sent, after signing etc
+		scrapeOpts.Har = newHarRecorder(*harFilename, *harMaxBody)
+		transport = withHar(transport, scrapeOpts.Har)
+	}
+	if len(*signFilename) > 0 {
+		signers, err := loadSigners(*signFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -sign: %s\n", err)
+			os.Exit(1)
+		}
+		transport = withSigning(transport, signers)
+	}
+	if len(*oauthFilename) > 0 {
+		conf, err := loadOauthConfig(*oauthFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -oauth2: %s\n", err)
+			os.Exit(1)
+		}
+		transport = withOauth(transport, conf)
+	}
+	if len(*renderer) > 0 {
+		if err := checkRenderEndpoint(*renderer); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -renderer: %s\n", err)
+			os.Exit(1)
+		}
+		transport = withRenderer(transport, *renderer)
+	}
+	if len(*rendererHar) > 0 {
+		if err := checkRenderEndpoint(*rendererHar); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -renderer-har: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	// outside the renderer and signing so snapshots are of the pages as
+	// requested, and replaying them doesn't depend on either
+	var bundle *runBundle
+	if len(*bundleFilename) > 0 {
+		bundle = newRunBundle(*bundleFilename)
+		transport = withHar(transport, bundle.pages)
+	}
+	var replay *replayTransport
+	if len(*replayFilename) > 0 {
+		if replay, err = loadReplay(*replayFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -replay: %s\n", err)
+			os.Exit(1)
+		}
+		transport = replay
+		if bundle != nil {
+			transport = withHar(transport, bundle.pages)
+		}
+	}
+	// outside the renderer so limits apply to the rendered site, not the
+	// rendering service
+	if *rateLimit < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -rate-limit: must not be negative")
+		os.Exit(1)
+	}
+	var stats *domainStats
+	if len(*serveAddr) > 0 && *statsWindow > 0 {
+		// inside the policy so rate limit waits don't count as latency
+		stats = newDomainStats(*statsWindow, politenessKeyFunc(*politenessByHost))
+		transport = withStats(transport, stats)
+	}
+	policy := newTargetPolicy(politenessKeyFunc(*politenessByHost))
+	policy.set(*rateLimit, splitList(*allowDomains), splitList(*denyDomains))
+	transport = withPolicy(transport, policy)
+	scrapeOpts.Transport = transport
+	if len(*cookiesFilename) > 0 {
+		scrapeOpts.Cookies, err = loadCookieJar(*cookiesFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -cookies: %s\n", err)
+			os.Exit(1)
+		}
+		scrapeOpts.Transport = withCookies(transport, scrapeOpts.Cookies)
+	} else if *sessionTtl > 0 && (len(*serveAddr) > 0 || len(*coordinator) > 0) {
+		// a session's cookies would mix with the -cookies jar's
+		scrapeOpts.Sessions = newSessionStore(*sessionTtl)
+	}
+	if len(*processorsFilename) > 0 {
+		scrapeOpts.Processors, err = loadProcessors(*processorsFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load -processors: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if _, found := scrapeOpts.Processors[*challengeSolver]; len(*challengeSolver) > 0 && !found {
+		fmt.Fprintf(os.Stderr, "Invalid -challenge-solver: no processor named %q, see -processors\n", *challengeSolver)
+		os.Exit(1)
+	}
+
+	prof, err := startProfiling(*cpuProfile, *memProfile, *traceFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start profiling: %s\n", err)
+		prof.exit(1)
+	}
+	if subcommand == "bench" {
+		results, err := runBench(benchRowCounts, scrapeOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while benchmarking: %s\n", err)
+			prof.exit(1)
+		}
+		j, _ := json.MarshalIndent(results, "", "    ")
+		fmt.Fprintln(os.Stdout, string(j))
+		prof.exit(0)
+	}
+
+	var retention time.Duration
+	if len(*storeRetention) > 0 {
+		var err error
+		if retention, err = parseSince(*storeRetention); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -store-retention:", err)
+			prof.exit(1)
+		}
+	}
+	var store *resultStore
+	if len(*storeFilename) > 0 {
+		store = newResultStore(*storeFilename, retention)
+	}
+	// always kept when serving, for /metrics
+	metrics := newMetricsExporter(*pushgateway, *graphite, *metricsTtl)
+	recorder := &runRecorder{store: store}
+	if len(*historyFilename) > 0 {
+		recorder.history = newHistoryStore(*historyFilename, retention)
+	}
+	if len(*pushgateway) > 0 || len(*graphite) > 0 {
+		recorder.metrics = metrics
+	}
+
+	if subcommand == "scrape" {
+		if *spillAfter > 0 {
+			fmt.Fprintln(os.Stderr, "-spill-after can't be used with scrape")
+			prof.exit(1)
+		}
+		exitCode, err := runConfigs(*inFilename, *parallel, *outPattern, merge, scrapeOpts, recorder)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Usage: gluestick scrape -f 'configs/*.json' [-P 4] [-out 'out/{{.name}}.json']:", err)
+			prof.exit(1)
+		}
+		prof.exit(exitCode)
+	}
+
+	if len(*coordinator) > 0 {
+		name := *workerName
+		if len(name) == 0 {
+			name, _ = os.Hostname()
+		}
+		runWorker(*coordinator, name, *apiKey, *workers, scrapeOpts)
+	}
+
+	if len(*serveAddr) > 0 {
+		if *distributed && *workLease <= 0 {
+			fmt.Fprintln(os.Stderr, "Invalid -work-lease: must be positive")
+			prof.exit(1)
+		}
+		var apiKeys []ApiKey
+		if len(*apiKeysFilename) > 0 {
+			if apiKeys, err = loadApiKeys(*apiKeysFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load -api-keys: %s\n", err)
+				prof.exit(1)
+			}
+		}
+		var audit *auditLog
+		if len(*auditFilename) > 0 {
+			if audit, err = openAuditLog(*auditFilename, *auditUserHeader); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open -audit-log: %s\n", err)
+				prof.exit(1)
+			}
+		}
+		err := runServer(serverConfig{
+			Addr:         *serveAddr,
+			Scrape:       scrapeOpts,
+			MaxBodyBytes: *maxBodyBytes,
+			ReadTimeout:  *readTimeout,
+			WriteTimeout: *writeTimeout,
+			IdleTimeout:  2 * time.Minute,
+			CorsOrigins:  splitList(*corsOrigins),
+			CorsMethods:  splitList(*corsMethods),
+			CorsHeaders:  splitList(*corsHeaders),
+			CorsMaxAge:   *corsMaxAge,
+			JobRetention: *jobRetention,
+			Runtime: runtimeConfig{
+				Workers:             *workers,
+				MaxItems:            *maxItems,
+				MaxFields:           *maxFields,
+				MaxWebsocketSeconds: *maxWebsocketSeconds,
+				MaxPipelineRuns:     *maxPipelineRuns,
+				MaxCrawlPages:       *maxCrawlPages,
+				RateLimit:           *rateLimit,
+				Allow:               splitList(*allowDomains),
+				Deny:                splitList(*denyDomains),
+			},
+			ConfigFile:    *configFilename,
+			AdminToken:    *adminToken,
+			ApiKeys:       apiKeys,
+			Policy:        policy,
+			Stats:         stats,
+			Audit:         audit,
+			Distributed:   *distributed,
+			WorkLease:     *workLease,
+			WebhookAllow:  splitList(*webhookAllow),
+			Downloads:     *serverDownloads,
+			MaxWorkResult: *maxWorkResult,
+			CacheSize:     *cacheSize,
+			CacheMaxTtl:   *cacheMaxTtl,
+			Store:         store,
+			Metrics:       metrics,
+		})
+		fmt.Fprintf(os.Stderr, "Server stopped, error: %s\n", err)
+		prof.exit(1)
+	}
 
 	var inputJson []byte
 	if len(*inString) > 0 {
@@ -44,111 +703,976 @@ func main() {
 		inBytes, err := ioutil.ReadFile(*inFilename)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to open input file: %q, error: %s\n", *inFilename, err)
-			os.Exit(1)
+			prof.exit(1)
 		}
 		inputJson = inBytes
+	} else if replay != nil && replay.request != nil {
+		inputJson = replay.request
 	} else {
 		inBytes, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to read from stdin, error: %s\n", err)
-			os.Exit(1)
+			prof.exit(1)
 		}
 		inputJson = inBytes
 	}
 
-	var scrapeReq ScrapeRequest
-	if err := json.Unmarshal(inputJson, &scrapeReq); err != nil {
+	scrapeReq, err := parseRequest(inputJson)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to parse input as json request, error: %s\n", err)
-		os.Exit(1)
+		prof.exit(1)
 	}
 	if err := validate(&scrapeReq); err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid scrape request: %s\n", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "Invalid scrape request:")
+		for _, e := range err.(ValidationErrors) {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", e.Path, e.Message)
+		}
+		prof.exit(1)
+	}
+
+	// results are written to -out if given, and through the signer if any
+	var out io.Writer = os.Stdout
+	var outPath string
+	var outFile *lazyOutput
+	if len(*outPattern) > 0 {
+		tmpl, err := parseOutTemplate(*outPattern)
+		if err == nil {
+			outPath, err = outputPath(tmpl, outputVars(scrapeReq, *inFilename, time.Now()))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			prof.exit(1)
+		}
+		outFile = &lazyOutput{path: outPath}
+		out = outFile
+	}
+	if signer != nil {
+		out = io.MultiWriter(out, signer)
+	}
+	// puts -out in place once all of the output is written to it
+	closeOutput := func() {
+		if outFile == nil {
+			return
+		}
+		if err := outFile.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s, error: %s\n", outPath, err)
+			prof.exit(1)
+		}
+	}
+
+	if subcommand == "diff" {
+		diff, err := scrapeDiff(scrapeReq, positional[0], positional[1], scrapeOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while scraping: %s\n", err)
+			prof.exit(1)
+		}
+		j, _ := json.MarshalIndent(diff, "", "    ")
+		if err := writeOutput(out, j); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write results, error: %s\n", err)
+			prof.exit(1)
+		}
+		closeOutput()
+		if len(diff.Differences) > 0 {
+			prof.exit(3)
+		}
+		prof.exit(0)
+	}
+	if subcommand == "audit" {
+		report, err := checkSelectorHealth(scrapeReq, scrapeOpts, store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while auditing: %s\n", err)
+			prof.exit(1)
+		}
+		j, _ := json.MarshalIndent(report, "", "    ")
+		if err := writeOutput(out, j); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write report, error: %s\n", err)
+			prof.exit(1)
+		}
+		closeOutput()
+		if report.Broken > 0 {
+			fmt.Fprintf(os.Stderr, "%d selectors matched nothing on %s\n", report.Broken, report.Url)
+			prof.exit(4)
+		}
+		prof.exit(0)
+	}
+
+	if *urlsFilename == "-" {
+		runner := &seedRunner{req: scrapeReq, opts: scrapeOpts, recorder: recorder}
+		err := runner.stream(os.Stdin, out)
+		// the lines written are complete results even if stdin failed
+		closeOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to scrape urls from stdin, error: %s\n", err)
+			prof.exit(1)
+		}
+		prof.exit(runner.exitCode())
+	}
+	if len(*seedFrom) > 0 || len(*urlsFilename) > 0 {
+		var seeds []SeededRun
+		if len(*urlsFilename) > 0 {
+			if seeds, err = loadUrlRows(*urlsFilename, scrapeReq.Url); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load -urls, error: %s\n", err)
+				prof.exit(1)
+			}
+		} else {
+			urls, err := loadSeeds(*seedFrom, *seedField, scrapeReq.Url)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load -seed-from, error: %s\n", err)
+				prof.exit(1)
+			}
+			for _, seedUrl := range urls {
+				seeds = append(seeds, SeededRun{Url: seedUrl})
+			}
+		}
+		runner := &seedRunner{req: scrapeReq, opts: scrapeOpts, recorder: recorder}
+		for i := range seeds {
+			runner.run(&seeds[i])
+		}
+		if j, err := json.MarshalIndent(seeds, "", "    "); err == nil {
+			if err := writeOutput(out, j); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write results, error: %s\n", err)
+				prof.exit(1)
+			}
+			closeOutput()
+			urls := make([]string, len(seeds))
+			counts := make(map[string]int)
+			for i, seed := range seeds {
+				urls[i] = seed.Url
+				for name, count := range countResults(seed.Results) {
+					counts[name] += count
+				}
+			}
+			exitCode := signResults(signer, scrapeReq, urls, runner.exitCode())
+			prof.exit(saveBundle(bundle, scrapeReq, urls, j, counts, nil, exitCode))
+		} else {
+			fmt.Fprintf(os.Stderr, "failed to marshal results as json, error: %v\n", err)
+			prof.exit(1)
+		}
 	}
 
-	results, err := scrape(scrapeReq, *doVerbose)
+	var sp *spill
+	if *spillAfter > 0 && !scrapeReq.DryRun {
+		for _, name := range sortedItemNames(scrapeReq.Items) {
+			if len(scrapeReq.Items[name].SortBy) > 0 {
+				fmt.Fprintf(os.Stderr, "Item %q has a sort_by, which can't be used with -spill-after, spilled results are written in the order they were scraped\n", name)
+				prof.exit(1)
+			}
+		}
+		if sp, err = newSpill(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create spill directory, error: %s\n", err)
+			prof.exit(1)
+		}
+		scrapeOpts.Stream = sp.write
+		scrapeOpts.StreamAfter = *spillAfter
+	}
+	results, err := scrape(scrapeReq, scrapeOpts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error while scraping: %s\n", err)
-		os.Exit(1)
+		if sp != nil {
+			sp.close()
+		}
+		exitCode := 1
+		var assertErr *AssertionError
+		if errors.As(err, &assertErr) {
+			exitCode = 4
+		}
+		prof.exit(saveBundle(bundle, scrapeReq, []string{scrapeReq.Url}, nil, nil, err, exitCode))
+	}
+
+	exitCode := 0
+	counts := countResults(results)
+	if sp != nil {
+		for name, count := range sp.counts {
+			counts[name] += count
+		}
+	}
+	anomalies, err := recorder.record(scrapeReq, results, counts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after scraping: %s\n", err)
+		prof.exit(1)
+	}
+	for _, anomaly := range anomalies {
+		fmt.Fprintf(os.Stderr, "ANOMALY: %s\n", anomaly)
+		exitCode = 2
 	}
 
+	if sp != nil {
+		spilled := len(sp.files) > 0
+		if spilled {
+			err = sp.writeJson(out, results)
+		}
+		sp.close()
+		if err != nil {
+			if outFile != nil {
+				outFile.discard()
+			}
+			fmt.Fprintf(os.Stderr, "failed to write spilled results, error: %v\n", err)
+			prof.exit(1)
+		}
+		if spilled {
+			closeOutput()
+			prof.exit(signResults(signer, scrapeReq, []string{scrapeReq.Url}, exitCode))
+		}
+	}
+	if len(merge.mode) > 0 {
+		existing, err := readOutput(outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read -out to merge into, error: %s\n", err)
+			prof.exit(1)
+		}
+		results = merge.merge(existing, results)
+	}
+	if *stable {
+		stableOrder(scrapeReq, results)
+	}
 	if j, err := json.MarshalIndent(results, "", "    "); err == nil {
-		fmt.Fprintln(os.Stdout, string(j))
-		os.Exit(0)
+		if err := writeOutput(out, j); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write results, error: %s\n", err)
+			prof.exit(1)
+		}
+		closeOutput()
+		exitCode = signResults(signer, scrapeReq, []string{scrapeReq.Url}, exitCode)
+		prof.exit(saveBundle(bundle, scrapeReq, []string{scrapeReq.Url}, j, counts, nil, exitCode))
 	} else {
 		fmt.Fprintf(os.Stderr, "failed to marshal results as json, error: %v\n", err)
-		os.Exit(1)
+		prof.exit(1)
+	}
+}
+
+// Writes the -bundle if there is one, returning the run's exit code, 1 if
+// the bundle couldn't be written.
+func saveBundle(bundle *runBundle, req ScrapeRequest, urls []string, output []byte, counts map[string]int, scrapeErr error, exitCode int) int {
+	if bundle == nil {
+		return exitCode
+	}
+	if err := bundle.write(req, urls, output, counts, scrapeErr, exitCode); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write -bundle, error: %s\n", err)
+		return 1
 	}
+	return exitCode
 }
 
-func scrape(req ScrapeRequest, verbose bool) (ScrapeResult, error) {
+func scrape(req ScrapeRequest, opts scrapeOptions) (ScrapeResult, error) {
+	verbose := opts.Verbose
+	if err := checkProcessors(req, opts.Processors); err != nil {
+		return nil, err
+	}
+	if err := checkDiscoverApis(req, opts.RendererHar); err != nil {
+		return nil, err
+	}
+	if req.DryRun {
+		plan, err := planScrape(req, opts)
+		if err != nil {
+			return nil, err
+		}
+		return ScrapeResult{metaKey: &ScrapeMeta{Plan: plan}}, nil
+	}
+	if len(req.Pipeline) > 0 {
+		// results are only complete once the steps nested theirs
+		opts.Stream = nil
+	}
+	var warm *warmSession
+	if len(req.Session) > 0 && opts.Sessions != nil {
+		// for everything the scrape fetches, downloads and frames included
+		warm = opts.Sessions.get(req.owner, req.Session)
+		opts.Transport = withCookies(opts.Transport, warm.jar)
+	}
 	c := colly.NewCollector()
+	c.MaxBodySize = opts.MaxPageBytes
+	c.RedirectHandler = redirectHandler(req.Redirects)
+	if opts.Transport != nil {
+		c.WithTransport(opts.Transport)
+	}
+	if opts.Cookies != nil || warm != nil {
+		c.DisableCookies() // handled by the transport
+	}
+	if opts.Cookies != nil {
+		defer func() {
+			if err := opts.Cookies.save(); err != nil {
+				log.Println("Failed to save cookies:", err)
+			}
+		}()
+	}
+	if opts.Har != nil {
+		defer func() {
+			if err := opts.Har.save(); err != nil {
+				log.Println("Failed to save har:", err)
+			}
+		}()
+	}
 	results := make(map[string]interface{})
+	meta := &ScrapeMeta{}
+	politenessKey := politenessKeyFunc(opts.PolitenessByHost)
+	throttler := newThrottle(politenessKey, opts.MaxRetries, verbose)
+	breaker := newBreaker(politenessKey, opts.BreakerFailures, opts.BreakerCooldown, verbose)
+	// pages not extracted from because their canonical page was used instead
+	replaced := make(map[string]bool)
+	missing := req.Missing
+	if len(missing) == 0 {
+		missing = opts.Missing
+	}
+	// NOTE: collector isn't async, so Visit() returns once all callbacks are done.
+	var scrapeErr error
+	handledErr := false
+	// status of the response scrapeErr is from, 0 if there wasn't one
+	scrapeStatus := 0
+	// results extracted so far, to stop paginating once a page has none
+	extracted := 0
+	// challenge pages and pages failing assertions, by request since a solved
+	// challenge retries the same url
+	rejected := make(map[*colly.Request]bool)
+	// urls as requested, before any redirects, for detectSoftError
+	requested := make(map[*colly.Request]string)
+	var crawl *crawler
+	if req.Crawl != nil {
+		crawl = newCrawler(*req.Crawl, req.Url)
+	}
+	var stream *streamer
+	if opts.Stream != nil {
+		stream = &streamer{req: req, opts: opts, d: newDownloader(opts)}
+	}
+	// set once the scrape should stop early, see opts.Done and opts.Stream
+	var stopErr error
 
+	session := ""
+	if warm != nil {
+		session = warm.id
+	} else if req.StickySession {
+		// only needs to differ between runs
+		session = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
 	c.OnRequest(func(r *colly.Request) {
+		select {
+		case <-opts.Done:
+			if stopErr == nil {
+				stopErr = errors.New("scrape canceled")
+			}
+		default:
+		}
+		if stopErr != nil {
+			r.Abort()
+			return
+		}
+		if crawl != nil && !crawl.onRequest(r, meta) {
+			return
+		}
+		if len(session) > 0 {
+			r.Headers.Set(sessionHeader, session)
+		}
+		if _, found := requested[r]; !found && req.SoftErrors {
+			requested[r] = r.URL.String()
+		}
+		breaker.onRequest(r, meta)
+		throttler.onRequest(r)
 		if verbose {
 			log.Println("Scraping", r.URL.String())
 		}
 	})
+	// Retries a challenge page if the solver can get past it or, failing that,
+	// rendered.  Otherwise fails the page like any other error.
+	onChallenge := func(r *colly.Response, kind string) {
+		url := r.Request.URL.String()
+		rejected[r.Request] = true
+		meta.page(PageMeta{Url: url, Status: r.StatusCode, Challenge: kind})
+		if verbose {
+			log.Println("Challenge page", kind, url)
+		}
+		solver, hasSolver := opts.Processors[opts.ChallengeSolver]
+		if hasSolver && r.Request.Method == http.MethodGet && r.Ctx.Get(challengeCtxKey) != url { // only one attempt
+			headers, err := solveChallenge(solver, r, kind)
+			if err == nil && len(headers) > 0 {
+				r.Ctx.Put(challengeCtxKey, url)
+				for name, val := range headers {
+					r.Request.Headers.Set(name, val)
+				}
+				r.Request.Retry()
+				return
+			} else if err != nil && verbose {
+				log.Println("Challenge solver failed:", err)
+			}
+		}
+		if opts.RenderChallenges && r.Request.Method == http.MethodGet && r.Ctx.Get(renderCtxKey) != url {
+			if verbose {
+				log.Println("Retrying rendered", url)
+			}
+			r.Ctx.Put(renderCtxKey, url)
+			r.Request.Headers.Set(renderHeader, "1")
+			r.Request.Retry()
+			return
+		}
+		err := fmt.Errorf("%s challenge page", kind)
+		if crawl != nil {
+			crawl.result(url, r.StatusCode, err)
+			if r.Request.Depth > 1 {
+				return
+			}
+		}
+		if scrapeErr == nil {
+			scrapeErr = fmt.Errorf("%s: %v", url, err)
+		}
+	}
+
+	// Fails a page that doesn't look like what the request expects.
+	onAssertion := func(r *colly.Response, reason string) {
+		url := r.Request.URL.String()
+		rejected[r.Request] = true
+		meta.page(PageMeta{Url: url, Status: r.StatusCode, Assertion: reason})
+		if verbose {
+			log.Println("Assertion failed on", url+":", reason)
+		}
+		err := &AssertionError{Url: url, Reason: reason}
+		if crawl != nil {
+			crawl.result(url, r.StatusCode, err)
+			if r.Request.Depth > 1 {
+				return
+			}
+		}
+		if scrapeErr == nil {
+			scrapeErr = err
+		}
+	}
+
+	c.OnResponse(func(r *colly.Response) {
+		breaker.success(r.Request.URL.Host)
+		if kind := detectChallenge(r); len(kind) > 0 {
+			onChallenge(r, kind)
+			return
+		}
+		if len(req.ParseHidden) > 0 && strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+			if body, err := revealHidden(r.Body, req.ParseHidden); err == nil {
+				r.Body = body
+			}
+		}
+		if reason := checkAssertions(req, r); len(reason) > 0 {
+			onAssertion(r, reason)
+			return
+		}
+		if req.SoftErrors {
+			if kind := detectSoftError(r, requested[r.Request]); len(kind) > 0 {
+				url := r.Request.URL.String()
+				rejected[r.Request] = true
+				meta.page(PageMeta{Url: url, Status: r.StatusCode, SoftError: kind})
+				if verbose {
+					log.Println("Leaving out", kind, "page", url)
+				}
+				if crawl != nil {
+					crawl.result(url, r.StatusCode, fmt.Errorf("%s page", kind))
+				}
+				return
+			}
+		}
+		page := PageMeta{Url: r.Request.URL.String(), Status: r.StatusCode}
+		if len(req.Fingerprint) > 0 {
+			page.Hash, page.Simhash = pageFingerprint(r.Body, r.Headers.Get("Content-Type"), req.Fingerprint == fingerprintSimhash)
+		}
+		if req.Canonical && r.Ctx.GetAny(canonicalCtxKey) == nil { // only one hop
+			page.Canonical, page.Amp = pageCanonical(r)
+		}
+		meta.page(page)
+		if crawl != nil {
+			crawl.result(page.Url, r.StatusCode, nil)
+		}
+		if len(page.Canonical) > 0 {
+			r.Ctx.Put(canonicalCtxKey, page.Canonical)
+			if verbose {
+				log.Println("Following canonical url", page.Canonical)
+			}
+			// already visited while crawling means it was already extracted from
+			if err := r.Request.Visit(page.Canonical); err == nil || err == colly.ErrAlreadyVisited {
+				replaced[page.Url] = true
+				return
+			} else if verbose {
+				log.Println("Failed to follow canonical url, using original page:", err)
+			}
+		}
+		if !isPdf(r.Headers.Get("Content-Type"), r.Body) {
+			return
+		}
+		for name, item := range req.Items {
+			if item.Type == itemTypePdf && len(item.Selector) == 0 {
+				accumValue(results, name, extractPdf(r.Request.URL.String(), r.Body, item.PdfPages, opts.MaxPageBytes))
+				extracted++
+			}
+		}
+	})
+
+	// The page the form was found on, items come from the form's response
+	// instead.  Registered before the items so it is known by the time they
+	// are extracted.
+	var formPage *colly.Request
+	var formErr error
+	if req.Form != nil {
+		c.OnHTML(req.Form.Selector, func(e *colly.HTMLElement) {
+			if formPage != nil || e.Request.Depth > 1 || rejected[e.Request] {
+				return
+			}
+			formPage = e.Request
+			if verbose {
+				log.Println("Submitting form", req.Form.Selector)
+			}
+			formErr = submitForm(c, e, req.Form)
+		})
+	}
+
+	// Keeps a result unless its language rules it out.  sources are where
+	// its fields came from with -provenance, nil otherwise.
+	addResult := func(name string, i ScrapeItem, parsed map[string]interface{}, sources map[string][]FieldSource, r *colly.Request) {
+		if i.Type != itemTypeArticle {
+			applyModes(parsed, i.Mode)
+			applyTransforms(parsed, i.Transform)
+		}
+		lang := ""
+		if i.DetectLanguage || len(i.Languages) > 0 {
+			lang = detectLanguage(resultText(parsed))
+			if len(i.Languages) > 0 && !containsString(i.Languages, lang) {
+				return
+			}
+		}
+		if i.Type == itemTypeDownload || i.Type == itemTypePdf {
+			mapFieldLeaves(parsed, func(val string) interface{} {
+				if len(val) == 0 {
+					return val
+				}
+				return r.AbsoluteURL(val)
+			})
+		}
+		// after the urls, it isn't one
+		if i.DetectLanguage {
+			parsed[languageKey] = lang
+		}
+		if sources != nil {
+			applySourceModes(sources, i.Mode)
+			parsed[provenanceKey] = sources
+		}
+		accumValue(results, name, parsed)
+		extracted++
+	}
+
+	// Items extracted by tokenizing each page, registered after the
+	// OnResponse above so pages it replaced or found challenges on are known.
+	// The form page is only known once its DOM is, so forms aren't tokenized.
+	// Nor are pages with -provenance, which traces values to the DOM.
+	var tokItems []*tokItem
+	if req.Tokenize && req.Form == nil && !opts.Provenance {
+		for _, name := range sortedItemNames(req.Items) {
+			if ti, ok := tokenizable(name, req.Items[name]); ok {
+				tokItems = append(tokItems, ti)
+			} else if verbose {
+				log.Printf("Item %q has selectors too complex to tokenize, extracting it from the DOM\n", name)
+			}
+		}
+	}
+	tokenized := make(map[string]bool)
+	for _, ti := range tokItems {
+		tokenized[ti.name] = true
+	}
+	if len(tokItems) > 0 {
+		c.OnResponse(func(r *colly.Response) {
+			if replaced[r.Request.URL.String()] || rejected[r.Request] ||
+				!strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+				return
+			}
+			found, ok := tokenizeItems(tokItems, r.Body, r.Request.URL, missing)
+			if !ok {
+				if verbose {
+					log.Println("Markup on", r.Request.URL, "is too broken to tokenize, extracting from its DOM")
+				}
+				if found, ok = domItems(tokItems, r, missing); !ok {
+					return
+				}
+			}
+			for _, ti := range tokItems {
+				for _, parsed := range found[ti.name] {
+					addResult(ti.name, ti.item, parsed, nil, r.Request)
+				}
+			}
+		})
+	}
 
+	var pages *pageSources
+	if opts.Provenance {
+		pages = newPageSources()
+	}
+	frameClient := &http.Client{Transport: opts.Transport, Timeout: time.Minute}
 	for itemName, item := range req.Items {
+		if item.Type == itemTypePdf && len(item.Selector) == 0 {
+			continue // pdf of the page itself, see OnResponse
+		}
+		if tokenized[itemName] {
+			continue
+		}
+		if item.Type == itemTypeScript {
+			func(name string, i ScrapeItem) {
+				c.OnHTML("html", func(e *colly.HTMLElement) {
+					if replaced[e.Request.URL.String()] || e.Request == formPage || rejected[e.Request] {
+						return
+					}
+					for _, val := range scriptValues(e.DOM, i.Script) {
+						extracted += addJsonRecords(results, name, i, val, missing)
+					}
+				})
+			}(itemName, item)
+			continue
+		}
+		if isJsonItem(item) {
+			continue // not from the page, see graphqlItems and websocketItems
+		}
+		if item.Type == itemTypeArticle && len(item.Selector) == 0 {
+			item.Selector = "html"
+		}
 		// NOTE: have to capture itemName, item else will only get last in loop:
 		func(name string, i ScrapeItem) {
+			extract := func(e *colly.HTMLElement) {
+				var parsed map[string]interface{}
+				var sources map[string][]FieldSource
+				if i.Type == itemTypeArticle {
+					parsed = extractArticle(e)
+				} else {
+					var trace sourceTracer
+					if pages != nil {
+						sources = make(map[string][]FieldSource)
+						trace = pages.tracer(e, sources)
+					}
+					var keep bool
+					if parsed, keep = parseFields(i.Fields, e, missing, trace); !keep {
+						return
+					}
+				}
+				addResult(name, i, parsed, sources, e.Request)
+			}
+			if len(i.IframeSelector) > 0 || strings.Contains(i.Selector, shadowCombinator) {
+				// extracted from the documents of the page's frames, or
+				// through shadow roots, which colly's selectors can't do
+				c.OnHTML("html", func(e *colly.HTMLElement) {
+					if replaced[e.Request.URL.String()] || e.Request == formPage || rejected[e.Request] {
+						return
+					}
+					docs := []*colly.HTMLElement{e}
+					if len(i.IframeSelector) > 0 {
+						docs = fetchFrames(frameClient, e, i.IframeSelector, opts.RenderChallenges, verbose)
+					}
+					for _, doc := range docs {
+						selectFrom(doc.DOM, i.Selector).Each(func(idx int, s *goquery.Selection) {
+							extract(colly.NewHTMLElementFromSelectionNode(doc.Response, s, s.Nodes[0], idx))
+						})
+					}
+				})
+				return
+			}
 			c.OnHTML(i.Selector, func(e *colly.HTMLElement) {
-				parsed := parseFields(i.Fields, e)
-				accumValue(results, name, parsed)
+				if replaced[e.Request.URL.String()] || e.Request == formPage || rejected[e.Request] {
+					return
+				}
+				extract(e)
 			})
 		}(itemName, item)
 	}
 
-	scrapeError := make(chan error, 1)
+	if opts.OnDocument != nil {
+		c.OnHTML("html", func(e *colly.HTMLElement) {
+			if replaced[e.Request.URL.String()] || e.Request == formPage || rejected[e.Request] {
+				return
+			}
+			opts.OnDocument(e)
+		})
+	}
+	if opts.DebugSelectors || req.Meta || verbose {
+		c.OnHTML("html", func(e *colly.HTMLElement) {
+			if replaced[e.Request.URL.String()] || e.Request == formPage || rejected[e.Request] {
+				return
+			}
+			pageUrl := e.Request.URL.String()
+			doc := goquery.NewDocumentFromNode(e.DOM.Nodes[0].Parent).Selection
+			if req.Meta || verbose {
+				counts := matchCounts(req.Items, doc)
+				meta.pageMatches(pageUrl, counts)
+				if verbose {
+					log.Println("Matches on", pageUrl+":", formatCounts(counts))
+				}
+			}
+			if opts.DebugSelectors {
+				debugPage(req.Items, doc, pageUrl)
+			}
+		})
+	}
+
+	// Without a crawl, OnScraped streams each page's results.
+	if stream != nil && crawl != nil {
+		c.OnHTML("html", func(e *colly.HTMLElement) {
+			if stopErr == nil {
+				stopErr = stream.flush(results)
+			}
+		})
+	}
+	// Registered after the items so a page's results are extracted (and
+	// streamed) before the links on it are followed.
+	if crawl != nil {
+		crawl.attach(c)
+	}
+
 	c.OnScraped(func(r *colly.Response) {
 		if verbose {
 			log.Println("Finished", r.Request.URL)
 		}
-		close(scrapeError)
+		if stream != nil && stopErr == nil {
+			stopErr = stream.flush(results)
+		}
+		if pages != nil {
+			pages.release(r)
+		}
+		if opts.OnPage != nil {
+			opts.OnPage(PageMeta{Url: r.Request.URL.String(), Status: r.StatusCode})
+		}
 	})
-	c.OnError(func(_ *colly.Response, err error) {
+	c.OnError(func(r *colly.Response, err error) {
+		handledErr = true
+		if kind := detectChallenge(r); len(kind) > 0 {
+			onChallenge(r, kind)
+			return
+		}
+		if throttler.onError(r) {
+			return
+		}
 		if verbose {
 			log.Println("Something went wrong:", err)
 		}
-		scrapeError <- err
+		breaker.failure(r.Request.URL.Host)
+		page := PageMeta{Url: r.Request.URL.String(), Status: r.StatusCode, Error: err.Error()}
+		meta.page(page)
+		if opts.OnPage != nil {
+			opts.OnPage(page)
+		}
+		if r.Ctx.Get(canonicalCtxKey) == r.Request.URL.String() {
+			return // falls back on extracting from the original page
+		}
+		if crawl != nil {
+			crawl.result(r.Request.URL.String(), r.StatusCode, err)
+			if r.Request.Depth > 1 {
+				return // only the start page failing fails a crawl
+			}
+		}
+		scrapeErr, scrapeStatus = err, r.StatusCode
 	})
-	c.Visit(req.Url)
-	scrapeErr := <-scrapeError
+	urls, err := pageUrls(req)
+	if err != nil {
+		return results, err
+	}
+	for i, pageUrl := range urls {
+		before := extracted
+		handledErr = false
+		if err := c.Visit(pageUrl); err != nil && !handledErr {
+			if i > 0 && err == colly.ErrAlreadyVisited {
+				break // the site sent later pages back to an earlier one
+			}
+			// Rejected before fetching (bad url, robots.txt, etc) so no callbacks fired.
+			return results, err
+		}
+		if i > 0 && scrapeErr != nil && (scrapeStatus == http.StatusNotFound || scrapeStatus == http.StatusGone) {
+			// ran past the last page, any other failure fails the scrape
+			scrapeErr = nil
+			break
+		}
+		if scrapeErr != nil || stopErr != nil || (len(urls) > 1 && extracted == before) {
+			break
+		}
+	}
+	if scrapeErr == nil {
+		scrapeErr = stopErr
+	}
+	if req.Form != nil && scrapeErr == nil {
+		if formPage == nil {
+			scrapeErr = fmt.Errorf("no form matching %q found", req.Form.Selector)
+		} else if formErr != nil {
+			scrapeErr = fmt.Errorf("submitting form: %v", formErr)
+		}
+	}
+	if scrapeErr == nil {
+		scrapeErr = graphqlItems(req, results, opts.Transport, missing)
+	}
+	if scrapeErr == nil {
+		scrapeErr = websocketItems(req, results, opts, breaker, missing)
+	}
+	if stream != nil && scrapeErr == nil {
+		scrapeErr = stream.flush(results)
+	}
+	if scrapeErr == nil {
+		d := newDownloader(opts)
+		d.extractPdfItems(req, results)
+		postProcessItems(req, results, opts.Processors)
+		if scrapeErr = filterItems(req, results); scrapeErr == nil {
+			sortItems(req, results)
+			scrapeErr = d.downloadItems(req, results)
+			mapOutputs(req, results)
+		}
+	}
+	if crawl != nil && req.Crawl.CheckLinks && scrapeErr == nil {
+		meta.BrokenLinks = crawl.checkLinks(c, throttler, breaker, meta, verbose)
+	}
+	if req.DiscoverApis && scrapeErr == nil {
+		client := &http.Client{Transport: opts.Transport, Timeout: 2 * time.Minute}
+		if meta.Apis, err = discoverApis(client, opts.RendererHar, req.Url); err != nil {
+			scrapeErr = fmt.Errorf("discovering apis: %v", err)
+		}
+	}
+	if len(req.Pipeline) > 0 && scrapeErr == nil {
+		runPipeline(req, results, opts)
+	}
+	if crawl != nil && req.Crawl.Sitemap {
+		meta.Sitemap = crawl.sitemap()
+	}
+	if req.Meta || req.DiscoverApis || len(req.Fingerprint) > 0 || (crawl != nil && (req.Crawl.Sitemap || req.Crawl.CheckLinks)) {
+		results[metaKey] = meta
+	}
 	return results, scrapeErr
 }
 
-func parseFields(fields map[string]interface{}, e *colly.HTMLElement) map[string]interface{} {
+// Policies for fields whose selector or attribute matched nothing.
+const (
+	missingOmit  = "omit"  // leave the field out (default)
+	missingNull  = "null"  // field is null
+	missingEmpty = "empty" // field is ""
+	missingDrop  = "drop"  // drop the whole result
+)
+
+// Parses fields relative to e.  Returns false if a field was missing and the
+// policy is to drop the result.  If trace is set, it's called with the
+// element each value came from, see -provenance.
+func parseFields(fields map[string]interface{}, e *colly.HTMLElement, missing string, trace sourceTracer) (map[string]interface{}, bool) {
 	parsed := make(map[string]interface{})
+	keep := true
 	for fieldName, field := range fields {
 		if fieldSelector, ok := field.(string); ok {
+			matched := false
 			sel, attr := getSelectorAndAttr(fieldSelector)
-			if len(sel) == 0 {
+			traced := func(node *html.Node) {
+				if trace != nil {
+					trace(fieldName, fieldSelector, node)
+				}
+			}
+			if isUrlField(fieldSelector) {
+				if val, found := urlField(e.Request.URL, fieldSelector); found {
+					accumValue(parsed, fieldName, val)
+					matched = true
+				}
+			} else if attr == attrCount || attr == attrExists {
+				n := 1 // the parent itself
+				if len(sel) > 0 {
+					n = selectFrom(e.DOM, sel).Length()
+				}
+				if attr == attrCount {
+					accumValue(parsed, fieldName, n)
+				} else {
+					accumValue(parsed, fieldName, n > 0)
+				}
+				traced(e.DOM.Nodes[0])
+				matched = true
+			} else if len(sel) == 0 {
 				if len(attr) == 0 { // Use text
 					accumValue(parsed, fieldName, e.Text)
-				} else { // Use attr
-					accumValue(parsed, fieldName, e.Attr(attr))
+					traced(e.DOM.Nodes[0])
+					matched = true
+				} else if attr == attrOwnText {
+					accumValue(parsed, fieldName, ownText(e.DOM))
+					traced(e.DOM.Nodes[0])
+					matched = true
+				} else if attrs, ok := imageAttrs(attr); ok {
+					if val, found := imageUrl(e.DOM, attrs); found {
+						accumValue(parsed, fieldName, val)
+						traced(e.DOM.Nodes[0])
+						matched = true
+					}
+				} else if val, found := e.DOM.Attr(attr); found { // Use attr
+					accumValue(parsed, fieldName, val)
+					traced(e.DOM.Nodes[0])
+					matched = true
 				}
 			} else {
-				if len(attr) == 0 {
-					e.ForEach(sel, func(i int, child *colly.HTMLElement) {
-						accumValue(parsed, fieldName, child.Text)
-					})
-				} else {
-					for _, val := range e.ChildAttrs(sel, attr) {
-						accumValue(parsed, fieldName, val)
+				selectFrom(e.DOM, sel).Each(func(_ int, child *goquery.Selection) {
+					if len(attr) == 0 {
+						accumValue(parsed, fieldName, child.Text())
+						traced(child.Nodes[0])
+						matched = true
+					} else if attr == attrOwnText {
+						accumValue(parsed, fieldName, ownText(child))
+						traced(child.Nodes[0])
+						matched = true
+					} else if attrs, ok := imageAttrs(attr); ok {
+						if val, found := imageUrl(child, attrs); found {
+							accumValue(parsed, fieldName, val)
+							traced(child.Nodes[0])
+							matched = true
+						}
+					} else if val, found := child.Attr(attr); found {
+						accumValue(parsed, fieldName, strings.TrimSpace(val))
+						traced(child.Nodes[0])
+						matched = true
 					}
+				})
+			}
+			if !matched {
+				switch missing {
+				case missingNull:
+					parsed[fieldName] = nil
+				case missingEmpty:
+					parsed[fieldName] = ""
+				case missingDrop:
+					keep = false
 				}
 			}
 		} else if nestedFields, ok := field.(map[string]interface{}); ok {
-			val := parseFields(nestedFields, e)
+			var nestedTrace sourceTracer
+			if trace != nil {
+				prefix := fieldName
+				nestedTrace = func(field string, selector string, node *html.Node) {
+					trace(prefix+"."+field, selector, node)
+				}
+			}
+			val, nestedKeep := parseFields(nestedFields, e, missing, nestedTrace)
+			keep = keep && nestedKeep
 			accumValue(parsed, fieldName, val)
 		} else {
 			log.Printf("ERROR: expected string or map[string]interface{}, got: %s\n", reflect.TypeOf(field))
 		}
 	}
-	return parsed
+	return parsed, keep
+}
+
+func validMissingPolicy(policy string) bool {
+	switch policy {
+	case missingOmit, missingNull, missingEmpty, missingDrop:
+		return true
+	}
+	return false
+}
+
+// Field modes, see ScrapeItem.Mode.
+const (
+	modeFirst = "first"
+	modeLast  = "last"
+	modeAll   = "all"
+)
+
+func validFieldMode(mode string) bool {
+	return mode == modeFirst || mode == modeLast || mode == modeAll
+}
+
+// Narrows or widens accumulated field values per their mode.
+func applyModes(parsed map[string]interface{}, modes map[string]string) {
+	for path, mode := range modes {
+		val, found := fieldByPath(parsed, path)
+		if !found || val == nil {
+			continue
+		}
+		values := valuesOf(val)
+		switch mode {
+		case modeFirst:
+			setByPath(parsed, path, values[0])
+		case modeLast:
+			setByPath(parsed, path, values[len(values)-1])
+		case modeAll:
+			setByPath(parsed, path, values)
+		}
+	}
 }
 
 // Store single/multi values to map.  On first set, single value.
@@ -169,6 +1693,32 @@ func accumValue(outMap map[string]interface{}, key string, value interface{}) {
 	}
 }
 
+// Parses flags that may come before, between or after positional args,
+// returning the positional args.  Exits on bad flags like flag.Parse().
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Splits a comma separated flag value, dropping blank entries.
+func splitList(input string) []string {
+	var list []string
+	for _, part := range strings.Split(input, ",") {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
 func getSelectorAndAttr(input string) (string, string) {
 	idx := strings.LastIndex(input, "|")
 	if idx == -1 {
@@ -178,26 +1728,211 @@ func getSelectorAndAttr(input string) (string, string) {
 	return strings.TrimSpace(input[:idx]), strings.TrimSpace(input[idx+1:])
 }
 
+// Checks req, returning ValidationErrors listing every problem found.
 func validate(req *ScrapeRequest) error {
 	if req == nil {
-		return errors.New("request was nil")
+		return ValidationErrors{{Message: "request was nil"}}
+	}
+	v := &validator{}
+	if req.Version < 1 || req.Version > requestVersion {
+		v.add("/version", "must be between 1 and %d", requestVersion)
 	}
 	if _, uErr := url.Parse(req.Url); uErr != nil {
-		return uErr
+		v.add("/url", "%v", uErr)
+	}
+	if len(req.Items) == 0 && !req.DiscoverApis && (req.Crawl == nil || !req.Crawl.CheckLinks) {
+		v.add("/items", "was empty")
+	}
+	if req.Form != nil && len(req.Form.Selector) == 0 {
+		v.add("/form/selector", "was empty")
+	} else if req.Form != nil {
+		if _, err := cascadia.ParseGroup(req.Form.Selector); err != nil {
+			v.add("/form/selector", "invalid selector %q: %v", req.Form.Selector, err)
+		}
 	}
-	if len(req.Items) == 0 {
-		return errors.New("request.items was empty")
+	for idx, kind := range req.ParseHidden {
+		if kind != hiddenNoscript && kind != hiddenComments {
+			v.add(jsonPointer("parse_hidden", strconv.Itoa(idx)), "must be %q or %q", hiddenNoscript, hiddenComments)
+		}
+	}
+	if req.Webhook != nil {
+		checkWebhook(v, "/webhook", req.Webhook)
+	}
+	if req.CacheTtl < 0 {
+		v.add("/cache_ttl", "can't be negative")
+	}
+	for i, status := range req.ExpectStatus {
+		if status < 100 || status > 599 {
+			v.add(jsonPointer("expect_status", strconv.Itoa(i)), "must be an http status")
+		}
+	}
+	if len(req.ExpectSelector) > 0 {
+		if err := checkSelector(req.ExpectSelector); err != nil {
+			v.add("/expect_selector", "invalid selector %q: %v", req.ExpectSelector, err)
+		}
+	}
+	if req.Redirects != nil {
+		if req.Redirects.Max < 0 {
+			v.add("/redirects/max", "can't be negative")
+		}
+		for i, domain := range req.Redirects.KeepCredentials {
+			if len(strings.TrimSpace(domain)) == 0 {
+				v.add(jsonPointer("redirects", "keep_credentials", strconv.Itoa(i)), "was empty")
+			}
+		}
+	}
+	if len(req.Fingerprint) > 0 && req.Fingerprint != fingerprintHash && req.Fingerprint != fingerprintSimhash {
+		v.add("/fingerprint", "must be %q or %q", fingerprintHash, fingerprintSimhash)
+	}
+	checkPipeline(v, req)
+	if len(req.Session) > 128 {
+		v.add("/session", "must be at most 128 characters")
+	}
+	if len(req.Missing) > 0 && !validMissingPolicy(req.Missing) {
+		v.add("/missing", "must be %q, %q, %q or %q", missingOmit, missingNull, missingEmpty, missingDrop)
 	}
-	for itemK, itemV := range req.Items {
-		if len(itemV.Selector) == 0 {
-			return fmt.Errorf("request.items[%q].selector was empty", itemK)
+	if req.PageParam != nil || pageRange.MatchString(req.Url) {
+		path := "/url"
+		if req.PageParam != nil {
+			path = "/page_param"
 		}
-		if len(itemV.Fields) == 0 {
-			return fmt.Errorf("request.items[%q].fields was empty", itemK)
+		if req.Crawl != nil || req.Form != nil {
+			v.add(path, "can't paginate as well as crawl or submit a form")
+		} else if _, err := pageUrls(*req); err != nil {
+			v.add(path, "%v", err)
+		}
+	}
+	if req.Crawl != nil {
+		if req.Crawl.MaxDepth < 0 {
+			v.add("/crawl/max_depth", "can't be negative")
+		}
+		if req.Crawl.MaxPages < 0 {
+			v.add("/crawl/max_pages", "can't be negative")
+		}
+	}
+	for _, itemK := range sortedItemNames(req.Items) {
+		itemV := req.Items[itemK]
+		path := jsonPointer("items", itemK)
+		if itemK == metaKey {
+			v.add(path, "%q is reserved", itemK)
+		}
+		switch itemV.Type {
+		case "", itemTypeDownload, itemTypePdf, itemTypeArticle, itemTypeGraphql, itemTypeWebsocket, itemTypeScript:
+		default:
+			v.add(path+"/type", "must be blank, %q, %q, %q, %q, %q or %q",
+				itemTypeDownload, itemTypePdf, itemTypeArticle, itemTypeGraphql, itemTypeWebsocket, itemTypeScript)
+		}
+		if itemV.Script != nil && itemV.Type != itemTypeScript {
+			v.add(path+"/script", "requires type %q", itemTypeScript)
+		}
+		if itemV.Graphql != nil && itemV.Type != itemTypeGraphql {
+			v.add(path+"/graphql", "requires type %q", itemTypeGraphql)
+		}
+		if itemV.Websocket != nil && itemV.Type != itemTypeWebsocket {
+			v.add(path+"/websocket", "requires type %q", itemTypeWebsocket)
+		}
+		if itemV.ImageMeta && itemV.Type != itemTypeDownload {
+			v.add(path+"/image_meta", "requires type %q", itemTypeDownload)
+		}
+		if itemV.PdfPages && itemV.Type != itemTypePdf {
+			v.add(path+"/pdf_pages", "requires type %q", itemTypePdf)
+		}
+		// pdf items without a selector apply to the scraped url itself, and
+		// articles are found without any fields.
+		pagePdf := itemV.Type == itemTypePdf && len(itemV.Selector) == 0
+		if itemV.Type == itemTypeGraphql {
+			checkGraphqlItem(v, path, itemV)
+		} else if itemV.Type == itemTypeWebsocket {
+			checkWebsocketItem(v, path, itemV)
+		} else if itemV.Type == itemTypeScript {
+			checkScriptItem(v, path, itemV)
+		} else if !pagePdf && itemV.Type != itemTypeArticle {
+			if len(itemV.Selector) == 0 {
+				v.add(path+"/selector", "was empty")
+			}
+			if len(itemV.Fields) == 0 {
+				v.add(path+"/fields", "was empty")
+			}
+		}
+		if len(itemV.IframeSelector) > 0 {
+			if isJsonItem(itemV) || pagePdf {
+				v.add(path+"/iframe_selector", "requires a css selector item")
+			} else if err := checkSelector(itemV.IframeSelector); err != nil {
+				v.add(path+"/iframe_selector", "%v", err)
+			}
+		}
+		if len(itemV.Selector) > 0 && !isJsonItem(itemV) {
+			var err error
+			if strings.Contains(itemV.Selector, shadowCombinator) {
+				err = checkSelector(itemV.Selector)
+			} else {
+				_, err = cascadia.ParseGroup(itemV.Selector)
+			}
+			if err != nil {
+				v.add(path+"/selector", "invalid selector %q: %v", itemV.Selector, err)
+			}
+		}
+		if !isJsonItem(itemV) {
+			checkFieldSelectors(v, path+"/fields", itemV.Fields)
+		}
+		for idx, lang := range itemV.Languages {
+			if len(strings.TrimSpace(lang)) == 0 {
+				v.add(jsonPointer("items", itemK, "languages", strconv.Itoa(idx)), "was empty")
+			}
+			itemV.Languages[idx] = strings.ToLower(strings.TrimSpace(lang))
+		}
+		for idx, pp := range itemV.PostProcess {
+			if len(pp.Field) == 0 || len(pp.Processor) == 0 || len(pp.Into) == 0 {
+				v.add(jsonPointer("items", itemK, "postprocess", strconv.Itoa(idx)), "requires field, processor and into")
+			}
+		}
+		checkMetrics(v, itemK, itemV.Metrics)
+		if len(itemV.Where) > 0 {
+			if _, err := compileWhere(itemV.Where); err != nil {
+				v.add(path+"/where", "%s", err)
+			}
+		}
+		if itemV.Output != nil {
+			for from, to := range itemV.Output.Rename {
+				if len(from) == 0 || len(to) == 0 {
+					v.add(path+"/output/rename", "can't have empty field names")
+					break
+				}
+			}
+		}
+		for _, field := range sortedKeys(itemV.Mode) {
+			if len(field) == 0 || !validFieldMode(itemV.Mode[field]) {
+				v.add(jsonPointer("items", itemK, "mode", field), "must be \"first\", \"last\" or \"all\"")
+			}
+		}
+		for _, field := range sortedKeys(itemV.Transform) {
+			if len(field) == 0 || !validTransform(itemV.Transform[field]) {
+				v.add(jsonPointer("items", itemK, "transform", field), "must be %q or %q", transformSrcset, transformSrcsetLargest)
+			}
+		}
+		for idx, key := range itemV.SortBy {
+			if len(strings.TrimPrefix(key, "-")) == 0 {
+				v.add(jsonPointer("items", itemK, "sort_by", strconv.Itoa(idx)), "was empty")
+			}
+		}
+		if itemV.ExpectMinItems < 0 {
+			v.add(path+"/expect_min_items", "was negative")
+		}
+		if itemV.ExpectMaxChangePct < 0 {
+			v.add(path+"/expect_max_change_pct", "was negative")
 		}
-		// TODO: recursively validate all field leafs?
 		// NOTE: can have an empty value (no selector|attribute) in which case
 		// the parent's full text is used.
 	}
-	return nil
+	return v.err()
+}
+
+// Keys of m in order, for reporting problems deterministically.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Grafana JSON datasource (https://grafana.com/grafana/plugins/simpod-json-datasource/)
+// over the -store results, at /grafana.  Targets are:
+//
+//   - "products" for how many results the item had each run
+//   - "headline.score" for a field's value each run, of the first result
+//     with a number in it if the item has several
+//   - "products.price by sku" for a series per value of another field, ex:
+//     each product's price
+//
+// A target scraped from several urls is a series per url.  Table panels
+// get the fields' text rather than numbers, ex: for availability.
+type grafanaTarget struct {
+	item  string
+	field string
+	by    string
+}
+
+func parseGrafanaTarget(target string) (grafanaTarget, error) {
+	var t grafanaTarget
+	name := strings.TrimSpace(target)
+	if idx := strings.Index(name, " by "); idx >= 0 {
+		t.by = strings.TrimSpace(name[idx+len(" by "):])
+		name = strings.TrimSpace(name[:idx])
+	}
+	if idx := strings.Index(name, "."); idx >= 0 {
+		t.item, t.field = name[:idx], name[idx+1:]
+	} else {
+		t.item = name
+	}
+	if len(t.item) == 0 || (len(t.by) > 0 && len(t.field) == 0) {
+		return t, fmt.Errorf("invalid target %q, ex: \"products\", \"products.price\" or \"products.price by sku\"", target)
+	}
+	return t, nil
+}
+
+// "item" or "item.field".
+func (t grafanaTarget) name() string {
+	if len(t.field) == 0 {
+		return t.item
+	}
+	return t.item + "." + t.field
+}
+
+type grafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string          `json:"target"`
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+type grafanaTable struct {
+	Type    string              `json:"type"`
+	Columns []map[string]string `json:"columns"`
+	Rows    [][]interface{}     `json:"rows"`
+}
+
+// Routes /grafana/..., GET / being Grafana's connection test.
+func (s *server) handleGrafana(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/grafana"), "/")
+	if len(path) == 0 {
+		writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	switch path {
+	case "/search":
+		s.grafanaSearch(w, r)
+	case "/query":
+		s.grafanaQuery(w, r)
+	case "/annotations":
+		writeJson(w, http.StatusOK, []interface{}{})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no grafana endpoint %q", path))
+	}
+}
+
+// Lists targets for the stored items and their fields, containing the
+// request's "target" text if any.
+func (s *server) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var search struct {
+		Target string `json:"target"`
+	}
+	json.NewDecoder(r.Body).Decode(&search) // an empty search lists everything
+	q := HistoryQuery{}
+	q.Scoped, q.Owner = s.ownerScope(r)
+	points, err := s.conf.Store.query(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	found := make(map[string]bool)
+	for _, point := range points {
+		results, _ := point.Values.(map[string]interface{})
+		for item, val := range results {
+			found[item] = true
+			for _, result := range valuesOf(val) {
+				if m, ok := result.(map[string]interface{}); ok {
+					for _, path := range leafPaths(m, "") {
+						found[item+"."+path] = true
+					}
+				}
+			}
+		}
+	}
+	targets := []string{}
+	for target := range found {
+		if strings.Contains(strings.ToLower(target), strings.ToLower(search.Target)) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	writeJson(w, http.StatusOK, targets)
+}
+
+// Dotted paths of the fields in result holding values rather than nested
+// fields.
+func leafPaths(result map[string]interface{}, prefix string) []string {
+	var paths []string
+	for name, val := range result {
+		if nested, ok := val.(map[string]interface{}); ok {
+			paths = append(paths, leafPaths(nested, prefix+name+".")...)
+		} else {
+			paths = append(paths, prefix+name)
+		}
+	}
+	return paths
+}
+
+func (s *server) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var q grafanaQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid query: %v", err))
+		return
+	}
+	var since time.Duration
+	if !q.Range.From.IsZero() {
+		since = time.Since(q.Range.From)
+	}
+	var response []interface{}
+	for _, qt := range q.Targets {
+		target, err := parseGrafanaTarget(qt.Target)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		hq := HistoryQuery{Since: since, Item: target.item}
+		hq.Scoped, hq.Owner = s.ownerScope(r)
+		points, err := s.conf.Store.query(hq)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		var inRange []HistoryPoint
+		urls := make(map[string]bool)
+		for _, point := range points {
+			if q.Range.To.IsZero() || !point.Time.After(q.Range.To) {
+				inRange = append(inRange, point)
+				urls[point.Url] = true
+			}
+		}
+		if qt.Type == "table" {
+			response = append(response, grafanaRows(target, inRange))
+		} else {
+			response = append(response, grafanaTimeseries(target, inRange, len(urls) > 1)...)
+		}
+	}
+	if response == nil {
+		response = []interface{}{}
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func grafanaTimeseries(target grafanaTarget, points []HistoryPoint, byUrl bool) []interface{} {
+	var order []string
+	series := make(map[string]*grafanaSeries)
+	add := func(key string, val float64, at time.Time) {
+		s, found := series[key]
+		if !found {
+			s = &grafanaSeries{Target: key, Datapoints: [][]interface{}{}}
+			series[key] = s
+			order = append(order, key)
+		}
+		s.Datapoints = append(s.Datapoints, []interface{}{val, at.UnixNano() / int64(time.Millisecond)})
+	}
+	for _, point := range points {
+		suffix := ""
+		if byUrl {
+			suffix = " " + point.Url
+		}
+		results := valuesOf(point.Values)
+		if len(target.field) == 0 {
+			add(target.name()+suffix, float64(len(results)), point.Time)
+			continue
+		}
+		for _, result := range results {
+			m, ok := result.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			val, found := fieldByPath(m, target.field)
+			if !found {
+				continue
+			}
+			num, ok := whereNumber(val)
+			if !ok {
+				continue
+			}
+			if len(target.by) == 0 {
+				add(target.name()+suffix, num, point.Time)
+				break
+			}
+			label, _ := fieldByPath(m, target.by)
+			add(fmt.Sprintf("%s{%s=%v}%s", target.name(), target.by, label, suffix), num, point.Time)
+		}
+	}
+	out := make([]interface{}, len(order))
+	for i, key := range order {
+		out[i] = series[key]
+	}
+	return out
+}
+
+// Every stored value of the target as text, a row per result.
+func grafanaRows(target grafanaTarget, points []HistoryPoint) grafanaTable {
+	table := grafanaTable{
+		Type: "table",
+		Columns: []map[string]string{
+			{"text": "Time", "type": "time"},
+			{"text": "Url", "type": "string"},
+		},
+		Rows: [][]interface{}{},
+	}
+	if len(target.by) > 0 {
+		table.Columns = append(table.Columns, map[string]string{"text": target.by, "type": "string"})
+	}
+	valueName := target.name()
+	valueType := "string"
+	if len(target.field) == 0 {
+		valueType = "number" // a count
+	}
+	table.Columns = append(table.Columns, map[string]string{"text": valueName, "type": valueType})
+	for _, point := range points {
+		at := point.Time.UnixNano() / int64(time.Millisecond)
+		results := valuesOf(point.Values)
+		if len(target.field) == 0 {
+			table.Rows = append(table.Rows, []interface{}{at, point.Url, len(results)})
+			continue
+		}
+		for _, result := range results {
+			m, ok := result.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			val, found := fieldByPath(m, target.field)
+			if !found {
+				continue
+			}
+			row := []interface{}{at, point.Url}
+			if len(target.by) > 0 {
+				label, _ := fieldByPath(m, target.by)
+				row = append(row, fmt.Sprint(label))
+			}
+			table.Rows = append(table.Rows, append(row, fmt.Sprint(val)))
+		}
+	}
+	return table
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const itemTypeGraphql = "graphql"
+
+// GraphqlQuery is sent by "graphql" items.  The item's selector is then a
+// json path to the records in the response, ex: "data.products.edges.node",
+// and its fields json paths within each record.
+type GraphqlQuery struct {
+	// Defaults to /graphql on the request url's host.
+	Endpoint      string                 `json:"endpoint,omitempty"`
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operation_name,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Headers       map[string]string      `json:"headers,omitempty"`
+}
+
+// Runs each graphql item's query, adding the records it selects to results.
+func graphqlItems(req ScrapeRequest, results ScrapeResult, transport http.RoundTripper, missing string) error {
+	client := &http.Client{Transport: transport, Timeout: time.Minute}
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		if item.Type != itemTypeGraphql {
+			continue
+		}
+		data, err := runGraphql(client, req.Url, item.Graphql)
+		if err != nil {
+			return fmt.Errorf("request.items[%q]: %v", name, err)
+		}
+		addJsonRecords(results, name, item, data, missing)
+	}
+	return nil
+}
+
+// Items whose selector and fields are json paths rather than css.
+func isJsonItem(item ScrapeItem) bool {
+	return item.Type == itemTypeGraphql || item.Type == itemTypeWebsocket || item.Type == itemTypeScript
+}
+
+// Adds the records selected from data by a json item to results, returning
+// how many were added.
+func addJsonRecords(results ScrapeResult, name string, item ScrapeItem, data interface{}, missing string) int {
+	added := 0
+	for _, record := range jsonSelect(data, item.Selector) {
+		parsed, keep := parseJsonFields(item.Fields, record, missing)
+		if !keep {
+			continue
+		}
+		applyModes(parsed, item.Mode)
+		applyTransforms(parsed, item.Transform)
+		accumValue(results, name, parsed)
+		added++
+	}
+	return added
+}
+
+// The endpoint q is sent to and its variables, with "@url..." variables
+// filled in from the request url (see urlField).
+func graphqlTarget(pageUrl string, q *GraphqlQuery) (*url.URL, map[string]interface{}, error) {
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	endpoint := q.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = "/graphql"
+	}
+	target, err := base.Parse(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	variables := make(map[string]interface{})
+	for name, val := range q.Variables {
+		if s, ok := val.(string); ok && isUrlField(s) {
+			val, _ = urlField(base, s)
+		}
+		variables[name] = val
+	}
+	return target, variables, nil
+}
+
+func runGraphql(client *http.Client, pageUrl string, q *GraphqlQuery) (interface{}, error) {
+	target, variables, err := graphqlTarget(pageUrl, q)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":         q.Query,
+		"operationName": q.OperationName,
+		"variables":     variables,
+	})
+	httpReq, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	for name, val := range q.Headers {
+		httpReq.Header.Set(name, val)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var decoded struct {
+		Data   interface{} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(respBody, &decoded); err != nil {
+		return nil, fmt.Errorf("graphql endpoint returned %s, not json", resp.Status)
+	}
+	// partial data alongside errors is still used
+	if decoded.Data == nil {
+		if len(decoded.Errors) > 0 {
+			return nil, fmt.Errorf("graphql error: %s", decoded.Errors[0].Message)
+		}
+		return nil, fmt.Errorf("graphql endpoint returned %s without data", resp.Status)
+	}
+	return map[string]interface{}{"data": decoded.Data}, nil
+}
+
+// Selects values from decoded json by a dotted path.  Lists along the way
+// are selected from element by element, so "products.name" gives every
+// product's name, and "products[0].name" (or "products[-1]") just one.
+func jsonSelect(val interface{}, path string) []interface{} {
+	cur := appendJsonValues(nil, val)
+	for _, part := range strings.Split(path, ".") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		key, index, hasIndex := part, 0, false
+		if open := strings.Index(part, "["); open != -1 && strings.HasSuffix(part, "]") {
+			n, err := strconv.Atoi(part[open+1 : len(part)-1])
+			if err == nil {
+				key, index, hasIndex = part[:open], n, true
+			}
+		}
+		var next []interface{}
+		for _, v := range cur {
+			if len(key) > 0 {
+				v = jsonKey(v, key)
+			}
+			if hasIndex {
+				list, ok := v.([]interface{})
+				if !ok {
+					continue
+				}
+				i := index
+				if i < 0 {
+					i += len(list)
+				}
+				if i < 0 || i >= len(list) {
+					continue
+				}
+				v = list[i]
+			}
+			next = appendJsonValues(next, v)
+		}
+		cur = next
+	}
+	return cur
+}
+
+// Looks key up in an object, or in each object of a list.
+func jsonKey(val interface{}, key string) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return v[key]
+	case []interface{}:
+		var found []interface{}
+		for _, elem := range v {
+			found = appendJsonValues(found, jsonKey(elem, key))
+		}
+		return found
+	}
+	return nil
+}
+
+// Appends val, flattening lists and dropping nulls.
+func appendJsonValues(values []interface{}, val interface{}) []interface{} {
+	switch v := val.(type) {
+	case nil:
+		return values
+	case []interface{}:
+		for _, elem := range v {
+			values = appendJsonValues(values, elem)
+		}
+		return values
+	}
+	return append(values, val)
+}
+
+// The json counterpart of parseFields: fields are json paths within record.
+// An empty path is the record itself.
+func parseJsonFields(fields map[string]interface{}, record interface{}, missing string) (map[string]interface{}, bool) {
+	parsed := make(map[string]interface{})
+	keep := true
+	for fieldName, field := range fields {
+		switch field := field.(type) {
+		case string:
+			values := jsonSelect(record, field)
+			for _, val := range values {
+				accumValue(parsed, fieldName, val)
+			}
+			if len(values) == 0 {
+				switch missing {
+				case missingNull:
+					parsed[fieldName] = nil
+				case missingEmpty:
+					parsed[fieldName] = ""
+				case missingDrop:
+					keep = false
+				}
+			}
+		case map[string]interface{}:
+			val, nestedKeep := parseJsonFields(field, record, missing)
+			keep = keep && nestedKeep
+			accumValue(parsed, fieldName, val)
+		}
+	}
+	return parsed, keep
+}
+
+func checkGraphqlItem(v *validator, path string, item ScrapeItem) {
+	if item.Graphql == nil || len(strings.TrimSpace(item.Graphql.Query)) == 0 {
+		v.add(path+"/graphql/query", "was empty")
+	}
+	if len(item.Fields) == 0 {
+		v.add(path+"/fields", "was empty")
+	}
+}
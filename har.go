@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Records all http traffic for -har, in HAR 1.2 format so it can be opened in
+// browser dev tools or a HAR viewer.  Bodies are truncated to maxBody bytes.
+type harRecorder struct {
+	filename string
+	maxBody  int64
+	lock     sync.Mutex
+	entries  []harEntry
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+	// Chrome's record of a websocket's frames, in HARs from -renderer-har.
+	WebsocketMessages []harWebsocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type harWebsocketMessage struct {
+	// "send" or "receive".
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	// Text, or for binary frames base64.
+	Data string `json:"data"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHarRecorder(filename string, maxBody int64) *harRecorder {
+	return &harRecorder{filename: filename, maxBody: maxBody}
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, vals := range header {
+		for _, val := range vals {
+			pairs = append(pairs, harNameValue{name, val})
+		}
+	}
+	return pairs
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	pairs := []harNameValue{}
+	for _, c := range cookies {
+		pairs = append(pairs, harNameValue{c.Name, c.Value})
+	}
+	return pairs
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (hr *harRecorder) add(entry harEntry) {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	hr.entries = append(hr.entries, entry)
+}
+
+// Writes everything recorded so far.  Headers include credentials so the
+// file is only readable by its owner.
+func (hr *harRecorder) save() error {
+	hr.lock.Lock()
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "gluestick", "version": "1"},
+			"entries": append([]harEntry{}, hr.entries...),
+		},
+	}
+	hr.lock.Unlock()
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(hr.filename), ".har-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), hr.filename)
+}
+
+// Truncated copy of a body for the har, base64 if it isn't text.
+func (hr *harRecorder) content(body []byte, size int) (text string, encoding string, comment string) {
+	if hr.maxBody >= 0 && int64(len(body)) > hr.maxBody {
+		body = body[:hr.maxBody]
+	}
+	if len(body) < size {
+		comment = "truncated"
+	}
+	if utf8.Valid(body) {
+		return string(body), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64", comment
+}
+
+type harTransport struct {
+	base     http.RoundTripper
+	recorder *harRecorder
+}
+
+func withHar(base http.RoundTripper, recorder *harRecorder) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &harTransport{base: base, recorder: recorder}
+}
+
+func (ht *harTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := harEntry{
+		Request: harRequest{
+			Method:      req.Method,
+			Url:         req.URL.String(),
+			HttpVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{HeadersSize: -1, BodySize: -1},
+	}
+	if len(entry.Request.HttpVersion) == 0 {
+		entry.Request.HttpVersion = "HTTP/1.1"
+	}
+	for name, vals := range req.URL.Query() {
+		for _, val := range vals {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, val})
+		}
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		entry.Request.BodySize = len(body)
+		text, _, _ := ht.recorder.content(body, len(body))
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text}
+	}
+
+	start := time.Now()
+	entry.StartedDateTime = start.Format(time.RFC3339Nano)
+	resp, err := ht.base.RoundTrip(req)
+	wait := time.Since(start)
+	if err != nil {
+		entry.Time = millis(wait)
+		entry.Timings = harTimings{Send: 0, Wait: millis(wait), Receive: 0}
+		entry.Comment = err.Error()
+		ht.recorder.add(entry)
+		return nil, err
+	}
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = http.StatusText(resp.StatusCode)
+	entry.Response.HttpVersion = resp.Proto
+	entry.Response.Cookies = harCookies(resp.Cookies())
+	entry.Response.Headers = harHeaders(resp.Header)
+	entry.Response.RedirectURL = resp.Header.Get("Location")
+	entry.Response.Content.MimeType = resp.Header.Get("Content-Type")
+	body := &harBody{ReadCloser: resp.Body, transport: ht, entry: entry, start: start, wait: wait}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// a protocol upgrade, ex: a websocket, still written to
+		resp.Body = struct {
+			*harBody
+			io.Writer
+		}{body, conn}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// Finishes the entry once the response body has been read and closed.
+type harBody struct {
+	io.ReadCloser
+	transport *harTransport
+	entry     harEntry
+	start     time.Time
+	wait      time.Duration
+	buf       bytes.Buffer
+	size      int
+	once      sync.Once
+}
+
+func (hb *harBody) Read(p []byte) (int, error) {
+	n, err := hb.ReadCloser.Read(p)
+	hb.size += n
+	if remaining := hb.transport.recorder.maxBody - int64(hb.buf.Len()); remaining > 0 {
+		if int64(n) < remaining {
+			remaining = int64(n)
+		}
+		hb.buf.Write(p[:remaining])
+	}
+	return n, err
+}
+
+func (hb *harBody) Close() error {
+	err := hb.ReadCloser.Close()
+	hb.once.Do(func() {
+		total := time.Since(hb.start)
+		hb.entry.Time = millis(total)
+		hb.entry.Timings = harTimings{Send: 0, Wait: millis(hb.wait), Receive: millis(total - hb.wait)}
+		hb.entry.Response.BodySize = hb.size
+		content := &hb.entry.Response.Content
+		content.Size = hb.size
+		content.Text, content.Encoding, content.Comment = hb.transport.recorder.content(hb.buf.Bytes(), hb.size)
+		hb.transport.recorder.add(hb.entry)
+	})
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// Values shown for each selector in a "gluestick audit" report, and how much
+// of each.
+const (
+	selectorHealthSamples   = 3
+	selectorHealthSampleLen = 100
+)
+
+// HealthReport is what "gluestick audit" prints: how each of a request's
+// selectors fares on its page as it is now.
+type HealthReport struct {
+	Url    string `json:"url"`
+	Status int    `json:"status"`
+	// Selectors that matched nothing.
+	Broken    int              `json:"broken"`
+	Selectors []SelectorHealth `json:"selectors"`
+}
+
+// SelectorHealth is an item's or field's selector in a HealthReport.
+type SelectorHealth struct {
+	Item string `json:"item"`
+	// Dotted path of the field, empty for the item's own selector.
+	Field    string `json:"field,omitempty"`
+	Selector string `json:"selector"`
+	Matched  bool   `json:"matched"`
+	// Elements matched, for fields in all of the item's elements.
+	Count   int      `json:"count"`
+	Samples []string `json:"samples,omitempty"`
+	// Why the selector wasn't checked, ex: its item isn't from the page's
+	// html.
+	Skipped string `json:"skipped,omitempty"`
+	// For selectors that matched nothing with -store, when the last run they
+	// had results was and selectors that find those results on the page.
+	LastSeen    *time.Time           `json:"last_seen,omitempty"`
+	Suggestions []SelectorSuggestion `json:"suggestions,omitempty"`
+}
+
+// Fetches req's page once (the first, for paginated requests) and checks
+// every item and field selector against it, without extracting or following
+// anything else.  Requests with a form are checked against the form's
+// response.  With a store, selectors that matched nothing get repairs
+// suggested from their last results, see suggestRepairs.
+func checkSelectorHealth(req ScrapeRequest, opts scrapeOptions, store *resultStore) (*HealthReport, error) {
+	urls, err := pageUrls(req)
+	if err != nil {
+		return nil, err
+	}
+	page := req
+	page.Url, page.PageParam, page.Crawl, page.Pipeline = urls[0], nil, nil, nil
+	page.Items, page.Canonical, page.DiscoverApis, page.Meta = nil, false, false, false
+	page.Webhook, page.DryRun, page.Tokenize = nil, false, false
+	var doc *colly.HTMLElement
+	opts.Stream, opts.Provenance = nil, false
+	opts.OnDocument = func(e *colly.HTMLElement) {
+		if doc == nil {
+			doc = e
+		}
+	}
+	if _, err := scrape(page, opts); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("no html page to audit")
+	}
+
+	report := &HealthReport{Url: doc.Request.URL.String(), Status: doc.Response.StatusCode, Selectors: []SelectorHealth{}}
+	root := goquery.NewDocumentFromNode(doc.DOM.Nodes[0].Parent).Selection
+	counts := matchCounts(req.Items, root)
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		health := SelectorHealth{Item: name, Selector: item.Selector}
+		switch {
+		case isJsonItem(item):
+			health.Skipped = "not from the page's html"
+		case len(item.IframeSelector) > 0:
+			health.Skipped = "in frames"
+		case len(item.Selector) == 0:
+			health.Skipped = "the whole page"
+		}
+		if len(health.Skipped) > 0 {
+			report.Selectors = append(report.Selectors, health)
+			continue
+		}
+		matches := safeFind(root, item.Selector)
+		if matches == nil {
+			health.Skipped = "invalid selector"
+			report.Selectors = append(report.Selectors, health)
+			continue
+		}
+		health.Count = counts[name]
+		health.Matched = health.Count > 0
+		var samples map[string][]string
+		if item.Type == itemTypeArticle {
+			matches.EachWithBreak(func(i int, s *goquery.Selection) bool {
+				health.Samples = append(health.Samples, selectorHealthSample(s.Text()))
+				return i+1 < selectorHealthSamples
+			})
+		} else {
+			samples = fieldSamples(item.Fields, matches, doc.Response)
+		}
+		report.Selectors = append(report.Selectors, health)
+		if item.Type != itemTypeArticle {
+			report.Selectors = append(report.Selectors, fieldHealth(name, "", item.Fields, counts, samples)...)
+		}
+	}
+	for _, health := range report.Selectors {
+		if !health.Matched && len(health.Skipped) == 0 {
+			report.Broken++
+		}
+	}
+	if store != nil && report.Broken > 0 {
+		if err := suggestRepairs(report, req, root, store); err != nil {
+			return nil, fmt.Errorf("reading -store: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// The health of fields under prefix, in field order.
+func fieldHealth(item string, prefix string, fields map[string]interface{}, counts map[string]int, samples map[string][]string) []SelectorHealth {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []SelectorHealth
+	for _, name := range names {
+		path := name
+		if len(prefix) > 0 {
+			path = prefix + "." + name
+		}
+		switch field := fields[name].(type) {
+		case string:
+			health := SelectorHealth{Item: item, Field: path, Selector: field}
+			if isUrlField(field) {
+				health.Skipped = "from the page's url"
+			} else {
+				// matched elements without the attribute give no values
+				health.Count = counts[item+"."+path]
+				health.Samples = samples[path]
+				health.Matched = len(health.Samples) > 0
+			}
+			list = append(list, health)
+		case map[string]interface{}:
+			list = append(list, fieldHealth(item, path, field, counts, samples)...)
+		}
+	}
+	return list
+}
+
+// The first few values of each field extracted from an item's matches,
+// keyed by dotted field path.
+func fieldSamples(fields map[string]interface{}, matches *goquery.Selection, resp *colly.Response) map[string][]string {
+	samples := make(map[string][]string)
+	var add func(prefix string, parsed map[string]interface{})
+	add = func(prefix string, parsed map[string]interface{}) {
+		for name, val := range parsed {
+			if nested, ok := val.(map[string]interface{}); ok {
+				add(prefix+name+".", nested)
+				continue
+			}
+			for _, v := range valuesOf(val) {
+				if nested, ok := v.(map[string]interface{}); ok {
+					add(prefix+name+".", nested)
+				} else if len(samples[prefix+name]) < selectorHealthSamples {
+					samples[prefix+name] = append(samples[prefix+name], selectorHealthSample(fmt.Sprint(v)))
+				}
+			}
+		}
+	}
+	matches.Each(func(i int, s *goquery.Selection) {
+		parsed, _ := parseFields(fields, colly.NewHTMLElementFromSelectionNode(resp, s, s.Nodes[0], i), missingOmit, nil)
+		add("", parsed)
+	})
+	return samples
+}
+
+func selectorHealthSample(val string) string {
+	val = strings.Join(strings.Fields(val), " ")
+	if len(val) > selectorHealthSampleLen {
+		cut := selectorHealthSampleLen
+		for !utf8.ValidString(val[:cut]) {
+			cut--
+		}
+		val = val[:cut] + "..."
+	}
+	return val
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Content parse_hidden can reveal.
+const (
+	hiddenNoscript = "noscript"
+	hiddenComments = "comments"
+)
+
+// What revealed content is wrapped in.  Not <noscript> itself, which colly
+// would parse back into plain text.
+const (
+	noscriptElement = "x-noscript"
+	commentElement  = "x-comment"
+)
+
+// Rewrites an html page so the markup inside <noscript> blocks and/or html
+// comments is parsed as regular elements, wrapped in <x-noscript> and
+// <x-comment> where the block or comment was, ex: "x-noscript img" for
+// the real images behind lazy loading placeholders.
+func revealHidden(body []byte, kinds []string) ([]byte, error) {
+	noscript := containsString(kinds, hiddenNoscript)
+	comments := containsString(kinds, hiddenComments)
+	// with scripting off the parser treats noscript content as markup
+	doc, err := html.ParseWithOptions(bytes.NewReader(body), html.ParseOptionEnableScripting(!noscript))
+	if err != nil {
+		return nil, err
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; {
+			next := child.NextSibling
+			switch {
+			case noscript && child.Type == html.ElementNode && child.DataAtom == atom.Noscript:
+				child.Data, child.DataAtom = noscriptElement, 0
+				walk(child)
+			case comments && child.Type == html.CommentNode && n.Type == html.ElementNode:
+				if wrapper := parseComment(child.Data); wrapper != nil {
+					n.InsertBefore(wrapper, child)
+					n.RemoveChild(child)
+				}
+			case child.Type == html.ElementNode:
+				walk(child)
+			}
+			child = next
+		}
+	}
+	walk(doc)
+	var b bytes.Buffer
+	if err := html.Render(&b, doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func parseComment(data string) *html.Node {
+	if len(strings.TrimSpace(data)) == 0 {
+		return nil
+	}
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(data), context)
+	if err != nil {
+		return nil
+	}
+	wrapper := &html.Node{Type: html.ElementNode, Data: commentElement}
+	for _, n := range nodes {
+		wrapper.AppendChild(n)
+	}
+	return wrapper
+}
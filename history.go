@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+func countResults(results ScrapeResult) map[string]int {
+	counts := make(map[string]int)
+	for name, val := range results {
+		if name == metaKey {
+			continue
+		}
+		counts[name] = countValues(val)
+	}
+	return counts
+}
+
+// Number of values accumulated via accumValue: a slice means many, anything
+// else is a single value.
+func countValues(val interface{}) int {
+	return len(valuesOf(val))
+}
+
+// Checks each item's expect_min_items and expect_max_change_pct thresholds,
+// in item name order.  prev may be nil in which case only the absolute
+// minimum is checked.
+func checkAnomalies(req ScrapeRequest, counts map[string]int, prev *StoredRun) []string {
+	var anomalies []string
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		count := counts[name]
+		if item.ExpectMinItems > 0 && count < item.ExpectMinItems {
+			anomalies = append(anomalies, fmt.Sprintf("item %q matched %d times, expected at least %d",
+				name, count, item.ExpectMinItems))
+		}
+		if item.ExpectMaxChangePct > 0 && prev != nil {
+			prevCount, found := prev.Counts[name]
+			if !found {
+				continue
+			}
+			if prevCount == 0 {
+				// any change from nothing is too big to be a percent of it
+				if count > 0 {
+					anomalies = append(anomalies, fmt.Sprintf("item %q matched %d times vs none on %s",
+						name, count, prev.Time.Format(time.RFC3339)))
+				}
+				continue
+			}
+			changePct := 100 * float64(count-prevCount) / float64(prevCount)
+			if changePct < 0 {
+				changePct = -changePct
+			}
+			if changePct > item.ExpectMaxChangePct {
+				anomalies = append(anomalies, fmt.Sprintf("item %q matched %d times vs %d on %s (%.1f%% change, max %.1f%%)",
+					name, count, prevCount, prev.Time.Format(time.RFC3339), changePct, item.ExpectMaxChangePct))
+			}
+		}
+	}
+	return anomalies
+}
+
+// What's kept of each CLI run: its results in the -store, its metrics
+// exported, and its counts in the -history for anomaly checks.
+type runRecorder struct {
+	// runs can be recorded concurrently, each needs the one before
+	lock    sync.Mutex
+	store   *resultStore
+	metrics *metricsExporter // nil unless pushing to -pushgateway or -graphite
+	history *resultStore
+}
+
+// Records a run, returning its anomalies.  Dry runs aren't recorded.  Runs
+// are compared with the previous run of their url in the -history, or
+// without one in the -store.
+func (rr *runRecorder) record(req ScrapeRequest, results ScrapeResult, counts map[string]int) ([]string, error) {
+	if req.DryRun {
+		return nil, nil
+	}
+	prev, err := rr.save(req, results, counts)
+	if err != nil {
+		return nil, err
+	}
+	if rr.metrics != nil {
+		if err := rr.metrics.record(req, results); err != nil {
+			return nil, fmt.Errorf("failed to export metrics: %v", err)
+		}
+	}
+	return checkAnomalies(req, counts, prev), nil
+}
+
+// Stores a run, returning the previous run of its url if needed.
+func (rr *runRecorder) save(req ScrapeRequest, results ScrapeResult, counts map[string]int) (*StoredRun, error) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	var prev *StoredRun
+	if previous := rr.previous(req); previous != nil {
+		var err error
+		if prev, err = previous.lastRun(req.Url); err != nil {
+			return nil, fmt.Errorf("failed to load history: %v", err)
+		}
+	}
+	if rr.store != nil {
+		if err := rr.store.add(req, results, counts); err != nil {
+			return nil, fmt.Errorf("failed to store results: %v", err)
+		}
+	}
+	if rr.history != nil {
+		if err := rr.history.add(req, results, counts); err != nil {
+			return nil, fmt.Errorf("failed to append history: %v", err)
+		}
+	}
+	return prev, nil
+}
+
+// Where req's previous run is read from, nil if it isn't needed.  The
+// -history is small enough to always read, the -store only for requests
+// comparing counts with it.
+func (rr *runRecorder) previous(req ScrapeRequest) *resultStore {
+	if rr.history != nil {
+		return rr.history
+	}
+	for _, item := range req.Items {
+		if item.ExpectMaxChangePct > 0 {
+			return rr.store
+		}
+	}
+	return nil
+}
+
+// Outcomes of a run, worst first as they're reported in the exit code.
+const (
+	runOk = iota
+	runAnomalous
+	runAsserted
+	runFailed
+)
+
+// Worst outcome of a set of runs, see exitCode.
+type runStatus struct {
+	lock  sync.Mutex
+	worst int
+}
+
+func (rs *runStatus) add(outcome int) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if outcome > rs.worst {
+		rs.worst = outcome
+	}
+}
+
+// Adds a failed scrape, see scrapeOutcome.
+func (rs *runStatus) scrapeFailed(err error) {
+	rs.add(scrapeOutcome(err))
+}
+
+// Outcome of a scrape that failed with err, failed assertions being
+// reported apart from errors.
+func scrapeOutcome(err error) int {
+	var assertErr *AssertionError
+	if errors.As(err, &assertErr) {
+		return runAsserted
+	}
+	return runFailed
+}
+
+// That of the worst run: 1 for errors, then 4 for failed assertions, then 2
+// for anomalies.
+func (rs *runStatus) exitCode() int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	switch rs.worst {
+	case runFailed:
+		return 1
+	case runAsserted:
+		return 4
+	case runAnomalous:
+		return 2
+	}
+	return 0
+}
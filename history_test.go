@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckAnomalies(t *testing.T) {
+	req := ScrapeRequest{Items: map[string]ScrapeItem{"products": {ExpectMinItems: 2, ExpectMaxChangePct: 50}}}
+	prev := func(count int) *StoredRun {
+		return &StoredRun{Time: time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC), Counts: map[string]int{"products": count}}
+	}
+	for _, test := range []struct {
+		name  string
+		count int
+		prev  *StoredRun
+		want  int
+	}{
+		{"no previous run", 10, nil, 0},
+		{"too few", 1, nil, 1},
+		{"small change", 12, prev(10), 0},
+		{"big drop", 4, prev(10), 1},
+		{"big rise", 20, prev(10), 1},
+		{"drop to none", 0, prev(10), 2},
+		{"recovery from none", 10, prev(0), 1},
+		{"still none", 0, prev(0), 1},
+		{"new item", 10, &StoredRun{Counts: map[string]int{}}, 0},
+	} {
+		got := checkAnomalies(req, map[string]int{"products": test.count}, test.prev)
+		if len(got) != test.want {
+			t.Errorf("%s: got %q, expected %d anomalies", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// Fetches the documents of the frames matching selector on the page, for
+// items with an iframe_selector.  Cross-origin frames are only fetched when
+// they can be rendered, as a browser would isolate them from the page.
+// Frames with a srcdoc are parsed inline.  Each document is returned as an
+// element for its <html>, with a request for the frame's url so relative
+// urls resolve against it.
+func fetchFrames(client *http.Client, e *colly.HTMLElement, selector string, render, verbose bool) []*colly.HTMLElement {
+	var frames []*colly.HTMLElement
+	safeFind(e.DOM, selector).Each(func(_ int, s *goquery.Selection) {
+		frameReq := &colly.Request{URL: e.Request.URL, Method: http.MethodGet, Depth: e.Request.Depth, Ctx: e.Request.Ctx}
+		var doc *goquery.Document
+		var err error
+		if srcdoc, ok := s.Attr("srcdoc"); ok {
+			doc, err = goquery.NewDocumentFromReader(strings.NewReader(srcdoc))
+		} else {
+			src := e.Request.AbsoluteURL(strings.TrimSpace(s.AttrOr("src", "")))
+			if len(src) == 0 || strings.HasPrefix(src, "about:") {
+				return
+			}
+			if frameReq.URL, err = e.Request.URL.Parse(src); err != nil {
+				return
+			}
+			crossOrigin := frameReq.URL.Scheme != e.Request.URL.Scheme || frameReq.URL.Host != e.Request.URL.Host
+			if crossOrigin && !render {
+				if verbose {
+					log.Println("Skipping cross-origin frame", src, "without -renderer")
+				}
+				return
+			}
+			doc, err = fetchFrame(client, src, e.Request.URL.String(), crossOrigin)
+		}
+		if err != nil {
+			if verbose {
+				log.Println("Couldn't load frame on", e.Request.URL.String()+":", err)
+			}
+			return
+		}
+		root := doc.Find("html")
+		if root.Length() == 0 {
+			return
+		}
+		resp := &colly.Response{Request: frameReq, Ctx: e.Request.Ctx}
+		frames = append(frames, colly.NewHTMLElementFromSelectionNode(resp, root, root.Nodes[0], 0))
+	})
+	return frames
+}
+
+func fetchFrame(client *http.Client, src, referer string, render bool) (*goquery.Document, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Referer", referer)
+	if render {
+		httpReq.Header.Set(renderHeader, "1")
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s", src, resp.Status)
+	}
+	return goquery.NewDocumentFromReader(resp.Body)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ImageMeta is recorded on downloaded images when the item sets image_meta.
+type ImageMeta struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	// 64 bit difference hash as hex.  Visually similar images have hashes
+	// with a small hamming distance, useful for dedupe downstream.
+	PHash string            `json:"phash,omitempty"`
+	Exif  map[string]string `json:"exif,omitempty"`
+}
+
+// Images with more pixels than this only get their size and exif, decoding
+// them to hash would take too much memory (a small, highly compressed file
+// can claim to be huge).
+const maxImageMetaPixels = 40 << 20
+
+func readImageMeta(filename string) (*ImageMeta, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	meta := &ImageMeta{Width: config.Width, Height: config.Height, Format: format}
+	if format == "jpeg" {
+		meta.Exif = jpegExif(data)
+	}
+	if int64(config.Width)*int64(config.Height) > maxImageMetaPixels {
+		return meta, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	meta.PHash = differenceHash(img)
+	return meta, nil
+}
+
+// Shrinks the image to 9x8 grayscale and sets a bit per pixel for whether
+// it is brighter than its right hand neighbor.
+func differenceHash(img image.Image) string {
+	const w, h = 9, 8
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return ""
+	}
+	var gray [h][w]float64
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			// average luminance over the box of source pixels
+			var sum float64
+			var n int
+			for sy := y0; sy < y1 && sy < bounds.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < bounds.Max.X; sx++ {
+					r, g, b, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			if n > 0 {
+				gray[y][x] = sum / float64(n)
+			}
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+var exifTagNames = map[uint16]string{
+	0x010f: "make",
+	0x0110: "model",
+	0x0112: "orientation",
+	0x0131: "software",
+	0x0132: "datetime",
+	0x9003: "datetime_original",
+}
+
+const exifSubIfdTag = 0x8769
+
+// Pulls a handful of common tags out of a jpeg's APP1 Exif segment.
+// Returns nil if there is no (parseable) exif data.
+func jpegExif(data []byte) map[string]string {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return nil
+		}
+		marker := data[pos+1]
+		if marker == 0xda || marker == 0xd9 { // start of scan / end of image
+			return nil
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		segEnd := pos + 2 + segLen
+		if segLen < 2 || segEnd > len(data) {
+			return nil
+		}
+		seg := data[pos+4 : segEnd]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return parseTiffTags(seg[6:])
+		}
+		pos = segEnd
+	}
+	return nil
+}
+
+func parseTiffTags(tiff []byte) map[string]string {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	tags := make(map[string]string)
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if subIfd := readIfd(tiff, order, ifd0, tags); subIfd > 0 {
+		readIfd(tiff, order, subIfd, tags)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// Reads known tags from the IFD at offset into tags.  Returns the offset of
+// the Exif sub-IFD if one was referenced.
+func readIfd(tiff []byte, order binary.ByteOrder, offset int, tags map[string]string) int {
+	if offset <= 0 || offset+2 > len(tiff) {
+		return 0
+	}
+	subIfd := 0
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := int(order.Uint32(tiff[entry+4:]))
+		valueBytes := tiff[entry+8 : entry+12]
+		if tag == exifSubIfdTag && typ == 4 {
+			subIfd = int(order.Uint32(valueBytes))
+			continue
+		}
+		name, known := exifTagNames[tag]
+		if !known {
+			continue
+		}
+		switch typ {
+		case 2: // ascii, inline if it fits in 4 bytes else at an offset
+			str := valueBytes
+			if n > 4 {
+				start := int(order.Uint32(valueBytes))
+				if start < 0 || start+n > len(tiff) {
+					continue
+				}
+				str = tiff[start : start+n]
+			} else if n < 4 {
+				str = valueBytes[:n]
+			}
+			tags[name] = strings.TrimSpace(strings.TrimRight(string(str), "\x00"))
+		case 3: // short
+			tags[name] = strconv.Itoa(int(order.Uint16(valueBytes)))
+		case 4: // long
+			tags[name] = strconv.Itoa(int(order.Uint32(valueBytes)))
+		}
+	}
+	return subIfd
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	defaultResultsLimit = 100
+	maxResultsLimit     = 1000
+
+	maxIdempotencyKey = 255
+)
+
+// Job is an asynchronous scrape submitted via POST /jobs.
+type Job struct {
+	Id       string         `json:"id"`
+	Status   string         `json:"status"`
+	Priority int            `json:"priority"`
+	Error    string         `json:"error,omitempty"`
+	Created  time.Time      `json:"created"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Counts   map[string]int `json:"counts,omitempty"`
+	// Name of the remote worker running the job, blank if run locally, and
+	// when it last reported in, see requeueExpired.
+	Worker    string     `json:"worker,omitempty"`
+	Heartbeat *time.Time `json:"heartbeat,omitempty"`
+
+	req     ScrapeRequest
+	results ScrapeResult
+	// Sends the request's webhook events, nil without one.
+	hooks *webhookSender
+}
+
+// ResultEntry is a single extracted value when paging through job results.
+type ResultEntry struct {
+	Item  string      `json:"item"`
+	Value interface{} `json:"value"`
+}
+
+type ResultsPage struct {
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Total   int           `json:"total"`
+	Results []ResultEntry `json:"results"`
+}
+
+type jobStore struct {
+	lock      sync.RWMutex
+	jobs      map[string]*Job
+	retention time.Duration
+	// Idempotency-Key, per api key, -> the job submitted with it, kept as
+	// long as the job.
+	keys map[idempotencyKey]idempotentJob
+	// Called with the results of each job that succeeded, if set.
+	onDone func(req ScrapeRequest, results ScrapeResult)
+	// Where jobs' webhooks can be sent.
+	webhooks *webhookPolicy
+}
+
+type idempotencyKey struct {
+	// Name of the api key the job was submitted with, see ScrapeRequest.owner.
+	owner string
+	key   string
+}
+
+type idempotentJob struct {
+	jobId string
+	// Hash of the submission, so reusing a key for a different request is
+	// caught rather than silently returning the wrong job.
+	hash string
+}
+
+var errIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{jobs: make(map[string]*Job), retention: retention, keys: make(map[idempotencyKey]idempotentJob),
+		webhooks: newWebhookPolicy(nil)}
+}
+
+// Adds a queued job.  With a non-empty idempotency key a job already added
+// by the same owner with the same key and request is returned instead, with
+// added false.
+func (js *jobStore) add(req ScrapeRequest, priority int, key string) (job *Job, added bool, err error) {
+	id, err := newJobId()
+	if err != nil {
+		return nil, false, err
+	}
+	hash := ""
+	if len(key) > 0 {
+		data, _ := json.Marshal(struct {
+			Req      ScrapeRequest
+			Priority int
+		}{req, priority})
+		sum := sha256.Sum256(data)
+		hash = hex.EncodeToString(sum[:])
+	}
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	js.pruneLocked()
+	ikey := idempotencyKey{owner: req.owner, key: key}
+	if prev, found := js.keys[ikey]; found && len(key) > 0 {
+		if prev.hash != hash {
+			return nil, false, errIdempotencyMismatch
+		}
+		if existing, found := js.jobs[prev.jobId]; found {
+			copied := *existing
+			return &copied, false, nil
+		}
+	}
+	job = &Job{Id: id, Status: jobQueued, Priority: priority, Created: time.Now(), req: req}
+	if req.Webhook != nil {
+		job.hooks = newWebhookSender(req.Webhook, js.webhooks.client)
+	}
+	js.jobs[id] = job
+	if len(key) > 0 {
+		js.keys[ikey] = idempotentJob{jobId: id, hash: hash}
+	}
+	return job, true, nil
+}
+
+// Returns a copy of the job so callers can read it without holding the lock.
+func (js *jobStore) get(id string) (Job, bool) {
+	js.lock.RLock()
+	defer js.lock.RUnlock()
+	job, found := js.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (js *jobStore) update(id string, fn func(job *Job)) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	if job, found := js.jobs[id]; found {
+		fn(job)
+	}
+}
+
+// Drops finished jobs older than the retention period so a long running
+// server doesn't hold on to every result forever.
+func (js *jobStore) pruneLocked() {
+	if js.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-js.retention)
+	for id, job := range js.jobs {
+		if job.Finished != nil && job.Finished.Before(cutoff) {
+			delete(js.jobs, id)
+		}
+	}
+	for key, prev := range js.keys {
+		if _, found := js.jobs[prev.jobId]; !found {
+			delete(js.keys, key)
+		}
+	}
+}
+
+func (js *jobStore) run(id string, opts scrapeOptions) {
+	req, ok := js.start(id, "")
+	if !ok {
+		return
+	}
+	if job, _ := js.get(id); job.hooks != nil {
+		opts.OnPage = func(page PageMeta) {
+			js.page(id, "", page)
+		}
+	}
+	results, err := scrape(req, opts)
+	js.finish(id, "", results, err)
+	if opts.Verbose {
+		log.Println("Finished job", id)
+	}
+}
+
+// Marks a queued job as running on the given worker ("" when run locally).
+func (js *jobStore) start(id string, worker string) (ScrapeRequest, bool) {
+	var req ScrapeRequest
+	var snapshot Job
+	started := false
+	js.update(id, func(job *Job) {
+		if job.Status != jobQueued {
+			return
+		}
+		now := time.Now()
+		job.Status = jobRunning
+		job.Started = &now
+		job.Worker = worker
+		if len(worker) > 0 {
+			job.Heartbeat = &now
+		}
+		req = job.req
+		snapshot = *job
+		started = true
+	})
+	if started && snapshot.hooks != nil {
+		snapshot.hooks.send(webhookStarted, snapshot, nil)
+	}
+	return req, started
+}
+
+// Sends a page_done event for a page of a job still running on the given
+// worker.  False if it isn't running there.
+func (js *jobStore) page(id string, worker string, page PageMeta) bool {
+	job, found := js.get(id)
+	if !found || job.Status != jobRunning || job.Worker != worker {
+		return false
+	}
+	if job.hooks != nil {
+		job.hooks.send(webhookPageDone, job, &page)
+	}
+	return true
+}
+
+// Records a job's outcome.  Ignored unless the job is still running on the
+// given worker, so a worker whose lease expired can't clobber a retry.
+func (js *jobStore) finish(id string, worker string, results ScrapeResult, err error) bool {
+	var snapshot Job
+	finished := false
+	js.update(id, func(job *Job) {
+		if job.Status != jobRunning || job.Worker != worker {
+			return
+		}
+		now := time.Now()
+		job.Finished = &now
+		job.results = results
+		job.Counts = countResults(results)
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = jobDone
+		}
+		snapshot = *job
+		finished = true
+	})
+	if finished && err == nil && js.onDone != nil {
+		js.onDone(snapshot.req, results)
+	}
+	if finished && snapshot.hooks != nil {
+		event := webhookCompleted
+		if snapshot.Status == jobFailed {
+			event = webhookFailed
+		}
+		snapshot.hooks.send(event, snapshot, nil)
+	}
+	return finished
+}
+
+func newJobId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// POST /jobs?priority=n submits a scrape to run in the background.  Higher
+// priority jobs are run first, equal priorities in submission order.  With
+// an Idempotency-Key header, resubmitting the same request with the same key
+// returns the original job (200 rather than 202) instead of starting another.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	priority, err := queryInt(r.URL.Query().Get("priority"), 0)
+	if err != nil || priority < minJobPriority || priority > maxJobPriority {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("priority must be an integer from %d to %d",
+			minJobPriority, maxJobPriority))
+		return
+	}
+	scrapeReq, status, err := s.readScrapeRequest(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if scrapeReq.Webhook != nil {
+		if err := s.jobs.webhooks.check(scrapeReq.Webhook.Url); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKey {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Idempotency-Key is longer than %d characters", maxIdempotencyKey))
+		return
+	}
+	job, added, err := s.jobs.add(scrapeReq, priority, key)
+	if err == errIdempotencyMismatch {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !added {
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeJson(w, http.StatusOK, job)
+		return
+	}
+	s.submitJob(job)
+	writeJson(w, http.StatusAccepted, job)
+}
+
+// Queues the job for local workers, or for remote workers to claim when
+// running distributed.
+func (s *server) submitJob(job *Job) {
+	if s.conf.Distributed {
+		s.remote.submit(&task{priority: job.Priority, jobId: job.Id})
+		return
+	}
+	id := job.Id
+	s.queue.submit(&task{priority: job.Priority, jobId: id, run: func() {
+		s.jobs.run(id, s.conf.Scrape)
+	}})
+}
+
+// GET /jobs/{id} and GET /jobs/{id}/results
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	job, found := s.jobs.get(parts[0])
+	if scoped, owner := s.ownerScope(r); scoped && job.req.owner != owner {
+		found = false // another key's job, as if it didn't exist
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job with id %q", parts[0]))
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		writeJson(w, http.StatusOK, job)
+	case len(parts) == 2 && parts[1] == "results":
+		s.handleJobResults(w, r, job)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Pages through a job's results.  Supports ?offset=&limit= and ?item= to
+// only return values from the given comma separated item names.
+func (s *server) handleJobResults(w http.ResponseWriter, r *http.Request, job Job) {
+	if job.Status == jobQueued || job.Status == jobRunning {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is still %s", job.Id, job.Status))
+		return
+	}
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %q", query.Get("offset")))
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultResultsLimit)
+	if err != nil || limit <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q", query.Get("limit")))
+		return
+	}
+	if limit > maxResultsLimit {
+		limit = maxResultsLimit
+	}
+
+	entries := flattenResults(job.results, splitList(query.Get("item")))
+	page := ResultsPage{Offset: offset, Limit: limit, Total: len(entries), Results: []ResultEntry{}}
+	if offset < len(entries) {
+		end := offset + limit
+		if end > len(entries) {
+			end = len(entries)
+		}
+		page.Results = entries[offset:end]
+	}
+	writeJson(w, http.StatusOK, page)
+}
+
+// Flattens results into a stable list of entries: ordered by item name, then
+// by extraction order.  If items is non-empty only those items are included.
+func flattenResults(results ScrapeResult, items []string) []ResultEntry {
+	var names []string
+	for name := range results {
+		if name == metaKey {
+			continue
+		}
+		if len(items) == 0 || containsString(items, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var entries []ResultEntry
+	for _, name := range names {
+		for _, val := range valuesOf(results[name]) {
+			entries = append(entries, ResultEntry{Item: name, Value: val})
+		}
+	}
+	return entries
+}
+
+// Values accumulated via accumValue as a slice regardless of single/multi.
+func valuesOf(val interface{}) []interface{} {
+	if val == nil {
+		return nil
+	}
+	if multi, ok := val.([]interface{}); ok {
+		return multi
+	}
+	return []interface{}{val}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func queryInt(val string, def int) (int, error) {
+	if len(val) == 0 {
+		return def, nil
+	}
+	return strconv.Atoi(val)
+}
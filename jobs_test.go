@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobIdempotency(t *testing.T) {
+	req := func(url string, owner string) ScrapeRequest {
+		return ScrapeRequest{Url: url, owner: owner}
+	}
+	js := newJobStore(time.Hour)
+	first, added, err := js.add(req("https://a.example", "team-a"), 0, "key-1")
+	if err != nil || !added {
+		t.Fatalf("got %v, %v", added, err)
+	}
+	for _, test := range []struct {
+		name      string
+		req       ScrapeRequest
+		priority  int
+		key       string
+		wantAdded bool
+		wantErr   error
+		wantFirst bool
+	}{
+		{"same key and request", req("https://a.example", "team-a"), 0, "key-1", false, nil, true},
+		{"different request", req("https://b.example", "team-a"), 0, "key-1", false, errIdempotencyMismatch, false},
+		{"different priority", req("https://a.example", "team-a"), 5, "key-1", false, errIdempotencyMismatch, false},
+		{"another owner's key", req("https://a.example", "team-b"), 0, "key-1", true, nil, false},
+		{"another key", req("https://a.example", "team-a"), 0, "key-2", true, nil, false},
+		{"no key", req("https://a.example", "team-a"), 0, "", true, nil, false},
+	} {
+		job, added, err := js.add(test.req, test.priority, test.key)
+		if err != test.wantErr || added != test.wantAdded {
+			t.Errorf("%s: got %v, %v, expected %v, %v", test.name, added, err, test.wantAdded, test.wantErr)
+			continue
+		}
+		if job != nil && (job.Id == first.Id) != test.wantFirst {
+			t.Errorf("%s: got job %s, first was %s", test.name, job.Id, first.Id)
+		}
+	}
+}
+
+func TestJobIdempotencyAfterPruning(t *testing.T) {
+	js := newJobStore(time.Millisecond)
+	req := ScrapeRequest{Url: "https://a.example"}
+	first, _, _ := js.add(req, 0, "key-1")
+	js.start(first.Id, "")
+	js.finish(first.Id, "", ScrapeResult{}, nil)
+	time.Sleep(5 * time.Millisecond)
+	job, added, err := js.add(req, 0, "key-1")
+	if err != nil || !added || job.Id == first.Id {
+		t.Errorf("got %v, %v, expected a new job once the first was pruned", added, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Key the detected language is stored under in each result of an item with
+// detect_language set.
+const languageKey = "_language"
+
+// ISO 639-1 code used when the language can't be determined.
+const languageUndetermined = "und"
+
+// Common words for languages written in latin script.  Enough short text
+// (titles, summaries) hits a few of these to tell the languages apart.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "was", "on", "are", "with", "as", "be", "this", "by", "at", "from", "have", "has", "not", "you", "they", "will", "an", "or", "which", "their", "been"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "las", "del", "se", "por", "con", "para", "una", "es", "su", "al", "lo", "como", "más", "pero", "sus", "le", "ya", "fue", "este", "ha", "sí", "porque", "esta"},
+	"fr": {"le", "la", "les", "de", "des", "et", "est", "un", "une", "du", "en", "que", "qui", "dans", "pour", "pas", "sur", "au", "avec", "ce", "il", "elle", "sont", "par", "plus", "ne", "nous", "vous", "été", "aux"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "von", "mit", "sich", "des", "auf", "für", "im", "dem", "auch", "es", "an", "werden", "aus", "er", "hat", "dass", "sie", "nach", "wird", "bei"},
+	"it": {"il", "di", "che", "e", "la", "per", "un", "una", "non", "sono", "del", "della", "le", "gli", "con", "si", "da", "al", "nel", "anche", "come", "ma", "più", "questo", "è", "alla", "dei", "delle", "ha", "lo"},
+	"pt": {"o", "a", "de", "que", "e", "do", "da", "em", "um", "para", "é", "com", "não", "uma", "os", "no", "se", "na", "por", "mais", "as", "dos", "como", "mas", "foi", "ao", "ele", "das", "tem", "à"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "op", "te", "in", "voor", "niet", "met", "zijn", "er", "aan", "ook", "als", "bij", "door", "maar", "om", "nog", "wordt", "dan", "naar", "uit", "worden", "heeft", "deze"},
+	"sv": {"och", "att", "det", "som", "en", "på", "är", "av", "för", "med", "till", "den", "har", "de", "inte", "om", "ett", "han", "men", "var", "jag", "sig", "från", "vi", "så", "kan", "när", "efter", "ska", "också"},
+	"pl": {"i", "w", "nie", "na", "się", "z", "do", "to", "że", "jest", "jak", "o", "co", "ale", "po", "tak", "za", "od", "przez", "jego", "dla", "czy", "być", "już", "tym", "oraz", "który", "które", "są", "może"},
+	"ru": {"и", "в", "не", "на", "что", "с", "по", "это", "как", "он", "но", "из", "к", "у", "за", "от", "о", "так", "для", "же", "все", "она", "было", "был", "они", "только", "его", "уже", "или", "бы"},
+	"uk": {"і", "в", "не", "на", "що", "з", "та", "до", "це", "як", "у", "він", "але", "за", "від", "по", "для", "її", "було", "був", "вони", "також", "який", "які", "або", "ще", "є", "його", "так", "вже"},
+}
+
+var stopwordLanguages = func() map[string][]string {
+	byWord := make(map[string][]string)
+	for lang, words := range languageStopwords {
+		for _, word := range words {
+			byWord[word] = append(byWord[word], lang)
+		}
+	}
+	return byWord
+}()
+
+// Scripts used by a single (main) language, checked before stopwords.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// Best guess ISO 639-1 code for text, or "und".
+func detectLanguage(text string) string {
+	// letters per script, a language specific script wins if it makes up
+	// a good part of the text
+	letters := 0
+	scriptCounts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, sl := range scriptLanguages {
+			if unicode.Is(sl.script, r) {
+				scriptCounts[sl.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return languageUndetermined
+	}
+	// japanese mixes kana with han characters
+	if scriptCounts["ja"] > 0 {
+		scriptCounts["ja"] += scriptCounts["zh"]
+	}
+	best, bestCount := "", 0
+	for _, sl := range scriptLanguages {
+		if count := scriptCounts[sl.lang]; count > bestCount {
+			best, bestCount = sl.lang, count
+		}
+	}
+	if bestCount*3 >= letters {
+		return best
+	}
+
+	hits := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, word := range words {
+		for _, lang := range stopwordLanguages[word] {
+			hits[lang]++
+		}
+	}
+	best, bestCount = languageUndetermined, 0
+	for lang, count := range hits {
+		// ties broken by code so results are stable
+		if count > bestCount || count == bestCount && lang < best {
+			best, bestCount = lang, count
+		}
+	}
+	if bestCount < 2 && len(words) > 3 {
+		return languageUndetermined
+	}
+	return best
+}
+
+// Concatenates all string values within an extracted result.
+func resultText(val interface{}) string {
+	var texts []string
+	mapLeaves(val, func(s string) interface{} {
+		texts = append(texts, s)
+		return s
+	})
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gocolly/colly"
+)
+
+// BrokenLink is a discovered link that failed or returned an error status,
+// along with the crawled pages linking to it.
+type BrokenLink struct {
+	Url     string   `json:"url"`
+	Status  int      `json:"status,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Checks every discovered link the crawl didn't visit itself (other domains,
+// beyond max_depth, etc) and returns all broken links found.  Requests go
+// through the same throttling and circuit breaking as the crawl.
+func (cr *crawler) checkLinks(c *colly.Collector, throttler *throttle, breaker *breaker, meta *ScrapeMeta, verbose bool) []BrokenLink {
+	var unchecked []string
+	cr.lock.Lock()
+	for link, entry := range cr.entries {
+		if !entry.Visited {
+			unchecked = append(unchecked, link)
+		}
+	}
+	cr.lock.Unlock()
+	sort.Strings(unchecked)
+
+	checker := c.Clone()
+	checker.MaxDepth = 0
+	checker.MaxBodySize = 64 << 10 // only the status matters
+	// collector isn't async, so these are set by the time Head() etc return
+	var status int
+	var checkErr error
+	checker.OnRequest(func(r *colly.Request) {
+		breaker.onRequest(r, meta)
+		throttler.onRequest(r)
+		if verbose {
+			log.Println("Checking", r.Method, r.URL.String())
+		}
+	})
+	checker.OnResponse(func(r *colly.Response) {
+		breaker.success(r.Request.URL.Host)
+		status, checkErr = r.StatusCode, nil
+	})
+	checker.OnError(func(r *colly.Response, err error) {
+		if throttler.onError(r) {
+			return
+		}
+		breaker.failure(r.Request.URL.Host)
+		status, checkErr = r.StatusCode, err
+	})
+	for _, link := range unchecked {
+		status, checkErr = 0, nil
+		checker.Head(link)
+		// not every server supports HEAD
+		if status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+			status, checkErr = 0, nil
+			checker.Request(http.MethodGet, link, nil, nil, nil)
+		}
+		if status != 0 || checkErr != nil { // else skipped by the breaker
+			cr.result(link, status, checkErr)
+		}
+	}
+
+	var broken []BrokenLink
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	for link, entry := range cr.entries {
+		if entry.Status < 400 && len(entry.Error) == 0 {
+			continue
+		}
+		b := BrokenLink{Url: link, Status: entry.Status, Error: entry.Error}
+		for source := range cr.sources[link] {
+			b.Sources = append(b.Sources, source)
+		}
+		sort.Strings(b.Sources)
+		broken = append(broken, b)
+	}
+	sort.Slice(broken, func(i, j int) bool { return broken[i].Url < broken[j].Url })
+	return broken
+}
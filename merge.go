@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// -merge policies, for results already in the -out file.
+const (
+	mergeAppend  = "append"
+	mergeReplace = "replace"
+	mergeSkip    = "skip"
+)
+
+// How new results are merged into those already in an -out file.
+type mergePolicy struct {
+	// mergeAppend keeps both, mergeReplace replaces existing results with
+	// new ones of the same key and mergeSkip drops new ones of a key that's
+	// already there.
+	mode string
+	// Dotted path of the field identifying a result, ex: "sku".  Without
+	// one, mergeSkip compares whole results.
+	key string
+}
+
+func (mp mergePolicy) check() error {
+	switch mp.mode {
+	case mergeAppend, mergeSkip:
+	case mergeReplace:
+		if len(mp.key) == 0 {
+			return errors.New("-merge replace requires -merge-key")
+		}
+	default:
+		return fmt.Errorf("invalid -merge %q, must be %q, %q or %q", mp.mode, mergeAppend, mergeReplace, mergeSkip)
+	}
+	return nil
+}
+
+// Reads the results in an -out file to merge into, none if it doesn't exist
+// yet.
+func readOutput(path string) (ScrapeResult, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ScrapeResult{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var existing ScrapeResult
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return nil, fmt.Errorf("%q doesn't hold results to merge into: %v", path, err)
+	}
+	return existing, nil
+}
+
+// Merges each item's results into those of the same item in existing,
+// which is changed and returned.  Items only in existing are kept as they
+// are, and _meta is that of the new run.
+func (mp mergePolicy) merge(existing ScrapeResult, results ScrapeResult) ScrapeResult {
+	if existing == nil {
+		existing = ScrapeResult{}
+	}
+	for name, val := range results {
+		old, found := existing[name]
+		if name == metaKey || !found {
+			existing[name] = val
+			continue
+		}
+		merged := mp.mergeValues(valuesOf(old), valuesOf(val))
+		_, oldMany := old.([]interface{})
+		_, newMany := val.([]interface{})
+		if len(merged) == 1 && !oldMany && !newMany {
+			existing[name] = merged[0]
+		} else {
+			existing[name] = merged
+		}
+	}
+	return existing
+}
+
+func (mp mergePolicy) mergeValues(old []interface{}, vals []interface{}) []interface{} {
+	merged := append([]interface{}{}, old...)
+	if mp.mode == mergeAppend {
+		return append(merged, vals...)
+	}
+	index := make(map[string]int)
+	for i, val := range merged {
+		if key, ok := mp.keyOf(val); ok {
+			index[key] = i
+		}
+	}
+	for _, val := range vals {
+		key, ok := mp.keyOf(val)
+		i, found := index[key]
+		switch {
+		case !ok || !found:
+			if ok {
+				index[key] = len(merged)
+			}
+			merged = append(merged, val)
+		case mp.mode == mergeReplace:
+			merged[i] = val
+		}
+		// mergeSkip keeps the existing result
+	}
+	return merged
+}
+
+// The key identifying val, if it has one: its key field's value, or with no
+// key field its json.
+func (mp mergePolicy) keyOf(val interface{}) (string, bool) {
+	if len(mp.key) == 0 {
+		j, err := json.Marshal(val)
+		return string(j), err == nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	keyVal, found := fieldByPath(m, mp.key)
+	if !found || keyVal == nil {
+		return "", false
+	}
+	return fmt.Sprint(keyVal), true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePolicies(t *testing.T) {
+	existing := `{"products": [{"sku": "1", "price": "$1"}, {"sku": "2", "price": "$2"}], "title": "Old", "kept": "yes"}`
+	results := `{"products": [{"sku": "2", "price": "$3"}, {"sku": "3", "price": "$4"}, {"price": "$5"}], "title": "New", "_meta": {"url": "https://a.example"}}`
+	for _, test := range []struct {
+		name   string
+		policy mergePolicy
+		want   string
+	}{
+		{"append", mergePolicy{mode: mergeAppend},
+			`{"_meta":{"url":"https://a.example"},"kept":"yes",` +
+				`"products":[{"price":"$1","sku":"1"},{"price":"$2","sku":"2"},{"price":"$3","sku":"2"},{"price":"$4","sku":"3"},{"price":"$5"}],` +
+				`"title":["Old","New"]}`},
+		{"replace by key", mergePolicy{mode: mergeReplace, key: "sku"},
+			`{"_meta":{"url":"https://a.example"},"kept":"yes",` +
+				`"products":[{"price":"$1","sku":"1"},{"price":"$3","sku":"2"},{"price":"$4","sku":"3"},{"price":"$5"}],` +
+				`"title":["Old","New"]}`},
+		{"skip by key", mergePolicy{mode: mergeSkip, key: "sku"},
+			`{"_meta":{"url":"https://a.example"},"kept":"yes",` +
+				`"products":[{"price":"$1","sku":"1"},{"price":"$2","sku":"2"},{"price":"$4","sku":"3"},{"price":"$5"}],` +
+				`"title":["Old","New"]}`},
+		{"skip whole results", mergePolicy{mode: mergeSkip},
+			`{"_meta":{"url":"https://a.example"},"kept":"yes",` +
+				`"products":[{"price":"$1","sku":"1"},{"price":"$2","sku":"2"},{"price":"$3","sku":"2"},{"price":"$4","sku":"3"},{"price":"$5"}],` +
+				`"title":["Old","New"]}`},
+	} {
+		var old, res ScrapeResult
+		json.Unmarshal([]byte(existing), &old)
+		json.Unmarshal([]byte(results), &res)
+		got, _ := json.Marshal(test.policy.merge(old, res))
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, expected %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeSkipsRepeats(t *testing.T) {
+	var old, res ScrapeResult
+	json.Unmarshal([]byte(`{"title": "Same"}`), &old)
+	json.Unmarshal([]byte(`{"title": "Same"}`), &res)
+	got, _ := json.Marshal(mergePolicy{mode: mergeSkip}.merge(old, res))
+	if string(got) != `{"title":"Same"}` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestMergePolicyCheck(t *testing.T) {
+	for _, test := range []struct {
+		policy mergePolicy
+		valid  bool
+	}{
+		{mergePolicy{mode: mergeAppend}, true},
+		{mergePolicy{mode: mergeSkip}, true},
+		{mergePolicy{mode: mergeSkip, key: "sku"}, true},
+		{mergePolicy{mode: mergeReplace, key: "sku"}, true},
+		{mergePolicy{mode: mergeReplace}, false},
+		{mergePolicy{mode: "upsert"}, false},
+	} {
+		if err := test.policy.check(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v", test.policy, err)
+		}
+	}
+}
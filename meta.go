@@ -0,0 +1,71 @@
+package main
+
+import "sync"
+
+// Key results are stored under when a request asks for "meta": true.
+const metaKey = "_meta"
+
+// ScrapeMeta is information about the run itself rather than extracted data.
+type ScrapeMeta struct {
+	lock    sync.Mutex
+	Pages   []PageMeta   `json:"pages,omitempty"`
+	Skipped []SkippedUrl `json:"skipped,omitempty"`
+	// Only for crawls with "sitemap": true.
+	Sitemap []SitemapEntry `json:"sitemap,omitempty"`
+	// Only for crawls with "check_links": true.
+	BrokenLinks []BrokenLink `json:"broken_links,omitempty"`
+	// Only for "discover_apis": true.
+	Apis []ApiEndpoint `json:"apis,omitempty"`
+	// Only for "dry_run": true, which returns nothing else.
+	Plan *FetchPlan `json:"plan,omitempty"`
+}
+
+type PageMeta struct {
+	Url    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Canonical url followed instead of extracting from this page, and the
+	// page's AMP variant if it advertised one (see request "canonical").
+	Canonical string `json:"canonical,omitempty"`
+	Amp       string `json:"amp,omitempty"`
+	// Fingerprints of the page's content, see request "fingerprint".
+	Hash    string `json:"hash,omitempty"`
+	Simhash string `json:"simhash,omitempty"`
+	// Kind of CAPTCHA/bot challenge the page was instead of content.
+	Challenge string `json:"challenge,omitempty"`
+	// Kind of error page it was despite its status, see "soft_errors".
+	SoftError string `json:"soft_error,omitempty"`
+	// Why the page failed the request's expect_status or expect_selector.
+	Assertion string `json:"assertion,omitempty"`
+	// Elements matched by each item and field selector, see matchCounts.
+	Matches map[string]int `json:"matches,omitempty"`
+}
+
+type SkippedUrl struct {
+	Url    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func (m *ScrapeMeta) page(p PageMeta) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Pages = append(m.Pages, p)
+}
+
+// Records match counts on the most recent entry for url.
+func (m *ScrapeMeta) pageMatches(url string, matches map[string]int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := len(m.Pages) - 1; i >= 0; i-- {
+		if m.Pages[i].Url == url {
+			m.Pages[i].Matches = matches
+			return
+		}
+	}
+}
+
+func (m *ScrapeMeta) skip(url string, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Skipped = append(m.Skipped, SkippedUrl{Url: url, Reason: reason})
+}
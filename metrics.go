@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricField exports a numeric field of an item's results as a gauge, one
+// sample per result, ex: {"name": "product_price", "field": "price",
+// "labels": ["sku"]}.
+type MetricField struct {
+	// Prometheus metric name.
+	Name string `json:"name"`
+	// Dotted path of the field within each result.  Text is parsed as
+	// "where" does, so "$1,299.99" is 1299.99.  Results without a number
+	// are skipped.
+	Field string `json:"field"`
+	// Fields (dotted paths) whose values label each sample, named after
+	// them with dots as underscores.
+	Labels []string `json:"labels,omitempty"`
+}
+
+var (
+	metricName     = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	metricLabelBad = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+type metricSample struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+// Identifies the sample's series.
+func (ms metricSample) series() string {
+	var b strings.Builder
+	b.WriteString(ms.name)
+	if len(ms.labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range ms.labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label[0] + `="` + escapeLabel(label[1]) + `"`)
+		}
+		b.WriteByte('}')
+	}
+	return b.String()
+}
+
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+func metricLabelName(path string) string {
+	name := metricLabelBad.ReplaceAllString(path, "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func checkMetrics(v *validator, itemName string, metrics []MetricField) {
+	for idx, m := range metrics {
+		path := jsonPointer("items", itemName, "metrics", strconv.Itoa(idx))
+		if !metricName.MatchString(m.Name) {
+			v.add(path+"/name", "must be a prometheus metric name, ex: \"product_price\"")
+		}
+		if len(m.Field) == 0 {
+			v.add(path+"/field", "was empty")
+		}
+		for i, label := range m.Labels {
+			if len(label) == 0 {
+				v.add(jsonPointer("items", itemName, "metrics", strconv.Itoa(idx), "labels", strconv.Itoa(i)), "was empty")
+			}
+		}
+	}
+}
+
+// Samples of each item's metrics, by item name.
+func collectMetrics(req ScrapeRequest, results ScrapeResult) map[string][]metricSample {
+	samples := make(map[string][]metricSample)
+	for name, item := range req.Items {
+		if len(item.Metrics) == 0 {
+			continue
+		}
+		samples[name] = []metricSample{} // replaces the item's samples even if there are none now
+		for _, result := range valuesOf(results[name]) {
+			m, ok := result.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, metric := range item.Metrics {
+				val, found := fieldByPath(m, metric.Field)
+				if !found {
+					continue
+				}
+				num, ok := whereNumber(val)
+				if !ok {
+					continue
+				}
+				sample := metricSample{name: metric.Name, value: num}
+				for _, label := range metric.Labels {
+					labelVal, _ := fieldByPath(m, label)
+					sample.labels = append(sample.labels, [2]string{metricLabelName(label), fmt.Sprint(labelVal)})
+				}
+				samples[name] = append(samples[name], sample)
+			}
+		}
+	}
+	return samples
+}
+
+// Prometheus text format for the samples, a gauge per metric.  Of samples
+// of the same series only the last is kept.
+func writeMetrics(samples []metricSample) []byte {
+	latest := make(map[string]metricSample)
+	for _, s := range samples {
+		latest[s.series()] = s
+	}
+	series := make([]string, 0, len(latest))
+	for key := range latest {
+		series = append(series, key)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		a, b := latest[series[i]], latest[series[j]]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return series[i] < series[j]
+	})
+	var b bytes.Buffer
+	lastName := ""
+	for _, key := range series {
+		s := latest[key]
+		if s.name != lastName {
+			fmt.Fprintf(&b, "# TYPE %s gauge\n", s.name)
+			lastName = s.name
+		}
+		fmt.Fprintf(&b, "%s %s\n", key, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	return b.Bytes()
+}
+
+// Where metrics of each run go: the server's /metrics, and/or pushed to a
+// Prometheus Pushgateway or Graphite.
+type metricsExporter struct {
+	lock sync.Mutex
+	// Latest samples of each request's items, see record.  Dropped once
+	// not updated for ttl, if set, so requests that stopped running don't
+	// pile up.
+	groups      map[string]metricGroup
+	ttl         time.Duration
+	pushgateway string
+	graphite    string
+	client      *http.Client
+}
+
+type metricGroup struct {
+	// Name of the api key the request was made with, see
+	// ScrapeRequest.owner.
+	owner   string
+	updated time.Time
+	samples []metricSample
+}
+
+func newMetricsExporter(pushgateway string, graphite string, ttl time.Duration) *metricsExporter {
+	return &metricsExporter{
+		groups:      make(map[string]metricGroup),
+		ttl:         ttl,
+		pushgateway: strings.TrimSuffix(pushgateway, "/"),
+		graphite:    graphite,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Records a run's metrics, replacing the samples of the same request's
+// items so results that are gone (ex: a product no longer listed) drop out,
+// and pushes them.
+func (me *metricsExporter) record(req ScrapeRequest, results ScrapeResult) error {
+	byItem := collectMetrics(req, results)
+	if len(byItem) == 0 {
+		return nil
+	}
+	config := configKey(req)
+	var samples []metricSample
+	now := time.Now()
+	me.lock.Lock()
+	me.expire(now)
+	for item, itemSamples := range byItem {
+		me.groups[req.owner+"/"+config+"/"+item] = metricGroup{owner: req.owner, updated: now, samples: itemSamples}
+		samples = append(samples, itemSamples...)
+	}
+	me.lock.Unlock()
+	var errs []string
+	if len(me.pushgateway) > 0 {
+		if err := me.push(config, samples); err != nil {
+			errs = append(errs, "pushgateway: "+err.Error())
+		}
+	}
+	if len(me.graphite) > 0 {
+		if err := me.sendGraphite(samples, now); err != nil {
+			errs = append(errs, "graphite: "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// The latest samples of every request, oldest first so newer ones win
+// where requests share a series.  With scoped, only those of owner's
+// requests.
+func (me *metricsExporter) samples(scoped bool, owner string) []metricSample {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.expire(time.Now())
+	groups := make([]metricGroup, 0, len(me.groups))
+	for _, g := range me.groups {
+		if !scoped || g.owner == owner {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].updated.Before(groups[j].updated) })
+	var samples []metricSample
+	for _, g := range groups {
+		samples = append(samples, g.samples...)
+	}
+	return samples
+}
+
+// Drops groups not updated within ttl, called with the lock held.
+func (me *metricsExporter) expire(now time.Time) {
+	if me.ttl <= 0 {
+		return
+	}
+	for key, g := range me.groups {
+		if now.Sub(g.updated) > me.ttl {
+			delete(me.groups, key)
+		}
+	}
+}
+
+// Replaces the request's group on the Pushgateway.
+func (me *metricsExporter) push(config string, samples []metricSample) error {
+	pushUrl := me.pushgateway + "/metrics/job/gluestick/config/" + url.PathEscape(config)
+	req, err := http.NewRequest(http.MethodPut, pushUrl, bytes.NewReader(writeMetrics(samples)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Sends the samples over Graphite's plaintext protocol, labels as tags.
+func (me *metricsExporter) sendGraphite(samples []metricSample, at time.Time) error {
+	conn, err := net.DialTimeout("tcp", me.graphite, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	clean := strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_", "\t", "_")
+	var b bytes.Buffer
+	for _, s := range samples {
+		b.WriteString(s.name)
+		for _, label := range s.labels {
+			val := clean.Replace(label[1])
+			if len(val) == 0 {
+				continue // graphite tags can't be empty
+			}
+			b.WriteString(";" + label[0] + "=" + val)
+		}
+		fmt.Fprintf(&b, " %s %d\n", strconv.FormatFloat(s.value, 'g', -1, 64), at.Unix())
+	}
+	_, err = conn.Write(b.Bytes())
+	return err
+}
+
+// GET /metrics exposes the latest value of each metric of every scrape and
+// job, in Prometheus text format.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(writeMetrics(s.conf.Metrics.samples(s.ownerScope(r))))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default -out of "gluestick scrape", beside the working directory.
+const defaultConfigsOut = "{{.name}}.out.json"
+
+// A request file of "gluestick scrape", and where its output goes.
+type configRun struct {
+	filename string
+	req      ScrapeRequest
+	out      string
+}
+
+// Runs every request file matching pattern (ex: "configs/*.json"), parallel
+// at a time, writing each's results to the file outPattern names for it (see
+// outputVars).  The runs share opts' transport, so -rate-limit and the
+// domain policy apply to them combined.  Returns the exit code of the worst
+// run, see runStatus.  With a merge policy, results are merged into those
+// already in each's file.
+func runConfigs(pattern string, parallel int, outPattern string, merge mergePolicy, opts scrapeOptions, recorder *runRecorder) (int, error) {
+	if len(pattern) == 0 {
+		return 0, errors.New("-f is required")
+	}
+	if parallel < 1 {
+		return 0, errors.New("-P must be at least 1")
+	}
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	if len(filenames) == 0 {
+		return 0, fmt.Errorf("no files match %q", pattern)
+	}
+	sort.Strings(filenames)
+	if len(outPattern) == 0 {
+		outPattern = defaultConfigsOut
+	}
+	tmpl, err := parseOutTemplate(outPattern)
+	if err != nil {
+		return 0, err
+	}
+
+	var status runStatus
+	var runs []configRun
+	outs := make(map[string]string)
+	started := time.Now()
+	for _, filename := range filenames {
+		req, err := loadConfig(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			status.add(runFailed)
+			continue
+		}
+		out, err := outputPath(tmpl, outputVars(req, filename, started))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", filename, err)
+		}
+		if other, found := outs[out]; found {
+			return 0, fmt.Errorf("%q and %q would both be written to %q, see -out", other, filename, out)
+		}
+		outs[out] = filename
+		runs = append(runs, configRun{filename: filename, req: req, out: out})
+	}
+
+	var wg sync.WaitGroup
+	pending := make(chan configRun)
+	for i := 0; i < parallel && i < len(runs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := range pending {
+				status.add(runConfig(run, merge, opts, recorder))
+			}
+		}()
+	}
+	for _, run := range runs {
+		pending <- run
+	}
+	close(pending)
+	wg.Wait()
+	return status.exitCode(), nil
+}
+
+func loadConfig(filename string) (ScrapeRequest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ScrapeRequest{}, err
+	}
+	req, err := parseRequest(data)
+	if err == nil {
+		err = validate(&req)
+	}
+	if err != nil {
+		return req, fmt.Errorf("invalid scrape request: %s", err)
+	}
+	return req, nil
+}
+
+// Scrapes a single request file, logging how it went.  Returns the run's
+// outcome.
+func runConfig(run configRun, merge mergePolicy, opts scrapeOptions, recorder *runRecorder) int {
+	req := run.req
+	results, err := scrape(req, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: error while scraping: %s\n", run.filename, err)
+		return scrapeOutcome(err)
+	}
+	outcome := runOk
+	anomalies, err := recorder.record(req, results, countResults(results))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: error after scraping: %s\n", run.filename, err)
+		outcome = runFailed
+	}
+	for _, anomaly := range anomalies {
+		fmt.Fprintf(os.Stderr, "%s: ANOMALY: %s\n", run.filename, anomaly)
+		if outcome < runAnomalous {
+			outcome = runAnomalous
+		}
+	}
+	output := results
+	if len(merge.mode) > 0 {
+		existing, err := readOutput(run.out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed to read %q to merge into: %s\n", run.filename, run.out, err)
+			return runFailed
+		}
+		output = merge.merge(existing, results)
+	}
+	if opts.Stable {
+		stableOrder(req, output)
+	}
+	j, err := json.MarshalIndent(output, "", "    ")
+	if err == nil {
+		out := &lazyOutput{path: run.out}
+		if err = writeOutput(out, j); err == nil {
+			err = out.close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to write %q: %s\n", run.filename, run.out, err)
+		return runFailed
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d results written to %s\n", run.filename, totalCount(countResults(results)), run.out)
+	return outcome
+}
+
+func totalCount(counts map[string]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
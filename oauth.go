@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 settings loaded from -oauth2.  With a refresh_token the refresh
+// token grant is used, otherwise client credentials.
+type oauthConfig struct {
+	TokenUrl     string   `json:"token_url"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	// Extra form values for the token request, ex: {"audience": "..."}.
+	Params map[string]string `json:"params,omitempty"`
+	// Send client credentials in the form body instead of basic auth, some
+	// providers require it.
+	CredentialsInBody bool `json:"credentials_in_body,omitempty"`
+	// Hosts the bearer token is sent to.  Required so tokens don't leak to
+	// whatever other sites a scrape touches.
+	Hosts []string `json:"hosts"`
+}
+
+func loadOauthConfig(filename string) (*oauthConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var conf oauthConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, err
+	}
+	if len(conf.TokenUrl) == 0 || len(conf.ClientId) == 0 {
+		return nil, errors.New("token_url and client_id are required")
+	}
+	if len(conf.Hosts) == 0 {
+		return nil, errors.New("hosts is required")
+	}
+	for i, host := range conf.Hosts {
+		conf.Hosts[i] = strings.ToLower(host)
+	}
+	return &conf, nil
+}
+
+// Adds bearer tokens to requests to the configured hosts, fetching and
+// refreshing tokens as needed.
+type oauthTransport struct {
+	base   http.RoundTripper
+	conf   *oauthConfig
+	client *http.Client
+	lock   sync.Mutex
+	token  string
+	// refreshed a little early so tokens don't expire mid request
+	expires time.Time
+}
+
+func withOauth(base http.RoundTripper, conf *oauthConfig) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &oauthTransport{
+		base:   base,
+		conf:   conf,
+		client: &http.Client{Transport: base, Timeout: 30 * time.Second},
+	}
+}
+
+func (ot *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !containsString(ot.conf.Hosts, strings.ToLower(req.URL.Hostname())) {
+		return ot.base.RoundTrip(req)
+	}
+	token, err := ot.currentToken(false)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2: %s", err)
+	}
+	resp, err := ot.base.RoundTrip(withBearer(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.GetBody == nil && req.Body != nil {
+		return resp, err
+	}
+	// token may have been revoked or expired early, get a new one and retry once
+	resp.Body.Close()
+	if token, err = ot.currentToken(true); err != nil {
+		return nil, fmt.Errorf("oauth2: %s", err)
+	}
+	retry := withBearer(req, token)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return ot.base.RoundTrip(retry)
+}
+
+func withBearer(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func (ot *oauthTransport) currentToken(force bool) (string, error) {
+	ot.lock.Lock()
+	defer ot.lock.Unlock()
+	if !force && len(ot.token) > 0 && time.Now().Before(ot.expires) {
+		return ot.token, nil
+	}
+
+	form := url.Values{}
+	if len(ot.conf.RefreshToken) > 0 {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", ot.conf.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(ot.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(ot.conf.Scopes, " "))
+	}
+	for k, v := range ot.conf.Params {
+		form.Set(k, v)
+	}
+	if ot.conf.CredentialsInBody {
+		form.Set("client_id", ot.conf.ClientId)
+		form.Set("client_secret", ot.conf.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, ot.conf.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !ot.conf.CredentialsInBody {
+		req.SetBasicAuth(url.QueryEscape(ot.conf.ClientId), url.QueryEscape(ot.conf.ClientSecret))
+	}
+	resp, err := ot.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+		Description  string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || len(tok.AccessToken) == 0 {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, tok.Error, tok.Description)
+	}
+	ot.token = tok.AccessToken
+	ot.expires = time.Now().Add(time.Hour) // when the endpoint doesn't say
+	if tok.ExpiresIn > 0 {
+		ot.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - 30*time.Second)
+	}
+	if len(tok.RefreshToken) > 0 {
+		// providers that rotate refresh tokens invalidate the old one
+		ot.conf.RefreshToken = tok.RefreshToken
+	}
+	return ot.token, nil
+}
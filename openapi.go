@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A json object in the OpenAPI document.
+type apiObject map[string]interface{}
+
+// Json schemas of the types requests are read into and responses written
+// from, so the document can't drift from them.  Named struct types are
+// shared components, referred to by name.
+type apiSchemas struct {
+	components apiObject
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (as *apiSchemas) of(v interface{}) apiObject {
+	return as.schema(reflect.TypeOf(v))
+}
+
+func (as *apiSchemas) schema(t reflect.Type) apiObject {
+	if t == timeType {
+		return apiObject{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return as.schema(t.Elem())
+	case reflect.Bool:
+		return apiObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return apiObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return apiObject{"type": "number"}
+	case reflect.String:
+		return apiObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return apiObject{"type": "string", "format": "byte"}
+		}
+		return apiObject{"type": "array", "items": as.schema(t.Elem())}
+	case reflect.Map:
+		return apiObject{"type": "object", "additionalProperties": as.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return as.structSchema(t)
+		}
+		if _, found := as.components[t.Name()]; !found {
+			as.components[t.Name()] = apiObject{} // for types referring to themselves
+			as.components[t.Name()] = as.structSchema(t)
+		}
+		return apiObject{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return apiObject{} // interface{}, any value
+}
+
+// Properties as encoding/json writes them: exported fields by their json
+// name, embedded structs' fields inline.
+func (as *apiSchemas) structSchema(t reflect.Type) apiObject {
+	props := apiObject{}
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			name := strings.Split(tag, ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+				add(field.Type)
+				continue
+			}
+			if len(field.PkgPath) > 0 {
+				continue // unexported
+			}
+			if len(name) == 0 {
+				name = field.Name
+			}
+			props[name] = as.schema(field.Type)
+		}
+	}
+	add(t)
+	return apiObject{"type": "object", "properties": props}
+}
+
+// The server's endpoints as an OpenAPI 3 document.  Only endpoints enabled
+// by its flags are listed.
+func (s *server) openApiSpec() apiObject {
+	as := &apiSchemas{components: apiObject{}}
+	as.components["Error"] = apiObject{
+		"type": "object",
+		"properties": apiObject{
+			"error":     apiObject{"type": "string"},
+			"errors":    as.of(ValidationErrors{}),
+			"assertion": apiObject{"type": "string"},
+		},
+	}
+	errorResponse := apiObject{
+		"description": "The request failed, see error",
+		"content":     apiObject{"application/json": apiObject{"schema": apiObject{"$ref": "#/components/schemas/Error"}}},
+	}
+	jsonBody := func(schema apiObject) apiObject {
+		return apiObject{"required": true, "content": apiObject{"application/json": apiObject{"schema": schema}}}
+	}
+	jsonResponse := func(description string, schema apiObject) apiObject {
+		return apiObject{"description": description, "content": apiObject{"application/json": apiObject{"schema": schema}}}
+	}
+	noContent := func(description string) apiObject {
+		return apiObject{"description": description}
+	}
+	param := func(name string, in string, description string, schema apiObject) apiObject {
+		return apiObject{"name": name, "in": in, "description": description, "required": in == "path", "schema": schema}
+	}
+	str, integer := apiObject{"type": "string"}, apiObject{"type": "integer"}
+	jobId := param("id", "path", "The job's id", str)
+	op := func(perm string, summary string, params []apiObject, body apiObject, responses apiObject) apiObject {
+		responses["default"] = errorResponse
+		o := apiObject{"summary": summary, "responses": responses}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if body != nil {
+			o["requestBody"] = body
+		}
+		if s.keysRequired || perm == permAdmin {
+			o["security"] = []apiObject{{"bearer": []string{}}}
+		}
+		return o
+	}
+
+	paths := apiObject{
+		"/scrape": apiObject{"post": op(permSubmit, "Runs a scrape and returns its results",
+			[]apiObject{param("preview", "query", "Reuse pages fetched by recent previews, for live previews", apiObject{"type": "boolean"})},
+			jsonBody(as.of(ScrapeRequest{})),
+			apiObject{"200": jsonResponse("The results, by item name", as.of(ScrapeResult{}))})},
+		"/scrape/stream": apiObject{"post": op(permSubmit, "Runs a scrape, streaming its results as newline delimited json", nil, jsonBody(as.of(ScrapeRequest{})),
+			apiObject{"200": apiObject{"description": "An {\"item\", \"value\"} line per result, then a {\"done\": true} or {\"error\"} line",
+				"content": apiObject{"application/x-ndjson": apiObject{"schema": str}}}})},
+		"/estimate": apiObject{"post": op(permSubmit, "Estimates a scrape's requests and duration without scraping", nil, jsonBody(as.of(ScrapeRequest{})),
+			apiObject{"200": jsonResponse("The estimate", as.of(Estimate{}))})},
+		"/jobs": apiObject{"post": op(permSubmit, "Submits a scrape to run in the background",
+			[]apiObject{
+				param("priority", "query", "Higher priority jobs run first", integer),
+				param("Idempotency-Key", "header", "Resubmitting with the same key returns the original job", str),
+			}, jsonBody(as.of(ScrapeRequest{})),
+			apiObject{
+				"202": jsonResponse("The queued job", as.of(Job{})),
+				"200": jsonResponse("The job already submitted with the Idempotency-Key", as.of(Job{})),
+			})},
+		"/jobs/{id}": apiObject{"get": op(permRead, "Returns a job", []apiObject{jobId}, nil,
+			apiObject{"200": jsonResponse("The job", as.of(Job{}))})},
+		"/jobs/{id}/results": apiObject{"get": op(permRead, "Pages through a finished job's results",
+			[]apiObject{
+				jobId,
+				param("offset", "query", "Results to skip", integer),
+				param("limit", "query", "Results to return", integer),
+				param("item", "query", "Comma separated item names to return results of", str),
+			}, nil,
+			apiObject{"200": jsonResponse("A page of results", as.of(ResultsPage{}))})},
+		"/metrics": apiObject{"get": op(permRead, "The latest value of each metric, in Prometheus text format", nil, nil,
+			apiObject{"200": apiObject{"description": "The metrics", "content": apiObject{"text/plain": apiObject{"schema": str}}}})},
+		"/openapi.json": apiObject{"get": apiObject{"summary": "This document",
+			"responses": apiObject{"200": jsonResponse("The OpenAPI document", apiObject{"type": "object"})}}},
+	}
+	if s.conf.Distributed {
+		worker := param("worker", "query", "Name of the remote worker", str)
+		paths["/work/claim"] = apiObject{"post": op(permWork, "Long polls for the next queued job", []apiObject{worker}, nil,
+			apiObject{
+				"200": jsonResponse("The claimed job", as.of(WorkClaim{})),
+				"204": noContent("No job showed up in time"),
+			})}
+		paths["/work/{id}/result"] = apiObject{"post": op(permWork, "Reports a claimed job's results", []apiObject{jobId}, jsonBody(as.of(WorkResult{})),
+			apiObject{"204": noContent("The results were recorded")})}
+		paths["/work/{id}/heartbeat"] = apiObject{"post": op(permWork, "Renews the lease on a claimed job", []apiObject{jobId, worker}, nil,
+			apiObject{"204": noContent("The lease was renewed")})}
+		paths["/work/{id}/page"] = apiObject{"post": op(permWork, "Sends a page of a claimed job to its webhook", []apiObject{jobId, worker}, jsonBody(as.of(PageMeta{})),
+			apiObject{"204": noContent("The page was passed on")})}
+	}
+	if s.conf.Store != nil {
+		paths["/history"] = apiObject{"get": op(permRead, "Stored runs' values, oldest first",
+			[]apiObject{
+				param("since", "query", "How far back, ex: \"7d\" or \"12h\"", str),
+				param("item", "query", "Only runs with this item, and only its values", str),
+				param("field", "query", "Dotted path of the field of item's results to return", str),
+				param("config", "query", "Only runs of the request with this key", str),
+				param("url", "query", "Only runs of this url", str),
+			}, nil,
+			apiObject{"200": jsonResponse("The runs", as.of([]HistoryPoint{}))})}
+		paths["/grafana"] = apiObject{"get": op(permRead, "Grafana JSON datasource connection test", nil, nil,
+			apiObject{"200": jsonResponse("Ok", apiObject{"type": "object"})})}
+		paths["/grafana/search"] = apiObject{"post": op(permRead, "Lists Grafana targets", nil, jsonBody(apiObject{"type": "object"}),
+			apiObject{"200": jsonResponse("The targets", as.of([]string{}))})}
+		paths["/grafana/query"] = apiObject{"post": op(permRead, "Grafana time series and tables of stored values", nil, jsonBody(as.of(grafanaQueryRequest{})),
+			apiObject{"200": jsonResponse("A series or table per target", apiObject{"type": "array"})})}
+	}
+	if s.conf.Stats != nil {
+		paths["/stats/domains"] = apiObject{"get": op(permRead, "Request stats per target domain",
+			[]apiObject{param("window", "query", "How far back, ex: \"5m\"", str)}, nil,
+			apiObject{"200": jsonResponse("The stats", apiObject{"type": "object"})})}
+	}
+	if len(s.keys) > 0 {
+		paths["/admin/config"] = apiObject{
+			"get": op(permAdmin, "The runtime config in effect", nil, nil,
+				apiObject{"200": jsonResponse("The config", as.of(runtimeConfig{}))}),
+			"patch": op(permAdmin, "Changes some of the runtime config", nil, jsonBody(as.of(runtimeConfig{})),
+				apiObject{"200": jsonResponse("The config", as.of(runtimeConfig{}))}),
+		}
+		paths["/admin/reload"] = apiObject{"post": op(permAdmin, "Re-reads -server-config", nil, nil,
+			apiObject{"200": jsonResponse("The config", as.of(runtimeConfig{}))})}
+	}
+
+	components := apiObject{"schemas": as.components}
+	if len(s.keys) > 0 {
+		components["securitySchemes"] = apiObject{"bearer": apiObject{"type": "http", "scheme": "bearer"}}
+	}
+	return apiObject{
+		"openapi":    "3.0.3",
+		"info":       apiObject{"title": "gluestick", "version": strconv.Itoa(requestVersion)},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// GET /openapi.json, open to all like the UI.
+func (s *server) handleOpenApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	writeJson(w, http.StatusOK, s.openApiSpec())
+}
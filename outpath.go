@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest a templated part of an -out path can be, in bytes.
+const maxPathPart = 128
+
+var (
+	// Not allowed in file names on Windows or Unix, or invisible.
+	unsafePathChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f\x7f]+`)
+	// Device names Windows won't create files with, even with an extension.
+	reservedPathNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\..*)?$`)
+)
+
+// Parses an -out path template, ex: "out/{{.domain}}/{{.date}}.json".
+func parseOutTemplate(pattern string) (*template.Template, error) {
+	tmpl, err := template.New("out").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -out: %v", err)
+	}
+	return tmpl, nil
+}
+
+// Values -out templates can use for a run of req from the request file
+// named filename (empty for -in), each safe as part of a file name:
+//
+//   - name: the request file's name without extension
+//   - domain: the host of the request's url, without port
+//   - path: the url's path with slashes as underscores, "index" for "/"
+//   - config: the request's key, see configKey
+//   - date: the day the run started, ex: "2024-05-01"
+//   - time: the time of day it started, ex: "060012"
+//
+// name, domain and path are left out if there's no request file or url, so
+// templates using them fail rather than write to an unexpected path.
+func outputVars(req ScrapeRequest, filename string, started time.Time) map[string]string {
+	vars := map[string]string{
+		"config": configKey(req),
+		"date":   started.Format("2006-01-02"),
+		"time":   started.Format("150405"),
+	}
+	if len(filename) > 0 {
+		vars["name"] = sanitizePathPart(strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)))
+	}
+	if u, err := url.Parse(req.Url); err == nil && len(u.Hostname()) > 0 {
+		vars["domain"] = sanitizePathPart(strings.ToLower(u.Hostname()))
+		path := strings.Trim(u.Path, "/")
+		if len(path) == 0 {
+			path = "index"
+		}
+		vars["path"] = sanitizePathPart(strings.Replace(path, "/", "_", -1))
+	}
+	return vars
+}
+
+// Makes part safe as a file or directory name on both Windows and Unix:
+// separators and other characters either doesn't allow are replaced, as
+// are "." and "..", Windows device names are prefixed and it's cut short
+// if long.
+func sanitizePathPart(part string) string {
+	part = unsafePathChars.ReplaceAllString(part, "_")
+	// Windows drops trailing dots and spaces
+	part = strings.TrimRight(part, ". ")
+	if len(part) > maxPathPart {
+		part = part[:maxPathPart]
+		for !utf8.ValidString(part) {
+			part = part[:len(part)-1]
+		}
+	}
+	if len(part) == 0 || part == "." || part == ".." {
+		return "_"
+	}
+	if reservedPathNames.MatchString(part) {
+		return "_" + part
+	}
+	return part
+}
+
+// The path tmpl makes of vars, cleaned.
+func outputPath(tmpl *template.Template, vars map[string]string) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("invalid -out: %v", err)
+	}
+	if len(strings.TrimSpace(b.String())) == 0 {
+		return "", fmt.Errorf("invalid -out: %q makes an empty path", tmpl.Root.String())
+	}
+	return filepath.Clean(b.String()), nil
+}
+
+// An -out file written to a temporary file next to it, created on the first
+// write, which replaces it on close.  A run that fails before then (ex: part
+// way through writing spilled results) leaves the file from the last run in
+// place, which for -merge is everything merged so far.
+type lazyOutput struct {
+	path string
+	tmp  *os.File
+}
+
+func (lo *lazyOutput) Write(p []byte) (int, error) {
+	if lo.tmp == nil {
+		if dir := filepath.Dir(lo.path); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return 0, err
+			}
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(lo.path), ".out-")
+		if err != nil {
+			return 0, err
+		}
+		// as os.Create would have made it, rather than private to the user
+		if err := tmp.Chmod(0644); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return 0, err
+		}
+		lo.tmp = tmp
+	}
+	n, err := lo.tmp.Write(p)
+	if err != nil {
+		lo.discard()
+	}
+	return n, err
+}
+
+// Replaces the file at path with what was written, if anything was.
+func (lo *lazyOutput) close() error {
+	if lo.tmp == nil {
+		return nil
+	}
+	tmp := lo.tmp
+	lo.tmp = nil
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), lo.path)
+}
+
+// Throws away what was written, leaving the file at path as it was.
+func (lo *lazyOutput) discard() {
+	if lo.tmp != nil {
+		lo.tmp.Close()
+		os.Remove(lo.tmp.Name())
+		lo.tmp = nil
+	}
+}
+
+// Writes json output followed by a newline, as it's printed to stdout.
+func writeOutput(w io.Writer, j []byte) error {
+	_, err := w.Write(append(j, '\n'))
+	return err
+}
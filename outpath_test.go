@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizePathPart(t *testing.T) {
+	for _, test := range []struct {
+		part string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "_"},
+		{"...", "_"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{`a\b/c`, "a_b_c"},
+		{`a<b>c:d"e|f?g*h`, "a_b_c_d_e_f_g_h"},
+		{"tab\there\nnewline", "tab_here_newline"},
+		{"trailing. ", "trailing"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"Lpt1", "_Lpt1"},
+		{"console", "console"},
+		{"größe", "größe"},
+		{strings.Repeat("a", 200), strings.Repeat("a", maxPathPart)},
+		// cut short on a rune boundary
+		{strings.Repeat("a", maxPathPart-1) + "é", strings.Repeat("a", maxPathPart-1)},
+	} {
+		if got := sanitizePathPart(test.part); got != test.want {
+			t.Errorf("sanitizePathPart(%q) = %q, expected %q", test.part, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Shaping of item results after extraction: ordering, renaming, etc.
+
+// Orders each item's results by its sort_by fields.  A "-" prefix sorts that
+// field descending.  Results missing a field sort after those that have it.
+func sortItems(req ScrapeRequest, results ScrapeResult) {
+	for name, item := range req.Items {
+		if len(item.SortBy) == 0 {
+			continue
+		}
+		list, ok := results[name].([]interface{})
+		if !ok {
+			continue // single or no results
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return compareSortBy(list[i], list[j], item.SortBy) < 0
+		})
+	}
+}
+
+// Compares two results by sort_by fields, 0 if they're equal in all of them.
+func compareSortBy(aVal, bVal interface{}, sortBy []string) int {
+	a, _ := aVal.(map[string]interface{})
+	b, _ := bVal.(map[string]interface{})
+	for _, key := range sortBy {
+		desc := strings.HasPrefix(key, "-")
+		field := strings.TrimPrefix(key, "-")
+		cmp, missing := compareFields(a, b, field)
+		if cmp == 0 {
+			continue
+		}
+		if desc && !missing {
+			cmp = -cmp
+		}
+		return cmp
+	}
+	return 0
+}
+
+// Orders each item's results, and the lists in _meta, the same way every
+// run for -stable, so runs that scraped the same content print the same even
+// if pages were fetched in another order (ex: crawls).  Results are ordered
+// by the item's sort_by if it has one, then by their json; _meta's lists by
+// url.  Object keys are always sorted in the output.
+func stableOrder(req ScrapeRequest, results ScrapeResult) {
+	for name, val := range results {
+		if meta, ok := val.(*ScrapeMeta); ok {
+			stableMeta(meta)
+			continue
+		}
+		list, ok := val.([]interface{})
+		if !ok {
+			continue
+		}
+		sortBy := req.Items[name].SortBy
+		keys := make([]string, len(list))
+		for i, result := range list {
+			j, _ := json.Marshal(result)
+			keys[i] = string(j)
+		}
+		// sort indexes so each result's json is only marshalled once
+		order := make([]int, len(list))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			if cmp := compareSortBy(list[order[i]], list[order[j]], sortBy); cmp != 0 {
+				return cmp < 0
+			}
+			return keys[order[i]] < keys[order[j]]
+		})
+		sorted := make([]interface{}, len(list))
+		for i, idx := range order {
+			sorted[i] = list[idx]
+		}
+		results[name] = sorted
+	}
+}
+
+func stableMeta(meta *ScrapeMeta) {
+	sort.SliceStable(meta.Pages, func(i, j int) bool { return meta.Pages[i].Url < meta.Pages[j].Url })
+	sort.SliceStable(meta.Skipped, func(i, j int) bool { return meta.Skipped[i].Url < meta.Skipped[j].Url })
+	sort.SliceStable(meta.Sitemap, func(i, j int) bool { return meta.Sitemap[i].Url < meta.Sitemap[j].Url })
+	sort.SliceStable(meta.Apis, func(i, j int) bool { return meta.Apis[i].Url < meta.Apis[j].Url })
+	sort.SliceStable(meta.BrokenLinks, func(i, j int) bool { return meta.BrokenLinks[i].Url < meta.BrokenLinks[j].Url })
+	for _, link := range meta.BrokenLinks {
+		sort.Strings(link.Sources)
+	}
+}
+
+// Compares a field of two results, numerically when both are numbers (see
+// strictNumber) and as strings when neither is, with numbers before strings
+// so that sorts are consistent whatever mix of values there is.  The second
+// return is true if either side was missing the field, in which case
+// the missing one always sorts last.
+func compareFields(a, b map[string]interface{}, field string) (int, bool) {
+	aVal, aFound := sortValue(a, field)
+	bVal, bFound := sortValue(b, field)
+	switch {
+	case !aFound && !bFound:
+		return 0, true
+	case !aFound:
+		return 1, true
+	case !bFound:
+		return -1, true
+	}
+	aNum, aIsNum := strictNumber(aVal)
+	bNum, bIsNum := strictNumber(bVal)
+	switch {
+	case aIsNum && bIsNum:
+		return compareFloats(aNum, bNum), false
+	case aIsNum:
+		return -1, false
+	case bIsNum:
+		return 1, false
+	}
+	aStr, _ := whereString(aVal)
+	bStr, _ := whereString(bVal)
+	return strings.Compare(aStr, bStr), false
+}
+
+// A multi valued field sorts by its first value.
+func sortValue(result map[string]interface{}, field string) (interface{}, bool) {
+	if result == nil {
+		return nil, false
+	}
+	val, found := fieldByPath(result, field)
+	if values := valuesOf(val); found && len(values) > 0 {
+		return values[0], true
+	}
+	return nil, false
+}
+
+// OutputMapping reshapes an item's results for flat sinks like csv or
+// database tables, without changing how they are extracted.
+type OutputMapping struct {
+	// Field path -> new path, ex: {"image.src": "image_url"}.  Applied before
+	// flattening.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Nested fields become top level keys joined by Separator (default ".").
+	// Lists of nested fields are keyed by index, ex: "images.0.src".
+	Flatten   bool   `json:"flatten,omitempty"`
+	Separator string `json:"separator,omitempty"`
+}
+
+func mapOutputs(req ScrapeRequest, results ScrapeResult) {
+	for name, item := range req.Items {
+		if item.Output == nil {
+			continue
+		}
+		val, found := results[name]
+		if !found {
+			continue
+		}
+		mapped := valuesOf(val)
+		for i, result := range mapped {
+			m, ok := plainValue(result).(map[string]interface{})
+			if !ok {
+				continue
+			}
+			mapped[i] = item.Output.apply(m)
+		}
+		if len(mapped) == 1 {
+			results[name] = mapped[0]
+		} else {
+			results[name] = mapped
+		}
+	}
+}
+
+func (o *OutputMapping) apply(result map[string]interface{}) map[string]interface{} {
+	// sorted so overlapping renames apply in a stable order
+	from := make([]string, 0, len(o.Rename))
+	for f := range o.Rename {
+		from = append(from, f)
+	}
+	sort.Strings(from)
+	moved := make(map[string]interface{})
+	for _, f := range from {
+		if val, found := removeByPath(result, f); found {
+			moved[o.Rename[f]] = val
+		}
+	}
+	for to, val := range moved {
+		setByPath(result, to, val)
+	}
+	if !o.Flatten {
+		return result
+	}
+	sep := o.Separator
+	if len(sep) == 0 {
+		sep = "."
+	}
+	flat := make(map[string]interface{})
+	flattenInto(flat, "", sep, result)
+	return flat
+}
+
+func flattenInto(flat map[string]interface{}, prefix string, sep string, val interface{}) {
+	join := func(key string) string {
+		if len(prefix) == 0 {
+			return key
+		}
+		return prefix + sep + key
+	}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			flattenInto(flat, join(k), sep, child)
+		}
+	case []interface{}:
+		// lists of plain values stay lists, lists of objects are indexed
+		nested := false
+		for _, child := range v {
+			if _, ok := child.(map[string]interface{}); ok {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			flat[prefix] = v
+			return
+		}
+		for i, child := range v {
+			flattenInto(flat, join(strconv.Itoa(i)), sep, child)
+		}
+	default:
+		flat[prefix] = v
+	}
+}
+
+func removeByPath(result map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	parent, ok := fieldByPath(result, strings.Join(parts[:len(parts)-1], "."))
+	if len(parts) == 1 {
+		parent, ok = result, true
+	}
+	m, isMap := parent.(map[string]interface{})
+	if !ok || !isMap {
+		return nil, false
+	}
+	val, found := m[parts[len(parts)-1]]
+	delete(m, parts[len(parts)-1])
+	return val, found
+}
+
+func setByPath(result map[string]interface{}, path string, val interface{}) {
+	parts := strings.Split(path, ".")
+	cur := result
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := cur[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			cur[part] = next
+		}
+		cur = next
+	}
+	cur[parts[len(parts)-1]] = val
+}
+
+// Converts typed values (downloaded assets, pdf text, etc) to the plain maps
+// and slices they'd be as json.
+func plainValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case string, nil:
+		return val
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = plainValue(v[k])
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = plainValue(v[i])
+		}
+		return v
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	var plain interface{}
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return val
+	}
+	return plain
+}
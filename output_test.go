@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCompareFields(t *testing.T) {
+	tests := []struct {
+		a, b    interface{}
+		want    int
+		missing bool
+	}{
+		{"$1,299.00", "999", 1, false},
+		{float64(2), "10", -1, false},
+		{"Model 3", "Version 3", -1, false},
+		{"SKU-100", "A-200", 1, false},
+		{"10", "5x", -1, false},
+		{"5x", "10", 1, false},
+		{"b", "b", 0, false},
+		{nil, "a", 1, true},
+		{"a", nil, -1, true},
+	}
+	for _, test := range tests {
+		a, b := map[string]interface{}{}, map[string]interface{}{}
+		if test.a != nil {
+			a["f"] = test.a
+		}
+		if test.b != nil {
+			b["f"] = test.b
+		}
+		got, missing := compareFields(a, b, "f")
+		if got != test.want || missing != test.missing {
+			t.Errorf("compareFields(%#v, %#v) = %d, %v, want %d, %v", test.a, test.b, got, missing, test.want, test.missing)
+		}
+	}
+}
+
+// Sorting mixed values must be consistent: with "10" > "9" numerically but
+// "10" < "5x" as strings, comparing each pair its own way isn't transitive.
+func TestCompareFieldsTransitive(t *testing.T) {
+	vals := []interface{}{"10", "9", "5x", "$3", "Model 3", float64(7), "apple", "-2"}
+	for _, a := range vals {
+		for _, b := range vals {
+			for _, c := range vals {
+				ab, _ := compareFields(map[string]interface{}{"f": a}, map[string]interface{}{"f": b}, "f")
+				bc, _ := compareFields(map[string]interface{}{"f": b}, map[string]interface{}{"f": c}, "f")
+				ac, _ := compareFields(map[string]interface{}{"f": a}, map[string]interface{}{"f": c}, "f")
+				if ab <= 0 && bc <= 0 && ac > 0 {
+					t.Errorf("%#v <= %#v <= %#v but %#v > %#v", a, b, c, a, c)
+				}
+			}
+		}
+	}
+	sort.Slice(vals, func(i, j int) bool {
+		cmp, _ := compareFields(map[string]interface{}{"f": vals[i]}, map[string]interface{}{"f": vals[j]}, "f")
+		return cmp < 0
+	})
+	want := []interface{}{"-2", "$3", float64(7), "9", "10", "5x", "Model 3", "apple"}
+	for i := range want {
+		if vals[i] != want[i] {
+			t.Fatalf("sorted %v, want %v", vals, want)
+		}
+	}
+}
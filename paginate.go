@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// Most urls a paginated request may enumerate.
+const maxPaginatedUrls = 10000
+
+// PageParam enumerates paginated urls by setting a query parameter on the
+// request's url, ex: {"name": "page", "start": 1, "end": 50} for ?page=1
+// through ?page=50.
+type PageParam struct {
+	Name string `json:"name"`
+	// Defaults to 1.
+	Start *int `json:"start,omitempty"`
+	End   int  `json:"end"`
+	// Defaults to 1, ex: 20 for offset based pagination.
+	Step int `json:"step,omitempty"`
+}
+
+// "{1..50}" or with a step "{0..980..20}" in a request's url.
+var pageRange = regexp.MustCompile(`\{(-?\d+)\.\.(-?\d+)(?:\.\.(\d+))?\}`)
+
+// The urls a request scrapes in order: just its url, or every page of a
+// page_param or "{start..end}" template.
+func pageUrls(req ScrapeRequest) ([]string, error) {
+	ranges := pageRange.FindAllStringSubmatchIndex(req.Url, -1)
+	if len(ranges) > 1 {
+		return nil, errors.New("request.url can only have one {start..end} range")
+	}
+	if len(ranges) == 1 && req.PageParam != nil {
+		return nil, errors.New("request.url can't have a {start..end} range as well as page_param")
+	}
+
+	var start, end, step int
+	var pageUrl func(n int) string
+	switch {
+	case req.PageParam != nil:
+		p := req.PageParam
+		if len(p.Name) == 0 {
+			return nil, errors.New("request.page_param.name was empty")
+		}
+		start, end, step = 1, p.End, p.Step
+		if p.Start != nil {
+			start = *p.Start
+		}
+		base, err := url.Parse(req.Url)
+		if err != nil {
+			return nil, err
+		}
+		pageUrl = func(n int) string {
+			u := *base
+			query := u.Query()
+			query.Set(p.Name, strconv.Itoa(n))
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	case len(ranges) == 1:
+		m := ranges[0]
+		start, _ = strconv.Atoi(req.Url[m[2]:m[3]])
+		end, _ = strconv.Atoi(req.Url[m[4]:m[5]])
+		if m[6] != -1 {
+			step, _ = strconv.Atoi(req.Url[m[6]:m[7]])
+		}
+		prefix, suffix := req.Url[:m[0]], req.Url[m[1]:]
+		pageUrl = func(n int) string {
+			return prefix + strconv.Itoa(n) + suffix
+		}
+	default:
+		return []string{req.Url}, nil
+	}
+
+	if step == 0 {
+		step = 1
+	}
+	if step < 0 || end < start {
+		return nil, fmt.Errorf("invalid page range %d to %d step %d", start, end, step)
+	}
+	if (end-start)/step+1 > maxPaginatedUrls {
+		return nil, fmt.Errorf("page range is over the max of %d pages", maxPaginatedUrls)
+	}
+	var urls []string
+	for n := start; n <= end; n += step {
+		urls = append(urls, pageUrl(n))
+	}
+	return urls, nil
+}
@@ -0,0 +1,870 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// Best effort pdf text extraction: handles the common cases of flate
+// compressed content streams, object streams and ToUnicode font maps, which
+// covers most generated reports and notices.  Encrypted pdfs are not
+// supported.
+
+const itemTypePdf = "pdf"
+
+// PdfText replaces each value of a "pdf" item, or is the value of a pdf item
+// without a selector when the scraped url itself is a pdf.
+type PdfText struct {
+	Url   string   `json:"url"`
+	Text  string   `json:"text,omitempty"`
+	Pages []string `json:"pages,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+func isPdf(contentType string, body []byte) bool {
+	return strings.HasPrefix(contentType, "application/pdf") || bytes.HasPrefix(body, []byte("%PDF-"))
+}
+
+// Streams are cut off once inflated past maxStreamBytes, 0 for no limit.
+func extractPdf(url string, body []byte, perPage bool, maxStreamBytes int) *PdfText {
+	result := &PdfText{Url: url}
+	pages, err := pdfPageTexts(body, maxStreamBytes)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Text = strings.TrimSpace(strings.Join(pages, "\n\n"))
+	if perPage {
+		result.Pages = pages
+	}
+	return result
+}
+
+// Fetches every url extracted by pdf items, replacing the values in results
+// with their PdfText.
+func (d *downloader) extractPdfItems(req ScrapeRequest, results ScrapeResult) {
+	// url -> whether per page text is wanted for it
+	urls := make(map[string]bool)
+	for name, item := range req.Items {
+		if item.Type != itemTypePdf || len(item.Selector) == 0 {
+			continue
+		}
+		mapFieldLeaves(results[name], func(url string) interface{} {
+			if len(url) > 0 {
+				urls[url] = urls[url] || item.PdfPages
+			}
+			return url
+		})
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	texts := make(map[string]*PdfText)
+	var lock sync.Mutex
+	d.forEach(urls, func(url string, perPage bool) {
+		var text *PdfText
+		if body, contentType, err := d.fetch(url); err != nil {
+			text = &PdfText{Url: url, Error: err.Error()}
+		} else if !isPdf(contentType, body) {
+			text = &PdfText{Url: url, Error: fmt.Sprintf("not a pdf: %q", contentType)}
+		} else {
+			text = extractPdf(url, body, perPage, d.maxPageBytes)
+		}
+		lock.Lock()
+		texts[url] = text
+		lock.Unlock()
+	})
+
+	for name, item := range req.Items {
+		if item.Type != itemTypePdf || len(item.Selector) == 0 {
+			continue
+		}
+		if val, found := results[name]; found {
+			results[name] = mapFieldLeaves(val, func(url string) interface{} {
+				if text, found := texts[url]; found {
+					return text
+				}
+				return url
+			})
+		}
+	}
+}
+
+type pdfName string
+type pdfKeyword string
+type pdfRef int
+type pdfDict map[string]interface{}
+
+type pdfObject struct {
+	value  interface{}
+	stream []byte // raw (still encoded) stream data, if any
+}
+
+type pdfDoc struct {
+	objs map[int]*pdfObject
+	// Largest a stream can inflate to, 0 for no limit.
+	maxStreamBytes int
+}
+
+var pdfObjStart = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+
+func parsePdf(data []byte, maxStreamBytes int) (*pdfDoc, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF-")) {
+		return nil, errors.New("not a pdf")
+	}
+	doc := &pdfDoc{objs: make(map[int]*pdfObject), maxStreamBytes: maxStreamBytes}
+	for _, loc := range pdfObjStart.FindAllSubmatchIndex(data, -1) {
+		num, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		lex := &pdfLexer{data: data, pos: loc[1]}
+		val, err := lex.object()
+		if err != nil {
+			continue
+		}
+		obj := &pdfObject{value: val}
+		if dict, ok := val.(pdfDict); ok {
+			obj.stream = lex.streamData(dict)
+		}
+		// later definitions (incremental updates) win
+		doc.objs[num] = obj
+	}
+	if len(doc.objs) == 0 {
+		return nil, errors.New("no objects found in pdf")
+	}
+	for _, obj := range doc.objects() {
+		if dict, ok := obj.value.(pdfDict); ok && dict["Type"] == pdfName("Encrypt") {
+			return nil, errors.New("encrypted pdfs are not supported")
+		}
+	}
+	doc.expandObjectStreams()
+	return doc, nil
+}
+
+func (d *pdfDoc) objects() []*pdfObject {
+	objs := make([]*pdfObject, 0, len(d.objs))
+	for _, obj := range d.objs {
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+// Objects in pdf 1.5+ files are often packed inside compressed object streams.
+func (d *pdfDoc) expandObjectStreams() {
+	for _, obj := range d.objects() {
+		dict, ok := obj.value.(pdfDict)
+		if !ok || dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		data, err := d.decodeStream(obj)
+		if err != nil {
+			continue
+		}
+		n, _ := d.resolve(dict["N"]).(int)
+		first, _ := d.resolve(dict["First"]).(int)
+		header := &pdfLexer{data: data}
+		for i := 0; i < n; i++ {
+			num, err1 := header.object()
+			offset, err2 := header.object()
+			numInt, ok1 := num.(int)
+			offsetInt, ok2 := offset.(int)
+			if err1 != nil || err2 != nil || !ok1 || !ok2 {
+				break
+			}
+			if _, exists := d.objs[numInt]; exists {
+				continue
+			}
+			lex := &pdfLexer{data: data, pos: first + offsetInt}
+			if val, err := lex.object(); err == nil {
+				d.objs[numInt] = &pdfObject{value: val}
+			}
+		}
+	}
+}
+
+func (d *pdfDoc) resolve(val interface{}) interface{} {
+	for i := 0; i < 32; i++ { // guard against reference loops
+		ref, ok := val.(pdfRef)
+		if !ok {
+			return val
+		}
+		obj, found := d.objs[int(ref)]
+		if !found {
+			return nil
+		}
+		val = obj.value
+	}
+	return nil
+}
+
+func (d *pdfDoc) dict(val interface{}) pdfDict {
+	dict, _ := d.resolve(val).(pdfDict)
+	return dict
+}
+
+func (d *pdfDoc) array(val interface{}) []interface{} {
+	arr, _ := d.resolve(val).([]interface{})
+	return arr
+}
+
+func (d *pdfDoc) decodeStream(obj *pdfObject) ([]byte, error) {
+	dict, _ := obj.value.(pdfDict)
+	var filters []interface{}
+	switch f := d.resolve(dict["Filter"]).(type) {
+	case pdfName:
+		filters = []interface{}{f}
+	case []interface{}:
+		filters = f
+	}
+	data := obj.stream
+	for _, f := range filters {
+		switch d.resolve(f) {
+		case pdfName("FlateDecode"):
+			r, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			var src io.Reader = r
+			if d.maxStreamBytes > 0 {
+				// one byte past the limit to tell "exactly at limit" from "over limit"
+				src = io.LimitReader(r, int64(d.maxStreamBytes)+1)
+			}
+			// truncated streams are common, keep whatever was inflated
+			inflated, err := ioutil.ReadAll(src)
+			if err != nil && len(inflated) == 0 {
+				return nil, err
+			}
+			if d.maxStreamBytes > 0 && len(inflated) > d.maxStreamBytes {
+				return nil, fmt.Errorf("stream inflates to over %d bytes, see -max-page-bytes", d.maxStreamBytes)
+			}
+			data = inflated
+		default:
+			return nil, fmt.Errorf("unsupported stream filter: %v", f)
+		}
+	}
+	return data, nil
+}
+
+func (d *pdfDoc) streamOf(val interface{}) ([]byte, error) {
+	if ref, ok := val.(pdfRef); ok {
+		if obj, found := d.objs[int(ref)]; found && obj.stream != nil {
+			return d.decodeStream(obj)
+		}
+	}
+	return nil, errors.New("not a stream")
+}
+
+// Pages in document order, each with its (possibly inherited) resources.
+func (d *pdfDoc) pages() []pdfDict {
+	var root pdfDict
+	for _, obj := range d.objs {
+		if dict, ok := obj.value.(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+			root = d.dict(dict["Pages"])
+			break
+		}
+	}
+	var pages []pdfDict
+	var walk func(node pdfDict, resources interface{}, depth int)
+	walk = func(node pdfDict, resources interface{}, depth int) {
+		if node == nil || depth > 64 {
+			return
+		}
+		if res, found := node["Resources"]; found {
+			resources = res
+		}
+		if node["Type"] == pdfName("Page") || node["Kids"] == nil {
+			page := pdfDict{}
+			for k, v := range node {
+				page[k] = v
+			}
+			page["Resources"] = resources
+			pages = append(pages, page)
+			return
+		}
+		for _, kid := range d.array(node["Kids"]) {
+			walk(d.dict(kid), resources, depth+1)
+		}
+	}
+	walk(root, nil, 0)
+	return pages
+}
+
+func pdfPageTexts(data []byte, maxStreamBytes int) ([]string, error) {
+	doc, err := parsePdf(data, maxStreamBytes)
+	if err != nil {
+		return nil, err
+	}
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil, errors.New("no pages found in pdf")
+	}
+	texts := make([]string, 0, len(pages))
+	for _, page := range pages {
+		var content []byte
+		contents := page["Contents"]
+		if arr := doc.array(contents); arr != nil {
+			for _, c := range arr {
+				if data, err := doc.streamOf(c); err == nil {
+					content = append(content, data...)
+					content = append(content, '\n')
+				}
+			}
+		} else if data, err := doc.streamOf(contents); err == nil {
+			content = data
+		}
+		fonts := doc.pageFonts(page)
+		texts = append(texts, strings.TrimSpace(contentText(content, fonts)))
+	}
+	return texts, nil
+}
+
+// Maps a page's font resource names to their ToUnicode cmaps, if any.
+func (d *pdfDoc) pageFonts(page pdfDict) map[string]*pdfCmap {
+	fonts := make(map[string]*pdfCmap)
+	resources := d.dict(page["Resources"])
+	for name, fontRef := range d.dict(resources["Font"]) {
+		font := d.dict(fontRef)
+		if font == nil {
+			continue
+		}
+		if data, err := d.streamOf(font["ToUnicode"]); err == nil {
+			fonts[name] = parseCmap(data)
+		} else if font["Subtype"] == pdfName("Type0") {
+			// composite font without a map: assume 2 byte codes that are unicode
+			fonts[name] = &pdfCmap{codeLen: 2, chars: map[int]string{}}
+		}
+	}
+	return fonts
+}
+
+// pdfCmap maps character codes to unicode text, from a ToUnicode stream.
+type pdfCmap struct {
+	codeLen int
+	chars   map[int]string
+}
+
+func parseCmap(data []byte) *pdfCmap {
+	cmap := &pdfCmap{codeLen: 1, chars: make(map[int]string)}
+	lex := &pdfLexer{data: data}
+	var operands []interface{}
+	for {
+		tok, err := lex.object()
+		if err != nil {
+			break
+		}
+		kw, isKeyword := tok.(pdfKeyword)
+		if !isKeyword {
+			operands = append(operands, tok)
+			continue
+		}
+		switch kw {
+		case "endcodespacerange":
+			if len(operands) > 0 {
+				if lo, ok := operands[0].(string); ok && len(lo) > 0 {
+					cmap.codeLen = len(lo)
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(string)
+				dst, ok2 := operands[i+1].(string)
+				if ok1 && ok2 {
+					cmap.chars[bytesToInt(src)] = utf16BE(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(string)
+				hi, ok2 := operands[i+1].(string)
+				if !ok1 || !ok2 {
+					continue
+				}
+				loCode, hiCode := bytesToInt(lo), bytesToInt(hi)
+				if hiCode-loCode > 0xffff {
+					continue
+				}
+				switch dst := operands[i+2].(type) {
+				case string:
+					base := []rune(utf16BE(dst))
+					if len(base) == 0 {
+						continue
+					}
+					for code := loCode; code <= hiCode; code++ {
+						r := append([]rune{}, base...)
+						r[len(r)-1] += rune(code - loCode)
+						cmap.chars[code] = string(r)
+					}
+				case []interface{}:
+					for j, d := range dst {
+						if s, ok := d.(string); ok && loCode+j <= hiCode {
+							cmap.chars[loCode+j] = utf16BE(s)
+						}
+					}
+				}
+			}
+		}
+		if strings.HasPrefix(string(kw), "end") || strings.HasPrefix(string(kw), "begin") {
+			operands = operands[:0]
+		}
+	}
+	return cmap
+}
+
+func (c *pdfCmap) decode(s string) string {
+	var out strings.Builder
+	for i := 0; i+c.codeLen <= len(s); i += c.codeLen {
+		code := bytesToInt(s[i : i+c.codeLen])
+		if text, found := c.chars[code]; found {
+			out.WriteString(text)
+		} else if c.codeLen == 2 {
+			out.WriteRune(rune(code))
+		} else {
+			out.WriteRune(rune(s[i]))
+		}
+	}
+	return out.String()
+}
+
+func bytesToInt(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		n = n<<8 | int(s[i])
+	}
+	return n
+}
+
+func utf16BE(s string) string {
+	if len(s)%2 != 0 {
+		return s
+	}
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+// Interprets a page content stream, keeping just the text showing operators
+// and using text positioning to decide where line breaks go.
+func contentText(content []byte, fonts map[string]*pdfCmap) string {
+	var out strings.Builder
+	var operands []interface{}
+	var cmap *pdfCmap
+	lastY := 0.0
+	show := func(val interface{}) {
+		s, ok := val.(string)
+		if !ok {
+			return
+		}
+		if cmap != nil {
+			out.WriteString(cmap.decode(s))
+			return
+		}
+		for i := 0; i < len(s); i++ { // treat as latin-1
+			out.WriteRune(rune(s[i]))
+		}
+	}
+	newline := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte('\n')
+		}
+	}
+
+	lex := &pdfLexer{data: content}
+	for {
+		tok, err := lex.object()
+		if err != nil {
+			break
+		}
+		op, isOp := tok.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, tok)
+			continue
+		}
+		switch op {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[0].(pdfName); ok {
+					cmap = fonts[string(name)]
+				}
+			}
+		case "Tj":
+			if len(operands) > 0 {
+				show(operands[len(operands)-1])
+			}
+		case "'", "\"":
+			newline()
+			if len(operands) > 0 {
+				show(operands[len(operands)-1])
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				arr, _ := operands[len(operands)-1].([]interface{})
+				for _, el := range arr {
+					// large negative adjustments are word gaps
+					if n, isNum := pdfNumber(el); isNum && n < -200 {
+						out.WriteByte(' ')
+					} else {
+						show(el)
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if ty, _ := pdfNumber(operands[len(operands)-1]); ty != 0 {
+					newline()
+				} else {
+					out.WriteByte(' ')
+				}
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				y, _ := pdfNumber(operands[5])
+				if y != lastY {
+					newline()
+				}
+				lastY = y
+			}
+		case "T*":
+			newline()
+		case "ET":
+			out.WriteByte(' ')
+		case "ID":
+			lex.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+	// collapse runs of spaces left by positioning operators
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func pdfNumber(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+	// Arrays and dictionaries the lexer is within.
+	depth int
+}
+
+// Deepest arrays and dictionaries can be nested, real pdfs don't come close.
+const maxPdfNesting = 64
+
+var errPdfNesting = errors.New("pdf objects nested too deeply")
+
+func isPdfSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPdfDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPdfSpace(c) {
+			l.pos++
+		} else if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else {
+			return
+		}
+	}
+}
+
+var errPdfEnd = errors.New("end of pdf data")
+
+// Parses the next object.  Bare words (operators, obj/endobj, etc) are
+// returned as pdfKeyword.  Strings are returned as raw bytes in a string.
+func (l *pdfLexer) object() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errPdfEnd
+	}
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return pdfName(l.regular(true)), nil
+	case c == '(':
+		return l.literalString(), nil
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		if l.depth >= maxPdfNesting {
+			return nil, errPdfNesting
+		}
+		l.pos += 2
+		l.depth++
+		defer func() { l.depth-- }()
+		return l.dictionary()
+	case c == '<':
+		return l.hexString(), nil
+	case c == '[':
+		if l.depth >= maxPdfNesting {
+			return nil, errPdfNesting
+		}
+		l.pos++
+		l.depth++
+		defer func() { l.depth-- }()
+		var arr []interface{}
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.data) {
+				return arr, errPdfEnd
+			}
+			if l.data[l.pos] == ']' {
+				l.pos++
+				return arr, nil
+			}
+			val, err := l.object()
+			if err != nil {
+				return arr, err
+			}
+			arr = append(arr, val)
+		}
+	case c == ']' || c == '>' || c == ')' || c == '{' || c == '}':
+		l.pos++
+		return pdfKeyword(string(c)), nil
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.number(), nil
+	}
+	word := l.regular(false)
+	if len(word) == 0 {
+		l.pos++ // unexpected byte, skip it
+		return pdfKeyword(string(c)), nil
+	}
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+func (l *pdfLexer) regular(isName bool) string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPdfSpace(l.data[l.pos]) && !isPdfDelim(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	if isName && strings.Contains(word, "#") {
+		// #xx hex escapes in names
+		var b strings.Builder
+		for i := 0; i < len(word); i++ {
+			if word[i] == '#' && i+2 < len(word) {
+				if n, err := strconv.ParseUint(word[i+1:i+3], 16, 8); err == nil {
+					b.WriteByte(byte(n))
+					i += 2
+					continue
+				}
+			}
+			b.WriteByte(word[i])
+		}
+		word = b.String()
+	}
+	return word
+}
+
+// Numbers, and "num gen R" indirect references.
+func (l *pdfLexer) number() interface{} {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.data) && (l.data[l.pos] == '.' || (l.data[l.pos] >= '0' && l.data[l.pos] <= '9')) {
+		l.pos++
+	}
+	text := string(l.data[start:l.pos])
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		f, _ := strconv.ParseFloat(text, 64)
+		return f
+	}
+	// look ahead for "gen R"
+	save := l.pos
+	l.skipSpace()
+	genStart := l.pos
+	for l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '9' {
+		l.pos++
+	}
+	if l.pos > genStart {
+		l.skipSpace()
+		if l.pos < len(l.data) && l.data[l.pos] == 'R' &&
+			(l.pos+1 == len(l.data) || isPdfSpace(l.data[l.pos+1]) || isPdfDelim(l.data[l.pos+1])) {
+			l.pos++
+			return pdfRef(n)
+		}
+	}
+	l.pos = save
+	return n
+}
+
+func (l *pdfLexer) dictionary() (interface{}, error) {
+	dict := pdfDict{}
+	for {
+		l.skipSpace()
+		if l.pos+1 < len(l.data) && l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return dict, nil
+		}
+		key, err := l.object()
+		if err != nil {
+			return dict, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			continue
+		}
+		val, err := l.object()
+		if err != nil {
+			return dict, err
+		}
+		dict[string(name)] = val
+	}
+}
+
+func (l *pdfLexer) literalString() string {
+	l.pos++ // (
+	var b strings.Builder
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return b.String()
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return b.String()
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					n := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						n = n*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					b.WriteByte(byte(n))
+				} else {
+					b.WriteByte(e)
+				}
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (l *pdfLexer) hexString() string {
+	l.pos++ // <
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		c := l.data[l.pos]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++ // >
+	if len(digits)%2 != 0 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		n, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		out[i] = byte(n)
+	}
+	return string(out)
+}
+
+// If a "stream" keyword follows a dictionary returns the raw stream bytes.
+func (l *pdfLexer) streamData(dict pdfDict) []byte {
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		return nil
+	}
+	start := l.pos + len("stream")
+	if start < len(l.data) && l.data[start] == '\r' {
+		start++
+	}
+	if start < len(l.data) && l.data[start] == '\n' {
+		start++
+	}
+	if length, ok := dict["Length"].(int); ok && length >= 0 && start+length <= len(l.data) {
+		if rest := bytes.TrimLeft(l.data[start+length:], "\r\n "); bytes.HasPrefix(rest, []byte("endstream")) {
+			return l.data[start : start+length]
+		}
+	}
+	// indirect or wrong length, fall back to searching for the end marker
+	end := bytes.Index(l.data[start:], []byte("endstream"))
+	if end == -1 {
+		return nil
+	}
+	return bytes.TrimRight(l.data[start:start+end], "\r\n")
+}
+
+// Skips inline image data following an ID operator, up to EI.
+func (l *pdfLexer) skipInlineImage() {
+	end := bytes.Index(l.data[l.pos:], []byte("EI"))
+	for end != -1 {
+		after := l.pos + end + 2
+		before := l.pos + end - 1
+		if (before < 0 || isPdfSpace(l.data[before])) && (after >= len(l.data) || isPdfSpace(l.data[after])) {
+			l.pos = after
+			return
+		}
+		next := bytes.Index(l.data[after:], []byte("EI"))
+		if next == -1 {
+			break
+		}
+		end = after - l.pos + next
+	}
+	l.pos = len(l.data)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPdfLexer(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		want []interface{}
+	}{
+		{"/Name /A#20B /#zz", []interface{}{pdfName("Name"), pdfName("A B"), pdfName("#zz")}},
+		{"12 -3 +4 .5 1.25 -.5", []interface{}{12, -3, 4, 0.5, 1.25, -0.5}},
+		{"3 0 R 4 0 Rx", []interface{}{pdfRef(3), 4, 0, pdfKeyword("Rx")}},
+		{"true false null BT", []interface{}{true, false, nil, pdfKeyword("BT")}},
+		{`(a (nested) \(paren\) \n\101\7 end)`, []interface{}{"a (nested) (paren) \nA\a end"}},
+		{"(line \\\r\ncontinued)", []interface{}{"line continued"}},
+		{"<48 65 6c6C 6> <>", []interface{}{"Hell`", ""}},
+		{"% a comment\n/After", []interface{}{pdfName("After")}},
+		{"[1 [2 /x] (s)]", []interface{}{[]interface{}{1, []interface{}{2, pdfName("x")}, "s"}}},
+		{"<< /Type /Page /Kids [1 0 R] /Count 1 >>",
+			[]interface{}{pdfDict{"Type": pdfName("Page"), "Kids": []interface{}{pdfRef(1)}, "Count": 1}}},
+		{"<< /A << /B 2 >> 7 /C 3 >>", []interface{}{pdfDict{"A": pdfDict{"B": 2}, "C": 3}}},
+		{"] } {", []interface{}{pdfKeyword("]"), pdfKeyword("}"), pdfKeyword("{")}},
+	} {
+		lex := &pdfLexer{data: []byte(test.data)}
+		var got []interface{}
+		for {
+			val, err := lex.object()
+			if err == errPdfEnd {
+				break
+			} else if err != nil {
+				t.Fatalf("%q: %v", test.data, err)
+			}
+			got = append(got, val)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, expected %#v", test.data, got, test.want)
+		}
+	}
+}
+
+func TestPdfLexerLimits(t *testing.T) {
+	for _, data := range []string{
+		strings.Repeat("[", maxPdfNesting+1),
+		strings.Repeat("<<", maxPdfNesting+1),
+	} {
+		lex := &pdfLexer{data: []byte(data)}
+		if _, err := lex.object(); err != errPdfNesting {
+			t.Errorf("%d levels: got %v, expected %v", maxPdfNesting+1, err, errPdfNesting)
+		}
+	}
+	for _, data := range []string{"[1 2", "<< /A 1", "(unterminated", "<41"} {
+		lex := &pdfLexer{data: []byte(data)}
+		// truncated objects end the data rather than hanging or panicking
+		for i := 0; i < 10; i++ {
+			if _, err := lex.object(); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Key a pipeline step's results are replaced with when its run failed.
+const errorKey = "_error"
+
+// PipelineStep scrapes a url made from each result of an earlier item, ex:
+// each category's page from a list of categories, then each product's page
+// from each category's products.
+type PipelineStep struct {
+	// Key the step's results are nested under in each result of From.
+	Name string `json:"name"`
+	// Item the step runs once per result of, from the request's own items or
+	// an earlier step's.
+	From string `json:"from"`
+	// With {field} placeholders (dotted paths) filled from each result of
+	// From.  A url that's only a placeholder (ex: "{link}") may be relative
+	// to the page the result was on, and a field with several values runs
+	// the step for each.
+	Url   string                `json:"url"`
+	Items map[string]ScrapeItem `json:"items"`
+	// Most times the step runs, 0 for no limit.
+	Limit int `json:"limit,omitempty"`
+}
+
+var pipelinePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// A result a step can run from, with the url it was scraped from.
+type pipelineParent struct {
+	result  map[string]interface{}
+	pageUrl string
+}
+
+// Runs req's pipeline steps in order, nesting each run's results into the
+// result it ran from.  Runs share results when their urls are the same.
+func runPipeline(req ScrapeRequest, results ScrapeResult, opts scrapeOptions) {
+	parents := make(map[string][]pipelineParent)
+	addParents := func(res ScrapeResult, pageUrl string) {
+		for name, val := range res {
+			for _, result := range valuesOf(val) {
+				if m, ok := result.(map[string]interface{}); ok {
+					parents[name] = append(parents[name], pipelineParent{m, pageUrl})
+				}
+			}
+		}
+	}
+	addParents(results, req.Url)
+	for _, step := range req.Pipeline {
+		runs := make(map[string]map[string]interface{})
+		for _, parent := range parents[step.From] {
+			urls, err := pipelineUrls(step.Url, parent)
+			if err != nil {
+				if opts.Verbose {
+					log.Printf("Skipping pipeline step %q for a %q result: %v\n", step.Name, step.From, err)
+				}
+				continue
+			}
+			var nested []interface{}
+			for _, stepUrl := range urls {
+				run, found := runs[stepUrl]
+				if !found {
+					if step.Limit > 0 && len(runs) >= step.Limit {
+						break
+					}
+					run = runStep(req, step, stepUrl, opts)
+					runs[stepUrl] = run
+					if _, failed := run[errorKey]; !failed {
+						addParents(run, stepUrl)
+					}
+				}
+				nested = append(nested, run)
+			}
+			if len(nested) == 1 {
+				parent.result[step.Name] = nested[0]
+			} else if len(nested) > 1 {
+				parent.result[step.Name] = nested
+			}
+		}
+	}
+}
+
+// Scrapes one url of a step with the request's settings, a failure being
+// recorded in place of the results.
+func runStep(req ScrapeRequest, step PipelineStep, stepUrl string, opts scrapeOptions) map[string]interface{} {
+	stepReq := stepRequest(req, step, stepUrl)
+	if opts.Verbose {
+		log.Printf("Running pipeline step %q on %s\n", step.Name, stepUrl)
+	}
+	results, err := scrape(stepReq, opts)
+	if err != nil {
+		return map[string]interface{}{errorKey: err.Error()}
+	}
+	return results
+}
+
+// The request scraping a url of step, with req's settings other than those
+// only for req's own url.
+func stepRequest(req ScrapeRequest, step PipelineStep, stepUrl string) ScrapeRequest {
+	req.Url = stepUrl
+	req.Items = step.Items
+	req.Pipeline = nil
+	req.PageParam = nil
+	req.Crawl = nil
+	req.Form = nil
+	req.DiscoverApis = false
+	return req
+}
+
+// The step's urls for a result, one per combination of values of fields
+// with several.
+func pipelineUrls(template string, parent pipelineParent) ([]string, error) {
+	var err error
+	urls := []string{template}
+	for _, m := range pipelinePlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		placeholder := template[m[0]:m[1]]
+		path := template[m[2]:m[3]]
+		val, found := fieldByPath(parent.result, path)
+		if !found {
+			return nil, fmt.Errorf("no %q field", path)
+		}
+		var vals []string
+		for _, v := range valuesOf(val) {
+			if s := strings.TrimSpace(fmt.Sprint(v)); len(s) > 0 {
+				vals = append(vals, s)
+			}
+		}
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("%q field is empty", path)
+		}
+		inQuery := strings.Contains(template[:m[0]], "?")
+		var expanded []string
+		for _, u := range urls {
+			for _, v := range vals {
+				if placeholder == template {
+					v, err = resolveUrl(parent.pageUrl, v)
+					if err != nil {
+						return nil, err
+					}
+				} else if inQuery {
+					v = url.QueryEscape(v)
+				} else {
+					v = url.PathEscape(v)
+				}
+				expanded = append(expanded, strings.Replace(u, placeholder, v, 1))
+			}
+		}
+		urls = expanded
+	}
+	return urls, nil
+}
+
+func resolveUrl(base string, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
+}
+
+// Checks the steps, and that each names an item of the request or an
+// earlier step that isn't already used.
+func checkPipeline(v *validator, req *ScrapeRequest) {
+	items := make(map[string]bool)
+	for name := range req.Items {
+		items[name] = true
+	}
+	names := make(map[string]bool)
+	for idx, step := range req.Pipeline {
+		path := jsonPointer("pipeline", strconv.Itoa(idx))
+		if len(step.Name) == 0 {
+			v.add(path+"/name", "was empty")
+		} else if names[step.Name] || step.Name == metaKey || step.Name == errorKey {
+			v.add(path+"/name", "%q is already used", step.Name)
+		}
+		names[step.Name] = true
+		if !items[step.From] {
+			v.add(path+"/from", "no item %q in the request or an earlier step", step.From)
+		}
+		if len(step.Url) == 0 {
+			v.add(path+"/url", "was empty")
+		}
+		if step.Limit < 0 {
+			v.add(path+"/limit", "can't be negative")
+		}
+		stepReq := stepRequest(*req, step, pipelinePlaceholder.ReplaceAllString(step.Url, "x"))
+		if err := validate(&stepReq); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				if strings.HasPrefix(e.Path, "/items") {
+					v.add(path+e.Path, "%s", e.Message)
+				}
+			}
+		}
+		for name := range step.Items {
+			if items[name] {
+				v.add(jsonPointer("pipeline", strconv.Itoa(idx), "items", name), "item %q is already in the request or an earlier step", name)
+			}
+			items[name] = true
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// FetchPlan is what a "dry_run" request returns under "_meta" instead of
+// scraping: the pages it would visit and the other requests it would make,
+// with templates resolved.
+type FetchPlan struct {
+	// Pages in the order they'd be fetched.  A crawl starts from these and
+	// follows links found on them.
+	Urls  []string       `json:"urls"`
+	Crawl *CrawlOptions  `json:"crawl,omitempty"`
+	Form  *FormStep      `json:"form,omitempty"`
+	Other []PlannedFetch `json:"other,omitempty"`
+	Notes []string       `json:"notes,omitempty"`
+}
+
+// PlannedFetch is a request made besides fetching pages, ex: a graphql query.
+type PlannedFetch struct {
+	// The item making it, if any.
+	Item   string `json:"item,omitempty"`
+	Method string `json:"method"`
+	Url    string `json:"url"`
+	// graphql variables as sent.
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Works out req's FetchPlan without making any requests.
+func planScrape(req ScrapeRequest, opts scrapeOptions) (*FetchPlan, error) {
+	urls, err := pageUrls(req)
+	if err != nil {
+		return nil, err
+	}
+	plan := &FetchPlan{Urls: urls, Form: req.Form}
+	if req.Crawl != nil {
+		crawl := newCrawler(*req.Crawl, req.Url).opts
+		plan.Crawl = &crawl
+	}
+	if req.Form != nil {
+		plan.Notes = append(plan.Notes, "items are extracted from the form's response, the form's own page isn't scraped")
+	}
+	if req.Canonical {
+		plan.Notes = append(plan.Notes, "pages with a rel=canonical link are scraped from the canonical url instead")
+	}
+	if req.DiscoverApis {
+		plan.Other = append(plan.Other, PlannedFetch{Method: http.MethodGet,
+			Url: strings.Replace(opts.RendererHar, "{url}", url.QueryEscape(req.Url), -1)})
+	}
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		switch item.Type {
+		case itemTypeGraphql:
+			target, variables, err := graphqlTarget(req.Url, item.Graphql)
+			if err != nil {
+				return nil, err
+			}
+			plan.Other = append(plan.Other, PlannedFetch{Item: name, Method: http.MethodPost,
+				Url: target.String(), Variables: variables})
+		case itemTypeWebsocket:
+			target, _, err := websocketTarget(req.Url, item.Websocket)
+			if err != nil {
+				return nil, err
+			}
+			if item.Websocket.Rendered {
+				// the page is rendered for its messages
+				target, _ = url.Parse(strings.Replace(opts.RendererHar, "{url}", url.QueryEscape(req.Url), -1))
+			}
+			plan.Other = append(plan.Other, PlannedFetch{Item: name, Method: http.MethodGet, Url: target.String()})
+		case itemTypeDownload:
+			plan.Notes = append(plan.Notes, "items[\""+name+"\"] downloads each asset it matches")
+		}
+		if len(item.IframeSelector) > 0 {
+			plan.Notes = append(plan.Notes, "items[\""+name+"\"] fetches each frame it matches")
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetPolicy limits which sites are scraped and how fast, for every
+// request made through its transport (pages, downloads, link checks,
+// redirects).  It can be changed while scrapes are running, see admin.go.
+type targetPolicy struct {
+	lock sync.Mutex
+	// Max requests per second to each domain, grouped by key, 0 for no limit.
+	rate float64
+	// If set, only these domains (and their subdomains) can be requested.
+	// Deny wins over allow.
+	allow []string
+	deny  []string
+	key   func(host string) string
+	// Earliest time the next request to each domain can go out.
+	next map[string]time.Time
+}
+
+func newTargetPolicy(key func(host string) string) *targetPolicy {
+	return &targetPolicy{key: key, next: make(map[string]time.Time)}
+}
+
+func (p *targetPolicy) set(rate float64, allow, deny []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rate = rate
+	p.allow = allow
+	p.deny = deny
+}
+
+// Returns an error if host can't be requested.
+func (p *targetPolicy) check(host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, domain := range p.deny {
+		if matchesDomain(host, domain) {
+			return fmt.Errorf("%s is on the deny list", host)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, domain := range p.allow {
+		if matchesDomain(host, domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not on the allow list", host)
+}
+
+// Whether host is domain or a subdomain of it.
+func matchesDomain(host, domain string) bool {
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// How long a request to host must wait for its turn under the rate limit.
+// Reserves the slot, so concurrent requests are spaced out.
+func (p *targetPolicy) reserve(host string) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.rate <= 0 {
+		return 0
+	}
+	key := p.key(host)
+	now := time.Now()
+	at := p.next[key]
+	if at.Before(now) {
+		at = now
+	}
+	p.next[key] = at.Add(time.Duration(float64(time.Second) / p.rate))
+	return at.Sub(now)
+}
+
+type policyTransport struct {
+	base   http.RoundTripper
+	policy *targetPolicy
+}
+
+func withPolicy(base http.RoundTripper, policy *targetPolicy) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &policyTransport{base: base, policy: policy}
+}
+
+func (pt *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := pt.policy.check(req.URL.Host); err != nil {
+		return nil, err
+	}
+	if wait := pt.policy.reserve(req.URL.Host); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return pt.base.RoundTrip(req)
+}
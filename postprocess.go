@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A processor transforms extracted text, ex: a summarizer or classifier.  It
+// is either a command, given the text on stdin, or an http endpoint the text
+// is POSTed to.  Its (trimmed) output is stored in a derived field.
+//
+// Processors are configured by whoever runs gluestick (see -processors), and
+// requests refer to them by name, so server clients can't run arbitrary
+// commands.
+type processor struct {
+	Command []string `json:"command,omitempty"`
+	Url     string   `json:"url,omitempty"`
+	// Defaults to 30 seconds.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// PostProcess runs a named processor over an item's field, storing the output
+// in Into.  Errors are stored in Into + "_error".
+type PostProcess struct {
+	// Field name, or a dotted path for nested fields, ex: "image.alt".
+	Field     string `json:"field"`
+	Processor string `json:"processor"`
+	Into      string `json:"into"`
+}
+
+func loadProcessors(filename string) (map[string]processor, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var processors map[string]processor
+	if err := json.Unmarshal(data, &processors); err != nil {
+		return nil, err
+	}
+	for name, p := range processors {
+		if (len(p.Command) == 0) == (len(p.Url) == 0) {
+			return nil, fmt.Errorf("processor %q must have exactly one of command or url", name)
+		}
+	}
+	return processors, nil
+}
+
+func checkProcessors(req ScrapeRequest, processors map[string]processor) error {
+	for name, item := range req.Items {
+		for _, pp := range item.PostProcess {
+			if _, found := processors[pp.Processor]; !found {
+				return fmt.Errorf("request.items[%q].postprocess: unknown processor %q, see -processors", name, pp.Processor)
+			}
+		}
+	}
+	return nil
+}
+
+func (p processor) run(text string) (string, error) {
+	timeout := 30 * time.Second
+	if p.TimeoutSeconds > 0 {
+		timeout = time.Duration(p.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(p.Command) > 0 {
+		cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+				return "", fmt.Errorf("%s: %s", err, msg)
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.Url, strings.NewReader(text))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("processor returned %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Runs each item's post processors over its results.  Identical inputs to the
+// same processor are only processed once.
+func postProcessItems(req ScrapeRequest, results ScrapeResult, processors map[string]processor) {
+	type cacheKey struct{ processor, text string }
+	type output struct {
+		text string
+		err  error
+	}
+	cache := make(map[cacheKey]output)
+	process := func(name string, text string) output {
+		key := cacheKey{name, text}
+		if out, found := cache[key]; found {
+			return out
+		}
+		var out output
+		out.text, out.err = processors[name].run(text)
+		cache[key] = out
+		return out
+	}
+
+	for name, item := range req.Items {
+		if len(item.PostProcess) == 0 {
+			continue
+		}
+		for _, result := range itemResults(results[name]) {
+			for _, pp := range item.PostProcess {
+				val, found := fieldByPath(result, pp.Field)
+				if !found {
+					continue
+				}
+				var errs []string
+				derived := mapLeaves(copyValue(val), func(text string) interface{} {
+					out := process(pp.Processor, text)
+					if out.err != nil {
+						errs = append(errs, out.err.Error())
+						return ""
+					}
+					return out.text
+				})
+				result[pp.Into] = derived
+				if len(errs) > 0 {
+					result[pp.Into+"_error"] = strings.Join(errs, "; ")
+				}
+			}
+		}
+	}
+}
+
+// An item's value is a single result or a slice of them.
+func itemResults(val interface{}) []map[string]interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		var list []map[string]interface{}
+		for _, el := range v {
+			if m, ok := el.(map[string]interface{}); ok {
+				list = append(list, m)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func fieldByPath(result map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = result
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Deep copies maps and slices so derived values don't alias the source.
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i := range v {
+			c[i] = copyValue(v[i])
+		}
+		return c
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k := range v {
+			c[k] = copyValue(v[k])
+		}
+		return c
+	}
+	return val
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pages fetched for the UI's live preview, kept a while so editing items
+// re-runs only the extraction rather than fetching the site on every pause
+// in typing.  The url changing fetches afresh, as does running the scrape.
+const (
+	previewPageTtl  = 5 * time.Minute
+	maxPreviewPages = 20
+	// Larger pages are fetched each time rather than kept.
+	maxPreviewPageBytes = 4 << 20
+)
+
+type previewCache struct {
+	lock  sync.Mutex
+	pages map[string]*previewPage
+}
+
+type previewPage struct {
+	fetched time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func newPreviewCache() *previewCache {
+	return &previewCache{pages: make(map[string]*previewPage)}
+}
+
+// Answers GET requests from the pages fetched for owner's previews within
+// previewPageTtl, fetching the rest with base and keeping successful ones.
+func (pc *previewCache) transport(base http.RoundTripper, owner string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &previewTransport{base: base, cache: pc, owner: owner}
+}
+
+func (pc *previewCache) get(key string) *previewPage {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	now := time.Now()
+	for k, page := range pc.pages {
+		if now.Sub(page.fetched) > previewPageTtl {
+			delete(pc.pages, k)
+		}
+	}
+	return pc.pages[key]
+}
+
+func (pc *previewCache) put(key string, page *previewPage) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if _, found := pc.pages[key]; !found && len(pc.pages) >= maxPreviewPages {
+		oldest := ""
+		for k, p := range pc.pages {
+			if len(oldest) == 0 || p.fetched.Before(pc.pages[oldest].fetched) {
+				oldest = k
+			}
+		}
+		delete(pc.pages, oldest)
+	}
+	pc.pages[key] = page
+}
+
+type previewTransport struct {
+	base  http.RoundTripper
+	cache *previewCache
+	// Name of the api key previewing, so keys don't see each other's pages.
+	owner string
+}
+
+func (pt *previewTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return pt.base.RoundTrip(req)
+	}
+	key := pt.owner + " " + req.URL.String()
+	if page := pt.cache.get(key); page != nil {
+		return page.response(req), nil
+	}
+	resp, err := pt.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	// one byte past the limit to tell "exactly at limit" from "over limit"
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPreviewPageBytes+1))
+	if err != nil || len(body) > maxPreviewPageBytes {
+		// hand back what was read followed by the rest, without keeping it
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	page := &previewPage{fetched: time.Now(), status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	pt.cache.put(key, page)
+	return page.response(req), nil
+}
+
+func (page *previewPage) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", page.status, http.StatusText(page.status)),
+		StatusCode:    page.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        page.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(page.body)),
+		ContentLength: int64(len(page.body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"syscall"
+)
+
+// Writes the -cpuprofile, -memprofile and -trace files, see stop.
+type profiler struct {
+	cpu         *os.File
+	trace       *os.File
+	memFilename string
+	once        sync.Once
+}
+
+// Starts the cpu profile and execution trace, for any non-empty filenames.
+// The memory profile is written by stop.
+func startProfiling(cpuFilename string, memFilename string, traceFilename string) (*profiler, error) {
+	p := &profiler{memFilename: memFilename}
+	if len(cpuFilename) > 0 {
+		f, err := os.Create(cpuFilename)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.cpu = f
+	}
+	if len(traceFilename) > 0 {
+		f, err := os.Create(traceFilename)
+		if err != nil {
+			p.stop()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			p.stop()
+			return nil, err
+		}
+		p.trace = f
+	}
+	if p.cpu != nil || p.trace != nil || len(memFilename) > 0 {
+		// the server and workers run until stopped
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			sig := <-signals
+			p.exit(128 + int(sig.(syscall.Signal)))
+		}()
+	}
+	return p, nil
+}
+
+// Finishes the profiles, only the first call does anything.
+func (p *profiler) stop() {
+	p.once.Do(func() {
+		if p.cpu != nil {
+			pprof.StopCPUProfile()
+			p.cpu.Close()
+		}
+		if p.trace != nil {
+			trace.Stop()
+			p.trace.Close()
+		}
+		if len(p.memFilename) > 0 {
+			f, err := os.Create(p.memFilename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write -memprofile: %s\n", err)
+				return
+			}
+			defer f.Close()
+			runtime.GC()
+			if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write -memprofile: %s\n", err)
+			}
+		}
+	})
+}
+
+// os.Exit, after finishing the profiles.
+func (p *profiler) exit(code int) {
+	p.stop()
+	os.Exit(code)
+}
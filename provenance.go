@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
+)
+
+// Key each result's field sources are stored under with -provenance.
+const provenanceKey = "_provenance"
+
+// FieldSource is where one of a field's values was extracted from, see
+// -provenance.
+type FieldSource struct {
+	// The field's selector as written in the request.
+	Selector string `json:"selector"`
+	// Selector of the element from the root of the document, ex:
+	// "html > body > div:nth-child(2) > span".
+	Path string `json:"path"`
+	// Character offsets of the element in the page's html, from its start
+	// tag to the end of its end tag.  -1 for elements the html parser added
+	// that aren't in the html (ex: a missing <tbody>).
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Called by parseFields for each value it extracts from an element, field
+// being its dotted path, ex: "details.sku".
+type sourceTracer func(field string, selector string, node *html.Node)
+
+// Where elements are in the html of the pages being scraped, so field
+// values can be traced back to it.  Each page's html is tokenized the first
+// time a value is extracted from it.
+type pageSources struct {
+	pages map[*colly.Response]map[*html.Node][2]int
+}
+
+func newPageSources() *pageSources {
+	return &pageSources{pages: make(map[*colly.Response]map[*html.Node][2]int)}
+}
+
+// Traces values extracted from e's page into sources.
+func (ps *pageSources) tracer(e *colly.HTMLElement, sources map[string][]FieldSource) sourceTracer {
+	return func(field string, selector string, node *html.Node) {
+		sources[field] = append(sources[field], ps.locate(e.Response, selector, node))
+	}
+}
+
+func (ps *pageSources) locate(r *colly.Response, selector string, node *html.Node) FieldSource {
+	offsets, found := ps.pages[r]
+	if !found {
+		root := node
+		for root.Parent != nil {
+			root = root.Parent
+		}
+		offsets = elementOffsets(root, r.Body)
+		ps.pages[r] = offsets
+	}
+	source := FieldSource{Selector: selector, Path: domPath(node), Start: -1, End: -1}
+	if span, found := offsets[node]; found {
+		source.Start, source.End = span[0], span[1]
+	}
+	return source
+}
+
+// Done with a page, its offsets aren't needed anymore.
+func (ps *pageSources) release(r *colly.Response) {
+	delete(ps.pages, r)
+}
+
+// A start tag in a page's html.
+type tagSpan struct {
+	tag        string
+	start, end int
+}
+
+// Elements the html parser adds when they're left out of the html.
+var impliedElements = map[string]bool{"html": true, "head": true, "body": true, "tbody": true, "colgroup": true}
+
+// How far ahead of the next start tag an element's own can be, past start
+// tags the parser dropped or moved.  Further than this and the element is
+// taken to be one the parser made up, ex: a reopened <b>, so the rest of
+// the document isn't skipped looking for it.
+const maxSpanLookahead = 8
+
+// Character offsets of the elements of the document parsed from body,
+// matching them to its start tags in document order.  Elements closed
+// implicitly end where the parser would close them, see closeImplied.
+func elementOffsets(root *html.Node, body []byte) map[*html.Node][2]int {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var spans []*tagSpan
+	// open elements, the first being a stand in for the document
+	stack := []*tokElem{{}}
+	open := []*tagSpan{nil}
+	pos, closedAt := 0, 0
+	popTo := func(idx int) {
+		for i := len(stack) - 1; i >= idx; i-- {
+			if open[i].end < 0 {
+				open[i].end = closedAt
+			}
+		}
+		stack, open = stack[:idx], open[:idx]
+	}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF, or the html was cut short
+		}
+		start := pos
+		pos += utf8.RuneCount(z.Raw())
+		// elements closed by this tag end where it starts
+		closedAt = start
+		name, _ := z.TagName()
+		tag := string(name)
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			span := &tagSpan{tag: tag, start: start, end: -1}
+			spans = append(spans, span)
+			switch {
+			case tag == "html" || tag == "head" || tag == "body":
+				// ended by their end tags
+			case tt == html.SelfClosingTagToken || voidElements[tag]:
+				span.end = pos
+			default:
+				closeImplied(tag, stack, popTo)
+				stack = append(stack, &tokElem{tag: tag})
+				open = append(open, span)
+			}
+		case html.EndTagToken:
+			if tag == "html" || tag == "head" || tag == "body" {
+				if tag != "head" {
+					popTo(1)
+				}
+				for i := len(spans) - 1; i >= 0; i-- {
+					if spans[i].tag == tag && spans[i].end < 0 {
+						spans[i].end = pos
+						break
+					}
+				}
+				continue
+			}
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].tag == tag {
+					open[i].end = pos
+					popTo(i)
+					break
+				}
+			}
+		}
+	}
+	for _, span := range spans {
+		if span.end < 0 {
+			span.end = pos // still open at the end of the page
+		}
+	}
+
+	offsets := make(map[*html.Node][2]int)
+	next := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for i := next; i < len(spans) && i <= next+maxSpanLookahead; i++ {
+				if !strings.EqualFold(spans[i].tag, n.Data) {
+					if i == next && impliedElements[n.Data] {
+						break // added by the parser
+					}
+					continue
+				}
+				offsets[n] = [2]int{spans[i].start, spans[i].end}
+				next = i + 1
+				break
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+	return offsets
+}
+
+// Selector of n from the root of its document, each element after its
+// parent with its position among its siblings if it has any.
+func domPath(n *html.Node) string {
+	var parts []string
+	for ; n != nil && n.Type == html.ElementNode; n = n.Parent {
+		part := n.Data
+		position, siblings := 0, 0
+		if n.Parent != nil {
+			for sibling := n.Parent.FirstChild; sibling != nil; sibling = sibling.NextSibling {
+				if sibling.Type != html.ElementNode {
+					continue
+				}
+				siblings++
+				if sibling == n {
+					position = siblings
+				}
+			}
+		}
+		if siblings > 1 {
+			part += fmt.Sprintf(":nth-child(%d)", position)
+		}
+		parts = append([]string{part}, parts...)
+	}
+	return strings.Join(parts, " > ")
+}
+
+// Narrows the sources of fields to the value their mode keeps, as
+// applyModes does to the values.
+func applySourceModes(sources map[string][]FieldSource, modes map[string]string) {
+	for path, mode := range modes {
+		list := sources[path]
+		if len(list) < 2 {
+			continue
+		}
+		switch mode {
+		case modeFirst:
+			sources[path] = list[:1]
+		case modeLast:
+			sources[path] = list[len(list)-1:]
+		}
+	}
+}
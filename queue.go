@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const (
+	// Synchronous /scrape requests have someone waiting on the other end so
+	// they jump ahead of any background job.
+	interactivePriority = 1 << 20
+	maxJobPriority      = 1000
+	minJobPriority      = -1000
+)
+
+type task struct {
+	priority int
+	seq      uint64
+	run      func()
+	// Set for background jobs so remote workers can claim them by id.
+	jobId string
+}
+
+// Max-heap on priority, FIFO (lowest seq first) within the same priority.
+type taskHeap []*task
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h taskHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(*task)) }
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// workQueue is a priority queue of tasks, pulled highest priority first by
+// either a fixed pool of local workers or by remote workers via next().
+type workQueue struct {
+	lock  sync.Mutex
+	tasks taskHeap
+	seq   uint64
+	// Holds a token whenever there may be tasks waiting to be pulled.
+	wake chan struct{}
+	// Local workers running, and how many there should be.  Extra workers
+	// exit once they're done with their current task.
+	workers int
+	target  int
+}
+
+// How often idle workers check whether they should exit after a resize.
+const workerIdleCheck = time.Second
+
+func newWorkQueue(workers int) *workQueue {
+	q := &workQueue{wake: make(chan struct{}, 1)}
+	q.resize(workers)
+	return q
+}
+
+// Changes the number of local workers.  Growing takes effect at once,
+// shrinking as running tasks finish, in-flight tasks are never dropped.
+func (q *workQueue) resize(workers int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.target = workers
+	for ; q.workers < q.target; q.workers++ {
+		go q.work()
+	}
+}
+
+// Returns true if the calling worker should exit to get down to target.
+func (q *workQueue) retire() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.workers > q.target {
+		q.workers--
+		return true
+	}
+	return false
+}
+
+func (q *workQueue) submit(t *task) {
+	q.lock.Lock()
+	q.seq++
+	t.seq = q.seq
+	heap.Push(&q.tasks, t)
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *workQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pops the highest priority task, waiting up to timeout for one to show up
+// or until cancel is closed.  A timeout <= 0 waits forever.  Returns nil on
+// timeout or cancel.
+func (q *workQueue) next(timeout time.Duration, cancel <-chan struct{}) *task {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		q.lock.Lock()
+		if len(q.tasks) > 0 {
+			t := heap.Pop(&q.tasks).(*task)
+			remaining := len(q.tasks)
+			q.lock.Unlock()
+			if remaining > 0 {
+				// pass the token on so another waiter picks up the rest
+				q.signal()
+			}
+			return t
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.wake:
+		case <-expired:
+			return nil
+		case <-cancel:
+			return nil
+		}
+	}
+}
+
+func (q *workQueue) work() {
+	for !q.retire() {
+		if t := q.next(workerIdleCheck, nil); t != nil {
+			t.run()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default redirects followed per request, as net/http does.
+const defaultMaxRedirects = 10
+
+// RedirectPolicy is how a request's page fetches follow redirects.
+type RedirectPolicy struct {
+	// Redirects followed per request, default 10.
+	Max int `json:"max,omitempty"`
+	// Domains (and their subdomains) cookies and auth headers are still sent
+	// to after a redirect leaves the original host, ex: an SSO login that
+	// bounces between hosts.  They're dropped otherwise.
+	KeepCredentials []string `json:"keep_credentials,omitempty"`
+}
+
+// Headers that carry credentials, dropped on redirects to other hosts.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Cookie2"}
+
+// Follows redirects like colly's default, copying the previous hop's headers,
+// except that credentials aren't copied to another host (or from https to
+// http) unless policy keeps them for it.  Colly only drops Authorization,
+// and net/http's own stripping doesn't apply since colly copies the headers
+// after it.  Cookies the jar has for the new host are still sent.
+func redirectHandler(policy *RedirectPolicy) func(req *http.Request, via []*http.Request) error {
+	max := defaultMaxRedirects
+	var keep []string
+	if policy != nil {
+		if policy.Max > 0 {
+			max = policy.Max
+		}
+		keep = policy.KeepCredentials
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		last := via[len(via)-1]
+		for name, values := range last.Header {
+			for _, value := range values {
+				req.Header.Set(name, value)
+			}
+		}
+		if keepCredentials(last, req, keep) {
+			return nil
+		}
+		for _, name := range credentialHeaders {
+			req.Header.Del(name)
+		}
+		return nil
+	}
+}
+
+func keepCredentials(from *http.Request, to *http.Request, keep []string) bool {
+	if from.URL.Scheme == "https" && to.URL.Scheme != "https" {
+		return false
+	}
+	if strings.EqualFold(from.URL.Host, to.URL.Host) {
+		return true
+	}
+	host := strings.ToLower(to.URL.Hostname())
+	for _, domain := range keep {
+		if matchesDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long a claim request waits for work before returning 204.
+const claimWait = 25 * time.Second
+
+// WorkClaim is what a remote worker gets back from POST /work/claim.
+type WorkClaim struct {
+	JobId   string        `json:"job_id"`
+	Request ScrapeRequest `json:"request"`
+	// Name of the api key the job was submitted with, see ScrapeRequest.owner.
+	Owner string `json:"owner,omitempty"`
+	// Seconds the worker has to send a heartbeat or its results before the
+	// job is handed to another worker, see -work-lease.
+	Lease float64 `json:"lease"`
+	// Whether the job wants each page sent to /work/{job_id}/page as it's
+	// scraped, for its webhook's page_done events.
+	Pages bool `json:"pages,omitempty"`
+}
+
+// WorkResult is what a remote worker posts to /work/{job_id}/result.
+type WorkResult struct {
+	Worker  string       `json:"worker"`
+	Results ScrapeResult `json:"results"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// POST /work/claim?worker=name long polls for the next queued job.
+func (s *server) handleWorkClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	name := r.URL.Query().Get("worker")
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing worker name"))
+		return
+	}
+	worker := workerId(r, name)
+	for {
+		t := s.remote.next(claimWait, r.Context().Done())
+		if r.Context().Err() != nil {
+			if t != nil {
+				s.remote.submit(t) // the worker went away, leave it for another
+			}
+			return
+		}
+		if t == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// a job may have been pruned or re-queued while waiting, skip it
+		if req, ok := s.jobs.start(t.jobId, worker); ok {
+			if s.conf.Scrape.Verbose {
+				log.Printf("Job %s claimed by %s\n", t.jobId, worker)
+			}
+			job, _ := s.jobs.get(t.jobId)
+			writeJson(w, http.StatusOK, WorkClaim{JobId: t.jobId, Request: req, Owner: req.owner,
+				Lease: s.conf.WorkLease.Seconds(), Pages: job.hooks != nil})
+			return
+		}
+	}
+}
+
+// The worker as recorded on jobs: its name qualified by the name of the api
+// key it authenticated with, so workers can only claim, renew and finish
+// jobs as their own key.
+func workerId(r *http.Request, name string) string {
+	if key := keyName(r); len(key) > 0 {
+		return key + "/" + name
+	}
+	return name
+}
+
+// POST /work/{job_id}/result, POST /work/{job_id}/heartbeat?worker=name and
+// POST /work/{job_id}/page?worker=name
+func (s *server) handleWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/work/"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "result":
+		s.handleWorkResult(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "heartbeat":
+		s.handleWorkHeartbeat(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "page":
+		s.handleWorkPage(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleWorkResult(w http.ResponseWriter, r *http.Request, jobId string) {
+	body := r.Body
+	if s.conf.MaxWorkResult > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.conf.MaxWorkResult)
+	}
+	var result WorkResult
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse result as json: %s", err))
+		return
+	}
+	var scrapeErr error
+	if len(result.Error) > 0 {
+		scrapeErr = errors.New(result.Error)
+	}
+	worker := workerId(r, result.Worker)
+	if !s.jobs.finish(jobId, worker, result.Results, scrapeErr) {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is not running on worker %q", jobId, worker))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Renews the worker's lease on a job it's still running.
+func (s *server) handleWorkHeartbeat(w http.ResponseWriter, r *http.Request, jobId string) {
+	worker := workerId(r, r.URL.Query().Get("worker"))
+	if !s.jobs.heartbeat(jobId, worker) {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is not running on worker %q", jobId, worker))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Takes a page the worker scraped for a job it's running, passing it on to
+// the job's webhook.
+func (s *server) handleWorkPage(w http.ResponseWriter, r *http.Request, jobId string) {
+	var page PageMeta
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&page); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse page as json: %s", err))
+		return
+	}
+	worker := workerId(r, r.URL.Query().Get("worker"))
+	if !s.jobs.page(jobId, worker, page) {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is not running on worker %q", jobId, worker))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Periodically hands jobs whose worker went quiet back to the queue.
+func (s *server) requeueExpiredWork() {
+	for range time.Tick(s.conf.WorkLease / 4) {
+		for _, job := range s.jobs.requeueExpired(s.conf.WorkLease) {
+			if s.conf.Scrape.Verbose {
+				log.Printf("Job %s lease expired on %s, re-queueing\n", job.Id, job.Worker)
+			}
+			s.remote.submit(&task{priority: job.Priority, jobId: job.Id})
+		}
+	}
+}
+
+// Resets remotely running jobs whose worker last reported in more than lease
+// ago back to queued.  Returns copies of the jobs as they were before being
+// reset.
+func (js *jobStore) requeueExpired(lease time.Duration) []Job {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	var expired []Job
+	cutoff := time.Now().Add(-lease)
+	for _, job := range js.jobs {
+		if job.Status == jobRunning && len(job.Worker) > 0 && job.Heartbeat != nil && job.Heartbeat.Before(cutoff) {
+			expired = append(expired, *job)
+			job.Status = jobQueued
+			job.Worker = ""
+			job.Started = nil
+			job.Heartbeat = nil
+		}
+	}
+	return expired
+}
+
+// Records that the job is still running on the given worker.  False if it
+// isn't, ex: its lease already expired.
+func (js *jobStore) heartbeat(id string, worker string) bool {
+	renewed := false
+	js.update(id, func(job *Job) {
+		if job.Status != jobRunning || len(worker) == 0 || job.Worker != worker {
+			return
+		}
+		now := time.Now()
+		job.Heartbeat = &now
+		renewed = true
+	})
+	return renewed
+}
+
+// Runs as a remote worker: claims jobs from the coordinator, scrapes them
+// and posts back the results.  apiKey is sent to coordinators requiring a
+// key (see -api-keys).  Never returns.
+func runWorker(coordinator string, name string, apiKey string, workers int, opts scrapeOptions) {
+	base := strings.TrimRight(coordinator, "/")
+	client := &http.Client{Timeout: claimWait + 30*time.Second}
+	if len(apiKey) > 0 {
+		client.Transport = withApiKey(nil, apiKey)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 1; i < workers; i++ {
+		go workLoop(client, base, fmt.Sprintf("%s-%d", name, i), opts)
+	}
+	workLoop(client, base, fmt.Sprintf("%s-%d", name, 0), opts)
+}
+
+func workLoop(client *http.Client, base string, name string, opts scrapeOptions) {
+	for {
+		claim, err := claimWork(client, base, name)
+		if err != nil {
+			log.Printf("ERROR: failed to claim work from %s: %s\n", base, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if claim == nil {
+			continue
+		}
+		if opts.Verbose {
+			log.Printf("%s running job %s\n", name, claim.JobId)
+		}
+		stop := make(chan struct{})
+		go sendHeartbeats(client, base, claim.JobId, name, time.Duration(claim.Lease*float64(time.Second)), stop)
+		claim.Request.owner = claim.Owner
+		jobOpts := opts
+		var pages chan PageMeta
+		pagesSent := make(chan struct{})
+		if claim.Pages {
+			pages = make(chan PageMeta, pageBacklog)
+			go sendPages(client, base, claim.JobId, name, pages, pagesSent)
+			jobOpts.OnPage = func(page PageMeta) {
+				select {
+				case pages <- page:
+				default:
+					if opts.Verbose {
+						log.Printf("Dropping page event for job %s, the coordinator is behind\n", claim.JobId)
+					}
+				}
+			}
+		} else {
+			close(pagesSent)
+		}
+		results, err := scrape(claim.Request, jobOpts)
+		close(stop)
+		if pages != nil {
+			close(pages)
+		}
+		<-pagesSent // so page_done events come before completed
+		result := WorkResult{Worker: name, Results: results}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := postResult(client, base, claim.JobId, result); err != nil {
+			log.Printf("ERROR: failed to post result for job %s: %s\n", claim.JobId, err)
+		}
+	}
+}
+
+// Returns nil, nil when there was no work available.
+func claimWork(client *http.Client, base string, name string) (*WorkClaim, error) {
+	resp, err := client.Post(base+"/work/claim?worker="+url.QueryEscape(name), "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	var claim WorkClaim
+	if err := json.Unmarshal(body, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// Renews the lease on a job a few times per lease until stop is closed.
+func sendHeartbeats(client *http.Client, base string, jobId string, name string, lease time.Duration, stop <-chan struct{}) {
+	if lease <= 0 {
+		return // a coordinator that doesn't take heartbeats
+	}
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := postHeartbeat(client, base, jobId, name); err != nil {
+				log.Printf("ERROR: failed to send heartbeat for job %s: %s\n", jobId, err)
+			}
+		}
+	}
+}
+
+// Pages a job's events can fall behind by before they're dropped rather than
+// holding up the scrape.
+const pageBacklog = 100
+
+// Sends each page to the coordinator in order until pages is closed, then
+// closes sent.
+func sendPages(client *http.Client, base string, jobId string, name string, pages <-chan PageMeta, sent chan<- struct{}) {
+	defer close(sent)
+	for page := range pages {
+		body, err := json.Marshal(page)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Post(base+"/work/"+url.PathEscape(jobId)+"/page?worker="+url.QueryEscape(name), "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("ERROR: failed to send page for job %s: %s\n", jobId, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func postHeartbeat(client *http.Client, base string, jobId string, name string) error {
+	resp, err := client.Post(base+"/work/"+url.PathEscape(jobId)+"/heartbeat?worker="+url.QueryEscape(name), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+func postResult(client *http.Client, base string, jobId string, result WorkResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(base+"/work/"+url.PathEscape(jobId)+"/result", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
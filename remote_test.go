@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkClaimAndFinish(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "worker-a-key-0123456789", Name: "workers-a", Role: roleWorker},
+		{Key: "worker-b-key-0123456789", Name: "workers-b", Role: roleWorker},
+	}
+	s := &server{conf: serverConfig{Distributed: true, WorkLease: time.Minute}, keys: keys, keysRequired: true,
+		jobs: newJobStore(time.Hour), remote: newWorkQueue(0)}
+	claim := s.requirePermission(permWork, s.handleWorkClaim)
+	work := s.requirePermission(permWork, s.handleWork)
+	post := func(handler http.HandlerFunc, key string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	job, _, err := s.jobs.add(ScrapeRequest{Url: "https://a.example", owner: "team-a"}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.submitJob(job)
+	w := post(claim, "worker-a-key-0123456789", "/work/claim?worker=host1", "")
+	var claimed WorkClaim
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &claimed) != nil || claimed.JobId != job.Id {
+		t.Fatalf("claim got %d: %s", w.Code, w.Body)
+	}
+	if claimed.Owner != "team-a" || claimed.Lease != 60 || claimed.Pages {
+		t.Errorf("got claim %+v", claimed)
+	}
+	if got, _ := s.jobs.get(job.Id); got.Status != jobRunning || got.Worker != "workers-a/host1" {
+		t.Errorf("got job %+v", got)
+	}
+
+	result := `{"worker": "host1", "results": {"a": "b"}}`
+	for _, test := range []struct {
+		name string
+		key  string
+		path string
+		body string
+		want int
+	}{
+		{"heartbeat with another key", "worker-b-key-0123456789", "/work/" + job.Id + "/heartbeat?worker=host1", "", http.StatusConflict},
+		{"page with another key", "worker-b-key-0123456789", "/work/" + job.Id + "/page?worker=host1", `{"url": "https://a.example"}`, http.StatusConflict},
+		{"result with another key", "worker-b-key-0123456789", "/work/" + job.Id + "/result", result, http.StatusConflict},
+		{"result from another worker", "worker-a-key-0123456789", "/work/" + job.Id + "/result", `{"worker": "host2"}`, http.StatusConflict},
+		{"heartbeat", "worker-a-key-0123456789", "/work/" + job.Id + "/heartbeat?worker=host1", "", http.StatusNoContent},
+		{"page", "worker-a-key-0123456789", "/work/" + job.Id + "/page?worker=host1", `{"url": "https://a.example"}`, http.StatusNoContent},
+		{"bad result", "worker-a-key-0123456789", "/work/" + job.Id + "/result", "{", http.StatusBadRequest},
+		{"unknown job", "worker-a-key-0123456789", "/work/nope/result", result, http.StatusConflict},
+		{"result", "worker-a-key-0123456789", "/work/" + job.Id + "/result", result, http.StatusNoContent},
+		{"result again", "worker-a-key-0123456789", "/work/" + job.Id + "/result", result, http.StatusConflict},
+		{"heartbeat once done", "worker-a-key-0123456789", "/work/" + job.Id + "/heartbeat?worker=host1", "", http.StatusConflict},
+	} {
+		if w := post(work, test.key, test.path, test.body); w.Code != test.want {
+			t.Errorf("%s: got %d, expected %d: %s", test.name, w.Code, test.want, w.Body)
+		}
+	}
+	if got, _ := s.jobs.get(job.Id); got.Status != jobDone || got.Counts["a"] != 1 {
+		t.Errorf("got job %+v", got)
+	}
+}
+
+func TestWorkLeaseExpiry(t *testing.T) {
+	js := newJobStore(time.Hour)
+	job, _, _ := js.add(ScrapeRequest{Url: "https://a.example"}, 0, "")
+	if _, ok := js.start(job.Id, "w/host1"); !ok {
+		t.Fatal("job didn't start")
+	}
+	if expired := js.requeueExpired(time.Hour); len(expired) != 0 {
+		t.Fatalf("got %d expired within the lease", len(expired))
+	}
+	time.Sleep(time.Millisecond)
+	if expired := js.requeueExpired(0); len(expired) != 1 || expired[0].Worker != "w/host1" {
+		t.Fatalf("got %+v", expired)
+	}
+	if js.heartbeat(job.Id, "w/host1") || js.finish(job.Id, "w/host1", ScrapeResult{}, nil) {
+		t.Error("the worker whose lease expired could still report on the job")
+	}
+	if _, ok := js.start(job.Id, "w/host2"); !ok || !js.finish(job.Id, "w/host2", ScrapeResult{}, nil) {
+		t.Error("another worker couldn't take over the job")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	renderCtxKey = "gluestick.render"
+	// Set on requests that should be fetched through the renderer, the
+	// transport strips it before anything is sent.
+	renderHeader = "X-Gluestick-Render"
+)
+
+// renderTransport fetches requests marked with renderHeader through a
+// headless browser rendering service instead of directly, ex: Splash or
+// browserless, so JS challenges get a chance to run.  The rendered html is
+// returned as the original url's response so relative links etc still work.
+type renderTransport struct {
+	base http.RoundTripper
+	// Renderer url with "{url}" where the page's escaped url goes, ex:
+	// "http://localhost:8050/render.html?wait=5&url={url}"
+	endpoint string
+}
+
+func checkRenderEndpoint(endpoint string) error {
+	if !strings.Contains(endpoint, "{url}") {
+		return errors.New("missing {url} placeholder")
+	}
+	_, err := url.Parse(strings.Replace(endpoint, "{url}", "", -1))
+	return err
+}
+
+func withRenderer(base http.RoundTripper, endpoint string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &renderTransport{base: base, endpoint: endpoint}
+}
+
+func (rt *renderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get(renderHeader)) == 0 {
+		return rt.base.RoundTrip(req)
+	}
+	renderUrl := strings.Replace(rt.endpoint, "{url}", url.QueryEscape(req.URL.String()), -1)
+	renderReq, err := http.NewRequest(http.MethodGet, renderUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	renderReq = renderReq.WithContext(req.Context())
+	resp, err := rt.base.RoundTrip(renderReq)
+	if err != nil {
+		return nil, err
+	}
+	// as far as colly is concerned this is the original page
+	resp.Request = req
+	if len(resp.Header.Get("Content-Type")) == 0 {
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	return resp, nil
+}
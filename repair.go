@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// Limits on looking for a broken selector's old values in the page.
+const (
+	// Last run values looked for, and for items, results.
+	maxRepairValues  = 20
+	maxRepairResults = 10
+	// Suggestions given for each broken selector.
+	maxRepairSuggestions = 3
+	// Shortest value found within an element's text rather than as all of
+	// it, shorter ones would be found all over.
+	minRepairContains = 3
+)
+
+// Classes and attribute values that can be used in a suggested selector as
+// they are.
+var plainCssIdent = regexp.MustCompile(`^-?[_a-zA-Z][_a-zA-Z0-9-]*$`)
+
+// Attributes that usually identify what an element holds, used in suggested
+// selectors when elements have them.
+var repairAttrs = []string{"itemprop", "data-testid", "data-test", "name"}
+
+// SelectorSuggestion is a selector that finds the values a broken selector
+// found the last time it worked, see suggestRepairs.
+type SelectorSuggestion struct {
+	Selector string `json:"selector"`
+	// Old values it finds of those looked for, or for items, old results it
+	// finds an element for.
+	Found int `json:"found"`
+	Of    int `json:"of"`
+	// Elements it matches, for fields in all of the item's elements.
+	Count int `json:"count"`
+}
+
+// Suggests selectors for the broken selectors in report that worked in the
+// last run of req in store with any results for them: the old values are
+// looked for in the page and selectors for the elements holding them are
+// ranked by how many they find.  Broken fields are looked for within their
+// item's elements, and broken items in the whole page.
+func suggestRepairs(report *HealthReport, req ScrapeRequest, root *goquery.Selection, store *resultStore) error {
+	for i := range report.Selectors {
+		health := &report.Selectors[i]
+		if health.Matched || len(health.Skipped) > 0 {
+			continue
+		}
+		item := req.Items[health.Item]
+		sel, attr := getSelectorAndAttr(health.Selector)
+		if len(health.Field) > 0 && (itemBroken(report, health.Item) || (len(attr) > 0 && isPseudoAttr(attr) && attr != attrOwnText)) {
+			continue // can't be looked for until its item is fixed, or not a value in the page
+		}
+		// the request's runs, or if it's been changed since (ex: its item
+		// selector fixed), those of its url
+		points, err := store.query(HistoryQuery{Config: configKey(req), Item: health.Item, Field: health.Field})
+		if err == nil && len(points) == 0 {
+			points, err = store.query(HistoryQuery{Url: req.Url, Item: health.Item, Field: health.Field})
+		}
+		if err != nil {
+			return err
+		}
+		// the values of each of the last results, one result for fields
+		var results [][]string
+		for p := len(points) - 1; p >= 0 && len(results) == 0; p-- {
+			if len(health.Field) > 0 {
+				if values := repairValues(points[p].Values); len(values) > 0 {
+					results = append(results, values)
+				}
+			} else {
+				for _, result := range valuesOf(points[p].Values) {
+					if values := repairValues(result); len(values) > 0 && len(results) < maxRepairResults {
+						results = append(results, values)
+					}
+				}
+			}
+			if len(results) > 0 {
+				seen := points[p].Time
+				health.LastSeen = &seen
+			}
+		}
+		if len(results) == 0 {
+			continue // never worked, or nothing to look for
+		}
+		if len(health.Field) == 0 {
+			health.Suggestions = suggestItemSelectors(root, results)
+		} else if scope := safeFind(root, item.Selector); scope != nil {
+			if len(sel) == 0 {
+				continue // the item's own attribute, nothing to select
+			}
+			health.Suggestions = suggestFieldSelectors(scope, results[0], attr)
+		}
+	}
+	return nil
+}
+
+func itemBroken(report *HealthReport, item string) bool {
+	for _, health := range report.Selectors {
+		if health.Item == item && len(health.Field) == 0 {
+			return !health.Matched
+		}
+	}
+	return false
+}
+
+// The distinct scalar values within a run's values, normalized as in page
+// text.
+func repairValues(val interface{}) []string {
+	var values []string
+	var add func(val interface{})
+	add = func(val interface{}) {
+		switch v := val.(type) {
+		case []interface{}:
+			for _, elem := range v {
+				add(elem)
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if !strings.HasPrefix(key, "_") { // ex: _language
+					add(v[key])
+				}
+			}
+		case string, float64:
+			s := strings.Join(strings.Fields(fmt.Sprint(v)), " ")
+			if len(s) > 0 && len(values) < maxRepairValues && !containsString(values, s) {
+				values = append(values, s)
+			}
+		}
+	}
+	add(val)
+	return values
+}
+
+// An element holding a value, in attr if it's an attribute's value.
+type valueElement struct {
+	node *html.Node
+	s    *goquery.Selection
+	attr string
+}
+
+// Elements under scope holding each value.  With inAttrs, as the value of
+// any of their attributes, so attributes that were renamed are found too.
+// Otherwise as their text, or for longer values, within their own text.
+func locateValues(scope *goquery.Selection, values []string, inAttrs bool) map[string][]valueElement {
+	found := make(map[string][]valueElement)
+	scope.Find("*").Each(func(_ int, s *goquery.Selection) {
+		node := s.Nodes[0]
+		if inAttrs {
+			for _, a := range node.Attr {
+				if val := strings.TrimSpace(a.Val); containsString(values, val) {
+					found[val] = append(found[val], valueElement{node: node, s: s, attr: a.Key})
+				}
+			}
+			return
+		}
+		text := strings.Join(strings.Fields(s.Text()), " ")
+		own := ownText(s)
+		for _, val := range values {
+			if text == val || (len(val) >= minRepairContains && strings.Contains(own, val)) {
+				found[val] = append(found[val], valueElement{node: node, s: s})
+			}
+		}
+	})
+	return found
+}
+
+// Selectors for s on its own: its tag, with each of its classes and all of
+// them, and with identifying attributes.
+func elementSelectors(s *goquery.Selection) []string {
+	tag := s.Nodes[0].Data
+	selectors := []string{tag}
+	var classes []string
+	for _, class := range strings.Fields(s.AttrOr("class", "")) {
+		if plainCssIdent.MatchString(class) && !containsString(classes, class) {
+			classes = append(classes, class)
+			selectors = append(selectors, tag+"."+class)
+		}
+	}
+	if len(classes) > 1 {
+		selectors = append(selectors, tag+"."+strings.Join(classes, "."))
+	}
+	for _, attr := range repairAttrs {
+		if val, found := s.Attr(attr); found && plainCssIdent.MatchString(val) {
+			selectors = append(selectors, fmt.Sprintf(`%s[%s="%s"]`, tag, attr, val))
+		}
+	}
+	return selectors
+}
+
+// Field selectors that find values within the item's elements (scope).
+// Attribute fields can be suggested another attribute.
+func suggestFieldSelectors(scope *goquery.Selection, values []string, attr string) []SelectorSuggestion {
+	inAttrs := len(attr) > 0 && !isPseudoAttr(attr)
+	located := locateValues(scope, values, inAttrs)
+	type candidate struct {
+		sel, attr string
+	}
+	var candidates []candidate
+	for _, val := range values {
+		for _, e := range located[val] {
+			for _, sel := range elementSelectors(e.s) {
+				c := candidate{sel: sel, attr: e.attr}
+				if !inAttrs {
+					c.attr = attr // ex: ownText
+				}
+				found := false
+				for _, other := range candidates {
+					found = found || other == c
+				}
+				if !found {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+	}
+	var suggestions []SelectorSuggestion
+	for _, c := range candidates {
+		suggestion := SelectorSuggestion{Selector: c.sel, Of: len(values)}
+		if len(c.attr) > 0 {
+			suggestion.Selector += "|" + c.attr
+		}
+		matches := make(map[*html.Node]bool)
+		scope.Each(func(_ int, item *goquery.Selection) {
+			if found := safeFind(item, c.sel); found != nil {
+				for _, n := range found.Nodes {
+					matches[n] = true
+				}
+			}
+		})
+		suggestion.Count = len(matches)
+		for _, val := range values {
+			for _, e := range located[val] {
+				if matches[e.node] && (!inAttrs || e.attr == c.attr) {
+					suggestion.Found++
+					break
+				}
+			}
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	// most values, then fewest other elements
+	return rankSuggestions(suggestions, func(a, b SelectorSuggestion) bool {
+		if a.Found != b.Found {
+			return a.Found > b.Found
+		}
+		if a.Count != b.Count {
+			return a.Count < b.Count
+		}
+		return len(a.Selector) > len(b.Selector) // the more specific
+	})
+}
+
+// Item selectors for elements holding the values of old results, from the
+// elements themselves up to (but not including) the body.  An element finds
+// a result if it holds all of the result's values found in the page that
+// are its own (not also another result's), and none of any other result's.
+func suggestItemSelectors(root *goquery.Selection, results [][]string) []SelectorSuggestion {
+	owners := make(map[string]int)
+	var values []string
+	for r, result := range results {
+		for _, val := range result {
+			if _, found := owners[val]; found {
+				owners[val] = -1 // shared, ex: a "more" link's text
+				continue
+			}
+			owners[val] = r
+			values = append(values, val)
+		}
+	}
+	located := locateValues(root, values, false)
+	var candidates []string
+	for _, val := range values {
+		for _, e := range located[val] {
+			for n := e.s; n.Length() > 0 && !n.Is("body, html"); n = n.Parent() {
+				for _, sel := range elementSelectors(n) {
+					if !containsString(candidates, sel) {
+						candidates = append(candidates, sel)
+					}
+				}
+			}
+		}
+	}
+	// the results' own values each element, or an ancestor of it, holds
+	holds := make(map[*html.Node]map[string]bool)
+	for _, val := range values {
+		if owners[val] < 0 {
+			continue
+		}
+		for _, e := range located[val] {
+			for n := e.node; n != nil; n = n.Parent {
+				if holds[n] == nil {
+					holds[n] = make(map[string]bool)
+				}
+				holds[n][val] = true
+			}
+		}
+	}
+	// which result an element holds, -1 for none or several
+	resultOf := func(n *html.Node) int {
+		r := -1
+		for val := range holds[n] {
+			if r >= 0 && owners[val] != r {
+				return -1
+			}
+			r = owners[val]
+		}
+		if r < 0 {
+			return -1
+		}
+		for _, val := range results[r] {
+			if owners[val] == r && len(located[val]) > 0 && !holds[n][val] {
+				return -1
+			}
+		}
+		return r
+	}
+	var suggestions []SelectorSuggestion
+	for _, sel := range candidates {
+		matches := safeFind(root, sel)
+		if matches == nil {
+			continue
+		}
+		suggestion := SelectorSuggestion{Selector: sel, Of: len(results), Count: matches.Length()}
+		found := make(map[int]bool)
+		for _, m := range matches.Nodes {
+			if r := resultOf(m); r >= 0 {
+				found[r] = true
+			}
+		}
+		suggestion.Found = len(found)
+		suggestions = append(suggestions, suggestion)
+	}
+	// most results, then fewest other elements
+	return rankSuggestions(suggestions, func(a, b SelectorSuggestion) bool {
+		if a.Found != b.Found {
+			return a.Found > b.Found
+		}
+		if a.Count-a.Found != b.Count-b.Found {
+			return a.Count-a.Found < b.Count-b.Found
+		}
+		return len(a.Selector) > len(b.Selector) // the more specific
+	})
+}
+
+// The best few suggestions finding any values, by less.
+func rankSuggestions(suggestions []SelectorSuggestion, less func(a, b SelectorSuggestion) bool) []SelectorSuggestion {
+	sort.SliceStable(suggestions, func(i, j int) bool { return less(suggestions[i], suggestions[j]) })
+	var best []SelectorSuggestion
+	for _, s := range suggestions {
+		if s.Found > 0 && len(best) < maxRepairSuggestions {
+			best = append(best, s)
+		}
+	}
+	return best
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version prefix of the message a -results-sig's hmac is over.
+const resultsSigVersion = "gluestick-results-v1"
+
+// ResultsSignature is the -results-sig file, a detached HMAC-SHA256 over the
+// results as written and the run they're from, so whoever loads them can
+// check they weren't changed on the way.  See message for what's signed.
+type ResultsSignature struct {
+	Algorithm string `json:"algorithm"`
+	// First 8 bytes of the key's sha256, to tell keys apart when rotating
+	// them.
+	KeyId         string    `json:"key_id"`
+	Time          time.Time `json:"time"`
+	Config        string    `json:"config"`
+	Urls          []string  `json:"urls"`
+	ExitCode      int       `json:"exit_code"`
+	ResultsSha256 string    `json:"results_sha256"`
+	ResultsBytes  int64     `json:"results_bytes"`
+	Hmac          string    `json:"hmac"`
+}
+
+// What the hmac is over, a line each: the version, time (RFC 3339), config,
+// urls (comma separated), exit code, results sha256 and size, so any of the
+// run's details can be checked as well as the results.
+func (rs *ResultsSignature) message() []byte {
+	return []byte(strings.Join([]string{
+		resultsSigVersion,
+		rs.Time.UTC().Format(time.RFC3339Nano),
+		rs.Config,
+		strings.Join(rs.Urls, ","),
+		strconv.Itoa(rs.ExitCode),
+		rs.ResultsSha256,
+		strconv.FormatInt(rs.ResultsBytes, 10),
+	}, "\n"))
+}
+
+func resultsHmac(key []byte, rs *ResultsSignature) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(rs.message())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func resultsKeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Reads a -results-key file, the secret being its contents without
+// surrounding whitespace.
+func loadResultsKey(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < 16 {
+		return nil, errors.New("key must be at least 16 bytes")
+	}
+	return key, nil
+}
+
+// Hashes the results as they're written, see signResults.
+type resultsSigner struct {
+	key      []byte
+	filename string
+	sum      hash.Hash
+	size     int64
+}
+
+func newResultsSigner(key []byte, filename string) *resultsSigner {
+	return &resultsSigner{key: key, filename: filename, sum: sha256.New()}
+}
+
+func (rs *resultsSigner) Write(p []byte) (int, error) {
+	rs.size += int64(len(p))
+	return rs.sum.Write(p)
+}
+
+// Writes the signature of everything written so far, if there's a signer.
+// Returns the run's exit code, 1 if the signature couldn't be written.
+func signResults(rs *resultsSigner, req ScrapeRequest, urls []string, exitCode int) int {
+	if rs == nil {
+		return exitCode
+	}
+	sig := &ResultsSignature{
+		Algorithm:     "hmac-sha256",
+		KeyId:         resultsKeyId(rs.key),
+		Time:          time.Now().UTC(),
+		Config:        configKey(req),
+		Urls:          urls,
+		ExitCode:      exitCode,
+		ResultsSha256: hex.EncodeToString(rs.sum.Sum(nil)),
+		ResultsBytes:  rs.size,
+	}
+	sig.Hmac = resultsHmac(rs.key, sig)
+	j, _ := json.MarshalIndent(sig, "", "    ")
+	if err := ioutil.WriteFile(rs.filename, append(j, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write -results-sig, error: %s\n", err)
+		return 1
+	}
+	return exitCode
+}
+
+// "gluestick verify": checks a results file against its -results-sig.
+func verifyResults(keyFilename string, sigFilename string, resultsFilename string) error {
+	if len(keyFilename) == 0 || len(sigFilename) == 0 {
+		return errors.New("-results-key and -results-sig are required")
+	}
+	key, err := loadResultsKey(keyFilename)
+	if err != nil {
+		return fmt.Errorf("failed to load -results-key: %v", err)
+	}
+	data, err := ioutil.ReadFile(sigFilename)
+	if err != nil {
+		return err
+	}
+	var sig ResultsSignature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return fmt.Errorf("invalid -results-sig: %v", err)
+	}
+	if sig.Algorithm != "hmac-sha256" {
+		return fmt.Errorf("unknown algorithm %q", sig.Algorithm)
+	}
+	if sig.KeyId != resultsKeyId(key) {
+		return fmt.Errorf("signed with another key (%s)", sig.KeyId)
+	}
+	if !hmac.Equal([]byte(sig.Hmac), []byte(resultsHmac(key, &sig))) {
+		return errors.New("signature doesn't match, the -results-sig was changed")
+	}
+	results, err := ioutil.ReadFile(resultsFilename)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(results)
+	if int64(len(results)) != sig.ResultsBytes || hex.EncodeToString(sum[:]) != sig.ResultsSha256 {
+		return fmt.Errorf("%q isn't the results that were signed", resultsFilename)
+	}
+	return nil
+}
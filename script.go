@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const itemTypeScript = "script"
+
+// ScriptData is read by "script" items from the page's inline scripts, the
+// state SPAs are hydrated from.  The item's selector and fields are then
+// json paths within it, as for graphql items.
+type ScriptData struct {
+	// Variable the json is assigned to, ex: "window.__INITIAL_STATE__".
+	// Both literals and JSON.parse("...") of a string literal are read.
+	Variable string `json:"variable,omitempty"`
+	// Or a script element whose whole body is json, ex:
+	// "script#__NEXT_DATA__" or "script[type='application/ld+json']".
+	Element string `json:"element,omitempty"`
+}
+
+// The decoded values the page's scripts hold for data, one per matching
+// assignment or element.
+func scriptValues(doc *goquery.Selection, data *ScriptData) []interface{} {
+	var values []interface{}
+	if len(data.Element) > 0 {
+		safeFind(doc, data.Element).Each(func(_ int, s *goquery.Selection) {
+			var val interface{}
+			if json.Unmarshal([]byte(strings.TrimSpace(s.Text())), &val) == nil {
+				values = append(values, val)
+			}
+		})
+		return values
+	}
+	assignment := regexp.MustCompile(`(?:^|[^\w$])` + regexp.QuoteMeta(data.Variable) + `\s*=\s*`)
+	doc.Find("script").Each(func(_ int, s *goquery.Selection) {
+		body := s.Text()
+		for _, loc := range assignment.FindAllStringIndex(body, -1) {
+			rest := body[loc[1]:]
+			if strings.HasPrefix(rest, "=") {
+				continue // a comparison, not an assignment
+			}
+			if val, ok := decodeScriptValue(rest); ok {
+				values = append(values, val)
+			}
+		}
+	})
+	return values
+}
+
+var jsonParseCall = regexp.MustCompile(`^JSON\.parse\(\s*`)
+
+// Decodes the json value at the start of js, which may be followed by more
+// code.  A JSON.parse() of a string literal is unwrapped first.
+func decodeScriptValue(js string) (interface{}, bool) {
+	if loc := jsonParseCall.FindStringIndex(js); loc != nil {
+		str, ok := jsStringLiteral(js[loc[1]:])
+		if !ok {
+			return nil, false
+		}
+		js = str
+	}
+	var val interface{}
+	if err := json.NewDecoder(strings.NewReader(js)).Decode(&val); err != nil {
+		return nil, false
+	}
+	return val, true
+}
+
+// Reads the single or double quoted js string literal js starts with.
+func jsStringLiteral(js string) (string, bool) {
+	if len(js) == 0 || (js[0] != '"' && js[0] != '\'') {
+		return "", false
+	}
+	quote := js[0]
+	var b strings.Builder
+	for i := 1; i < len(js); i++ {
+		c := js[i]
+		if c == quote {
+			return b.String(), true
+		}
+		if c != '\\' || i+1 >= len(js) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch js[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'x', 'u':
+			size := 2
+			if js[i] == 'u' {
+				size = 4
+			}
+			if i+size >= len(js) {
+				return "", false
+			}
+			code, err := strconv.ParseUint(js[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", false
+			}
+			i += size
+			r := rune(code)
+			if utf16.IsSurrogate(r) && strings.HasPrefix(js[i+1:], "\\u") && i+6 < len(js) {
+				// characters outside the BMP are escaped as a surrogate pair
+				if low, err := strconv.ParseUint(js[i+3:i+7], 16, 32); err == nil {
+					r = utf16.DecodeRune(r, rune(low))
+					i += 6
+				}
+			}
+			b.WriteRune(r)
+		default: // \" \' \\ \/ and anything else escaped needlessly
+			b.WriteByte(js[i])
+		}
+	}
+	return "", false
+}
+
+func checkScriptItem(v *validator, path string, item ScrapeItem) {
+	if item.Script == nil || (len(item.Script.Variable) == 0) == (len(item.Script.Element) == 0) {
+		v.add(path+"/script", "requires one of variable or element")
+	} else if len(item.Script.Element) > 0 {
+		if err := checkSelector(item.Script.Element); err != nil {
+			v.add(path+"/script/element", "%v", err)
+		}
+	}
+	if len(item.Fields) == 0 {
+		v.add(path+"/fields", "was empty")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Key each result of a -urls row's run has the row's columns under, so
+// results can be joined back to rows once taken out of their run.
+const rowKey = "_row"
+
+// Key results that aren't objects are kept under when wrapped with their
+// row, see addRowColumns.
+const rowValueKey = "value"
+
+// SeededRun is the output of one of a -seed-from or -urls run's urls.
+type SeededRun struct {
+	Url string `json:"url"`
+	// The -urls row's columns.
+	Vars    map[string]string `json:"vars,omitempty"`
+	Results ScrapeResult      `json:"results,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Urls from a previous run's json output, ex: seedField "products.url" for
+// the url field of each products result.  The output of a -seed-from run
+// works too, so runs can be chained.  Relative urls are resolved against the
+// page they were scraped from when known, otherwise base (the request's
+// url).  Urls are deduped, keeping their order.
+func loadSeeds(filename string, seedField string, base string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var output interface{}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("%q isn't json output of a run: %v", filename, err)
+	}
+	type resultSet struct {
+		results map[string]interface{}
+		pageUrl string
+	}
+	var sets []resultSet
+	switch o := output.(type) {
+	case map[string]interface{}:
+		sets = append(sets, resultSet{o, base})
+	case []interface{}:
+		for _, run := range o {
+			m, _ := run.(map[string]interface{})
+			results, _ := m["results"].(map[string]interface{})
+			pageUrl, _ := m["url"].(string)
+			sets = append(sets, resultSet{results, pageUrl})
+		}
+	default:
+		return nil, fmt.Errorf("%q isn't json output of a run", filename)
+	}
+
+	item, path := seedField, ""
+	if idx := strings.Index(seedField, "."); idx >= 0 {
+		item, path = seedField[:idx], seedField[idx+1:]
+	}
+	var urls []string
+	seen := make(map[string]bool)
+	for _, set := range sets {
+		for _, result := range valuesOf(set.results[item]) {
+			val := result
+			if len(path) > 0 {
+				m, ok := result.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if val, ok = fieldByPath(m, path); !ok {
+					continue
+				}
+			}
+			for _, v := range valuesOf(val) {
+				ref := strings.TrimSpace(fmt.Sprint(v))
+				if len(ref) == 0 {
+					continue
+				}
+				u, err := resolveSeed(set.pageUrl, ref)
+				if err != nil {
+					return nil, err
+				}
+				if !seen[u] {
+					seen[u] = true
+					urls = append(urls, u)
+				}
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no %q values in %q", seedField, filename)
+	}
+	return urls, nil
+}
+
+func resolveSeed(base string, ref string) (string, error) {
+	if len(base) > 0 {
+		return resolveUrl(base, ref)
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("relative url %q, and the request has no url to resolve it against", ref)
+	}
+	return ref, nil
+}
+
+// Runs a request once per seed, recording each run like a single scrape's.
+// A failed seed doesn't stop the others.
+type seedRunner struct {
+	runStatus
+	req      ScrapeRequest
+	opts     scrapeOptions
+	recorder *runRecorder
+}
+
+// Scrapes run.Url, filling in the run's results or error.
+func (sr *seedRunner) run(run *SeededRun) {
+	seedReq := sr.req
+	seedReq.Url = run.Url
+	results, err := scrape(seedReq, sr.opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while scraping %s: %s\n", run.Url, err)
+		run.Error = err.Error()
+		sr.scrapeFailed(err)
+		return
+	}
+	if len(run.Vars) > 0 {
+		addRowColumns(results, run.Vars)
+	}
+	if sr.opts.Stable {
+		stableOrder(seedReq, results)
+	}
+	run.Results = results
+	anomalies, err := sr.recorder.record(seedReq, results, countResults(results))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after scraping %s: %s\n", run.Url, err)
+		sr.add(runFailed)
+	}
+	for _, anomaly := range anomalies {
+		fmt.Fprintf(os.Stderr, "ANOMALY: %s: %s\n", run.Url, anomaly)
+		sr.add(runAnomalous)
+	}
+}
+
+// Adds the row's columns to each result of every item.  Results that aren't
+// objects (ex: a pdf's text) are wrapped in one, as {"value": ..., "_row":
+// ...}, so every result can be joined back to its row.
+func addRowColumns(results ScrapeResult, vars map[string]string) {
+	for name, val := range results {
+		if name == metaKey {
+			continue
+		}
+		vals := valuesOf(val)
+		for i, result := range vals {
+			plain := plainValue(result)
+			if m, ok := plain.(map[string]interface{}); ok {
+				m[rowKey] = vars
+				vals[i] = m
+			} else {
+				vals[i] = map[string]interface{}{rowValueKey: plain, rowKey: vars}
+			}
+		}
+		if len(vals) == 1 {
+			if _, many := val.([]interface{}); !many {
+				results[name] = vals[0]
+			}
+		}
+	}
+}
+
+// Runs each url read from r, a line each, as it arrives, writing each run
+// to w as a line of json.  Relative urls are resolved against the request's.
+func (sr *seedRunner) stream(r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		run := SeededRun{Url: line}
+		if seedUrl, err := resolveSeed(sr.req.Url, line); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid url from stdin: %s\n", err)
+			run.Error = err.Error()
+			sr.add(runFailed)
+		} else {
+			run.Url = seedUrl
+			sr.run(&run)
+		}
+		if err := enc.Encode(run); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Seeds from a csv file (tab separated if named .tsv) with a header row, one
+// per row.  The row's columns fill {column} placeholders in the request's
+// url, or if it has none the "url" column is the url (relative to the
+// request's).
+func loadUrlRows(filename string, template string) ([]SeededRun, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	if strings.EqualFold(filepath.Ext(filename), ".tsv") {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%q is empty", filename)
+	} else if err != nil {
+		return nil, err
+	}
+	for i, col := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(col, "\ufeff"))
+	}
+	placeholders := pipelinePlaceholder.FindAllStringSubmatch(template, -1)
+	for _, m := range placeholders {
+		if !containsString(header, m[1]) {
+			return nil, fmt.Errorf("the request's url has a {%s} placeholder, but %q has no such column", m[1], filename)
+		}
+	}
+	if len(placeholders) == 0 && !containsString(header, "url") {
+		return nil, fmt.Errorf("%q needs a url column, or the request's url {column} placeholders to fill", filename)
+	}
+
+	var seeds []SeededRun
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		vars := make(map[string]string, len(header))
+		fields := make(map[string]interface{}, len(header))
+		for i, col := range header {
+			vars[col] = strings.TrimSpace(record[i])
+			fields[col] = vars[col]
+		}
+		var seedUrl string
+		if len(placeholders) > 0 {
+			urls, err := pipelineUrls(template, pipelineParent{result: fields})
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", row, err)
+			}
+			seedUrl = urls[0]
+		} else if len(vars["url"]) == 0 {
+			return nil, fmt.Errorf("row %d: url is empty", row)
+		} else if seedUrl, err = resolveSeed(template, vars["url"]); err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		seeds = append(seeds, SeededRun{Url: seedUrl, Vars: vars})
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("%q has no rows", filename)
+	}
+	return seeds, nil
+}
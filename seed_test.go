@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddRowColumns(t *testing.T) {
+	vars := map[string]string{"id": "1001"}
+	results := ScrapeResult{
+		"info":  map[string]interface{}{"price": "$89.99"},
+		"tags":  []interface{}{"shoes", map[string]interface{}{"name": "sale"}},
+		"text":  "Spec sheet",
+		"pages": []interface{}{"one"},
+		"empty": []interface{}{},
+		metaKey: &ScrapeMeta{},
+	}
+	addRowColumns(results, vars)
+	delete(results, metaKey)
+	got, _ := json.Marshal(results)
+	want := `{"empty":[],` +
+		`"info":{"_row":{"id":"1001"},"price":"$89.99"},` +
+		`"pages":[{"_row":{"id":"1001"},"value":"one"}],` +
+		`"tags":[{"_row":{"id":"1001"},"value":"shoes"},{"_row":{"id":"1001"},"name":"sale"}],` +
+		`"text":{"_row":{"id":"1001"},"value":"Spec sheet"}}`
+	if string(got) != want {
+		t.Errorf("got %s, expected %s", got, want)
+	}
+}
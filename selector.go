@@ -0,0 +1,331 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// Pseudo attributes: only an element's own text, not its descendants', the
+// number of elements matched, whether any were, and an image's real url.
+const (
+	attrOwnText = "owntext"
+	attrCount   = "count"
+	attrExists  = "exists"
+	attrImage   = "image"
+)
+
+func isPseudoAttr(attr string) bool {
+	_, image := imageAttrs(attr)
+	return image || attr == attrOwnText || attr == attrCount || attr == attrExists
+}
+
+// Where lazy loading scripts keep an image's real url, in the order they are
+// tried by "|image".  "src" is last as it is usually the placeholder.
+var defaultImageAttrs = []string{"data-src", "data-lazy-src", "data-original", "data-srcset", "srcset", "src"}
+
+// The attributes an "|image" or "|image(data-hi-res, src)" pseudo attribute
+// looks in, ok false for other attributes.
+func imageAttrs(attr string) (attrs []string, ok bool) {
+	if attr == attrImage {
+		return defaultImageAttrs, true
+	}
+	if !strings.HasPrefix(attr, attrImage+"(") || !strings.HasSuffix(attr, ")") {
+		return nil, false
+	}
+	list := attr[len(attrImage)+1 : len(attr)-1]
+	return strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }), true
+}
+
+// The first usable image url in attrs: blank values and inline data: urls
+// (placeholders) are skipped, and for srcset attributes the largest
+// candidate is used.
+func imageUrl(sel *goquery.Selection, attrs []string) (string, bool) {
+	for _, attr := range attrs {
+		val := strings.TrimSpace(sel.AttrOr(attr, ""))
+		if strings.HasSuffix(attr, "srcset") {
+			val = largestSrcset(parseSrcset(val))
+		}
+		if len(val) > 0 && !strings.HasPrefix(strings.ToLower(val), "data:") {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// Text directly inside the element, whitespace collapsed, ex: "Price: $10"
+// for <div>Price: <span>old</span> $10</div>.
+func ownText(sel *goquery.Selection) string {
+	var b strings.Builder
+	for _, n := range sel.Nodes {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.TextNode {
+				b.WriteString(child.Data)
+				b.WriteString(" ")
+			}
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+const documentPrefix = "document:"
+
+// The document root is in, so fields can pull in page level values.
+func documentRoot(root *goquery.Selection) *goquery.Selection {
+	if len(root.Nodes) == 0 {
+		return root
+	}
+	n := root.Nodes[0]
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return goquery.NewDocumentFromNode(n).Selection
+}
+
+// A trailing "[n]" or python style "[n:m]" slice of a field's matches.
+var indexSuffix = regexp.MustCompile(`\[\s*(-?\d*)\s*(:\s*(-?\d*)\s*)?\]$`)
+
+// Splits a trailing index/slice off selector.  The range is [start, end) of
+// matches, negative counting from the end, with hasEnd false meaning through
+// the last match.
+func splitIndex(selector string) (sel string, start int, end int, hasEnd bool, found bool) {
+	m := indexSuffix.FindStringSubmatchIndex(selector)
+	if m == nil {
+		return selector, 0, 0, false, false
+	}
+	groups := indexSuffix.FindStringSubmatch(selector)
+	if len(groups[1]) == 0 && len(groups[2]) == 0 {
+		return selector, 0, 0, false, false // "[]", leave it to the css parser
+	}
+	start, _ = strconv.Atoi(groups[1])
+	if len(groups[2]) == 0 { // "[n]" is a single match
+		end, hasEnd = start+1, true
+		if start == -1 {
+			hasEnd = false
+		}
+	} else if len(groups[3]) > 0 {
+		end, _ = strconv.Atoi(groups[3])
+		hasEnd = true
+	}
+	return strings.TrimSpace(selector[:m[0]]), start, end, hasEnd, true
+}
+
+// Selects the elements a field selector matches under root.  Besides plain
+// css (matched against root's descendants) a selector can start with
+// ":scope" or a combinator to be relative to root itself, ex: ":scope > li"
+// for only direct children, or "+ p" for the element right after root.  A
+// trailing "[n]" or "[n:m]" keeps only those matches, ex: "td[2]" for the
+// third cell.  A "document:" prefix matches against the whole page instead of
+// root, ex: "document:title".  ">>>" descends into the shadow roots of the
+// elements matched so far, see selectShadow.
+func selectFrom(root *goquery.Selection, selector string) *goquery.Selection {
+	if strings.HasPrefix(selector, documentPrefix) {
+		root = documentRoot(root)
+		selector = strings.TrimSpace(strings.TrimPrefix(selector, documentPrefix))
+	}
+	sel, start, end, hasEnd, indexed := splitIndex(selector)
+	if !indexed {
+		return selectAll(root, selector)
+	}
+	matches := selectAll(root, sel)
+	n := matches.Length()
+	if start < 0 {
+		start += n
+	}
+	if !hasEnd {
+		end = n
+	} else if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > n {
+		end = n
+	}
+	if start >= end {
+		return matches.FilterFunction(func(int, *goquery.Selection) bool { return false })
+	}
+	return matches.Slice(start, end)
+}
+
+func selectAll(root *goquery.Selection, selector string) *goquery.Selection {
+	shadow := strings.Contains(selector, shadowCombinator)
+	if !shadow && !isScoped(selector) {
+		return root.Find(selector)
+	}
+	// NOTE: not root.Slice(0, 0), adding to that would overwrite root's nodes
+	matches := root.FilterFunction(func(int, *goquery.Selection) bool { return false })
+	for _, group := range splitSelectorGroups(selector) {
+		if shadow {
+			matches = matches.Union(selectShadow(root, group))
+		} else {
+			matches = matches.Union(selectScoped(root, group))
+		}
+	}
+	return matches
+}
+
+// Pierces shadow roots, ex: "product-card >>> span.price".
+const shadowCombinator = ">>>"
+
+// Declarative shadow roots, as server rendered web components and rendering
+// services that serialize shadow DOM put them in the html.
+const shadowRootSelector = "template[shadowrootmode], template[shadowroot]"
+
+// Matches each ">>>" separated part of selector within the shadow roots of
+// what the part before it matched, so "product-card >>> span.price" is a
+// span.price inside a product-card's shadow root and not in its light DOM.
+// A leading ">>>" starts from root's own shadow root, and a trailing one
+// gives the shadow roots themselves.
+func selectShadow(root *goquery.Selection, selector string) *goquery.Selection {
+	parts := splitShadowParts(selector)
+	cur := root
+	if len(parts[0]) > 0 {
+		cur = selectAll(root, parts[0])
+	}
+	for _, part := range parts[1:] {
+		cur = cur.ChildrenFiltered(shadowRootSelector)
+		if len(part) > 0 {
+			cur = selectAll(cur, part)
+		}
+	}
+	return cur
+}
+
+// Splits a selector on ">>>" outside of quotes, brackets and parens.
+func splitShadowParts(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(selector); i++ {
+		c := selector[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case depth == 0 && strings.HasPrefix(selector[i:], shadowCombinator):
+			parts = append(parts, strings.TrimSpace(selector[start:i]))
+			i += len(shadowCombinator) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(selector[start:]))
+}
+
+func isScoped(selector string) bool {
+	for _, group := range splitSelectorGroups(selector) {
+		if strings.HasPrefix(group, ":scope") || strings.IndexAny(group, ">+~") == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Walks selector a step at a time from root, see splitSelectorSteps.
+func selectScoped(root *goquery.Selection, selector string) *goquery.Selection {
+	selector = strings.TrimSpace(selector)
+	if !strings.HasPrefix(selector, ":scope") && strings.IndexAny(selector, ">+~") != 0 {
+		return root.Find(selector) // another group of the same selector
+	}
+	cur := root
+	rest := strings.TrimPrefix(selector, ":scope")
+	if len(rest) > 0 && !strings.ContainsAny(rest[:1], " \t\n>+~") {
+		// ":scope.open > li" style, the first step filters root itself
+		steps := splitSelectorSteps(rest)
+		cur = cur.Filter(steps[0])
+		rest = strings.Join(steps[1:], "")
+	}
+	for _, step := range splitSelectorSteps(rest) {
+		step = strings.TrimSpace(step)
+		combinator := " "
+		if strings.IndexAny(step, ">+~") == 0 {
+			combinator, step = step[:1], strings.TrimSpace(step[1:])
+		}
+		switch combinator {
+		case ">":
+			cur = cur.ChildrenFiltered(step)
+		case "+":
+			cur = cur.NextFiltered(step)
+		case "~":
+			cur = cur.NextAllFiltered(step)
+		default:
+			cur = cur.Find(step)
+		}
+	}
+	return cur
+}
+
+// Parses selector to catch mistakes (ex: a bad :matches() regex) up front,
+// rather than them silently matching nothing.
+func checkSelector(selector string) error {
+	selector = strings.TrimSpace(strings.TrimPrefix(selector, documentPrefix))
+	selector, _, _, _, _ = splitIndex(selector)
+	for _, group := range splitSelectorGroups(selector) {
+		if parts := splitShadowParts(group); len(parts) > 1 {
+			for _, part := range parts {
+				if err := checkSelector(part); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(group, ":scope") {
+			group = strings.TrimPrefix(group, ":scope")
+			if len(group) > 0 && !strings.ContainsAny(group[:1], " \t\n>+~") {
+				group = "*" + group // ":scope.open > li", the root's own filter
+			}
+		}
+		group = strings.TrimSpace(group)
+		if strings.IndexAny(group, ">+~") == 0 {
+			group = strings.TrimSpace(group[1:])
+		}
+		if len(group) == 0 {
+			continue
+		}
+		if _, err := cascadia.ParseGroup(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks every field selector, recursing into nested fields.  path is the
+// dotted name of fields' parent, "" at the top.
+func checkFieldSelectors(v *validator, path string, fields map[string]interface{}) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fieldPath := path + jsonPointer(name)
+		switch field := fields[name].(type) {
+		case string:
+			if isUrlField(field) {
+				if err := checkUrlField(field); err != nil {
+					v.add(fieldPath, "%v", err)
+				}
+				continue
+			}
+			sel, _ := getSelectorAndAttr(field)
+			if err := checkSelector(sel); err != nil {
+				v.add(fieldPath, "invalid selector %q: %v", sel, err)
+			}
+		case map[string]interface{}:
+			checkFieldSelectors(v, fieldPath, field)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed ui/index.html
+var uiPage []byte
+
+type serverConfig struct {
+	Addr   string
+	Scrape scrapeOptions
+	// Limits protecting the server from oversized or pathological requests.
+	// Item/field limits are part of Runtime.
+	MaxBodyBytes int64
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// CORS settings for browser based clients.  No origins means CORS disabled.
+	CorsOrigins []string
+	CorsMethods []string
+	CorsHeaders []string
+	CorsMaxAge  time.Duration
+	// How long finished jobs and their results are kept around.
+	JobRetention time.Duration
+	// Settings that can be changed while running, as given by flags.
+	// ConfigFile, if set, overrides them and is reloaded on SIGHUP.
+	Runtime    runtimeConfig
+	ConfigFile string
+	// Enables the /admin endpoints, which require it as a bearer token.
+	AdminToken string
+	// If set, every endpoint but the UI requires one of these keys with a
+	// role allowing it, see requirePermission.
+	ApiKeys []ApiKey
+	// Applies Runtime's rate limit and allow/deny lists to Scrape.Transport.
+	Policy *targetPolicy
+	// Per domain request stats recorded by Scrape.Transport, if enabled.
+	Stats *domainStats
+	// Records every scrape request, if set.
+	Audit *auditLog
+	// When distributed, background jobs are only run by remote workers
+	// claiming them via /work/claim.  A claimed job whose worker doesn't send
+	// a heartbeat or its results within WorkLease is handed out again.
+	// Results over MaxWorkResult bytes are refused.
+	Distributed   bool
+	WorkLease     time.Duration
+	MaxWorkResult int64
+	// Hosts (and their subdomains) jobs' webhooks can be sent to, any
+	// public host if empty.  Only these can be internal addresses.
+	WebhookAllow []string
+	// Whether "download" items are allowed, they write to the server's disk.
+	Downloads bool
+	// Max /scrape results cached for requests with a cache_ttl, and the
+	// longest they can be reused for.  Zero size disables caching.
+	CacheSize   int
+	CacheMaxTtl time.Duration
+	// Results of every scrape and job are appended to, if set, and queried
+	// by /history.
+	Store *resultStore
+	// Exports the metrics of every scrape and job, see recordRun.
+	Metrics *metricsExporter
+}
+
+type server struct {
+	conf        serverConfig
+	runtimeLock sync.RWMutex
+	rt          runtimeConfig
+	// ApiKeys plus the AdminToken as an admin key.
+	keys         []ApiKey
+	keysRequired bool
+	jobs         *jobStore
+	queue        *workQueue
+	remote       *workQueue
+	cache        *resultCache
+	previews     *previewCache
+}
+
+func runServer(conf serverConfig) error {
+	if conf.Runtime.Workers < 1 {
+		conf.Runtime.Workers = 1
+	}
+	s := &server{
+		conf:     conf,
+		jobs:     newJobStore(conf.JobRetention),
+		queue:    newWorkQueue(0),
+		remote:   newWorkQueue(0),
+		previews: newPreviewCache(),
+	}
+	s.jobs.onDone = s.recordRun
+	s.jobs.webhooks = newWebhookPolicy(conf.WebhookAllow)
+	s.keys = append(s.keys, conf.ApiKeys...)
+	s.keysRequired = len(conf.ApiKeys) > 0
+	if len(conf.AdminToken) > 0 {
+		s.keys = append(s.keys, ApiKey{Key: conf.AdminToken, Name: "admin-token", Role: roleAdmin})
+	}
+	rc, err := s.loadRuntimeConfig()
+	if err != nil {
+		return fmt.Errorf("invalid -server-config: %s", err)
+	}
+	s.applyRuntimeConfig(rc)
+	if len(conf.ConfigFile) > 0 {
+		go s.reloadOnHangup()
+	}
+	if conf.CacheSize > 0 && conf.CacheMaxTtl > 0 {
+		s.cache = newResultCache(conf.CacheSize, conf.CacheMaxTtl)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scrape", s.requirePermission(permSubmit, s.handleScrape))
+	mux.HandleFunc("/scrape/stream", s.requirePermission(permSubmit, s.handleScrapeStream))
+	mux.HandleFunc("/estimate", s.requirePermission(permSubmit, s.handleEstimate))
+	mux.HandleFunc("/jobs", s.requirePermission(permSubmit, s.handleJobs))
+	mux.HandleFunc("/jobs/", s.requirePermission(permRead, s.handleJob))
+	if conf.Distributed {
+		mux.HandleFunc("/work/claim", s.requirePermission(permWork, s.handleWorkClaim))
+		mux.HandleFunc("/work/", s.requirePermission(permWork, s.handleWork))
+		go s.requeueExpiredWork()
+	}
+	mux.HandleFunc("/metrics", s.requirePermission(permRead, s.handleMetrics))
+	if conf.Store != nil {
+		mux.HandleFunc("/history", s.requirePermission(permRead, s.handleHistory))
+		mux.HandleFunc("/grafana", s.requirePermission(permRead, s.handleGrafana))
+		mux.HandleFunc("/grafana/", s.requirePermission(permRead, s.handleGrafana))
+	}
+	if conf.Stats != nil {
+		mux.HandleFunc("/stats/domains", s.requirePermission(permRead, s.handleDomainStats))
+	}
+	if len(s.keys) > 0 {
+		mux.HandleFunc("/admin/config", s.requirePermission(permAdmin, s.handleAdminConfig))
+		mux.HandleFunc("/admin/reload", s.requirePermission(permAdmin, s.handleAdminReload))
+	}
+	mux.HandleFunc("/openapi.json", s.handleOpenApi)
+	mux.HandleFunc("/", s.handleUi)
+
+	httpServer := &http.Server{
+		Addr:              conf.Addr,
+		Handler:           s.withCors(mux),
+		ReadTimeout:       conf.ReadTimeout,
+		ReadHeaderTimeout: conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    1 << 16,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+	log.Println("Serving on", conf.Addr)
+	return httpServer.ListenAndServe()
+}
+
+type connCtxKey struct{}
+
+// Pushes back the deadline for writing to r's connection, set from
+// -write-timeout when the request was read, for responses that go on for
+// longer than that.  Does nothing with no -write-timeout.
+func (s *server) extendWriteDeadline(r *http.Request) {
+	conn, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+	if conn != nil && s.conf.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.conf.WriteTimeout))
+	}
+}
+
+// Adds CORS headers for allowed origins and answers preflight requests.
+func (s *server) withCors(next http.Handler) http.Handler {
+	if len(s.conf.CorsOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || !s.corsAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(s.conf.CorsMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.conf.CorsHeaders, ", "))
+			if s.conf.CorsMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(s.conf.CorsMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) corsAllowed(origin string) bool {
+	for _, allowed := range s.conf.CorsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serves the embedded single page UI for building and running scrapes.
+func (s *server) handleUi(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
+
+// POST /scrape runs a scrape and returns its results.  With ?preview=true,
+// as the UI's live preview sends, pages fetched by recent previews are
+// reused, see previewCache.
+func (s *server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	scrapeReq, status, err := s.readScrapeRequest(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	opts := s.conf.Scrape
+	if r.URL.Query().Get("preview") == "true" {
+		opts.Transport = s.previews.transport(opts.Transport, scrapeReq.owner)
+	}
+	run := func() (ScrapeResult, error) {
+		var results ScrapeResult
+		var err error
+		done := make(chan struct{})
+		s.queue.submit(&task{priority: interactivePriority, run: func() {
+			defer close(done)
+			results, err = scrape(scrapeReq, opts)
+			if err == nil {
+				s.recordRun(scrapeReq, results)
+			}
+		}})
+		<-done
+		return results, err
+	}
+	var results ScrapeResult
+	if s.cache != nil && scrapeReq.CacheTtl > 0 {
+		ttl := time.Duration(scrapeReq.CacheTtl * float64(time.Second))
+		results, err = s.cache.get(scrapeReq, ttl, run)
+	} else {
+		results, err = run()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("error while scraping: %w", err))
+		return
+	}
+	writeJson(w, http.StatusOK, results)
+}
+
+// Reads, parses and validates a ScrapeRequest from the request body.
+// On failure returns the http status code to respond with.  Either way the
+// request is recorded in the audit log, if any.
+func (s *server) readScrapeRequest(r *http.Request) (ScrapeRequest, int, error) {
+	scrapeReq, parsed, status, err := s.parseScrapeRequest(r)
+	scrapeReq.owner = keyName(r)
+	if s.conf.Audit != nil {
+		var req *ScrapeRequest
+		if parsed {
+			req = &scrapeReq
+		}
+		s.conf.Audit.record(r, req, status, err)
+	}
+	return scrapeReq, status, err
+}
+
+func (s *server) parseScrapeRequest(r *http.Request) (scrapeReq ScrapeRequest, parsed bool, status int, err error) {
+	// Read one byte past the limit to tell "exactly at limit" from "over limit".
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.conf.MaxBodyBytes+1))
+	if err != nil {
+		return scrapeReq, false, http.StatusBadRequest, fmt.Errorf("failed to read request body: %s", err)
+	}
+	if int64(len(body)) > s.conf.MaxBodyBytes {
+		return scrapeReq, false, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body exceeds %d bytes", s.conf.MaxBodyBytes)
+	}
+	if scrapeReq, err = parseRequest(body); err != nil {
+		return scrapeReq, false, http.StatusBadRequest, fmt.Errorf("failed to parse request as json: %s", err)
+	}
+	if err := validate(&scrapeReq); err != nil {
+		return scrapeReq, true, http.StatusBadRequest, fmt.Errorf("invalid scrape request: %w", err)
+	}
+	if err := s.checkLimits(&scrapeReq); err != nil {
+		return scrapeReq, true, http.StatusUnprocessableEntity, err
+	}
+	if len(scrapeReq.Session) > 0 && s.conf.Scrape.Sessions == nil {
+		return scrapeReq, true, http.StatusUnprocessableEntity,
+			errors.New("sessions are disabled, they need -session-ttl and can't be used with -cookies")
+	}
+	if u, err := url.Parse(scrapeReq.Url); err == nil && s.conf.Policy != nil {
+		if err := s.conf.Policy.check(u.Host); err != nil {
+			return scrapeReq, true, http.StatusForbidden, err
+		}
+		// checked again as they're connected to, this is to fail early
+		for _, name := range sortedItemNames(scrapeReq.Items) {
+			if ws := scrapeReq.Items[name].Websocket; ws != nil && !ws.Rendered {
+				if target, _, err := websocketTarget(scrapeReq.Url, ws); err == nil {
+					if err := s.conf.Policy.check(target.Host); err != nil {
+						return scrapeReq, true, http.StatusForbidden, fmt.Errorf("items[%q]: %v", name, err)
+					}
+				}
+			}
+		}
+	}
+	return scrapeReq, true, http.StatusOK, nil
+}
+
+func (s *server) checkLimits(req *ScrapeRequest) error {
+	limits := s.runtime()
+	items := []map[string]ScrapeItem{req.Items}
+	numItems := len(req.Items)
+	for _, step := range req.Pipeline {
+		items = append(items, step.Items)
+		numItems += len(step.Items)
+	}
+	if limits.MaxItems > 0 && numItems > limits.MaxItems {
+		return fmt.Errorf("request has %d items, max allowed is %d", numItems, limits.MaxItems)
+	}
+	if limits.MaxFields > 0 {
+		numFields := 0
+		for _, stepItems := range items {
+			for _, item := range stepItems {
+				numFields += countFields(item.Fields)
+			}
+		}
+		if numFields > limits.MaxFields {
+			return fmt.Errorf("request has %d fields, max allowed is %d", numFields, limits.MaxFields)
+		}
+	}
+	if !s.conf.Downloads {
+		for _, stepItems := range items {
+			for _, name := range sortedItemNames(stepItems) {
+				if stepItems[name].Type == itemTypeDownload {
+					return fmt.Errorf("items[%q]: download items are disabled, they need -server-downloads", name)
+				}
+			}
+		}
+	}
+	if limits.MaxWebsocketSeconds > 0 {
+		max := time.Duration(limits.MaxWebsocketSeconds * float64(time.Second))
+		for _, stepItems := range items {
+			for _, name := range sortedItemNames(stepItems) {
+				ws := stepItems[name].Websocket
+				if ws != nil && !ws.Rendered && websocketDuration(ws) > max {
+					return fmt.Errorf("items[%q] listens for %s, max allowed is %s", name, websocketDuration(ws), max)
+				}
+			}
+		}
+	}
+	if limits.MaxPipelineRuns > 0 {
+		runs := 0
+		for idx, step := range req.Pipeline {
+			if step.Limit == 0 {
+				return fmt.Errorf("pipeline[%d] has no limit, max allowed is %d runs", idx, limits.MaxPipelineRuns)
+			}
+			runs += step.Limit
+		}
+		if runs > limits.MaxPipelineRuns {
+			return fmt.Errorf("pipeline runs up to %d times, max allowed is %d", runs, limits.MaxPipelineRuns)
+		}
+	}
+	if limits.MaxCrawlPages > 0 && req.Crawl != nil {
+		// crawls default to 100 pages
+		pages := req.Crawl.MaxPages
+		if pages == 0 {
+			pages = 100
+		}
+		if pages > limits.MaxCrawlPages {
+			return fmt.Errorf("crawl fetches up to %d pages, max allowed is %d", pages, limits.MaxCrawlPages)
+		}
+	}
+	return nil
+}
+
+// Number of leaf value selectors, including those in nested fields.
+func countFields(fields map[string]interface{}) int {
+	count := 0
+	for _, field := range fields {
+		if nested, ok := field.(map[string]interface{}); ok {
+			count += countFields(nested)
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// Stores a successful run's results and exports its metrics, if enabled.
+func (s *server) recordRun(req ScrapeRequest, results ScrapeResult) {
+	if req.DryRun {
+		return
+	}
+	if s.conf.Store != nil {
+		if err := s.conf.Store.add(req, results, countResults(results)); err != nil {
+			log.Println("Failed to store results:", err)
+		}
+	}
+	if s.conf.Metrics != nil {
+		if err := s.conf.Metrics.record(req, results); err != nil {
+			log.Println("Failed to export metrics:", err)
+		}
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("ERROR: failed to write response: %s\n", err)
+	}
+}
+
+// Errors are {"error": "..."}, with "errors" listing each problem for
+// invalid scrape requests, see ValidationErrors, and "assertion" saying why
+// for pages failing the request's assertions, see AssertionError.
+func writeError(w http.ResponseWriter, status int, err error) {
+	var problems ValidationErrors
+	if errors.As(err, &problems) {
+		writeJson(w, status, map[string]interface{}{"error": err.Error(), "errors": problems})
+		return
+	}
+	var assertErr *AssertionError
+	if errors.As(err, &assertErr) {
+		writeJson(w, status, map[string]string{"error": err.Error(), "assertion": assertErr.Reason})
+		return
+	}
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/cookiejar"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Named sessions kept in the server (or worker) process between scrapes, for
+// requests with "session".  Scrapes sharing a session share its cookies (ex:
+// a login) and keep each domain on the same -bind IP, as with
+// "sticky_session" but across runs.  Together with the connections the
+// transport keeps open, frequent scrapes of a site stay warm.  Each api key
+// has its own sessions, so clients can't use each other's logins.
+type sessionStore struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	sessions map[sessionKey]*warmSession
+}
+
+type sessionKey struct {
+	// Name of the api key, blank without -api-keys.
+	owner string
+	name  string
+}
+
+type warmSession struct {
+	jar *cookieJar
+	// See sessionHeader.
+	id       string
+	lastUsed time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{ttl: ttl, sessions: make(map[sessionKey]*warmSession)}
+}
+
+// The owner's named session, started afresh if it's new or went unused for
+// longer than the ttl.
+func (ss *sessionStore) get(owner string, name string) *warmSession {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	now := time.Now()
+	for n, ws := range ss.sessions {
+		if now.Sub(ws.lastUsed) > ss.ttl {
+			delete(ss.sessions, n)
+		}
+	}
+	key := sessionKey{owner: owner, name: name}
+	ws, found := ss.sessions[key]
+	if !found {
+		jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+		ws = &warmSession{
+			jar: &cookieJar{Jar: jar, cookies: make(map[string]savedCookie)},
+			id:  strconv.FormatInt(now.UnixNano(), 36),
+		}
+		ss.sessions[key] = ws
+	}
+	ws.lastUsed = now
+	return ws
+}
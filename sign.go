@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A request signer loaded from -sign, for internal APIs that want an HMAC of
+// the request in a header or query param.  Message, Headers and Query are
+// templates, see signVars for the placeholders.
+type signer struct {
+	// Hosts whose requests are signed.
+	Hosts  []string `json:"hosts"`
+	Secret string   `json:"secret"`
+	// "sha256" (default), "sha1" or "sha512".
+	Hash string `json:"hash,omitempty"`
+	// Encoding of {signature}: "hex" (default) or "base64".
+	Encoding string `json:"encoding,omitempty"`
+	// Format of {timestamp}: "unix" (default), "unix_ms" or "rfc3339".
+	Timestamp string `json:"timestamp,omitempty"`
+	// What is signed, ex: "{method}\n{path}\n{timestamp}".
+	Message string            `json:"message"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+}
+
+func loadSigners(filename string) ([]signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var signers []signer
+	if err := json.Unmarshal(data, &signers); err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no signers")
+	}
+	for i := range signers {
+		s := &signers[i]
+		if len(s.Hosts) == 0 || len(s.Secret) == 0 || len(s.Message) == 0 {
+			return nil, fmt.Errorf("signer %d: hosts, secret and message are required", i)
+		}
+		if len(s.Headers) == 0 && len(s.Query) == 0 {
+			return nil, fmt.Errorf("signer %d: needs headers or query to put the signature in", i)
+		}
+		if s.hashFunc() == nil {
+			return nil, fmt.Errorf("signer %d: unknown hash %q", i, s.Hash)
+		}
+		switch s.Encoding {
+		case "", "hex", "base64":
+		default:
+			return nil, fmt.Errorf("signer %d: unknown encoding %q", i, s.Encoding)
+		}
+		switch s.Timestamp {
+		case "", "unix", "unix_ms", "rfc3339":
+		default:
+			return nil, fmt.Errorf("signer %d: unknown timestamp %q", i, s.Timestamp)
+		}
+		for j, host := range s.Hosts {
+			s.Hosts[j] = strings.ToLower(host)
+		}
+	}
+	return signers, nil
+}
+
+func (s *signer) hashFunc() func() hash.Hash {
+	switch s.Hash {
+	case "", "sha256":
+		return sha256.New
+	case "sha1":
+		return sha1.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+// Placeholders available to templates.  {signature} is only available to
+// Headers and Query.
+func signVars(req *http.Request, body []byte, now time.Time, format string) map[string]string {
+	var timestamp string
+	switch format {
+	case "unix_ms":
+		timestamp = strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	case "rfc3339":
+		timestamp = now.UTC().Format(time.RFC3339)
+	default:
+		timestamp = strconv.FormatInt(now.Unix(), 10)
+	}
+	bodyHash := sha256.Sum256(body)
+	return map[string]string{
+		"method":      req.Method,
+		"host":        req.URL.Host,
+		"path":        req.URL.EscapedPath(),
+		"query":       req.URL.RawQuery,
+		"timestamp":   timestamp,
+		"body_sha256": hex.EncodeToString(bodyHash[:]),
+	}
+}
+
+func expandTemplate(tmpl string, vars map[string]string) string {
+	for name, val := range vars {
+		tmpl = strings.Replace(tmpl, "{"+name+"}", val, -1)
+	}
+	return tmpl
+}
+
+type signingTransport struct {
+	base    http.RoundTripper
+	signers []signer
+}
+
+func withSigning(base http.RoundTripper, signers []signer) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &signingTransport{base: base, signers: signers}
+}
+
+func (st *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var s *signer
+	for i := range st.signers {
+		if containsString(st.signers[i].Hosts, strings.ToLower(req.URL.Hostname())) {
+			s = &st.signers[i]
+			break
+		}
+	}
+	if s == nil {
+		return st.base.RoundTrip(req)
+	}
+
+	orig := req
+	req = req.Clone(req.Context())
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	vars := signVars(req, body, time.Now(), s.Timestamp)
+	mac := hmac.New(s.hashFunc(), []byte(s.Secret))
+	mac.Write([]byte(expandTemplate(s.Message, vars)))
+	if s.Encoding == "base64" {
+		vars["signature"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		vars["signature"] = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for name, tmpl := range s.Headers {
+		req.Header.Set(name, expandTemplate(tmpl, vars))
+	}
+	if len(s.Query) > 0 {
+		query := req.URL.Query()
+		for name, tmpl := range s.Query {
+			query.Set(name, expandTemplate(tmpl, vars))
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	resp, err := st.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// keep the signature out of the url pages are recorded and resolved under
+	resp.Request = orig
+	return resp, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
+)
+
+// Kinds of soft errors, see detectSoftError.
+const (
+	softNotFound = "not_found"
+	softLogin    = "login"
+	softEmpty    = "empty"
+)
+
+// Pages with less visible text than this many characters have nothing worth
+// extracting, ex: a blank template or a placeholder left by a failed render.
+const softErrorMinText = 64
+
+var (
+	notFoundHeading = regexp.MustCompile(`(?is)<(?:title|h1)[^>]*>[^<]*(\b404\b|not found|(?:doesn't|does not|no longer) exists?|no longer available|(?:could not|couldn't|cannot) be found|page (?:is )?unavailable)[^<]*</(?:title|h1)>`)
+	loginPath       = regexp.MustCompile(`(?i)(^|/)(log-?in|sign-?in|sign_in|signon|sso|auth|authenticate|session/new)(/|\.|$)`)
+	passwordInput   = regexp.MustCompile(`(?i)<input[^>]+type\s*=\s*["']?password`)
+)
+
+// Returns the kind of error page r is despite its 2xx status: a "not_found"
+// page, a redirect from requested to a "login" page, or an "empty" page, or
+// "" if it looks like content.  Only html pages are checked.
+func detectSoftError(r *colly.Response, requested string) string {
+	if !strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+		return ""
+	}
+	if notFoundHeading.Match(r.Body) {
+		return softNotFound
+	}
+	if final := r.Request.URL.String(); len(requested) > 0 && final != requested {
+		if from, err := url.Parse(requested); err == nil && !loginPath.MatchString(from.Path) &&
+			(loginPath.MatchString(r.Request.URL.Path) || passwordInput.Match(r.Body)) {
+			return softLogin
+		}
+	}
+	if visibleText(r.Body, softErrorMinText) < softErrorMinText {
+		return softEmpty
+	}
+	return ""
+}
+
+// Counts the non-space characters of body's text outside of scripts and
+// styles, stopping at max.
+func visibleText(body []byte, max int) int {
+	count := 0
+	eachVisibleText(body, func(text []byte) bool {
+		for _, r := range string(text) {
+			if !unicode.IsSpace(r) {
+				count++
+			}
+		}
+		return count < max
+	})
+	return count
+}
+
+// Calls fn with each run of text in body outside of scripts and styles, until
+// it returns false.
+func eachVisibleText(body []byte, fn func(text []byte) bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken:
+			switch name, _ := z.TagName(); string(name) {
+			case "script", "style", "noscript", "template":
+				skip++
+			}
+		case html.EndTagToken:
+			switch name, _ := z.TagName(); string(name) {
+			case "script", "style", "noscript", "template":
+				if skip > 0 {
+					skip--
+				}
+			}
+		case html.TextToken:
+			if skip == 0 && !fn(z.Text()) {
+				return
+			}
+		}
+	}
+}
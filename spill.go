@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Holds a scrape's results in temporary files rather than memory, for
+// -spill-after.  Used as the scrape's scrapeOptions.Stream, so results go
+// through the same per result processing as when streamed.
+type spill struct {
+	dir   string
+	files map[string]*os.File
+	bufs  map[string]*bufio.Writer
+	// Results written per item.
+	counts map[string]int
+}
+
+func newSpill() (*spill, error) {
+	dir, err := ioutil.TempDir("", "gluestick-spill")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{dir: dir, files: make(map[string]*os.File), bufs: make(map[string]*bufio.Writer),
+		counts: make(map[string]int)}, nil
+}
+
+// Appends results to the item's file, a json line each.
+func (sp *spill) write(item string, results []interface{}) error {
+	buf, found := sp.bufs[item]
+	if !found {
+		// item names aren't necessarily valid filenames
+		f, err := os.Create(filepath.Join(sp.dir, strconv.Itoa(len(sp.files))+".jsonl"))
+		if err != nil {
+			return err
+		}
+		sp.files[item] = f
+		buf = bufio.NewWriter(f)
+		sp.bufs[item] = buf
+	}
+	for _, result := range results {
+		line, err := json.Marshal(plainValue(result))
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		if err := buf.WriteByte('\n'); err != nil {
+			return err
+		}
+		sp.counts[item]++
+	}
+	return nil
+}
+
+// Writes the spilled results, along with what's left in results (ex:
+// "_meta"), as the same indented json object the results would marshal to,
+// reading the spilled results back a line at a time.
+func (sp *spill) writeJson(w io.Writer, results ScrapeResult) error {
+	names := make([]string, 0, len(results)+len(sp.files))
+	for name := range results {
+		if _, found := sp.files[name]; !found {
+			names = append(names, name)
+		}
+	}
+	for name := range sp.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := bufio.NewWriter(w)
+	out.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		key, _ := json.Marshal(name)
+		out.WriteString("\n    " + string(key) + ": ")
+		var err error
+		if _, found := sp.files[name]; found {
+			err = sp.writeItem(out, name)
+		} else {
+			var val []byte
+			if val, err = json.MarshalIndent(results[name], "    ", "    "); err == nil {
+				_, err = out.Write(val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		out.WriteString("\n")
+	}
+	out.WriteString("}\n")
+	return out.Flush()
+}
+
+// Writes an item's results as accumValue would hold them: the result itself
+// if there's only one, else an array.
+func (sp *spill) writeItem(out *bufio.Writer, name string) error {
+	if err := sp.bufs[name].Flush(); err != nil {
+		return err
+	}
+	f := sp.files[name]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	single := sp.counts[name] == 1
+	prefix := "        "
+	if single {
+		prefix = "    "
+	} else {
+		out.WriteString("[")
+	}
+	reader := bufio.NewReader(f)
+	var indented bytes.Buffer
+	for i := 0; ; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		indented.Reset()
+		if err := json.Indent(&indented, bytes.TrimSpace(line), prefix, "    "); err != nil {
+			return err
+		}
+		if !single {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + prefix)
+		}
+		out.Write(indented.Bytes())
+	}
+	if !single {
+		out.WriteString("\n    ]")
+	}
+	return nil
+}
+
+// Removes the temporary files.
+func (sp *spill) close() {
+	for _, f := range sp.files {
+		f.Close()
+	}
+	os.RemoveAll(sp.dir)
+}
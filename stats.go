@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Granularity of the sliding window domain stats are kept over.
+const statsBucket = time.Minute
+
+// domainStats counts requests, errors, throttling and latency per target
+// domain (grouped like throttling) over a sliding window, so operators can
+// spot sites blocking or slowing down the scraper.
+type domainStats struct {
+	lock    sync.Mutex
+	window  time.Duration
+	key     func(host string) string
+	domains map[string][]statsCounts
+}
+
+// Counts for one bucket of one domain.
+type statsCounts struct {
+	start     time.Time
+	requests  int
+	errors    int
+	throttled int
+	latency   time.Duration
+	last      time.Time
+}
+
+type DomainSummary struct {
+	Domain   string `json:"domain"`
+	Requests int    `json:"requests"`
+	// Requests that failed outright or got a 4xx/5xx status.
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// Requests answered with 429 or 503.
+	Throttled    int       `json:"throttled"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	LastRequest  time.Time `json:"last_request"`
+}
+
+func newDomainStats(window time.Duration, key func(host string) string) *domainStats {
+	return &domainStats{window: window, key: key, domains: make(map[string][]statsCounts)}
+}
+
+func (ds *domainStats) record(host string, status int, failed bool, latency time.Duration) {
+	now := time.Now()
+	start := now.Truncate(statsBucket)
+	key := ds.key(host)
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	buckets := ds.domains[key]
+	if len(buckets) == 0 || buckets[len(buckets)-1].start != start {
+		buckets = append(ds.pruned(buckets, now), statsCounts{start: start})
+	}
+	b := &buckets[len(buckets)-1]
+	b.requests++
+	if failed || status >= 400 {
+		b.errors++
+	}
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		b.throttled++
+	}
+	b.latency += latency
+	b.last = now
+	ds.domains[key] = buckets
+}
+
+// Drops buckets that have slid out of the window.
+func (ds *domainStats) pruned(buckets []statsCounts, now time.Time) []statsCounts {
+	cutoff := now.Add(-ds.window)
+	for len(buckets) > 0 && buckets[0].start.Add(statsBucket).Before(cutoff) {
+		buckets = buckets[1:]
+	}
+	return buckets
+}
+
+// Average latency of the recent requests to host's domain, if any.
+func (ds *domainStats) latency(host string) (time.Duration, bool) {
+	key := ds.key(host)
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	var requests int
+	var total time.Duration
+	for _, b := range ds.pruned(ds.domains[key], time.Now()) {
+		requests += b.requests
+		total += b.latency
+	}
+	if requests == 0 {
+		return 0, false
+	}
+	return total / time.Duration(requests), true
+}
+
+// Per domain totals over the last window (at most the configured window),
+// busiest domains first.
+func (ds *domainStats) summary(window time.Duration) []DomainSummary {
+	now := time.Now()
+	cutoff := now.Add(-window)
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	summaries := []DomainSummary{}
+	for domain, buckets := range ds.domains {
+		if buckets = ds.pruned(buckets, now); len(buckets) == 0 {
+			delete(ds.domains, domain)
+			continue
+		}
+		ds.domains[domain] = buckets
+		sum := DomainSummary{Domain: domain}
+		var latency time.Duration
+		for _, b := range buckets {
+			if b.start.Add(statsBucket).Before(cutoff) {
+				continue
+			}
+			sum.Requests += b.requests
+			sum.Errors += b.errors
+			sum.Throttled += b.throttled
+			latency += b.latency
+			if b.last.After(sum.LastRequest) {
+				sum.LastRequest = b.last
+			}
+		}
+		if sum.Requests == 0 {
+			continue
+		}
+		sum.ErrorRate = float64(sum.Errors) / float64(sum.Requests)
+		sum.AvgLatencyMs = float64(latency) / float64(sum.Requests) / float64(time.Millisecond)
+		summaries = append(summaries, sum)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Requests != summaries[j].Requests {
+			return summaries[i].Requests > summaries[j].Requests
+		}
+		return summaries[i].Domain < summaries[j].Domain
+	})
+	return summaries
+}
+
+type statsTransport struct {
+	base  http.RoundTripper
+	stats *domainStats
+}
+
+func withStats(base http.RoundTripper, stats *domainStats) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &statsTransport{base: base, stats: stats}
+}
+
+func (st *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := st.base.RoundTrip(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	st.stats.record(req.URL.Host, status, err != nil, time.Since(start))
+	return resp, err
+}
+
+// GET /stats/domains?window=5m summarizes requests per target domain over
+// the window, by default all of -stats-window.
+func (s *server) handleDomainStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	window := s.conf.Stats.window
+	if val := r.URL.Query().Get("window"); len(val) > 0 {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid window %q, ex: \"5m\"", val))
+			return
+		}
+		if d < window {
+			window = d
+		}
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"window":  window.String(),
+		"domains": s.conf.Stats.summary(window),
+	})
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every run's results, appended to the -store json-lines file so scraped
+// values can be followed over time (ex: a product's price), see query.  The
+// -history file is the same without the results, just each item's count for
+// anomaly checks, see lastRun.
+//
+// Each run is also summarized in memory, and for the -store in an index file
+// next to it (see indexFilename), so queries only read the lines of the runs
+// they match and lastRun reads none.  Runs older than the retention are
+// dropped from the files as new ones are added.
+type resultStore struct {
+	// Held while appending, and while finding which lines to read, so reads
+	// never see a partly written line.
+	lock       sync.Mutex
+	filename   string
+	countsOnly bool
+	retention  time.Duration
+	// The runs summarized so far, oldest first, and the length of the file
+	// they cover.
+	loaded  bool
+	index   []indexedRun
+	indexed int64
+	// When old runs were last dropped.
+	pruned time.Time
+}
+
+// indexedRun is a line of a -store's index: a run without its results, and
+// where its line is in the -store.
+type indexedRun struct {
+	StoredRun
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// How often runs past the retention are dropped.
+const storePruneInterval = time.Hour
+
+// StoredRun is a single line in the -store or -history file.
+type StoredRun struct {
+	// Which request the results are from, see configKey.
+	Config string `json:"config,omitempty"`
+	// Name of the api key the run was submitted with, see
+	// ScrapeRequest.owner.
+	Owner string    `json:"owner,omitempty"`
+	Url   string    `json:"url"`
+	Time  time.Time `json:"time"`
+	// Number of values of each item, see countResults.
+	Counts  map[string]int         `json:"counts,omitempty"`
+	Results map[string]interface{} `json:"results,omitempty"`
+}
+
+// HistoryQuery selects stored runs, and optionally which of their values.
+type HistoryQuery struct {
+	// Runs within this long of now, zero for all.
+	Since  time.Duration
+	Config string
+	Url    string
+	// With Scoped, only runs submitted with the Owner api key name.
+	Scoped bool
+	Owner  string
+	// Only runs with this item, its values rather than all results.
+	Item string
+	// Dotted path of the field within each of Item's results to keep, ex:
+	// "price" or "image.src".
+	Field string
+}
+
+// HistoryPoint is one run's values matching a HistoryQuery.
+type HistoryPoint struct {
+	Time   time.Time   `json:"time"`
+	Config string      `json:"config"`
+	Url    string      `json:"url"`
+	Values interface{} `json:"values"`
+}
+
+// Runs older than retention are dropped, 0 to keep them all.
+func newResultStore(filename string, retention time.Duration) *resultStore {
+	return &resultStore{filename: filename, retention: retention}
+}
+
+func newHistoryStore(filename string, retention time.Duration) *resultStore {
+	return &resultStore{filename: filename, countsOnly: true, retention: retention}
+}
+
+// The index of a -store, the -history file being its own.
+func (rs *resultStore) indexFilename() string {
+	return rs.filename + ".index"
+}
+
+// Identifies runs of the same request, ignoring settings that don't affect
+// the results (see cacheKey).
+func configKey(req ScrapeRequest) string {
+	return cacheKey(req)[:12]
+}
+
+// Appends a run with the given item counts, and its results unless the
+// store keeps counts only.
+func (rs *resultStore) add(req ScrapeRequest, results ScrapeResult, counts map[string]int) error {
+	run := StoredRun{Config: configKey(req), Owner: req.owner, Url: req.Url, Time: time.Now(), Counts: counts}
+	if !rs.countsOnly {
+		run.Results = make(map[string]interface{})
+		for name, val := range results {
+			if name != metaKey {
+				run.Results[name] = val
+			}
+		}
+	}
+	line, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if err := rs.syncIndex(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rs.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	// caught up with rather than added to, should something else have
+	// appended to the file meanwhile
+	if err := rs.syncIndex(); err != nil {
+		return err
+	}
+	if rs.retention > 0 && time.Since(rs.pruned) > storePruneInterval {
+		rs.pruned = time.Now()
+		return rs.prune(time.Now().Add(-rs.retention))
+	}
+	return nil
+}
+
+// Stored runs matching q, oldest first.  A missing file is no runs yet.
+func (rs *resultStore) query(q HistoryQuery) ([]HistoryPoint, error) {
+	var since time.Time
+	if q.Since > 0 {
+		since = time.Now().Add(-q.Since)
+	}
+	points := []HistoryPoint{}
+	err := rs.each(func(run indexedRun) bool {
+		return q.summaryMatch(run.StoredRun, since)
+	}, func(run StoredRun) {
+		if point, ok := q.match(run, since); ok {
+			points = append(points, point)
+		}
+	})
+	return points, err
+}
+
+// The last stored run of url, with its counts but not its results, or nil
+// if it was never run.
+func (rs *resultStore) lastRun(url string) (*StoredRun, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if err := rs.syncIndex(); err != nil {
+		return nil, err
+	}
+	for idx := len(rs.index) - 1; idx >= 0; idx-- {
+		if rs.index[idx].Url == url {
+			run := rs.index[idx].StoredRun
+			return &run, nil
+		}
+	}
+	return nil, nil
+}
+
+// Calls fn with each stored run that want is true for, oldest first.  Only
+// runs stored by the time it's called are read, without holding up those
+// being added meanwhile.
+func (rs *resultStore) each(want func(run indexedRun) bool, fn func(run StoredRun)) error {
+	rs.lock.Lock()
+	err := rs.syncIndex()
+	var runs []indexedRun
+	var f *os.File
+	if err == nil && len(rs.index) > 0 {
+		for _, run := range rs.index {
+			if want(run) {
+				runs = append(runs, run)
+			}
+		}
+		// opened while locked so pruning can't move the lines from under it
+		f, err = os.Open(rs.filename)
+	}
+	rs.lock.Unlock()
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, indexed := range runs {
+		if rs.countsOnly {
+			fn(indexed.StoredRun)
+			continue
+		}
+		line := make([]byte, indexed.Length)
+		if _, err := f.ReadAt(line, indexed.Offset); err != nil {
+			return err
+		}
+		var run StoredRun
+		if err := json.Unmarshal(line, &run); err != nil {
+			return fmt.Errorf("bad line in %q: %s", rs.filename, err)
+		}
+		fn(run)
+	}
+	return nil
+}
+
+// Brings the in memory index up to date with the file, loading it on first
+// use and summarizing any runs appended since.  Called with the lock held.
+func (rs *resultStore) syncIndex() error {
+	info, err := os.Stat(rs.filename)
+	if os.IsNotExist(err) {
+		rs.loaded, rs.index, rs.indexed = true, nil, 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rewrite := false
+	if !rs.loaded || info.Size() < rs.indexed {
+		// first use, or the file was replaced
+		rs.index, rs.indexed = nil, 0
+		if !rs.countsOnly {
+			if rewrite, err = rs.readIndexFile(info.Size()); err != nil {
+				return err
+			}
+		}
+		rs.loaded = true
+	}
+	if info.Size() == rs.indexed {
+		if rewrite {
+			return rs.writeIndexFile()
+		}
+		return nil
+	}
+
+	f, err := os.Open(rs.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// results can make for long lines, so no bufio.Scanner
+	reader := bufio.NewReader(io.NewSectionReader(f, rs.indexed, info.Size()-rs.indexed))
+	var added []indexedRun
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // a line still being written is left for next time
+		} else if err != nil {
+			return err
+		}
+		offset := rs.indexed
+		rs.indexed += int64(len(line))
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var run StoredRun
+		if err := json.Unmarshal(line, &run); err != nil {
+			return fmt.Errorf("bad line in %q: %s", rs.filename, err)
+		}
+		if run.Counts == nil {
+			// stored before counts were
+			run.Counts = countResults(run.Results)
+		}
+		run.Results = nil
+		added = append(added, indexedRun{StoredRun: run, Offset: offset, Length: int64(len(line))})
+	}
+	rs.index = append(rs.index, added...)
+	if rs.countsOnly {
+		return nil
+	}
+	if rewrite {
+		return rs.writeIndexFile()
+	}
+	return rs.appendIndexFile(added)
+}
+
+// Loads the index file's runs, as far as they're in order and within the
+// first size bytes of the -store.  True if the index file needs rewriting
+// as it had anything else, ex: runs since pruned.
+func (rs *resultStore) readIndexFile(size int64) (bool, error) {
+	f, err := os.Open(rs.indexFilename())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var run indexedRun
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil || run.Offset != rs.indexed || run.Offset+run.Length > size {
+			return true, nil
+		}
+		rs.index = append(rs.index, run)
+		rs.indexed += run.Length
+	}
+	return scanner.Err() != nil, nil
+}
+
+func (rs *resultStore) appendIndexFile(runs []indexedRun) error {
+	if len(runs) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(rs.indexFilename(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeIndexed(f, runs)
+}
+
+// Replaces the index file with the in memory index.
+func (rs *resultStore) writeIndexFile() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(rs.filename), ".index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	err = writeIndexed(tmp, rs.index)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rs.indexFilename())
+}
+
+func writeIndexed(w io.Writer, runs []indexedRun) error {
+	buf := bufio.NewWriter(w)
+	for _, run := range runs {
+		line, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return buf.Flush()
+}
+
+// Drops the runs from before cutoff, copying the newer ones to a new file
+// that replaces the old.  Called with the lock held and the index in sync.
+func (rs *resultStore) prune(cutoff time.Time) error {
+	keep := sort.Search(len(rs.index), func(idx int) bool {
+		return !rs.index[idx].Time.Before(cutoff)
+	})
+	if keep == 0 {
+		return nil
+	}
+	var from int64 = rs.indexed
+	if keep < len(rs.index) {
+		from = rs.index[keep].Offset
+	}
+	f, err := os.Open(rs.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(rs.filename), ".store-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	_, err = io.Copy(tmp, io.NewSectionReader(f, from, rs.indexed-from))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), rs.filename); err != nil {
+		return err
+	}
+	rs.index = append([]indexedRun(nil), rs.index[keep:]...)
+	for idx := range rs.index {
+		rs.index[idx].Offset -= from
+	}
+	rs.indexed -= from
+	if rs.countsOnly {
+		return nil
+	}
+	return rs.writeIndexFile()
+}
+
+// Whether a run could match q going by its summary, so only those that can
+// are read in full.
+func (q HistoryQuery) summaryMatch(run StoredRun, since time.Time) bool {
+	if run.Time.Before(since) || (len(q.Config) > 0 && run.Config != q.Config) || (len(q.Url) > 0 && run.Url != q.Url) {
+		return false
+	}
+	if q.Scoped && run.Owner != q.Owner {
+		return false
+	}
+	if len(q.Item) > 0 {
+		if _, found := run.Counts[q.Item]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (q HistoryQuery) match(run StoredRun, since time.Time) (HistoryPoint, bool) {
+	point := HistoryPoint{Time: run.Time, Config: run.Config, Url: run.Url}
+	if run.Time.Before(since) || (len(q.Config) > 0 && run.Config != q.Config) || (len(q.Url) > 0 && run.Url != q.Url) {
+		return point, false
+	}
+	if q.Scoped && run.Owner != q.Owner {
+		return point, false
+	}
+	if len(q.Item) == 0 {
+		point.Values = run.Results
+		return point, true
+	}
+	val, found := run.Results[q.Item]
+	if !found {
+		return point, false
+	}
+	if len(q.Field) == 0 {
+		point.Values = val
+		return point, true
+	}
+	var fieldVals []interface{}
+	for _, result := range valuesOf(val) {
+		if m, ok := result.(map[string]interface{}); ok {
+			if fieldVal, found := fieldByPath(m, q.Field); found {
+				fieldVals = append(fieldVals, fieldVal)
+			}
+		}
+	}
+	if len(fieldVals) == 0 {
+		return point, false
+	}
+	if _, many := val.([]interface{}); many {
+		point.Values = fieldVals
+	} else {
+		point.Values = fieldVals[0]
+	}
+	return point, true
+}
+
+// Parses how far back a history query goes, a duration like "36h" or a
+// number of days like "7d".
+func parseSince(val string) (time.Duration, error) {
+	if strings.HasSuffix(val, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(val, "d"), 64)
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid since %q, ex: \"7d\" or \"12h\"", val)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid since %q, ex: \"7d\" or \"12h\"", val)
+	}
+	return d, nil
+}
+
+// Prints "gluestick history" results as json, see HistoryQuery.  With a
+// request from -f or -in, only its runs.
+func printHistory(storeFilename string, since string, item string, field string, config string, inFilename string, inString string) error {
+	if len(storeFilename) == 0 {
+		return errors.New("-store is required")
+	}
+	if len(field) > 0 && len(item) == 0 {
+		return errors.New("-field requires -item")
+	}
+	q := HistoryQuery{Config: config, Item: item, Field: field}
+	if len(since) > 0 {
+		var err error
+		if q.Since, err = parseSince(since); err != nil {
+			return err
+		}
+	}
+	if len(q.Config) == 0 && (len(inFilename) > 0 || len(inString) > 0) {
+		data := []byte(inString)
+		if len(inFilename) > 0 {
+			var err error
+			if data, err = ioutil.ReadFile(inFilename); err != nil {
+				return err
+			}
+		}
+		req, err := parseRequest(data)
+		if err == nil {
+			err = validate(&req)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid request: %v", err)
+		}
+		q.Config = configKey(req)
+	}
+	points, err := newResultStore(storeFilename, 0).query(q)
+	if err != nil {
+		return err
+	}
+	j, _ := json.MarshalIndent(points, "", "    ")
+	fmt.Println(string(j))
+	return nil
+}
+
+// GET /history?since=7d&item=products&field=price returns stored runs'
+// values oldest first, optionally only those of a config (see configKey)
+// or url.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	params := r.URL.Query()
+	q := HistoryQuery{Config: params.Get("config"), Url: params.Get("url"), Item: params.Get("item"), Field: params.Get("field")}
+	q.Scoped, q.Owner = s.ownerScope(r)
+	if len(q.Field) > 0 && len(q.Item) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("field requires item"))
+		return
+	}
+	if val := params.Get("since"); len(val) > 0 {
+		var err error
+		if q.Since, err = parseSince(val); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	points, err := s.conf.Store.query(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, points)
+}
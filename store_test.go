@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func storeRun(t *testing.T, filename string, url string, at time.Time, price string) {
+	run := StoredRun{Config: "cfg", Url: url, Time: at, Counts: map[string]int{"products": 1},
+		Results: map[string]interface{}{"products": map[string]interface{}{"price": price}}}
+	line, err := json.Marshal(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func prices(t *testing.T, rs *resultStore, q HistoryQuery) []interface{} {
+	q.Item, q.Field = "products", "price"
+	points, err := rs.query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals []interface{}
+	for _, point := range points {
+		vals = append(vals, point.Values)
+	}
+	return vals
+}
+
+func TestResultStoreIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "runs.jsonl")
+	now := time.Now()
+
+	// a store from before there were indexes
+	storeRun(t, filename, "https://a.example", now.Add(-3*time.Hour), "$1")
+	storeRun(t, filename, "https://b.example", now.Add(-2*time.Hour), "$2")
+	rs := newResultStore(filename, 0)
+	if got := prices(t, rs, HistoryQuery{}); len(got) != 2 || got[0] != "$1" || got[1] != "$2" {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := os.Stat(rs.indexFilename()); err != nil {
+		t.Fatalf("index wasn't written: %v", err)
+	}
+
+	// appended by another process, then picked up by both old and new readers
+	storeRun(t, filename, "https://a.example", now.Add(-time.Hour), "$3")
+	if got := prices(t, rs, HistoryQuery{Url: "https://a.example"}); len(got) != 2 || got[1] != "$3" {
+		t.Fatalf("got %v", got)
+	}
+	fresh := newResultStore(filename, 0)
+	if got := prices(t, fresh, HistoryQuery{Since: 90 * time.Minute}); len(got) != 1 || got[0] != "$3" {
+		t.Fatalf("got %v", got)
+	}
+	last, err := fresh.lastRun("https://b.example")
+	if err != nil || last == nil || last.Counts["products"] != 1 || last.Results != nil {
+		t.Fatalf("got %+v, %v", last, err)
+	}
+
+	// a stale index is caught up with rather than trusted
+	if err := ioutil.WriteFile(rs.indexFilename(), []byte("{\"offset\": 5, \"length\": 1}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := prices(t, newResultStore(filename, 0), HistoryQuery{}); len(got) != 3 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestResultStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, countsOnly := range []bool{false, true} {
+		filename := filepath.Join(dir, "runs.jsonl")
+		os.Remove(filename)
+		os.Remove(filename + ".index")
+		now := time.Now()
+		storeRun(t, filename, "https://a.example", now.Add(-48*time.Hour), "$1")
+		storeRun(t, filename, "https://a.example", now.Add(-36*time.Hour), "$2")
+		storeRun(t, filename, "https://a.example", now.Add(-12*time.Hour), "$3")
+		rs := newResultStore(filename, 24*time.Hour)
+		if countsOnly {
+			rs = newHistoryStore(filename, 24*time.Hour)
+		}
+		req := ScrapeRequest{Url: "https://a.example"}
+		if err := rs.add(req, ScrapeResult{"products": map[string]interface{}{"price": "$4"}}, map[string]int{"products": 1}); err != nil {
+			t.Fatal(err)
+		}
+		points, err := newResultStore(filename, 0).query(HistoryQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 2 {
+			t.Fatalf("countsOnly %v: got %d runs, expected the 2 within a day", countsOnly, len(points))
+		}
+		if !countsOnly {
+			if got := prices(t, rs, HistoryQuery{}); len(got) != 2 || got[0] != "$3" || got[1] != "$4" {
+				t.Fatalf("got %v", got)
+			}
+		}
+	}
+}
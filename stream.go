@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Hands results to scrapeOptions.Stream as pages are scraped rather than
+// returning them all at the end.  Each batch goes through the same per
+// result processing as the final results would (pdf text, post processing,
+// where, downloads and output mapping), only sort_by, which needs every
+// result, isn't applied.
+type streamer struct {
+	req  ScrapeRequest
+	opts scrapeOptions
+	d    *downloader
+	// Set once results reached opts.StreamAfter.
+	started bool
+}
+
+// Streams everything in results so far, removing it from results.  Until
+// results hold opts.StreamAfter results they're left alone, to be returned
+// as usual if the scrape ends before then.
+func (st *streamer) flush(results ScrapeResult) error {
+	if !st.started {
+		total := 0
+		for _, count := range countResults(results) {
+			total += count
+		}
+		if total < st.opts.StreamAfter {
+			return nil
+		}
+		st.started = true
+	}
+	for _, name := range sortedItemNames(st.req.Items) {
+		val, found := results[name]
+		if !found {
+			continue
+		}
+		delete(results, name)
+		batch := ScrapeResult{name: val}
+		st.d.extractPdfItems(st.req, batch)
+		postProcessItems(st.req, batch, st.opts.Processors)
+		if err := filterItems(st.req, batch); err != nil {
+			return err
+		}
+		if err := st.d.downloadItems(st.req, batch); err != nil {
+			return err
+		}
+		mapOutputs(st.req, batch)
+		if val, found := batch[name]; found {
+			if err := st.opts.Stream(name, valuesOf(val)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var errClientGone = errors.New("client went away")
+
+// Streams a scrape's results as newline delimited json: an {"item", "value"}
+// line per result (as for job results) as pages are scraped, then a final
+// {"done": true} line, with "_meta" if requested, or an {"error"} line.
+// Writes block while the client isn't reading, which holds up the scrape,
+// and the scrape stops once the client goes away.  -write-timeout applies to
+// each line rather than the whole stream, so long scrapes aren't cut off
+// while a client that stops reading still is.
+func (s *server) handleScrapeStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	scrapeReq, status, err := s.readScrapeRequest(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if len(scrapeReq.Pipeline) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("pipelines can't be streamed, their results are only complete at the end"))
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	writeLine := func(v interface{}) error {
+		s.extendWriteDeadline(r)
+		if err := enc.Encode(v); err != nil {
+			return errClientGone
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	opts := s.conf.Scrape
+	opts.Done = r.Context().Done()
+	opts.Stream = func(name string, results []interface{}) error {
+		for _, result := range results {
+			if err := writeLine(map[string]interface{}{"item": name, "value": plainValue(result)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var results ScrapeResult
+	done := make(chan struct{})
+	s.queue.submit(&task{priority: interactivePriority, run: func() {
+		defer close(done)
+		results, err = scrape(scrapeReq, opts)
+	}})
+	<-done
+	if err == errClientGone || r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		writeLine(map[string]string{"error": "error while scraping: " + err.Error()})
+		return
+	}
+	last := map[string]interface{}{"done": true}
+	if meta, found := results[metaKey]; found {
+		last[metaKey] = meta
+	}
+	writeLine(last)
+}
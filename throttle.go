@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	minThrottleDelay = time.Second
+	maxThrottleDelay = 2 * time.Minute
+	retriesCtxKey    = "gluestick.retries"
+)
+
+// throttle slows down requests to domains that answer with 429/503 for the
+// remainder of a run, honoring any Retry-After header, and retries the
+// throttled request up to maxRetries times.
+type throttle struct {
+	lock       sync.Mutex
+	delays     map[string]time.Duration
+	key        func(host string) string
+	maxRetries int
+	verbose    bool
+}
+
+func newThrottle(key func(host string) string, maxRetries int, verbose bool) *throttle {
+	return &throttle{
+		delays:     make(map[string]time.Duration),
+		key:        key,
+		maxRetries: maxRetries,
+		verbose:    verbose,
+	}
+}
+
+func (t *throttle) delay(host string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.delays[t.key(host)]
+}
+
+// Waits out the domain's current delay before a request goes out.
+func (t *throttle) onRequest(r *colly.Request) {
+	if d := t.delay(r.URL.Host); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Returns true if the failed response was a throttling response that was
+// retried, in which case the error should not be reported.
+func (t *throttle) onError(r *colly.Response) bool {
+	if r == nil || r.Request == nil {
+		return false
+	}
+	if r.StatusCode != http.StatusTooManyRequests && r.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	host := t.key(r.Request.URL.Host)
+	t.lock.Lock()
+	// back off exponentially, or longer if the server told us to
+	delay := t.delays[host] * 2
+	if delay < minThrottleDelay {
+		delay = minThrottleDelay
+	}
+	if r.Headers != nil {
+		if retryAfter := parseRetryAfter(r.Headers.Get("Retry-After")); retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+	if delay > maxThrottleDelay {
+		delay = maxThrottleDelay
+	}
+	t.delays[host] = delay
+	t.lock.Unlock()
+
+	retries, _ := r.Request.Ctx.GetAny(retriesCtxKey).(int)
+	if retries >= t.maxRetries {
+		return false
+	}
+	r.Request.Ctx.Put(retriesCtxKey, retries+1)
+	if t.verbose {
+		log.Printf("Throttled (%d) by %s, waiting %s before retry %d\n",
+			r.StatusCode, host, delay, retries+1)
+	}
+	r.Request.Retry()
+	return true
+}
+
+// Returns the func used to group requests for throttling and circuit
+// breaking.  By default hosts are grouped by registrable domain (eTLD+1) so
+// www.example.com and shop.example.com share a budget, or by exact host if
+// byHost is set.
+func politenessKeyFunc(byHost bool) func(host string) string {
+	if byHost {
+		return strings.ToLower
+	}
+	return registrableDomain
+}
+
+func registrableDomain(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	// ip addresses, localhost, bare public suffixes, etc.
+	return host
+}
+
+// Retry-After is either a number of seconds or an http date.
+func parseRetryAfter(val string) time.Duration {
+	val = strings.TrimSpace(val)
+	if len(val) == 0 {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(val); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
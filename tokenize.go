@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
+)
+
+// Selectors the tokenizer can match without a DOM: comma separated groups
+// of tag, "*", ".class", "#id", "[attr]" and "[attr=value]" compounds joined
+// by spaces (descendant combinators), ex: "div.product a[href]".
+type simpleSelector [][]simpleCompound
+
+type simpleCompound struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []simpleAttr
+}
+
+type simpleAttr struct {
+	name   string
+	val    string
+	hasVal bool
+}
+
+// Parses selector as a simpleSelector, ok false if it uses anything more,
+// ex: pseudo classes or child combinators.
+func parseSimpleSelector(selector string) (simpleSelector, bool) {
+	var sel simpleSelector
+	for _, group := range strings.Split(selector, ",") {
+		var chain []simpleCompound
+		for _, part := range strings.Fields(group) {
+			compound, ok := parseSimpleCompound(part)
+			if !ok {
+				return nil, false
+			}
+			chain = append(chain, compound)
+		}
+		if len(chain) == 0 {
+			return nil, false
+		}
+		sel = append(sel, chain)
+	}
+	return sel, true
+}
+
+func parseSimpleCompound(part string) (simpleCompound, bool) {
+	var c simpleCompound
+	rest := part
+	if strings.HasPrefix(rest, "*") {
+		rest = rest[1:]
+	} else if name, n := scanIdent(rest); n > 0 {
+		c.tag, rest = strings.ToLower(name), rest[n:]
+	}
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.', '#':
+			name, n := scanIdent(rest[1:])
+			if n == 0 {
+				return c, false
+			}
+			if rest[0] == '.' {
+				c.classes = append(c.classes, name)
+			} else if len(c.id) == 0 {
+				c.id = name
+			} else {
+				return c, false
+			}
+			rest = rest[1+n:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return c, false
+			}
+			attr, ok := parseSimpleAttr(rest[1:end])
+			if !ok {
+				return c, false
+			}
+			c.attrs = append(c.attrs, attr)
+			rest = rest[end+1:]
+		default:
+			return c, false
+		}
+	}
+	return c, true
+}
+
+func parseSimpleAttr(inner string) (simpleAttr, bool) {
+	var attr simpleAttr
+	inner = strings.TrimSpace(inner)
+	name, n := scanIdent(inner)
+	if n == 0 {
+		return attr, false
+	}
+	attr.name = strings.ToLower(name)
+	rest := strings.TrimSpace(inner[n:])
+	if len(rest) == 0 {
+		return attr, true
+	}
+	if rest[0] != '=' {
+		return attr, false // ~=, ^= and the like
+	}
+	val := strings.TrimSpace(rest[1:])
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+		val = val[1 : len(val)-1]
+	} else if _, n := scanIdent(val); n != len(val) || n == 0 {
+		return attr, false
+	}
+	if strings.ContainsAny(val, `\"'`) {
+		return attr, false
+	}
+	attr.val, attr.hasVal = val, true
+	return attr, true
+}
+
+// The css identifier at the start of s and its length, 0 if there isn't one.
+func scanIdent(s string) (string, int) {
+	n := 0
+	for n < len(s) {
+		ch := s[n]
+		letter := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || ch >= 0x80
+		if letter || ch == '-' || (n > 0 && ch >= '0' && ch <= '9') {
+			n++
+			continue
+		}
+		break
+	}
+	return s[:n], n
+}
+
+// An open element while tokenizing.
+type tokElem struct {
+	tag   string
+	attrs []html.Attribute
+	// "svg" or "math" for their elements, "" for html's
+	ns string
+}
+
+// Whether e is one of boundaries.  <svg> and <math> elements html can go in
+// bound the scopes table cells do, but not table scope.
+func (e *tokElem) bounds(boundaries map[string]bool) bool {
+	if len(e.ns) > 0 {
+		return boundaries["td"] && (e.integrationPoint() || e.tag == "annotation-xml")
+	}
+	return boundaries[e.tag]
+}
+
+// Whether e is an <svg> or <math> element html start tags and text can go
+// in, ex: <foreignObject>.
+func (e *tokElem) integrationPoint() bool {
+	switch e.ns {
+	case "svg":
+		return e.tag == "foreignobject" || e.tag == "desc" || e.tag == "title"
+	case "math":
+		return e.tag == "mi" || e.tag == "mo" || e.tag == "mn" || e.tag == "ms" || e.tag == "mtext"
+	}
+	return false
+}
+
+func (e *tokElem) attr(name string) (string, bool) {
+	for _, a := range e.attrs {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func (c simpleCompound) matches(e *tokElem) bool {
+	if len(c.tag) > 0 && c.tag != e.tag {
+		return false
+	}
+	if len(c.id) > 0 {
+		if id, _ := e.attr("id"); id != c.id {
+			return false
+		}
+	}
+	if len(c.classes) > 0 {
+		class, _ := e.attr("class")
+		classes := strings.Fields(class)
+		for _, want := range c.classes {
+			if !containsString(classes, want) {
+				return false
+			}
+		}
+	}
+	for _, a := range c.attrs {
+		val, found := e.attr(a.name)
+		if !found || (a.hasVal && val != a.val) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the element at stack[idx] matches, its ancestors being the rest of
+// stack.  The element must be below stack[under] (-1 for anywhere), but as
+// with goquery's Find the rest of the selector can match above it.
+func (sel simpleSelector) matches(stack []*tokElem, idx int, under int) bool {
+	if idx <= under {
+		return false
+	}
+	for _, chain := range sel {
+		if !chain[len(chain)-1].matches(stack[idx]) {
+			continue
+		}
+		pos := idx - 1
+		c := len(chain) - 2
+		for ; c >= 0 && pos >= 0; pos-- {
+			if chain[c].matches(stack[pos]) {
+				c--
+			}
+		}
+		if c < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// An item extracted by tokenizing pages rather than from their DOM.
+type tokItem struct {
+	name   string
+	item   ScrapeItem
+	sel    simpleSelector
+	fields []tokField
+	// index into fields by path, see tokPath
+	byPath map[string]int
+}
+
+// A leaf field of a tokItem.
+type tokField struct {
+	// nil for the item's element itself
+	sel  simpleSelector
+	attr string
+	url  string
+}
+
+// The tokItem for item if its selector and every field selector are simple
+// enough to extract without a DOM, see simpleSelector.  Fields can also use
+// text, attributes, "|owntext", "|count", "|exists" and "@url".
+func tokenizable(name string, item ScrapeItem) (*tokItem, bool) {
+	if len(item.Type) > 0 || len(item.IframeSelector) > 0 || len(item.Selector) == 0 {
+		return nil, false
+	}
+	sel, ok := parseSimpleSelector(item.Selector)
+	if !ok {
+		return nil, false
+	}
+	ti := &tokItem{name: name, item: item, sel: sel, byPath: make(map[string]int)}
+	if !ti.addFields("", item.Fields) {
+		return nil, false
+	}
+	return ti, true
+}
+
+func (ti *tokItem) addFields(prefix string, fields map[string]interface{}) bool {
+	for name, field := range fields {
+		path := tokPath(prefix, name)
+		switch field := field.(type) {
+		case string:
+			f := tokField{}
+			if isUrlField(field) {
+				f.url = field
+			} else {
+				sel, attr := getSelectorAndAttr(field)
+				if _, image := imageAttrs(attr); image {
+					return false
+				}
+				if len(sel) > 0 {
+					var ok bool
+					if f.sel, ok = parseSimpleSelector(sel); !ok {
+						return false
+					}
+				}
+				f.attr = attr
+			}
+			ti.byPath[path] = len(ti.fields)
+			ti.fields = append(ti.fields, f)
+		case map[string]interface{}:
+			if !ti.addFields(path, field) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func tokPath(prefix string, name string) string {
+	return prefix + "\x00" + name
+}
+
+// An element matching a tokItem's selector, with its fields' values so far.
+type tokMatch struct {
+	item  *tokItem
+	depth int
+	// by field, in document order
+	values [][]string
+	counts []int
+}
+
+// A field value being collected from the text inside the element at depth,
+// for the slot'th value of the match's field.
+type tokCapture struct {
+	depth int
+	own   bool
+	text  strings.Builder
+	match *tokMatch
+	field int
+	slot  int
+}
+
+// Extracts items from body without building a DOM, returning each item's
+// results in document order as parseFields would have them.  Tags the html
+// parser would close implicitly are handled (paragraphs, list items,
+// headings, table rows and cells, options), as are stray table tags and
+// quirks mode tables.  Markup the parser would rearrange rather than just
+// close, like misnested formatting tags (<b>1<p>2</b>3), nested links or
+// content directly inside a table, isn't: ok is false on pages with any, for
+// them to be extracted from their DOM instead.
+func tokenizeItems(items []*tokItem, body []byte, pageUrl *url.URL, missing string) (results map[string][]map[string]interface{}, ok bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var stack []*tokElem
+	headSeen, headClosed, bodyOpen := false, false, false
+	// the doctype, if one came before any tags or text, see quirksTable
+	doctype, doctypeSeen, pastDoctype := "", false, false
+	var matches []*tokMatch
+	var open []*tokMatch
+	var captures []*tokCapture
+	// set once the page has markup the tree can't be built for here
+	unsupported := false
+	// whether the last thing added to the current node was text, which
+	// more text is added to rather than being a node of its own
+	inText := false
+	// set from a <form> to its end tag, forms can't be nested
+	formOpen := false
+
+	// safe is false when the element is closed implicitly, which for a
+	// formatting element means the parser would reopen it for what follows
+	pop := func(safe bool) {
+		depth := len(stack) - 1
+		if !safe && formattingElements[stack[depth].tag] {
+			unsupported = true
+		}
+		inText = false
+		headClosed = headClosed || stack[depth].tag == "head"
+		kept := captures[:0]
+		for _, c := range captures {
+			if c.depth < depth {
+				kept = append(kept, c)
+				continue
+			}
+			val := c.text.String()
+			if c.own {
+				val = strings.Join(strings.Fields(val), " ")
+			}
+			c.match.values[c.field][c.slot] = val
+		}
+		captures = kept
+		keptOpen := open[:0]
+		for _, m := range open {
+			if m.depth < depth {
+				keptOpen = append(keptOpen, m)
+			}
+		}
+		open = keptOpen
+		stack = stack[:depth]
+	}
+	popTo := func(idx int) {
+		// formatting elements inside a table cell (and the like) or still
+		// open at the end aren't reopened
+		safe := idx <= 1 || markerElements[stack[idx].tag]
+		for len(stack) > idx {
+			pop(safe)
+		}
+	}
+	capture := func(m *tokMatch, field int, depth int, own bool) {
+		m.values[field] = append(m.values[field], "")
+		captures = append(captures, &tokCapture{depth: depth, own: own, match: m, field: field, slot: len(m.values[field]) - 1})
+	}
+	// values taken from the element just pushed
+	take := func(m *tokMatch, field int, f tokField, e *tokElem, self bool) {
+		idx := len(stack) - 1
+		switch f.attr {
+		case "":
+			capture(m, field, idx, false)
+		case attrOwnText:
+			capture(m, field, idx, true)
+		case attrCount, attrExists:
+			m.counts[field]++
+		default:
+			if val, found := e.attr(f.attr); found {
+				if !self {
+					val = strings.TrimSpace(val)
+				}
+				m.values[field] = append(m.values[field], val)
+			}
+		}
+	}
+	push := func(e *tokElem) {
+		headSeen = headSeen || e.tag == "head"
+		formOpen = formOpen || e.tag == "form"
+		inText = false
+		stack = append(stack, e)
+		idx := len(stack) - 1
+		for _, m := range open {
+			for i, f := range m.item.fields {
+				if f.sel != nil && f.sel.matches(stack, idx, m.depth) {
+					take(m, i, f, e, false)
+				}
+			}
+		}
+		for _, ti := range items {
+			if !ti.sel.matches(stack, idx, -1) {
+				continue
+			}
+			m := &tokMatch{item: ti, depth: idx, values: make([][]string, len(ti.fields)), counts: make([]int, len(ti.fields))}
+			for i, f := range ti.fields {
+				if f.sel == nil && len(f.url) == 0 {
+					take(m, i, f, e, true)
+				}
+			}
+			matches = append(matches, m)
+			open = append(open, m)
+		}
+	}
+	// where the html parser would put content: in the html element, with
+	// head elements before the body and everything else in the body
+	ensureParent := func(tag string) {
+		if len(stack) == 0 {
+			push(&tokElem{tag: "html"})
+		}
+		if bodyOpen {
+			return
+		}
+		inHead := len(stack) > 1 && stack[1].tag == "head"
+		// once the head is closed, <noscript> goes in the body
+		if headElements[tag] && !(tag == "noscript" && headClosed) {
+			if !inHead {
+				push(&tokElem{tag: "head"})
+			}
+			return
+		}
+		if inHead {
+			popTo(1)
+		}
+		push(&tokElem{tag: "body"})
+		bodyOpen = true
+	}
+	// index of the nearest open element named tag, -1 if there isn't one
+	// before a boundary
+	inScope := func(tag string, boundaries map[string]bool) int {
+		for i := len(stack) - 1; i > 0; i-- {
+			if stack[i].tag == tag {
+				return i
+			}
+			if stack[i].bounds(boundaries) {
+				break
+			}
+		}
+		return -1
+	}
+
+	// whether a formatting element named tag is open since the last marker
+	formattingOpen := func(tag string) bool {
+		for i := len(stack) - 1; i > 0; i-- {
+			if len(stack[i].ns) > 0 {
+				continue
+			}
+			if stack[i].tag == tag {
+				return true
+			}
+			if markerElements[stack[i].tag] {
+				break
+			}
+		}
+		return false
+	}
+
+	// index of the open <select>, -1 if there isn't one
+	openSelect := func() int {
+		for i := len(stack) - 1; i > 0; i-- {
+			if stack[i].tag == "select" && len(stack[i].ns) == 0 {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for !unsupported {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF, or the html was cut short
+		}
+		tok := z.Token()
+		if tt != html.DoctypeToken && tt != html.CommentToken && (tt != html.TextToken || len(strings.TrimSpace(tok.Data)) > 0) {
+			pastDoctype = true
+		}
+		switch tt {
+		case html.DoctypeToken:
+			if !pastDoctype {
+				doctype, doctypeSeen, pastDoctype = strings.ToLower(strings.TrimSpace(tok.Data)), true, true
+			}
+		case html.TextToken:
+			// whitespace before the head is dropped, other text outside the
+			// head opens the body
+			if len(strings.TrimSpace(tok.Data)) == 0 {
+				if len(stack) == 0 || (len(stack) == 1 && !headSeen && !bodyOpen) {
+					continue
+				}
+			} else if len(stack) <= 1 || (!bodyOpen && stack[len(stack)-1].tag == "head") {
+				ensureParent("")
+			} else if top := stack[len(stack)-1].tag; tableContexts[top] || top == "colgroup" {
+				unsupported = true // moved out in front of the table
+				continue
+			}
+			top := len(stack) - 1
+			for _, c := range captures {
+				if !c.own {
+					c.text.WriteString(tok.Data)
+				} else if c.depth == top {
+					if !inText {
+						c.text.WriteByte(' ') // a text node of its own, as ownText has them
+					}
+					c.text.WriteString(tok.Data)
+				}
+			}
+			inText = true
+		case html.CommentToken:
+			inText = false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			e := &tokElem{tag: tok.Data, attrs: tok.Attr}
+			if len(stack) > 0 && len(stack[len(stack)-1].ns) > 0 && !stack[len(stack)-1].integrationPoint() {
+				if breaksOutOfForeign[e.tag] {
+					unsupported = true
+					continue
+				}
+				e.ns = stack[len(stack)-1].ns // even for <svg> in <math>
+				push(e)
+				if tt == html.SelfClosingTagToken {
+					pop(true)
+				} else {
+					z.NextIsNotRawText() // ex: <textarea> isn't html's here
+				}
+				continue
+			}
+			switch e.tag {
+			case "html", "head", "body":
+				for _, el := range stack {
+					if el.tag == e.tag && len(e.attrs) > 0 {
+						unsupported = true // added to the open element
+					}
+				}
+				if len(stack) == 0 {
+					if e.tag == "html" {
+						push(e)
+						continue
+					}
+					push(&tokElem{tag: "html"})
+				}
+				if e.tag == "head" && len(stack) == 1 && !bodyOpen {
+					push(e)
+				} else if e.tag == "body" && !bodyOpen {
+					popTo(1)
+					push(e)
+					bodyOpen = true
+				}
+				continue
+			}
+			ensureParent(e.tag)
+			if e.tag == "image" {
+				e.tag = "img" // as the parser does
+			}
+			if e.tag == "svg" || e.tag == "math" {
+				e.ns = e.tag
+			}
+			if stack[len(stack)-1].tag == "colgroup" && e.tag != "col" && e.tag != "template" {
+				pop(true) // only holds cols
+			}
+			top := stack[len(stack)-1].tag
+			if (tableParts[e.tag] || e.tag == "table") && (inScope("caption", tableScope) != -1 || openSelect() != -1) {
+				unsupported = true // closes the caption or select
+				continue
+			}
+			if (e.tag == "caption" || e.tag == "col" || e.tag == "colgroup") &&
+				(inScope("td", tableScope) != -1 || inScope("th", tableScope) != -1 || (tableContexts[top] && top != "table")) {
+				unsupported = true // closes the cell, row or table section
+				continue
+			}
+			if i := openSelect(); i != -1 {
+				switch e.tag {
+				case "option", "optgroup", "script", "template":
+				case "select":
+					popTo(i) // closes the open one instead
+					continue
+				case "input", "keygen", "textarea", "hr":
+					unsupported = true
+					continue
+				default:
+					continue // ignored in a select
+				}
+			}
+			switch {
+			case tableParts[e.tag] && inScope("table", nil) == -1:
+				continue // ignored outside a table
+			case tableContexts[top] && !tableContent(e):
+				unsupported = true // moved out in front of the table
+				continue
+			case (e.tag == "a" || e.tag == "nobr") && formattingOpen(e.tag):
+				unsupported = true // the open one is closed and reopened around the new one
+				continue
+			case e.tag == "form" && formOpen:
+				continue // forms can't be nested, even once the first is closed implicitly
+			}
+			if e.tag != "table" || !quirksTable(doctype, doctypeSeen, &unsupported) {
+				closeImplied(e.tag, stack, popTo)
+			}
+			top = stack[len(stack)-1].tag
+			switch {
+			case headings[e.tag] && headings[top]:
+				pop(true)
+			case e.tag == "tr" && top == "table", (e.tag == "td" || e.tag == "th") && top == "table":
+				push(&tokElem{tag: "tbody"}) // as the parser does
+			case e.tag == "col" && top == "table":
+				push(&tokElem{tag: "colgroup"})
+			}
+			if (e.tag == "td" || e.tag == "th") && tableSections[stack[len(stack)-1].tag] {
+				push(&tokElem{tag: "tr"})
+			}
+			push(e)
+			if tt == html.SelfClosingTagToken || voidElements[e.tag] {
+				pop(true)
+			}
+		case html.EndTagToken:
+			tag := tok.Data
+			// end tags in <svg> and <math> close the element they name, or
+			// are html end tags once past the html element they're in
+			if len(stack) > 0 && len(stack[len(stack)-1].ns) > 0 {
+				i := len(stack) - 1
+				for len(stack[i].ns) > 0 && stack[i].tag != tag {
+					i--
+				}
+				if len(stack[i].ns) > 0 {
+					popTo(i)
+					continue
+				}
+				if (tag == "br" || tag == "p") && !stack[len(stack)-1].integrationPoint() {
+					unsupported = true // read as a start tag, which ends the foreign content
+					continue
+				}
+			}
+			switch {
+			case tag == "html" || tag == "body":
+				ensureParent("") // opens the body if it isn't already
+				continue
+			case tag == "head" && !headSeen && !bodyOpen:
+				ensureParent("meta") // an empty head
+				popTo(1)
+				continue
+			case openSelect() != -1 && (tableParts[tag] || tag == "table"):
+				unsupported = true // closes the select
+				continue
+			case openSelect() != -1 && tag != "option" && tag != "optgroup" && tag != "select":
+				continue // ignored in a select
+			case tag == "br":
+				ensureParent(tag) // read as <br>
+				push(&tokElem{tag: "br"})
+				pop(true)
+				continue
+			case tag == "p" && inScope("p", paragraphScope) == -1:
+				if !bodyOpen {
+					continue // ignored before the body
+				}
+				// as if it were <p></p>
+				push(&tokElem{tag: "p"})
+				pop(true)
+				continue
+			case formattingElements[tag]:
+				if i := inScope(tag, nil); i != -1 && i == len(stack)-1 {
+					pop(true)
+				} else if i != -1 {
+					unsupported = true // rearranged to keep the tags nested
+				}
+				continue
+			case headings[tag]:
+				for i := len(stack) - 1; i > 0 && !stack[i].bounds(scopeElements); i-- {
+					if headings[stack[i].tag] {
+						popTo(i)
+						break
+					}
+				}
+				continue
+			}
+			// special elements close what's open inside them up to a scope
+			// boundary, others can't close special elements
+			boundaries := specialElements
+			switch {
+			case tag == "form":
+				formOpen, boundaries = false, scopeElements
+				// only the form is closed, leaving what's open in it
+				// besides implicitly ended elements open
+				if i := inScope(tag, scopeElements); i != -1 {
+					for _, el := range stack[i+1:] {
+						if !impliedEndElements[el.tag] {
+							unsupported = true
+						}
+					}
+				}
+			case tag == "p":
+				boundaries = paragraphScope
+			case tag == "table":
+				boundaries = nil
+			case tableParts[tag]:
+				boundaries = tableScope
+			case tag == "li":
+				boundaries = listItemScope
+			case specialElements[tag]:
+				boundaries = scopeElements
+			}
+			if i := inScope(tag, boundaries); i != -1 {
+				popTo(i)
+			}
+		}
+	}
+	if unsupported {
+		return nil, false
+	}
+	if !bodyOpen {
+		ensureParent("") // there's always a body
+	}
+	popTo(0)
+
+	results = make(map[string][]map[string]interface{})
+	for _, m := range matches {
+		if parsed, keep := m.parsed("", m.item.item.Fields, pageUrl, missing); keep {
+			results[m.item.name] = append(results[m.item.name], parsed)
+		}
+	}
+	return results, true
+}
+
+// Extracts items from the DOM of a page tokenizeItems can't handle, as they
+// would be without tokenizing.
+func domItems(items []*tokItem, r *colly.Response, missing string) (map[string][]map[string]interface{}, bool) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, false
+	}
+	results := make(map[string][]map[string]interface{})
+	for _, ti := range items {
+		doc.Find(ti.item.Selector).Each(func(idx int, s *goquery.Selection) {
+			e := colly.NewHTMLElementFromSelectionNode(r, s, s.Nodes[0], idx)
+			if parsed, keep := parseFields(ti.item.Fields, e, missing, nil); keep {
+				results[ti.name] = append(results[ti.name], parsed)
+			}
+		})
+	}
+	return results, true
+}
+
+// Whether a <table> leaves an open <p> open, as it does in quirks mode:
+// without a doctype, and not with the standard one.  Other doctypes can go
+// either way, so set unsupported instead.
+func quirksTable(doctype string, doctypeSeen bool, unsupported *bool) bool {
+	switch {
+	case !doctypeSeen:
+		return true
+	case doctype != "html":
+		*unsupported = true
+	}
+	return false
+}
+
+// Whether e can go straight inside a table, tbody or tr, rather than being
+// moved out in front of the table.
+func tableContent(e *tokElem) bool {
+	switch e.tag {
+	case "caption", "colgroup", "col", "tbody", "thead", "tfoot", "tr", "td", "th", "script", "style", "template":
+		return true
+	case "input":
+		typ, _ := e.attr("type")
+		return strings.EqualFold(typ, "hidden")
+	}
+	return false
+}
+
+// Builds the match's fields as parseFields does.
+func (m *tokMatch) parsed(prefix string, fields map[string]interface{}, pageUrl *url.URL, missing string) (map[string]interface{}, bool) {
+	parsed := make(map[string]interface{})
+	keep := true
+	for name, field := range fields {
+		path := tokPath(prefix, name)
+		if nested, ok := field.(map[string]interface{}); ok {
+			val, nestedKeep := m.parsed(path, nested, pageUrl, missing)
+			keep = keep && nestedKeep
+			accumValue(parsed, name, val)
+			continue
+		}
+		idx := m.item.byPath[path]
+		f := m.item.fields[idx]
+		matched := false
+		switch {
+		case len(f.url) > 0:
+			if val, found := urlField(pageUrl, f.url); found {
+				accumValue(parsed, name, val)
+				matched = true
+			}
+		case f.attr == attrCount || f.attr == attrExists:
+			n := m.counts[idx]
+			if f.sel == nil {
+				n = 1
+			}
+			if f.attr == attrCount {
+				accumValue(parsed, name, n)
+			} else {
+				accumValue(parsed, name, n > 0)
+			}
+			matched = true
+		default:
+			for _, val := range m.values[idx] {
+				accumValue(parsed, name, val)
+				matched = true
+			}
+		}
+		if !matched {
+			switch missing {
+			case missingNull:
+				parsed[name] = nil
+			case missingEmpty:
+				parsed[name] = ""
+			case missingDrop:
+				keep = false
+			}
+		}
+	}
+	return parsed, keep
+}
+
+var voidElements = map[string]bool{"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true, "param": true, "source": true,
+	"track": true, "wbr": true}
+
+var headElements = map[string]bool{"base": true, "link": true, "meta": true, "script": true,
+	"style": true, "title": true, "noscript": true, "template": true}
+
+// Elements whose start tag closes an open <p>.
+var closesParagraph = setOf("address", "article", "aside", "blockquote", "center", "details", "dir", "div",
+	"dl", "fieldset", "figcaption", "figure", "footer", "form", "h1", "h2", "h3", "h4", "h5", "h6", "header",
+	"hgroup", "hr", "li", "listing", "main", "menu", "nav", "ol", "p", "pre", "section", "summary", "table",
+	"ul", "dd", "dt", "xmp")
+
+var headings = setOf("h1", "h2", "h3", "h4", "h5", "h6")
+
+// Elements the parser reopens when they're closed implicitly, and that
+// nest in odd ways when misnested.
+var formattingElements = setOf("a", "b", "big", "code", "em", "font", "i", "nobr", "s", "small", "strike",
+	"strong", "tt", "u")
+
+// Elements formatting elements aren't reopened past.
+var markerElements = setOf("applet", "caption", "marquee", "object", "td", "template", "th")
+
+// Elements the end tags of other elements don't close.
+var specialElements = setOf("address", "applet", "area", "article", "aside", "base", "basefont", "bgsound",
+	"blockquote", "body", "br", "button", "caption", "center", "col", "colgroup", "dd", "details", "dir",
+	"div", "dl", "dt", "embed", "fieldset", "figcaption", "figure", "footer", "form", "frame", "frameset",
+	"h1", "h2", "h3", "h4", "h5", "h6", "head", "header", "hgroup", "hr", "html", "iframe", "img", "input",
+	"keygen", "li", "link", "listing", "main", "marquee", "menu", "meta", "nav", "noembed", "noframes",
+	"noscript", "object", "ol", "p", "param", "plaintext", "pre", "script", "section", "select", "source",
+	"style", "summary", "table", "tbody", "td", "template", "textarea", "tfoot", "th", "thead", "title",
+	"tr", "track", "ul", "wbr", "xmp")
+
+// Elements closed by the end tags of the elements they're in.
+var impliedEndElements = setOf("dd", "dt", "li", "optgroup", "option", "p", "rb", "rp", "rt", "rtc")
+
+// Scope boundaries, the elements implied closes don't reach past.
+var (
+	scopeElements  = setOf("applet", "caption", "html", "table", "td", "th", "marquee", "object", "template")
+	paragraphScope = setOf("applet", "caption", "html", "table", "td", "th", "marquee", "object", "template", "button")
+	listItemScope  = setOf("applet", "caption", "html", "table", "td", "th", "marquee", "object", "template", "ol", "ul")
+	tableScope     = setOf("html", "table", "template")
+)
+
+// Tags only parsed inside a table, and the elements of one content can't
+// go directly in.
+var (
+	tableParts    = setOf("caption", "col", "colgroup", "tbody", "td", "tfoot", "th", "thead", "tr")
+	tableSections = setOf("tbody", "thead", "tfoot")
+	tableContexts = setOf("table", "tbody", "thead", "tfoot", "tr")
+)
+
+// List items close the previous one unless a special element other than
+// these comes first.
+var listItemBoundaries = func() map[string]bool {
+	boundaries := make(map[string]bool)
+	for special := range specialElements {
+		if special != "address" && special != "div" && special != "p" {
+			boundaries[special] = true
+		}
+	}
+	return boundaries
+}()
+
+// Html tags that end <svg> and <math> content.
+var breaksOutOfForeign = setOf("b", "big", "blockquote", "body", "br", "center", "code", "dd", "div", "dl",
+	"dt", "em", "embed", "font", "h1", "h2", "h3", "h4", "h5", "h6", "head", "hr", "i", "img", "li", "listing",
+	"menu", "meta", "nobr", "ol", "p", "pre", "ruby", "s", "small", "span", "strong", "strike", "sub", "sup",
+	"table", "tt", "u", "ul", "var")
+
+func setOf(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// Closes the elements the html parser would implicitly close on a tag start
+// tag, ex: an open <li> on the next <li>.
+func closeImplied(tag string, stack []*tokElem, popTo func(int)) {
+	// closes the nearest open element in closing, unless one of the
+	// boundaries comes first
+	closeOpen := func(closing []string, boundaries map[string]bool) {
+		for i := len(stack) - 1; i > 0; i-- {
+			if containsString(closing, stack[i].tag) {
+				popTo(i)
+				return
+			}
+			if stack[i].bounds(boundaries) {
+				return
+			}
+		}
+	}
+	if closesParagraph[tag] {
+		closeOpen([]string{"p"}, paragraphScope)
+	}
+	switch tag {
+	case "li":
+		closeOpen([]string{"li"}, listItemBoundaries)
+	case "dt", "dd":
+		closeOpen([]string{"dt", "dd"}, listItemBoundaries)
+	case "button":
+		closeOpen([]string{"button"}, scopeElements)
+	case "tr":
+		closeOpen([]string{"tr"}, setOf("table", "tbody", "thead", "tfoot"))
+	case "td", "th":
+		closeOpen([]string{"td", "th"}, setOf("tr", "table"))
+	case "tbody", "thead", "tfoot":
+		closeOpen([]string{"tbody", "thead", "tfoot"}, setOf("table"))
+	case "option", "optgroup":
+		if stack[len(stack)-1].tag == "option" {
+			popTo(len(stack) - 1)
+		}
+	}
+}
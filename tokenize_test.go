@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly"
+)
+
+var tokenizeTestItems = map[string]ScrapeItem{
+	"links":  {Selector: "a", Fields: map[string]interface{}{"text": "", "href": "|href"}},
+	"bold":   {Selector: "b", Fields: map[string]interface{}{"text": ""}},
+	"paras":  {Selector: "p", Fields: map[string]interface{}{"text": "", "own": "|owntext", "bolds": "b|count"}},
+	"cells":  {Selector: "td", Fields: map[string]interface{}{"text": ""}},
+	"tables": {Selector: "table", Fields: map[string]interface{}{"text": "", "cells": "td|count", "rows": "tbody tr|count"}},
+	"bodies": {Selector: "body", Fields: map[string]interface{}{"paras": "p|count", "cells": "td|count", "class": "|class"}},
+	"nested": {Selector: "div p, section li", Fields: map[string]interface{}{"text": ""}},
+	"items":  {Selector: "li", Fields: map[string]interface{}{"text": ""}},
+	"heads":  {Selector: "h1, h2", Fields: map[string]interface{}{"text": ""}},
+}
+
+// Runs the tokenizer on body, and extracts the same items from its DOM.
+func tokenizeAndParse(t *testing.T, body string) (tokenized, parsed map[string][]map[string]interface{}, ok bool) {
+	pageUrl, _ := url.Parse("http://example.com/")
+	var items []*tokItem
+	for _, name := range sortedItemNames(tokenizeTestItems) {
+		ti, tokOk := tokenizable(name, tokenizeTestItems[name])
+		if !tokOk {
+			t.Fatalf("item %q isn't tokenizable", name)
+		}
+		items = append(items, ti)
+	}
+	tokenized, ok = tokenizeItems(items, []byte(body), pageUrl, "")
+	resp := &colly.Response{Body: []byte(body), Request: &colly.Request{URL: pageUrl}}
+	parsed, domOk := domItems(items, resp, "")
+	if !domOk {
+		t.Fatalf("parsing %s failed", body)
+	}
+	return tokenized, parsed, ok
+}
+
+func TestTokenizeMatchesDom(t *testing.T) {
+	pages := []string{
+		`<p>one<p>two<ul><li>a<li>b</ul>`,
+		`<!doctype html><p>x<table><tr><td>1<td>2</table>`,
+		`<p>x<table><tr><td>1</table>`,
+		`<table><tr><td>1</td></tr></table>`,
+		`<table><td>1</td></table>`,
+		`<table><tr><td><b>x</td><td>y</td></tr></table>`,
+		`<td>stray</td><tr><p>after`,
+		`<h1>a<h2>b</h2>c`,
+		`<div><span>x</div>y`,
+		`<div><span><div>x</span>y</div>`,
+		`</p>text`,
+		`x</br>y`,
+		`<section><li>a<div><li>b</div></section>`,
+		`<li>a<section><li>b</section>`,
+		`<svg><title>t</title><path/></svg><p>x`,
+		`<form><p>a<form><p>b</form>`,
+		`<p>a<b>bold</b>c</p><a href=x>link</a>`,
+		`<html class=x><body class=home><p>x`,
+		`<title>t</title>text<p>x`,
+		string(benchPage(3)),
+	}
+	for _, page := range pages {
+		tokenized, parsed, ok := tokenizeAndParse(t, page)
+		if !ok {
+			t.Errorf("%s wasn't tokenized", page)
+			continue
+		}
+		if !reflect.DeepEqual(tokenized, parsed) {
+			got, _ := json.Marshal(tokenized)
+			want, _ := json.Marshal(parsed)
+			t.Errorf("%s\ntokenized %s\nDOM       %s", page, got, want)
+		}
+	}
+}
+
+// Markup the parser rearranges can't be tokenized, and must be reported so
+// the page is extracted from its DOM instead.
+func TestTokenizeRejectsRearrangedMarkup(t *testing.T) {
+	pages := []string{
+		`<a href=1>1<a href=2>2</a>`,
+		`<b>1<p>2</b>3`,
+		`<p><b>x</p>y`,
+		`<p><i>x<div>y</div>`,
+		`<table><div>x</div><tr><td>1</table>`,
+		`<table>text<tr><td>1</table>`,
+		`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01 Transitional//EN"><p>x<table><tr><td>1</table>`,
+		`<svg><p>x</svg>`,
+		`<p>x<body class=late><p>y`,
+		`<form><div>x</form>y`,
+	}
+	for _, page := range pages {
+		tokenized, parsed, ok := tokenizeAndParse(t, page)
+		if ok && !reflect.DeepEqual(tokenized, parsed) {
+			got, _ := json.Marshal(tokenized)
+			want, _ := json.Marshal(parsed)
+			t.Errorf("%s was tokenized differently\ntokenized %s\nDOM       %s", page, got, want)
+		}
+		if ok {
+			t.Errorf("%s should fall back on the DOM", page)
+		}
+	}
+}
+
+// Random tag soup is either tokenized exactly as it's parsed, or left to
+// the DOM.
+func TestTokenizeRandomMarkup(t *testing.T) {
+	parts := []string{"<p>", "</p>", "<b>", "</b>", "<a href=1>", "</a>", "<div>", "</div>", "<table>", "</table>",
+		"<tr>", "</tr>", "<td>", "</td>", "<th>", "<tbody>", "<caption>", "</caption>", "<col>", "<li>", "</li>",
+		"<ul>", "</ul>", "<dl>", "</dl>", "<dd>", "<dt>", "<span>", "</span>", "<h1>", "</h1>", "<h2>",
+		"<section>", "</section>", "<br>", "</br>", "<form>", "</form>", "<svg>", "</svg>", "<math>", "</math>",
+		"<foreignObject>", "<i>", "</i>", "<em>", "</em>", "<nobr>", "<select>", "<option>", "</select>",
+		"<button>", "</button>", "<html>", "<head>", "</head>", "<body class=z>", "</body>", "<title>t</title>",
+		"<meta>", "<img>", "<image>", "<hr>", "<input type=hidden>", "<noscript>n</noscript>",
+		"<textarea>q</textarea>", "<!doctype html>", "<!-- c -->", "x", "y "}
+	r := rand.New(rand.NewSource(1))
+	tokenizedPages := 0
+	for n := 0; n < 5000; n++ {
+		var b strings.Builder
+		for k := r.Intn(16) + 1; k > 0; k-- {
+			b.WriteString(parts[r.Intn(len(parts))])
+		}
+		page := b.String()
+		tokenized, parsed, ok := tokenizeAndParse(t, page)
+		if !ok {
+			continue
+		}
+		tokenizedPages++
+		if !reflect.DeepEqual(tokenized, parsed) {
+			got, _ := json.Marshal(tokenized)
+			want, _ := json.Marshal(parsed)
+			t.Fatalf("%s\ntokenized %s\nDOM       %s", page, got, want)
+		}
+	}
+	if tokenizedPages < 2500 {
+		t.Errorf("only %d of 5000 pages were tokenized", tokenizedPages)
+	}
+}
+
+// Pages that can't be tokenized are scraped from their DOM, with the same
+// results as without tokenize.
+func TestScrapeTokenizeFallback(t *testing.T) {
+	pages := map[string]string{
+		"/ok":     string(benchPage(20)),
+		"/broken": `<div class="product"><a href=1>1<a href=2>2</a></div><div class="product"><b>1<p>2</b>3</div>`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, pages[r.URL.Path])
+	}))
+	defer ts.Close()
+	for path := range pages {
+		req := benchRequest(ts.URL+path, false)
+		req.Items["links"] = ScrapeItem{Selector: "div.product a", Fields: map[string]interface{}{"text": "", "href": "|href"}}
+		req.Items["paras"] = ScrapeItem{Selector: "p", Fields: map[string]interface{}{"text": ""}}
+		want, err := scrape(req, scrapeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Tokenize = true
+		got, err := scrape(req, scrapeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s tokenized %v, want %v", path, got, want)
+		}
+	}
+}
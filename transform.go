@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Transforms a field's extracted text can go through, see ScrapeItem.Transform.
+const (
+	// A srcset attribute as a list of {"url", "width"} or {"url", "density"}.
+	transformSrcset = "srcset"
+	// The url of a srcset's largest candidate.
+	transformSrcsetLargest = "srcset_largest"
+)
+
+func validTransform(transform string) bool {
+	return transform == transformSrcset || transform == transformSrcsetLargest
+}
+
+// Replaces the values of fields listed in transforms with their transformed
+// value.  Each value of a multi valued field is transformed on its own.
+func applyTransforms(parsed map[string]interface{}, transforms map[string]string) {
+	for path, transform := range transforms {
+		val, found := fieldByPath(parsed, path)
+		if !found || val == nil {
+			continue
+		}
+		transform := transform
+		setByPath(parsed, path, mapLeaves(val, func(s string) interface{} {
+			return transformValue(transform, s)
+		}))
+	}
+}
+
+func transformValue(transform, val string) interface{} {
+	switch transform {
+	case transformSrcset:
+		candidates := parseSrcset(val)
+		entries := make([]interface{}, len(candidates))
+		for i, c := range candidates {
+			entry := map[string]interface{}{"url": c.url}
+			if c.width > 0 {
+				entry["width"] = c.width
+			} else {
+				entry["density"] = c.density
+			}
+			entries[i] = entry
+		}
+		return entries
+	case transformSrcsetLargest:
+		return largestSrcset(parseSrcset(val))
+	}
+	return val
+}
+
+type srcsetCandidate struct {
+	url string
+	// One of width ("800w") or density ("2x", the default of 1).
+	width   int
+	density float64
+}
+
+// Parses a srcset attribute roughly per the html spec: urls may contain
+// commas (ex: image cdn parameters), only a comma after whitespace or at the
+// end of a url separates candidates.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	rest := srcset
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f,")
+		if len(rest) == 0 {
+			return candidates
+		}
+		end := strings.IndexAny(rest, " \t\n\r\f")
+		if end == -1 {
+			end = len(rest)
+		}
+		u := rest[:end]
+		rest = rest[end:]
+		descriptors := ""
+		if strings.HasSuffix(u, ",") {
+			u = strings.TrimRight(u, ",")
+		} else {
+			// descriptors run to the next comma outside of parens
+			depth, i := 0, 0
+			for ; i < len(rest); i++ {
+				if rest[i] == '(' {
+					depth++
+				} else if rest[i] == ')' && depth > 0 {
+					depth--
+				} else if rest[i] == ',' && depth == 0 {
+					break
+				}
+			}
+			descriptors, rest = rest[:i], rest[i:]
+		}
+		c := srcsetCandidate{url: u, density: 1}
+		for _, d := range strings.Fields(descriptors) {
+			if len(d) < 2 {
+				continue
+			}
+			num := d[:len(d)-1]
+			switch d[len(d)-1] {
+			case 'w':
+				if w, err := strconv.Atoi(num); err == nil && w > 0 {
+					c.width = w
+				}
+			case 'x':
+				if x, err := strconv.ParseFloat(num, 64); err == nil && x > 0 {
+					c.density = x
+				}
+			}
+		}
+		if len(c.url) > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+}
+
+// The url of the widest candidate, or the densest when none give a width.
+func largestSrcset(candidates []srcsetCandidate) string {
+	best := -1
+	for i, c := range candidates {
+		if best == -1 {
+			best = i
+			continue
+		}
+		b := candidates[best]
+		if c.width > b.width || (c.width == b.width && c.width == 0 && c.density > b.density) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return ""
+	}
+	return candidates[best].url
+}
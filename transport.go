@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Set on requests by scrapes with "sticky_session" so rotatingTransport sends
+// all of a run's requests to a domain the same way.  Stripped before sending.
+const sessionHeader = "X-Gluestick-Session"
+
+// How many connections are kept open between requests, so repeated requests
+// to a host (ex: from different /scrape requests or jobs) skip the TCP and
+// TLS handshakes.
+type idleLimits struct {
+	// Across all hosts, and per host.  Concurrent requests to a host beyond
+	// PerHost still connect, but their connections are closed once done.
+	Max     int
+	PerHost int
+	Timeout time.Duration
+}
+
+// Builds the transport used for all scrape requests, shared by every scrape
+// in the process so connections are reused between them.  Names are
+// resolved via lookup, and if localIps are given requests are rotated across
+// them.
+func buildTransport(localIps []string, lookup lookupFunc, idle idleLimits) (http.RoundTripper, error) {
+	rt := &rotatingTransport{}
+	if len(localIps) == 0 {
+		rt.transports = append(rt.transports, newTransport(newDialer(), lookup, idle))
+		return rt, nil
+	}
+	for _, ip := range localIps {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("not an IP address: %q", ip)
+		}
+		dialer := newDialer()
+		dialer.LocalAddr = &net.TCPAddr{IP: parsed}
+		rt.transports = append(rt.transports, newTransport(dialer, lookup, idle))
+	}
+	return rt, nil
+}
+
+// Builds a transport like http.DefaultTransport but with its own dialer so
+// outgoing connections can be customized.
+func newTransport(dialer *net.Dialer, lookup lookupFunc, idle idleLimits) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialWithLookup(dialer, lookup),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          idle.Max,
+		MaxIdleConnsPerHost:   idle.PerHost,
+		IdleConnTimeout:       idle.Timeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func newDialer() *net.Dialer {
+	return &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+}
+
+// rotatingTransport round robins requests across transports, each bound to a
+// different local address, spreading requests over multiple egress IPs.
+// Requests in a sticky session always use the same transport for a given
+// domain instead, since switching IPs mid-session can get them blocked.
+type rotatingTransport struct {
+	transports []http.RoundTripper
+	next       uint32
+}
+
+func (rt *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if session := req.Header.Get(sessionHeader); len(session) > 0 {
+		req = req.Clone(req.Context())
+		req.Header.Del(sessionHeader)
+		// hashed rather than assigned so there's nothing to clean up after
+		h := fnv.New32a()
+		h.Write([]byte(session + "|" + registrableDomain(req.URL.Host)))
+		return rt.transports[int(h.Sum32()%uint32(len(rt.transports)))].RoundTrip(req)
+	}
+	n := atomic.AddUint32(&rt.next, 1)
+	return rt.transports[int(n)%len(rt.transports)].RoundTrip(req)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Fields starting with this take their value from the page's url rather than
+// its html, ex: "@url.query.id".
+const urlFieldPrefix = "@url"
+
+func isUrlField(field string) bool {
+	return field == urlFieldPrefix || strings.HasPrefix(field, urlFieldPrefix+".")
+}
+
+// Checks a "@url..." field names a part of the url that exists.
+func checkUrlField(field string) error {
+	part := strings.TrimPrefix(strings.TrimPrefix(field, urlFieldPrefix), ".")
+	name := part
+	if idx := strings.Index(part, "."); idx != -1 {
+		name = part[:idx]
+		if arg := part[idx+1:]; name == "path" {
+			if _, err := strconv.Atoi(arg); err != nil {
+				return fmt.Errorf("%q: path segments are numbered, ex: %s.path.0", field, urlFieldPrefix)
+			}
+		} else if name != "query" || len(arg) == 0 {
+			return fmt.Errorf("%q: only path and query take a part, ex: %s.query.id", field, urlFieldPrefix)
+		}
+	}
+	switch name {
+	case "", "scheme", "host", "hostname", "port", "path", "query", "fragment":
+		return nil
+	}
+	return fmt.Errorf("%q: unknown url part %q", field, name)
+}
+
+// Value of a "@url..." field for u, false if that part is missing:
+//
+//	@url              the whole url
+//	@url.host         host including any port, or hostname/port separately
+//	@url.path         path, or @url.path.N for the Nth segment (negative
+//	                  counts from the end)
+//	@url.query        raw query string, or @url.query.NAME for a parameter
+//	@url.scheme, @url.fragment
+func urlField(u *url.URL, field string) (string, bool) {
+	part := strings.TrimPrefix(strings.TrimPrefix(field, urlFieldPrefix), ".")
+	arg := ""
+	if idx := strings.Index(part, "."); idx != -1 {
+		part, arg = part[:idx], part[idx+1:]
+	}
+	var val string
+	switch part {
+	case "":
+		val = u.String()
+	case "scheme":
+		val = u.Scheme
+	case "host":
+		val = u.Host
+	case "hostname":
+		val = u.Hostname()
+	case "port":
+		val = u.Port()
+	case "fragment":
+		val = u.Fragment
+	case "query":
+		if len(arg) == 0 {
+			val = u.RawQuery
+		} else if vals, found := u.Query()[arg]; found && len(vals) > 0 {
+			return vals[0], true
+		}
+	case "path":
+		if len(arg) == 0 {
+			val = u.Path
+			break
+		}
+		n, _ := strconv.Atoi(arg)
+		var segments []string
+		for _, seg := range strings.Split(u.Path, "/") {
+			if len(seg) > 0 {
+				segments = append(segments, seg)
+			}
+		}
+		if n < 0 {
+			n += len(segments)
+		}
+		if n >= 0 && n < len(segments) {
+			return segments[n], true
+		}
+	}
+	return val, len(val) > 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError is a problem with one part of a scrape request, located
+// by a JSON pointer (RFC 6901) into the request json, ex:
+// "/items/products/fields/price".
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"error"`
+}
+
+// ValidationErrors is every problem validate found with a request.
+type ValidationErrors []ValidationError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, len(ve))
+	for i, e := range ve {
+		if len(e.Path) == 0 {
+			msgs[i] = e.Message
+		} else {
+			msgs[i] = e.Path + ": " + e.Message
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Collects ValidationErrors rather than stopping at the first.
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Joins parts into a JSON pointer, escaping "~" and "/" within them.
+func jsonPointer(parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteByte('/')
+		b.WriteString(strings.Replace(strings.Replace(part, "~", "~0", -1), "/", "~1", -1))
+	}
+	return b.String()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Version of the scrape request format this build reads.  Requests without
+// a "version" are version 1.
+const requestVersion = 1
+
+// Upgrades a request's json from the keyed version to the next, so configs
+// written for older versions keep working after syntax changes.  There are
+// none yet, version 1 being the first.
+var requestMigrations = map[int]func(req map[string]interface{}) error{}
+
+// Migrates data to the current request version if needed, returning the
+// version it was and the migrated json (data itself if already current,
+// whether or not it says so).  Migrated json keeps the keys of data in the
+// order they were, so files stay recognizable.
+func migrateRequest(data []byte) (int, []byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return 0, nil, err
+	}
+	if raw == nil {
+		return 0, nil, errors.New("request must be a json object")
+	}
+	version := 1
+	if val, found := raw["version"]; found {
+		num, ok := val.(json.Number)
+		n, err := num.Int64()
+		if !ok || err != nil || n < 1 {
+			return 0, nil, fmt.Errorf("version must be a positive integer")
+		}
+		version = int(n)
+	}
+	if version > requestVersion {
+		return version, nil, fmt.Errorf("version %d is newer than this gluestick supports (%d)", version, requestVersion)
+	}
+	if version == requestVersion {
+		return version, data, nil
+	}
+	for v := version; v < requestVersion; v++ {
+		migrate, found := requestMigrations[v]
+		if !found {
+			return version, nil, fmt.Errorf("no migration from version %d", v)
+		}
+		if err := migrate(raw); err != nil {
+			return version, nil, fmt.Errorf("migrating from version %d: %v", v, err)
+		}
+	}
+	raw["version"] = requestVersion
+	order, err := readKeyOrder(data)
+	if err != nil {
+		return version, nil, err
+	}
+	var migrated bytes.Buffer
+	err = writeInOrder(&migrated, raw, order)
+	return version, migrated.Bytes(), err
+}
+
+// The order of the keys of a json document's objects, nested as they are.
+type keyOrder struct {
+	keys   []string
+	fields map[string]*keyOrder
+	elems  []*keyOrder
+}
+
+func readKeyOrder(data []byte) (*keyOrder, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return readValueOrder(dec)
+}
+
+// Reads the next value from dec, returning its key order if it's an object
+// or array and nil otherwise.
+func readValueOrder(dec *json.Decoder) (*keyOrder, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		order := &keyOrder{fields: make(map[string]*keyOrder)}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			name, _ := key.(string)
+			if order.fields[name], err = readValueOrder(dec); err != nil {
+				return nil, err
+			}
+			order.keys = append(order.keys, name)
+		}
+		_, err = dec.Token()
+		return order, err
+	case json.Delim('['):
+		order := &keyOrder{}
+		for dec.More() {
+			elem, err := readValueOrder(dec)
+			if err != nil {
+				return nil, err
+			}
+			order.elems = append(order.elems, elem)
+		}
+		_, err = dec.Token()
+		return order, err
+	}
+	return nil, nil
+}
+
+// Writes val as compact json, with object keys in the order given and any
+// not in it (added by migrations) after them, sorted.  Unlike json.Marshal,
+// <, > and & are left as they are so selectors like "ul > li" stay readable.
+func writeInOrder(buf *bytes.Buffer, val interface{}, order *keyOrder) error {
+	if order == nil {
+		order = &keyOrder{}
+	}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for _, key := range order.keys {
+			if _, found := v[key]; found {
+				keys = append(keys, key)
+			}
+		}
+		var added []string
+		for key := range v {
+			if _, found := order.fields[key]; !found {
+				added = append(added, key)
+			}
+		}
+		sort.Strings(added)
+		buf.WriteByte('{')
+		for i, key := range append(keys, added...) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeInOrder(buf, key, nil); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeInOrder(buf, v[key], order.fields[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			var elemOrder *keyOrder
+			if i < len(order.elems) {
+				elemOrder = order.elems[i]
+			}
+			if err := writeInOrder(buf, elem, elemOrder); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return nil
+}
+
+// Parses a scrape request of any supported version.
+func parseRequest(data []byte) (ScrapeRequest, error) {
+	var req ScrapeRequest
+	_, migrated, err := migrateRequest(data)
+	if err != nil {
+		return req, err
+	}
+	err = json.Unmarshal(migrated, &req)
+	return req, err
+}
+
+// "gluestick migrate <file>..." upgrades request files to the current
+// version in place.  Migrated files are re-indented with their keys kept in
+// order, and files are left alone if already current (with or without a
+// "version") or if they don't validate after migrating.
+func migrateFiles(filenames []string) error {
+	failed := 0
+	for _, filename := range filenames {
+		if err := migrateFile(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to migrate", failed, len(filenames))
+	}
+	return nil
+}
+
+func migrateFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	from, migrated, err := migrateRequest(data)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(migrated, data) {
+		fmt.Printf("%s: already version %d, nothing to migrate\n", filename, requestVersion)
+		return nil
+	}
+	var req ScrapeRequest
+	if err := json.Unmarshal(migrated, &req); err != nil {
+		return err
+	}
+	if err := validate(&req); err != nil {
+		return fmt.Errorf("invalid after migrating: %v", err)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, migrated, "", "    "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, out.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	fmt.Printf("%s: version %d -> %d\n", filename, from, requestVersion)
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateFileLeavesCurrentAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, data := range []string{
+		`{"url": "https://example.com", "items": {"links": {"selector": "ul > li", "fields": {"href": "a @href"}}}}`,
+		`{"version": 1, "url":"https://example.com","items":{}}`,
+	} {
+		filename := filepath.Join(dir, "req.json")
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := migrateFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("migrate changed %s to %s", data, got)
+		}
+	}
+}
+
+func TestWriteInOrder(t *testing.T) {
+	data := []byte(`{"url": "https://example.com", "items": {"b": {"selector": "ul > li", "fields": {"z": "a", "a": "b & c"}}, "a": {"selector": "p"}}, "render": [{"y": 1, "x": 2.50}]}`)
+	order, err := readKeyOrder(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	// as a migration might: drop a key, add some
+	delete(raw["items"].(map[string]interface{})["a"].(map[string]interface{}), "selector")
+	raw["items"].(map[string]interface{})["a"].(map[string]interface{})["css"] = "p"
+	raw["version"] = 2
+	var buf bytes.Buffer
+	if err := writeInOrder(&buf, raw, order); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"url":"https://example.com","items":{"b":{"selector":"ul > li","fields":{"z":"a","a":"b & c"}},"a":{"css":"p"}},"render":[{"y":1,"x":2.50}],"version":2}`
+	if buf.String() != want {
+		t.Errorf("got  %s\nwant %s", buf.String(), want)
+	}
+}
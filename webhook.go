@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Job lifecycle events a webhook can be sent for.
+const (
+	webhookStarted   = "started"
+	webhookPageDone  = "page_done"
+	webhookCompleted = "completed"
+	webhookFailed    = "failed"
+)
+
+var webhookEvents = []string{webhookStarted, webhookPageDone, webhookCompleted, webhookFailed}
+
+// Webhook is POSTed to as a job progresses, so orchestrators can track jobs
+// without polling.  Only used by POST /jobs.
+type Webhook struct {
+	Url string `json:"url"`
+	// Defaults to every event.
+	Events  []string          `json:"events,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body to send instead of the default {"event", "job", "page"} json, with
+	// placeholders filled in, see webhookVars.
+	Template string `json:"template,omitempty"`
+}
+
+func checkWebhook(v *validator, path string, hook *Webhook) {
+	u, err := url.Parse(hook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		v.add(path+"/url", "must be an http(s) url")
+	}
+	for idx, event := range hook.Events {
+		if !containsString(webhookEvents, event) {
+			v.add(path+"/events/"+strconv.Itoa(idx), "must be %q, %q, %q or %q",
+				webhookStarted, webhookPageDone, webhookCompleted, webhookFailed)
+		}
+	}
+}
+
+// Networks webhooks can't be sent to unless their host is on -webhook-allow:
+// the server's own addresses, private networks and link local addresses,
+// which include cloud metadata services (169.254.169.254).
+var internalNetworks = parseCidrs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseCidrs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func internalAddress(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, n := range internalNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where webhooks can be sent.  Any submitter picks the url and headers, so
+// with an allow list only hosts on it (and their subdomains) can be used,
+// and hosts not on it can't be internal addresses whatever they resolve to.
+type webhookPolicy struct {
+	allow  []string
+	client *http.Client
+}
+
+func newWebhookPolicy(allow []string) *webhookPolicy {
+	wp := &webhookPolicy{allow: allow}
+	dialer := newDialer()
+	wp.client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// no proxy, it would be what's dialed and checked
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				d := *dialer
+				if !wp.allowed(host) {
+					// checked as connecting, so names resolving to internal
+					// addresses (or changing to one) are caught too
+					d.Control = func(network, address string, _ syscall.RawConn) error {
+						ip, _, err := net.SplitHostPort(address)
+						if err != nil {
+							return err
+						}
+						if parsed := net.ParseIP(ip); parsed == nil || internalAddress(parsed) {
+							return fmt.Errorf("%s is an internal address, webhook hosts must be on -webhook-allow to use one", ip)
+						}
+						return nil
+					}
+				}
+				return d.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// a redirect could go anywhere, webhooks are only sent where asked
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return wp
+}
+
+// Whether host is on the allow list.
+func (wp *webhookPolicy) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range wp.allow {
+		if matchesDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if webhooks can't be sent to hookUrl.  Hosts that
+// resolve to internal addresses are only caught when sending.
+func (wp *webhookPolicy) check(hookUrl string) error {
+	u, err := url.Parse(hookUrl)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if wp.allowed(host) {
+		return nil
+	}
+	if len(wp.allow) > 0 {
+		return fmt.Errorf("webhook host %s is not on -webhook-allow", host)
+	}
+	if ip := net.ParseIP(host); (ip != nil && internalAddress(ip)) || strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("webhook host %s is an internal address, it must be on -webhook-allow to use it", host)
+	}
+	return nil
+}
+
+// Max queued page_done events per job, beyond that the oldest are dropped
+// rather than holding up the scrape.  Other events are never dropped.
+const webhookBacklog = 256
+
+type webhookEvent struct {
+	name string
+	job  Job
+	page *PageMeta
+}
+
+// Delivers a job's events to its webhook in order, from one goroutine so a
+// slow endpoint doesn't hold up the job.  Sending only ever queues, so it
+// never blocks, even while the job store's lock is held.
+type webhookSender struct {
+	hook   *Webhook
+	client *http.Client
+	lock   sync.Mutex
+	// Events waiting to be delivered, pages of them page_done.
+	queue  []webhookEvent
+	pages  int
+	closed bool
+	// Holds a token whenever there may be events waiting.
+	wake chan struct{}
+}
+
+func newWebhookSender(hook *Webhook, client *http.Client) *webhookSender {
+	ws := &webhookSender{
+		hook:   hook,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+	go func() {
+		for {
+			event, ok := ws.next()
+			if !ok {
+				return
+			}
+			if err := ws.deliver(event); err != nil {
+				log.Printf("Webhook %s for job %s failed: %s\n", event.name, event.job.Id, err)
+			}
+		}
+	}()
+	return ws
+}
+
+// Queues an event if the webhook wants it.  The job finishing closes the
+// queue, ignoring anything sent after.
+func (ws *webhookSender) send(name string, job Job, page *PageMeta) {
+	if len(ws.hook.Events) > 0 && !containsString(ws.hook.Events, name) {
+		if name == webhookCompleted || name == webhookFailed {
+			ws.close()
+		}
+		return
+	}
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.closed {
+		return
+	}
+	if name == webhookPageDone {
+		if ws.pages >= webhookBacklog {
+			for i, queued := range ws.queue {
+				if queued.name == webhookPageDone {
+					log.Printf("Webhook backlog full for job %s, dropping page_done for %s\n", job.Id, queued.page.Url)
+					ws.queue = append(ws.queue[:i], ws.queue[i+1:]...)
+					ws.pages--
+					break
+				}
+			}
+		}
+		ws.pages++
+	}
+	ws.queue = append(ws.queue, webhookEvent{name: name, job: job, page: page})
+	if name == webhookCompleted || name == webhookFailed {
+		ws.closed = true
+	}
+	ws.signal()
+}
+
+func (ws *webhookSender) close() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.closed = true
+	ws.signal()
+}
+
+func (ws *webhookSender) signal() {
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for the next event to deliver, false once the queue is closed and
+// everything in it delivered.
+func (ws *webhookSender) next() (webhookEvent, bool) {
+	for {
+		ws.lock.Lock()
+		if len(ws.queue) > 0 {
+			event := ws.queue[0]
+			ws.queue = ws.queue[1:]
+			if event.name == webhookPageDone {
+				ws.pages--
+			}
+			ws.lock.Unlock()
+			return event, true
+		}
+		closed := ws.closed
+		ws.lock.Unlock()
+		if closed {
+			return webhookEvent{}, false
+		}
+		<-ws.wake
+	}
+}
+
+// Posts the event, retrying a couple of times on errors and 5xx responses.
+func (ws *webhookSender) deliver(event webhookEvent) error {
+	body := ws.payload(event)
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, ws.hook.Url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, val := range ws.hook.Headers {
+			req.Header.Set(name, val)
+		}
+		var resp *http.Response
+		if resp, err = ws.client.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("webhook returned %s", resp.Status)
+			}
+			return nil
+		}
+		err = fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return err
+}
+
+func (ws *webhookSender) payload(event webhookEvent) []byte {
+	if len(ws.hook.Template) == 0 {
+		body, _ := json.Marshal(map[string]interface{}{"event": event.name, "job": event.job, "page": event.page})
+		return body
+	}
+	return []byte(expandTemplate(ws.hook.Template, webhookVars(event)))
+}
+
+// Placeholders for webhook templates.  Text values are json string escaped
+// (without quotes) so they can go inside string literals, {job}, {page} and
+// {counts} are whole json values.
+func webhookVars(event webhookEvent) map[string]string {
+	escape := func(s string) string {
+		quoted, _ := json.Marshal(s)
+		return string(quoted[1 : len(quoted)-1])
+	}
+	toJson := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	vars := map[string]string{
+		"event":       event.name,
+		"job_id":      event.job.Id,
+		"status":      event.job.Status,
+		"error":       escape(event.job.Error),
+		"url":         escape(event.job.req.Url),
+		"job":         toJson(event.job),
+		"counts":      toJson(event.job.Counts),
+		"page":        "null",
+		"page_url":    "",
+		"page_status": "0",
+	}
+	if event.page != nil {
+		vars["page"] = toJson(event.page)
+		vars["page_url"] = escape(event.page.Url)
+		vars["page_status"] = strconv.Itoa(event.page.Status)
+	}
+	return vars
+}
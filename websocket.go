@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	itemTypeWebsocket = "websocket"
+
+	defaultWebsocketDuration = 30 * time.Second
+	// Larger messages fail the capture rather than being read into memory.
+	maxWebsocketMessage = 16 << 20
+)
+
+// WebsocketCapture is listened to by "websocket" items, for pages that
+// stream their data (live prices, scores) instead of rendering it.  Each
+// message is decoded as json, or kept as a string if it isn't, and the
+// item's selector and fields are json paths within the messages.
+type WebsocketCapture struct {
+	// Resolved against the request url, http(s) urls are switched to ws(s).
+	Url string `json:"url"`
+	// Defaults to the request url's scheme and host, servers often check it.
+	Origin  string            `json:"origin,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Sent in order once connected, ex: a subscribe message.
+	Send []string `json:"send,omitempty"`
+	// Stop after this many messages...
+	Messages int `json:"messages,omitempty"`
+	// ...or after this long, whichever comes first.  Defaults to 30.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// Take the messages the page received while -renderer-har rendered it
+	// instead of connecting, for streams the page's scripts set up (ex: with
+	// a token they fetch).  The renderer decides how long the page runs, so
+	// duration_seconds, send, origin and headers don't apply.
+	Rendered bool `json:"rendered,omitempty"`
+}
+
+// Captures each websocket item's messages, adding the records it selects
+// to results.  Connections go through opts.Transport like pages do, and
+// are skipped while b has the domain's circuit open.
+func websocketItems(req ScrapeRequest, results ScrapeResult, opts scrapeOptions, b *breaker, missing string) error {
+	for _, name := range sortedItemNames(req.Items) {
+		item := req.Items[name]
+		if item.Type != itemTypeWebsocket {
+			continue
+		}
+		var messages []interface{}
+		target, origin, err := websocketTarget(req.Url, item.Websocket)
+		if err == nil && item.Websocket.Rendered {
+			client := &http.Client{Transport: opts.Transport, Timeout: 2 * time.Minute}
+			messages, err = renderedWebsocketMessages(client, opts.RendererHar, req.Url, target, item.Websocket.Messages)
+		} else if err == nil {
+			if !b.allow(target.Host) {
+				return fmt.Errorf("request.items[%q]: too many consecutive failures for %s", name, b.key(target.Host))
+			}
+			if messages, err = captureWebsocket(opts.Transport, target, origin, item.Websocket); err != nil {
+				b.failure(target.Host)
+			} else {
+				b.success(target.Host)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("request.items[%q]: %v", name, err)
+		}
+		addJsonRecords(results, name, item, messages, missing)
+	}
+	return nil
+}
+
+// The ws(s) url capture connects to, relative to the page, and the Origin
+// it sends.
+func websocketTarget(pageUrl string, capture *WebsocketCapture) (*url.URL, string, error) {
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	target, err := base.Parse(capture.Url)
+	if err != nil {
+		return nil, "", err
+	}
+	switch target.Scheme {
+	case "http":
+		target.Scheme = "ws"
+	case "https":
+		target.Scheme = "wss"
+	}
+	origin := capture.Origin
+	if len(origin) == 0 {
+		origin = base.Scheme + "://" + base.Host
+	}
+	return target, origin, nil
+}
+
+// How long capture listens for.
+func websocketDuration(capture *WebsocketCapture) time.Duration {
+	if capture.DurationSeconds > 0 {
+		return time.Duration(capture.DurationSeconds * float64(time.Second))
+	}
+	return defaultWebsocketDuration
+}
+
+func captureWebsocket(transport http.RoundTripper, target *url.URL, origin string, capture *WebsocketCapture) ([]interface{}, error) {
+	deadline := time.Now().Add(websocketDuration(capture))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ws, err := dialWebsocket(ctx, transport, target, origin, capture.Headers)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.close()
+	// reads don't take a deadline, closing the connection ends a blocked one
+	timer := time.AfterFunc(time.Until(deadline), func() { ws.rwc.Close() })
+	defer timer.Stop()
+	for _, msg := range capture.Send {
+		if err := ws.writeFrame(wsText, []byte(msg)); err != nil {
+			return nil, fmt.Errorf("sending %q: %v", msg, err)
+		}
+	}
+
+	var messages []interface{}
+	for capture.Messages <= 0 || len(messages) < capture.Messages {
+		raw, err := ws.receive()
+		if err != nil {
+			// running out of time or the server hanging up just ends the
+			// capture, whatever arrived until then is still used
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || !time.Now().Before(deadline) {
+				break
+			}
+			return nil, err
+		}
+		messages = append(messages, decodeWebsocketMessage(raw))
+	}
+	return messages, nil
+}
+
+func decodeWebsocketMessage(raw []byte) interface{} {
+	var decoded interface{}
+	if json.Unmarshal(raw, &decoded) != nil {
+		return string(raw)
+	}
+	return decoded
+}
+
+// Websocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// A client's end of a websocket, just enough of RFC 6455 to read a stream:
+// messages (fragmented or not), answering pings, and closing.
+type wsConn struct {
+	rwc io.ReadCloser
+	// Nil if the connection can't be written to, which is the case for
+	// responses replayed from a -bundle.  Sends and pongs are skipped then,
+	// the recorded messages being what was received after them.
+	w io.Writer
+}
+
+// Opens the websocket at target with an HTTP upgrade request sent through
+// transport, so it goes through the same allow and deny lists, rate limits,
+// egress IPs, resolver and recording as the pages do.
+func dialWebsocket(ctx context.Context, transport http.RoundTripper, target *url.URL, origin string, headers map[string]string) (*wsConn, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpUrl := *target
+	switch httpUrl.Scheme {
+	case "ws":
+		httpUrl.Scheme = "http"
+	case "wss":
+		httpUrl.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("%q isn't a ws(s) or http(s) url", target.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Origin", origin)
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("handshake failed: %s", resp.Status)
+	}
+	ws := &wsConn{rwc: resp.Body}
+	if w, ok := resp.Body.(io.Writer); ok {
+		ws.w = w
+	}
+	return ws, nil
+}
+
+// The next message, io.EOF once the server closes the stream.
+func (ws *wsConn) receive() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsClose:
+			return nil, io.EOF
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsContinuation, wsText, wsBinary:
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+		if len(message)+len(payload) > maxWebsocketMessage {
+			return nil, fmt.Errorf("message over %d bytes", maxWebsocketMessage)
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.rwc, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rwc, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rwc, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(ws.rwc, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	if size > maxWebsocketMessage {
+		return false, 0, nil, fmt.Errorf("message over %d bytes", maxWebsocketMessage)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.rwc, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Sends a single frame, masked as frames from clients must be.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	if ws.w == nil {
+		return nil
+	}
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := ws.w.Write(frame)
+	return err
+}
+
+// Says goodbye, as far as the connection is still open, and closes it.
+func (ws *wsConn) close() {
+	ws.writeFrame(wsClose, nil)
+	ws.rwc.Close()
+}
+
+// The messages the page received on the websocket at target while the
+// -renderer-har endpoint rendered it, the first max if max is set.  The
+// query string isn't compared, pages often add a token or cache buster.
+func renderedWebsocketMessages(client *http.Client, endpoint string, pageUrl string, target *url.URL, max int) ([]interface{}, error) {
+	entries, err := renderHar(client, endpoint, pageUrl)
+	if err != nil {
+		return nil, err
+	}
+	want := *target
+	want.RawQuery, want.Fragment = "", ""
+	found := false
+	var messages []interface{}
+	for _, entry := range entries {
+		got, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			continue
+		}
+		got.RawQuery, got.Fragment = "", ""
+		if got.String() != want.String() {
+			continue
+		}
+		found = true
+		for _, msg := range entry.WebsocketMessages {
+			if msg.Type != "receive" || (msg.Opcode != wsText && msg.Opcode != wsBinary) {
+				continue
+			}
+			if max > 0 && len(messages) >= max {
+				break
+			}
+			raw := []byte(msg.Data)
+			if msg.Opcode == wsBinary {
+				if raw, err = base64.StdEncoding.DecodeString(msg.Data); err != nil {
+					continue
+				}
+			}
+			messages = append(messages, decodeWebsocketMessage(raw))
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("the rendered page didn't open %s", want.String())
+	}
+	return messages, nil
+}
+
+func checkWebsocketItem(v *validator, path string, item ScrapeItem) {
+	if item.Websocket == nil || len(strings.TrimSpace(item.Websocket.Url)) == 0 {
+		v.add(path+"/websocket/url", "was empty")
+	}
+	if item.Websocket != nil && item.Websocket.Messages < 0 {
+		v.add(path+"/websocket/messages", "can't be negative")
+	}
+	if item.Websocket != nil && item.Websocket.DurationSeconds < 0 {
+		v.add(path+"/websocket/duration_seconds", "can't be negative")
+	}
+	if len(item.Fields) == 0 {
+		v.add(path+"/fields", "was empty")
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A small expression language for filtering an item's results, ex:
+//
+//	price < 100 && in_stock == true
+//	title =~ "(?i)sale" || (rating >= 4 && !sponsored)
+//
+// Identifiers are field names (dotted for nested fields).  Values compare as
+// numbers when both sides are numeric (see compareNumbers), as booleans
+// against true/false and otherwise as strings.  A comparison against a multi valued field is true if
+// any of its values match.  Missing fields are null.
+
+type whereExpr interface {
+	eval(result map[string]interface{}) interface{}
+}
+
+func compileWhere(expr string) (whereExpr, error) {
+	tokens, err := tokenizeWhere(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+// Keeps only the item results matching each item's where expression.
+func filterItems(req ScrapeRequest, results ScrapeResult) error {
+	for name, item := range req.Items {
+		if len(item.Where) == 0 {
+			continue
+		}
+		val, found := results[name]
+		if !found {
+			continue
+		}
+		expr, err := compileWhere(item.Where)
+		if err != nil {
+			return err
+		}
+		var kept []interface{}
+		for _, result := range valuesOf(val) {
+			if m, ok := result.(map[string]interface{}); ok && truthy(expr.eval(m)) {
+				kept = append(kept, result)
+			}
+		}
+		switch len(kept) {
+		case 0:
+			delete(results, name)
+		case 1:
+			results[name] = kept[0]
+		default:
+			results[name] = kept
+		}
+	}
+	return nil
+}
+
+type whereToken struct {
+	kind string // "op", "ident", "string", "number"
+	text string
+}
+
+func tokenizeWhere(expr string) ([]whereToken, error) {
+	var tokens []whereToken
+	ops := []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")"}
+	// the rune starting at byte i and its size, 0 past the end
+	runeAt := func(i int) (rune, int) {
+		if i >= len(expr) {
+			return utf8.RuneError, 0
+		}
+		return utf8.DecodeRuneInString(expr[i:])
+	}
+	for i := 0; i < len(expr); {
+		c, size := runeAt(i)
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			j := i + size
+			var b strings.Builder
+			for {
+				r, n := runeAt(j)
+				if n == 0 || r == c {
+					break
+				}
+				if r == '\\' {
+					if next, m := runeAt(j + n); m > 0 {
+						r = next
+						n += m
+					}
+				}
+				b.WriteRune(r)
+				j += n
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, whereToken{"string", b.String()})
+			i = j + 1
+		case isDigit(c) || (c == '-' && i+1 < len(expr) && isDigit(rune(expr[i+1]))):
+			j := i + 1
+			for j < len(expr) && (isDigit(rune(expr[j])) || expr[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, whereToken{"number", expr[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + size
+			for {
+				r, n := runeAt(j)
+				if n == 0 || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-') {
+					break
+				}
+				j += n
+			}
+			tokens = append(tokens, whereToken{"ident", expr[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range ops {
+				if strings.HasPrefix(expr[i:], op) {
+					tokens = append(tokens, whereToken{"op", op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+}
+
+func (p *whereParser) peekOp(ops ...string) string {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" {
+		for _, op := range ops {
+			if p.tokens[p.pos].text == op {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func (p *whereParser) or() (whereExpr, error) {
+	left, err := p.and()
+	for err == nil && p.peekOp("||") != "" {
+		p.pos++
+		var right whereExpr
+		if right, err = p.and(); err == nil {
+			left = whereLogic{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *whereParser) and() (whereExpr, error) {
+	left, err := p.comparison()
+	for err == nil && p.peekOp("&&") != "" {
+		p.pos++
+		var right whereExpr
+		if right, err = p.comparison(); err == nil {
+			left = whereLogic{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *whereParser) comparison() (whereExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peekOp("==", "!=", "<=", ">=", "<", ">", "=~"); op != "" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		cmp := whereCompare{op: op, left: left, right: right}
+		if op == "=~" {
+			lit, ok := right.(whereLiteral)
+			pattern, isString := lit.val.(string)
+			if !ok || !isString {
+				return nil, fmt.Errorf("=~ requires a string pattern")
+			}
+			if cmp.re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return cmp, nil
+	}
+	return left, nil
+}
+
+func (p *whereParser) unary() (whereExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case "string":
+		return whereLiteral{tok.text}, nil
+	case "number":
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok.text)
+		}
+		return whereLiteral{f}, nil
+	case "ident":
+		switch tok.text {
+		case "true":
+			return whereLiteral{true}, nil
+		case "false":
+			return whereLiteral{false}, nil
+		case "null":
+			return whereLiteral{nil}, nil
+		}
+		return whereField(tok.text), nil
+	}
+	switch tok.text {
+	case "!":
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return whereNot{inner}, nil
+	case "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekOp(")") == "" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+type whereLiteral struct{ val interface{} }
+
+func (l whereLiteral) eval(map[string]interface{}) interface{} { return l.val }
+
+type whereField string
+
+func (f whereField) eval(result map[string]interface{}) interface{} {
+	val, _ := fieldByPath(result, string(f))
+	return val
+}
+
+type whereNot struct{ inner whereExpr }
+
+func (n whereNot) eval(result map[string]interface{}) interface{} {
+	return !truthy(n.inner.eval(result))
+}
+
+type whereLogic struct {
+	op          string
+	left, right whereExpr
+}
+
+func (l whereLogic) eval(result map[string]interface{}) interface{} {
+	if l.op == "&&" {
+		return truthy(l.left.eval(result)) && truthy(l.right.eval(result))
+	}
+	return truthy(l.left.eval(result)) || truthy(l.right.eval(result))
+}
+
+type whereCompare struct {
+	op          string
+	left, right whereExpr
+	re          *regexp.Regexp
+}
+
+func (c whereCompare) eval(result map[string]interface{}) interface{} {
+	lefts, rights := c.left.eval(result), c.right.eval(result)
+	if lefts == nil || rights == nil {
+		// null only equals null
+		switch c.op {
+		case "==":
+			return lefts == nil && rights == nil
+		case "!=":
+			return (lefts == nil) != (rights == nil)
+		}
+		return false
+	}
+	for _, l := range valuesOf(lefts) {
+		for _, r := range valuesOf(rights) {
+			if c.compare(l, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c whereCompare) compare(l, r interface{}) bool {
+	if c.re != nil {
+		s, _ := whereString(l)
+		return c.re.MatchString(s)
+	}
+	cmp, ok := compareNumbers(l, r)
+	if !ok {
+		lb, lIsBool := l.(bool)
+		rb, rIsBool := r.(bool)
+		if lIsBool || rIsBool {
+			if !lIsBool {
+				lb = truthy(l)
+			}
+			if !rIsBool {
+				rb = truthy(r)
+			}
+			if c.op == "==" {
+				return lb == rb
+			} else if c.op == "!=" {
+				return lb != rb
+			}
+			return false
+		}
+		ls, _ := whereString(l)
+		rs, _ := whereString(r)
+		cmp = strings.Compare(ls, rs)
+	}
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func whereString(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return fmt.Sprint(val), false
+}
+
+// Compares l and r as numbers if they both are.  Against a number, as from a
+// literal like price < 100, strings with a single number in them count, so
+// "$99 each" is 99.  Otherwise strings must be numbers through and through,
+// so "Model 3" and "Version 3" compare as the strings they are.
+func compareNumbers(l, r interface{}) (int, bool) {
+	parse := strictNumber
+	if isNumber(l) || isNumber(r) {
+		parse = whereNumber
+	}
+	lf, lok := parse(l)
+	rf, rok := parse(r)
+	if !lok || !rok {
+		return 0, false
+	}
+	return compareFloats(lf, rf), true
+}
+
+func isNumber(val interface{}) bool {
+	switch val.(type) {
+	case float64, int:
+		return true
+	}
+	return false
+}
+
+// What's left of a strict number once currency symbols, spaces and
+// thousands separators are taken out.
+var strictNumberPattern = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)$`)
+
+// Numbers, and strings that are a number apart from currency symbols, spaces
+// and thousands separators, like "$1,299.00", "-5" or "€ -3.50".
+func strictNumber(val interface{}) (float64, bool) {
+	s, ok := val.(string)
+	if !ok {
+		return whereNumber(val)
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r != ',' && !unicode.IsSpace(r) && !unicode.Is(unicode.Sc, r) {
+			b.WriteRune(r)
+		}
+	}
+	num := b.String()
+	if !strictNumberPattern.MatchString(num) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	return f, err == nil
+}
+
+// Numbers, and strings that look like numbers ignoring currency symbols,
+// thousands separators and surrounding text like "$1,299.00" or "Model 3".
+// Strings with more than one number don't, ex: "1 of 2".
+var numberPattern = regexp.MustCompile(`^([^\d]*?)([\d,]*\.?\d+)[^\d]*$`)
+
+func whereNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		m := numberPattern.FindStringSubmatch(strings.TrimSpace(v))
+		if m == nil {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(strings.Replace(m[2], ",", "", -1), 64)
+		if err != nil {
+			return 0, false
+		}
+		// a minus sign only where a token starts, so "-5" and "$-5" are
+		// negative but "SKU-100" is 100
+		if prefix := m[1]; strings.HasSuffix(prefix, "-") {
+			before, _ := utf8.DecodeLastRuneInString(strings.TrimSuffix(prefix, "-"))
+			if !unicode.IsLetter(before) {
+				f = -f
+			}
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+func truthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		s := strings.ToLower(strings.TrimSpace(v))
+		return len(s) > 0 && s != "false" && s != "0" && s != "no"
+	case float64:
+		return v != 0
+	case int:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestWhereNumber(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want float64
+		ok   bool
+	}{
+		{float64(3.5), 3.5, true},
+		{4, 4, true},
+		{"42", 42, true},
+		{"$1,299.00", 1299, true},
+		{" 1,299.99 USD ", 1299.99, true},
+		{".5", 0.5, true},
+		{"-5", -5, true},
+		{"$-5", -5, true},
+		{"Price: -12.50", -12.5, true},
+		{"SKU-100", 100, true},
+		{"X-100", 100, true},
+		{"Model 3", 3, true},
+		{"1 of 2", 0, false},
+		{"no number", 0, false},
+		{"", 0, false},
+		{true, 0, false},
+		{nil, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := whereNumber(test.val)
+		if ok != test.ok || got != test.want {
+			t.Errorf("whereNumber(%#v) = %v, %v, want %v, %v", test.val, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestStrictNumber(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want float64
+		ok   bool
+	}{
+		{float64(3.5), 3.5, true},
+		{"42", 42, true},
+		{"$1,299.00", 1299, true},
+		{"€ -3.50", -3.5, true},
+		{"-$5", -5, true},
+		{" 12 ", 12, true},
+		{"A-100", 0, false},
+		{"Model 3", 0, false},
+		{"1,299.99 USD", 0, false},
+		{"1e5", 0, false},
+		{"Inf", 0, false},
+		{"1.2.3", 0, false},
+		{"$", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := strictNumber(test.val)
+		if ok != test.ok || got != test.want {
+			t.Errorf("strictNumber(%#v) = %v, %v, want %v, %v", test.val, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	result := map[string]interface{}{
+		"sku":     "B-100",
+		"name":    "Model 3",
+		"price":   "$1,299.00",
+		"each":    "$99 each",
+		"count":   float64(12),
+		"city":    "Zürich",
+		"größe":   "42",
+		"tags":    []interface{}{"new", "sale"},
+		"on_sale": "yes",
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`sku == "A-100"`, false},
+		{`sku == "B-100"`, true},
+		{`sku != "A-100"`, true},
+		{`name == "Version 3"`, false},
+		{`name == "Model 3"`, true},
+		{`name == 3`, true},
+		{`price == "1299"`, true},
+		{`price > "$999"`, true},
+		{`price < 1300 && price > 1298.5`, true},
+		{`each < 100`, true},
+		{`each == "99"`, false},
+		{`count > 9`, true},
+		{`count > "9"`, true},
+		{`city == "Zürich"`, true},
+		{`city == 'Zurich'`, false},
+		{`city =~ "^Zü"`, true},
+		{`größe >= 42`, true},
+		{`"a\"b" == 'a"b'`, true},
+		{`tags == "sale"`, true},
+		{`on_sale == true`, true},
+		{`missing == null`, true},
+	}
+	for _, test := range tests {
+		expr, err := compileWhere(test.expr)
+		if err != nil {
+			t.Errorf("compileWhere(%q): %v", test.expr, err)
+			continue
+		}
+		if got := truthy(expr.eval(result)); got != test.want {
+			t.Errorf("%s = %v, want %v", test.expr, got, test.want)
+		}
+	}
+	for _, bad := range []string{`city == "Zürich`, `a ==`, `(a == 1`, `a § 1`} {
+		if _, err := compileWhere(bad); err == nil {
+			t.Errorf("compileWhere(%q) should fail", bad)
+		}
+	}
+}